@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rgehrsitz/me/internal/config"
+	"github.com/rgehrsitz/me/internal/db"
+	"github.com/rgehrsitz/me/internal/models"
+	"github.com/rgehrsitz/me/internal/services"
+	"github.com/rgehrsitz/me/internal/vector"
+)
+
+// backend is the knowledge base the CLI talks to, either a running server
+// or a database opened directly
+type backend interface {
+	Create(ctx context.Context, content *db.Content) (*db.Content, error)
+	Get(ctx context.Context, id int64) (*db.Content, error)
+	Update(ctx context.Context, content *db.Content) error
+	Delete(ctx context.Context, id int64) error
+	List(ctx context.Context, filter db.ContentFilter) (*db.ContentPage, error)
+	Search(ctx context.Context, query models.SearchQuery) (*models.SearchResponse, error)
+	Encrypt(ctx context.Context, passphrase string) error
+	Unlock(ctx context.Context, passphrase string) error
+	Lock(ctx context.Context) error
+	Rekey(ctx context.Context, passphrase string, rotate bool) error
+	Close() error
+}
+
+// httpBackend talks to a running server over its HTTP API
+type httpBackend struct {
+	baseURL string
+	token   string
+	// vault, if set, sends API requests to that vault's /api/v/:vault routes
+	vault  string
+	client *http.Client
+}
+
+// newHTTPBackend creates a backend for the server at baseURL, authenticating
+// with the given API token if it is not empty and using the named vault
+// instead of the main knowledge base if vault is not empty
+func newHTTPBackend(baseURL, token, vault string) *httpBackend {
+	return &httpBackend{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		token:   token,
+		vault:   vault,
+		client:  &http.Client{Timeout: 60 * time.Second},
+	}
+}
+
+// do sends a request to the API and decodes the JSON response into out
+func (b *httpBackend) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	if b.vault != "" {
+		path = "/api/v/" + url.PathEscape(b.vault) + strings.TrimPrefix(path, "/api")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, b.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if b.token != "" {
+		req.Header.Set("Authorization", "Bearer "+b.token)
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach server: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil || apiErr.Error == "" {
+			return fmt.Errorf("server returned %s", resp.Status)
+		}
+		return fmt.Errorf("%s", apiErr.Error)
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (b *httpBackend) Create(ctx context.Context, content *db.Content) (*db.Content, error) {
+	var created db.Content
+	if err := b.do(ctx, http.MethodPost, "/api/content", content, &created); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+func (b *httpBackend) Get(ctx context.Context, id int64) (*db.Content, error) {
+	var content db.Content
+	if err := b.do(ctx, http.MethodGet, fmt.Sprintf("/api/content/%d", id), nil, &content); err != nil {
+		return nil, err
+	}
+	return &content, nil
+}
+
+func (b *httpBackend) Update(ctx context.Context, content *db.Content) error {
+	return b.do(ctx, http.MethodPut, fmt.Sprintf("/api/content/%d", content.ID), content, nil)
+}
+
+func (b *httpBackend) Delete(ctx context.Context, id int64) error {
+	return b.do(ctx, http.MethodDelete, fmt.Sprintf("/api/content/%d", id), nil, nil)
+}
+
+func (b *httpBackend) List(ctx context.Context, filter db.ContentFilter) (*db.ContentPage, error) {
+	params := url.Values{}
+	if filter.Type != "" {
+		params.Set("type", filter.Type)
+	}
+	if filter.CollectionID != 0 {
+		params.Set("collection", strconv.FormatInt(filter.CollectionID, 10))
+	}
+	if filter.Recursive {
+		params.Set("recursive", "true")
+	}
+	params.Set("limit", strconv.Itoa(filter.Limit))
+	if filter.Cursor != "" {
+		params.Set("cursor", filter.Cursor)
+	} else {
+		params.Set("offset", strconv.Itoa(filter.Offset))
+	}
+
+	var page db.ContentPage
+	if err := b.do(ctx, http.MethodGet, "/api/content?"+params.Encode(), nil, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+func (b *httpBackend) Search(ctx context.Context, query models.SearchQuery) (*models.SearchResponse, error) {
+	var response models.SearchResponse
+	if err := b.do(ctx, http.MethodPost, "/api/search", query, &response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// passphraseRequest is the body of the encryption endpoints
+type passphraseRequest struct {
+	Passphrase string `json:"passphrase"`
+	Rotate     bool   `json:"rotate,omitempty"`
+}
+
+func (b *httpBackend) Encrypt(ctx context.Context, passphrase string) error {
+	return b.do(ctx, http.MethodPost, "/api/encryption", passphraseRequest{Passphrase: passphrase}, nil)
+}
+
+func (b *httpBackend) Unlock(ctx context.Context, passphrase string) error {
+	return b.do(ctx, http.MethodPost, "/api/encryption/unlock", passphraseRequest{Passphrase: passphrase}, nil)
+}
+
+func (b *httpBackend) Lock(ctx context.Context) error {
+	return b.do(ctx, http.MethodPost, "/api/encryption/lock", nil, nil)
+}
+
+func (b *httpBackend) Rekey(ctx context.Context, passphrase string, rotate bool) error {
+	return b.do(ctx, http.MethodPost, "/api/encryption/rekey", passphraseRequest{Passphrase: passphrase, Rotate: rotate}, nil)
+}
+
+func (b *httpBackend) Close() error {
+	return nil
+}
+
+// localBackend opens the database directly and acts as a single user.
+// Embeddings and semantic search are only available when an OpenAI API key is
+// configured.
+type localBackend struct {
+	db               *db.DB
+	userID           int64
+	embeddingService *services.EmbeddingService
+	// nextEmbeddingService is set while switching to another embedding model
+	nextEmbeddingService *services.EmbeddingService
+	searchService        *services.SearchService
+	// pending is the content waiting to be embedded on Close
+	pending []db.EmbedTarget
+}
+
+// newLocalBackend opens the database at dbPath acting as the named user, or
+// as the default user if username is empty
+func newLocalBackend(dbPath, username string) (*localBackend, error) {
+	database, err := db.New(dbPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// AI settings and the passphrase come from the same config file and
+	// environment as the server
+	cfg, err := config.Load("")
+	if err != nil {
+		database.Close()
+		return nil, err
+	}
+
+	if database.Encrypted() {
+		if err := unlockLocal(database, cfg); err != nil {
+			database.Close()
+			return nil, err
+		}
+	}
+
+	var userID int64
+	if username != "" {
+		user, err := database.GetUserByName(username)
+		if err != nil {
+			database.Close()
+			return nil, fmt.Errorf("user %q not found: %w", username, err)
+		}
+		userID = user.ID
+	} else if userID, err = database.DefaultUserID(); err != nil {
+		database.Close()
+		return nil, err
+	}
+
+	// Keyword search works without an API key
+	embeddingService, err := services.NewEmbeddingService(cfg.AI, services.NewUsageService(database, cfg.AI))
+	if err != nil {
+		embeddingService = nil
+	} else {
+		quantization, err := vector.ParseKind(cfg.AI.EmbeddingQuantization)
+		if err != nil {
+			database.Close()
+			return nil, err
+		}
+		if _, err := database.SetEmbeddingQuantization(quantization); err != nil {
+			database.Close()
+			return nil, err
+		}
+	}
+
+	if embeddingService != nil {
+		// File new items under their topic clusters, as the server does
+		embeddingService.OnStore(services.NewClusterService(database, embeddingService, nil).AssignContent)
+	}
+
+	var nextEmbeddingService *services.EmbeddingService
+	if embeddingService != nil && cfg.AI.NextEmbeddingModel != "" {
+		if nextEmbeddingService, err = embeddingService.WithModel(cfg.AI.NextEmbeddingModel); err != nil {
+			database.Close()
+			return nil, err
+		}
+	}
+
+	return &localBackend{
+		db:                   database,
+		userID:               userID,
+		embeddingService:     embeddingService,
+		nextEmbeddingService: nextEmbeddingService,
+		searchService:        services.NewSearchService(database, embeddingService),
+	}, nil
+}
+
+// embed queues a content item to be embedded when the backend is closed, so
+// an import embeds its items in a few batched requests
+func (b *localBackend) embed(id int64, body string) {
+	if b.embeddingService == nil || body == "" {
+		return
+	}
+	b.pending = append(b.pending, db.EmbedTarget{ID: id, Body: body})
+}
+
+// flushEmbeddings embeds the queued content, also with the model being
+// switched to if there is one
+func (b *localBackend) flushEmbeddings(ctx context.Context) error {
+	if len(b.pending) == 0 {
+		return nil
+	}
+
+	var errs []error
+	embedders := []*services.EmbeddingService{b.embeddingService}
+	if b.nextEmbeddingService != nil {
+		embedders = append(embedders, b.nextEmbeddingService)
+	}
+	for _, embedder := range embedders {
+		_, failed := embedder.EmbedContents(ctx, b.db, b.pending)
+		for id, err := range failed {
+			errs = append(errs, fmt.Errorf("content %d: %w", id, err))
+		}
+	}
+	b.pending = nil
+
+	if len(errs) > 0 {
+		return fmt.Errorf("content saved but %d embeddings failed: %w", len(errs), errors.Join(errs...))
+	}
+	return nil
+}
+
+func (b *localBackend) Create(ctx context.Context, content *db.Content) (*db.Content, error) {
+	id, err := b.db.CreateContent(b.userID, content)
+	if err != nil {
+		return nil, err
+	}
+	b.embed(id, content.Body)
+	return b.db.GetContent(b.userID, id)
+}
+
+func (b *localBackend) Get(ctx context.Context, id int64) (*db.Content, error) {
+	content, err := b.db.GetContent(b.userID, id)
+	if err != nil {
+		if newID, redirectErr := b.db.ResolveRedirect(b.userID, id); redirectErr == nil {
+			return b.db.GetContent(b.userID, newID)
+		}
+		return nil, fmt.Errorf("content not found: %w", err)
+	}
+	return content, nil
+}
+
+func (b *localBackend) Update(ctx context.Context, content *db.Content) error {
+	rewritten, err := b.db.UpdateContent(b.userID, content)
+	if err != nil {
+		return err
+	}
+	b.embed(content.ID, content.Body)
+	for _, target := range rewritten {
+		b.embed(target.ID, target.Body)
+	}
+	return nil
+}
+
+func (b *localBackend) Delete(ctx context.Context, id int64) error {
+	return b.db.DeleteContent(b.userID, id)
+}
+
+func (b *localBackend) List(ctx context.Context, filter db.ContentFilter) (*db.ContentPage, error) {
+	return b.db.ListContent(b.userID, filter)
+}
+
+func (b *localBackend) Search(ctx context.Context, query models.SearchQuery) (*models.SearchResponse, error) {
+	if (query.Semantic || query.Hybrid) && b.embeddingService == nil {
+		return nil, fmt.Errorf("semantic search requires OPENAI_API_KEY")
+	}
+	return b.searchService.Search(ctx, b.userID, query)
+}
+
+func (b *localBackend) Encrypt(ctx context.Context, passphrase string) error {
+	return b.db.EnableEncryption(passphrase)
+}
+
+// Unlock checks the passphrase, since the database was already unlocked when
+// it was opened
+func (b *localBackend) Unlock(ctx context.Context, passphrase string) error {
+	return b.db.Unlock(passphrase)
+}
+
+func (b *localBackend) Lock(ctx context.Context) error {
+	return fmt.Errorf("only a running server can be locked; the database is locked whenever it is closed")
+}
+
+func (b *localBackend) Rekey(ctx context.Context, passphrase string, rotate bool) error {
+	return b.db.Rekey(passphrase, rotate)
+}
+
+func (b *localBackend) Close() error {
+	err := b.flushEmbeddings(context.Background())
+	if closeErr := b.db.Close(); closeErr != nil {
+		err = errors.Join(err, closeErr)
+	}
+	return err
+}
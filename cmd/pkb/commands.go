@@ -0,0 +1,431 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/rgehrsitz/me/internal/db"
+	"github.com/rgehrsitz/me/internal/models"
+)
+
+// stringList is a repeatable string flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// parseArgs parses flags that may appear before, between or after the
+// positional arguments and returns the positional arguments
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		if args[0] == "--" {
+			return append(positional, args[1:]...), nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// parseQueryArgs is parseArgs for a search query: once the query has begun,
+// words starting with a dash that are not flags, such as -tag:draft, are
+// part of it
+func parseQueryArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var flags, query []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			query = append(query, args[i+1:]...)
+			i = len(args)
+		case arg == "-" || !strings.HasPrefix(arg, "-"):
+			query = append(query, arg)
+		default:
+			name, _, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+			f := fs.Lookup(name)
+			if f == nil && len(query) > 0 {
+				query = append(query, arg)
+				continue
+			}
+			flags = append(flags, arg)
+			if f != nil && !hasValue && !isBoolFlag(f) && i+1 < len(args) {
+				i++
+				flags = append(flags, args[i])
+			}
+		}
+	}
+	if err := fs.Parse(flags); err != nil {
+		return nil, err
+	}
+	return query, nil
+}
+
+// isBoolFlag reports whether a flag takes no value
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// parseID parses a content ID argument
+func parseID(raw string) (int64, error) {
+	id, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ID %q", raw)
+	}
+	return id, nil
+}
+
+// stdinIsPiped reports whether stdin is a pipe or file rather than a terminal
+func stdinIsPiped() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice == 0
+}
+
+// runAdd adds a content item. The body comes from the arguments, from stdin
+// when it is piped, or from $EDITOR.
+func runAdd(ctx context.Context, b backend, args []string) error {
+	fs := flag.NewFlagSet("add", flag.ContinueOnError)
+	var tags stringList
+	contentType := fs.String("type", string(models.ContentTypeNote), "Content type (note, snippet, bookmark, document)")
+	title := fs.String("title", "", "Title (defaults to the first line of the body)")
+	sourceURL := fs.String("url", "", "Source URL for bookmarks and documents")
+	language := fs.String("lang", "", "Language of a snippet's code (detected if not given)")
+	edit := fs.Bool("e", false, "Compose the body in $EDITOR")
+	asJSON := fs.Bool("json", false, "Print the created item as JSON")
+	fs.Var(&tags, "tag", "Tag to apply (repeatable or comma-separated)")
+
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	content := &db.Content{
+		Type:      *contentType,
+		Title:     *title,
+		SourceURL: *sourceURL,
+		Language:  *language,
+		Tags:      tags,
+	}
+
+	switch {
+	case len(positional) > 0 && positional[0] != "-":
+		content.Body = strings.Join(positional, " ")
+	case !*edit && (stdinIsPiped() || len(positional) > 0):
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return fmt.Errorf("failed to read stdin: %w", err)
+		}
+		content.Body = string(data)
+	default:
+		if err := editContent(content); err != nil {
+			return err
+		}
+	}
+
+	if strings.TrimSpace(content.Body) == "" && content.SourceURL == "" {
+		return fmt.Errorf("nothing to add")
+	}
+	if content.Title == "" {
+		content.Title = defaultTitle(content.Body, content.SourceURL)
+	}
+
+	created, err := b.Create(ctx, content)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return printJSON(created)
+	}
+	fmt.Printf("Added %d: %s\n", created.ID, created.Title)
+	return nil
+}
+
+// runSearch searches the knowledge base
+func runSearch(ctx context.Context, b backend, args []string) error {
+	fs := flag.NewFlagSet("search", flag.ContinueOnError)
+	var tags stringList
+	mode := fs.String("mode", "keyword", "Search mode: keyword, semantic or hybrid")
+	contentType := fs.String("type", "", "Only return this content type")
+	language := fs.String("lang", "", "Only return snippets in this language")
+	limit := fs.Int("limit", 10, "Maximum number of results")
+	offset := fs.Int("offset", 0, "Number of results to skip")
+	cursor := fs.String("cursor", "", "Continue after the page that printed this cursor")
+	sort := fs.String("sort", "", "Sort by relevance (default), created, updated or title")
+	order := fs.String("order", "", "Sort order: asc or desc")
+	asJSON := fs.Bool("json", false, "Print results as JSON")
+	fs.Var(&tags, "tag", "Only return items with this tag (repeatable)")
+
+	positional, err := parseQueryArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) == 0 {
+		return fmt.Errorf("missing search query")
+	}
+
+	query := models.SearchQuery{
+		Query:    strings.Join(positional, " "),
+		Type:     *contentType,
+		Language: *language,
+		Tags:     tags,
+		Limit:    *limit,
+		Offset:   *offset,
+		Cursor:   *cursor,
+		Sort:     *sort,
+		Order:    *order,
+	}
+	switch *mode {
+	case "keyword":
+	case "semantic":
+		query.Semantic = true
+	case "hybrid":
+		query.Hybrid = true
+	default:
+		return fmt.Errorf("unknown search mode %q", *mode)
+	}
+
+	response, err := b.Search(ctx, query)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return printJSON(response.Results)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTYPE\tSCORE\tTITLE\tTAGS")
+	for _, result := range response.Results {
+		score := ""
+		if result.Score != 0 {
+			score = fmt.Sprintf("%.3f", result.Score)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n",
+			result.Content.ID, result.Content.Type, score,
+			truncate(result.Content.Title, 60), strings.Join(result.Content.Tags, ","))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if response.NextCursor != "" {
+		total := strconv.Itoa(response.Total)
+		if response.TotalEstimated {
+			total = "about " + total
+		}
+		fmt.Fprintf(os.Stderr, "%d of %s results; for more use -cursor %s\n", len(response.Results), total, response.NextCursor)
+	}
+	return nil
+}
+
+// runShow prints a content item
+func runShow(ctx context.Context, b backend, args []string) error {
+	fs := flag.NewFlagSet("show", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "Print the item as JSON")
+
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return fmt.Errorf("usage: pkb show [-json] ID")
+	}
+
+	id, err := parseID(positional[0])
+	if err != nil {
+		return err
+	}
+
+	content, err := b.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return printJSON(content)
+	}
+
+	fmt.Printf("# %s\n\n", content.Title)
+	fmt.Printf("ID:      %d\n", content.ID)
+	fmt.Printf("Type:    %s\n", content.Type)
+	if content.Language != "" {
+		fmt.Printf("Lang:    %s\n", content.Language)
+	}
+	if len(content.Tags) > 0 {
+		fmt.Printf("Tags:    %s\n", strings.Join(content.Tags, ", "))
+	}
+	if content.SourceURL != "" {
+		fmt.Printf("URL:     %s\n", content.SourceURL)
+	}
+	fmt.Printf("Created: %s\n", content.CreatedAt)
+	fmt.Printf("Updated: %s\n", content.UpdatedAt)
+	if content.Body != "" {
+		fmt.Printf("\n%s\n", strings.TrimRight(content.Body, "\n"))
+	}
+	return nil
+}
+
+// runEdit edits a content item in $EDITOR
+func runEdit(ctx context.Context, b backend, args []string) error {
+	fs := flag.NewFlagSet("edit", flag.ContinueOnError)
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return fmt.Errorf("usage: pkb edit ID")
+	}
+
+	id, err := parseID(positional[0])
+	if err != nil {
+		return err
+	}
+
+	content, err := b.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	before := *content
+	if err := editContent(content); err != nil {
+		return err
+	}
+	if content.Type == before.Type && content.Title == before.Title && content.Body == before.Body &&
+		content.SourceURL == before.SourceURL && content.Language == before.Language &&
+		strings.Join(content.Tags, ",") == strings.Join(before.Tags, ",") {
+		fmt.Println("No changes")
+		return nil
+	}
+
+	if err := b.Update(ctx, content); err != nil {
+		return err
+	}
+	fmt.Printf("Updated %d: %s\n", content.ID, content.Title)
+	return nil
+}
+
+// runRemove deletes content items
+func runRemove(ctx context.Context, b backend, args []string) error {
+	fs := flag.NewFlagSet("rm", flag.ContinueOnError)
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) == 0 {
+		return fmt.Errorf("usage: pkb rm ID...")
+	}
+
+	for _, raw := range positional {
+		id, err := parseID(raw)
+		if err != nil {
+			return err
+		}
+		if err := b.Delete(ctx, id); err != nil {
+			return fmt.Errorf("failed to delete %d: %w", id, err)
+		}
+		fmt.Printf("Deleted %d\n", id)
+	}
+	return nil
+}
+
+// runTag adds and removes tags: pkb tag ID +add -remove
+func runTag(ctx context.Context, b backend, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("usage: pkb tag ID +tag|-tag...")
+	}
+
+	id, err := parseID(args[0])
+	if err != nil {
+		return err
+	}
+
+	content, err := b.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	tags := make(map[string]bool)
+	for _, tag := range content.Tags {
+		tags[tag] = true
+	}
+	order := append([]string{}, content.Tags...)
+
+	for _, arg := range args[1:] {
+		switch {
+		case strings.HasPrefix(arg, "-"):
+			delete(tags, db.NormalizeTagName(arg[1:]))
+		default:
+			tag := db.NormalizeTagName(strings.TrimPrefix(arg, "+"))
+			if tag != "" && !tags[tag] {
+				tags[tag] = true
+				order = append(order, tag)
+			}
+		}
+	}
+
+	content.Tags = []string{}
+	for _, tag := range order {
+		if tags[tag] {
+			content.Tags = append(content.Tags, tag)
+			delete(tags, tag)
+		}
+	}
+
+	if err := b.Update(ctx, content); err != nil {
+		return err
+	}
+	fmt.Printf("Tags for %d: %s\n", content.ID, strings.Join(content.Tags, ", "))
+	return nil
+}
+
+// printJSON prints a value as indented JSON
+func printJSON(v interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// truncate shortens s to at most n runes
+func truncate(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n-1]) + "…"
+}
+
+// defaultTitle derives a title from the first non-empty line of the body
+func defaultTitle(body, sourceURL string) string {
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(line), "#"))
+		if line != "" {
+			return truncate(line, 80)
+		}
+	}
+	return sourceURL
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/rgehrsitz/me/internal/db"
+)
+
+// headerSeparator separates the editable header fields from the body
+const headerSeparator = "---"
+
+// editContent opens the content in $EDITOR as a small header followed by the
+// body, and reads the edited fields back
+func editContent(content *db.Content) error {
+	file, err := os.CreateTemp("", "pkb-*.md")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.WriteString(formatForEditor(content)); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write temporary file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+
+	// The editor may include arguments, e.g. "code --wait"
+	parts := strings.Fields(editor)
+	cmd := exec.Command(parts[0], append(parts[1:], file.Name())...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("editor failed: %w", err)
+	}
+
+	data, err := os.ReadFile(file.Name())
+	if err != nil {
+		return fmt.Errorf("failed to read temporary file: %w", err)
+	}
+
+	parseFromEditor(string(data), content)
+	return nil
+}
+
+// formatForEditor renders the editable fields of a content item
+func formatForEditor(content *db.Content) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Title: %s\n", content.Title)
+	fmt.Fprintf(&b, "Type: %s\n", content.Type)
+	if content.Type == "snippet" {
+		fmt.Fprintf(&b, "Language: %s\n", content.Language)
+	}
+	fmt.Fprintf(&b, "Tags: %s\n", strings.Join(content.Tags, ", "))
+	fmt.Fprintf(&b, "URL: %s\n", content.SourceURL)
+	fmt.Fprintf(&b, "%s\n", headerSeparator)
+	b.WriteString(content.Body)
+	return b.String()
+}
+
+// parseFromEditor reads the fields written by formatForEditor back into the
+// content item. Text without a header is treated as the body.
+func parseFromEditor(text string, content *db.Content) {
+	header, body, found := strings.Cut(text, "\n"+headerSeparator+"\n")
+	if !found {
+		content.Body = text
+		return
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(header))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "title":
+			content.Title = value
+		case "type":
+			if value != "" {
+				content.Type = value
+			}
+		case "tags":
+			content.Tags = []string{}
+			for _, tag := range strings.Split(value, ",") {
+				if tag = db.NormalizeTagName(tag); tag != "" {
+					content.Tags = append(content.Tags, tag)
+				}
+			}
+		case "url":
+			content.SourceURL = value
+		case "language":
+			content.Language = value
+		}
+	}
+
+	content.Body = body
+}
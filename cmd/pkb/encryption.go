@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/rgehrsitz/me/internal/config"
+	"github.com/rgehrsitz/me/internal/db"
+)
+
+// stdinReader is shared by every passphrase prompt so piped input is not lost
+// between prompts
+var stdinReader = bufio.NewReader(os.Stdin)
+
+// readPassphrase prints a prompt to stderr and reads a passphrase from the
+// terminal without echoing it, or a line from stdin when it is piped
+func readPassphrase(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	if !stdinIsPiped() && stty("-echo") == nil {
+		defer func() {
+			stty("echo")
+			fmt.Fprintln(os.Stderr)
+		}()
+	}
+
+	line, err := stdinReader.ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("failed to read passphrase: %w", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// readNewPassphrase reads a new passphrase, asking for it twice when typed
+// on a terminal
+func readNewPassphrase() (string, error) {
+	passphrase, err := readPassphrase("New passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if stdinIsPiped() {
+		return passphrase, nil
+	}
+
+	confirm, err := readPassphrase("Repeat passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if confirm != passphrase {
+		return "", errors.New("passphrases do not match")
+	}
+	return passphrase, nil
+}
+
+// stty changes the terminal settings of stdin
+func stty(arg string) error {
+	cmd := exec.Command("stty", arg)
+	cmd.Stdin = os.Stdin
+	return cmd.Run()
+}
+
+// unlockLocal unlocks an encrypted database opened with -db, using the
+// configured passphrase or asking for one
+func unlockLocal(database *db.DB, cfg *config.Config) error {
+	passphrase, err := cfg.Storage.Passphrase()
+	if err != nil {
+		return err
+	}
+	if passphrase == "" {
+		if passphrase, err = readPassphrase("Passphrase: "); err != nil {
+			return err
+		}
+	}
+
+	if err := database.Unlock(passphrase); err != nil {
+		return fmt.Errorf("failed to unlock database: %w", err)
+	}
+	return nil
+}
+
+// runEncrypt encrypts the knowledge base with a new passphrase
+func runEncrypt(ctx context.Context, b backend, args []string) error {
+	fs := flag.NewFlagSet("encrypt", flag.ContinueOnError)
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+
+	passphrase, err := readNewPassphrase()
+	if err != nil {
+		return err
+	}
+	if err := b.Encrypt(ctx, passphrase); err != nil {
+		return err
+	}
+
+	fmt.Println("Knowledge base encrypted. Keep the passphrase safe: content cannot be recovered without it.")
+	return nil
+}
+
+// runUnlock unlocks an encrypted knowledge base on the server
+func runUnlock(ctx context.Context, b backend, args []string) error {
+	fs := flag.NewFlagSet("unlock", flag.ContinueOnError)
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+
+	passphrase, err := readPassphrase("Passphrase: ")
+	if err != nil {
+		return err
+	}
+	if err := b.Unlock(ctx, passphrase); err != nil {
+		return err
+	}
+
+	fmt.Println("Knowledge base unlocked")
+	return nil
+}
+
+// runLock locks an encrypted knowledge base on the server
+func runLock(ctx context.Context, b backend, args []string) error {
+	fs := flag.NewFlagSet("lock", flag.ContinueOnError)
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+
+	if err := b.Lock(ctx); err != nil {
+		return err
+	}
+
+	fmt.Println("Knowledge base locked")
+	return nil
+}
+
+// runRekey changes the passphrase of an encrypted knowledge base
+func runRekey(ctx context.Context, b backend, args []string) error {
+	fs := flag.NewFlagSet("rekey", flag.ContinueOnError)
+	rotate := fs.Bool("rotate", false, "Also re-encrypt all content under a new data key")
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+
+	passphrase, err := readNewPassphrase()
+	if err != nil {
+		return err
+	}
+	if err := b.Rekey(ctx, passphrase, *rotate); err != nil {
+		return err
+	}
+
+	fmt.Println("Knowledge base re-keyed")
+	return nil
+}
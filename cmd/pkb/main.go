@@ -0,0 +1,107 @@
+// Command pkb is a terminal client for the personal knowledge base. It talks
+// to a running server over HTTP, or opens the database directly with -db.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/joho/godotenv"
+)
+
+const usage = `Usage: pkb [-server URL [-token TOKEN] [-vault NAME] | -db PATH [-user NAME]] <command> [arguments]
+
+Commands:
+  add      Add content from arguments, stdin or $EDITOR
+  search   Search content (keyword, semantic or hybrid)
+  show     Show a content item
+  edit     Edit a content item in $EDITOR
+  rm       Delete content items
+  tag      Add (+tag) or remove (-tag) tags on a content item
+  import   Import content from JSON, JSON Lines or Markdown files
+  export   Export all content as JSON, JSON Lines or Markdown
+  encrypt  Encrypt the knowledge base with a passphrase
+  unlock   Unlock an encrypted knowledge base on the server
+  lock     Lock an encrypted knowledge base on the server
+  rekey    Change the passphrase of an encrypted knowledge base
+
+Run 'pkb <command> -h' for the options of a command.
+
+Global options:
+`
+
+// command is a pkb subcommand
+type command func(ctx context.Context, b backend, args []string) error
+
+var commands = map[string]command{
+	"add":     runAdd,
+	"search":  runSearch,
+	"show":    runShow,
+	"edit":    runEdit,
+	"rm":      runRemove,
+	"tag":     runTag,
+	"import":  runImport,
+	"export":  runExport,
+	"encrypt": runEncrypt,
+	"unlock":  runUnlock,
+	"lock":    runLock,
+	"rekey":   runRekey,
+}
+
+func main() {
+	// Load environment variables from .env file
+	_ = godotenv.Load()
+
+	defaultServer := os.Getenv("PKB_SERVER")
+	if defaultServer == "" {
+		defaultServer = "http://localhost:8080"
+	}
+
+	var (
+		server = flag.String("server", defaultServer, "URL of the PKB server (env PKB_SERVER)")
+		token  = flag.String("token", os.Getenv("PKB_TOKEN"), "API token for the server (env PKB_TOKEN)")
+		dbPath = flag.String("db", os.Getenv("PKB_DB"), "Open this SQLite database directly instead of using the server (env PKB_DB)")
+		user   = flag.String("user", os.Getenv("PKB_USER"), "With -db, act as this user instead of the first one (env PKB_USER)")
+		vault  = flag.String("vault", os.Getenv("PKB_VAULT"), "Use this vault on the server instead of the main knowledge base (env PKB_VAULT)")
+	)
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	run, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "pkb: unknown command %q\n\n", flag.Arg(0))
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var b backend
+	if *dbPath != "" {
+		local, err := newLocalBackend(*dbPath, *user)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "pkb: %v\n", err)
+			os.Exit(1)
+		}
+		b = local
+	} else {
+		b = newHTTPBackend(*server, *token, *vault)
+	}
+
+	err := run(context.Background(), b, flag.Args()[1:])
+	if closeErr := b.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "pkb %s: %v\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/rgehrsitz/me/internal/db"
+	"github.com/rgehrsitz/me/internal/models"
+)
+
+// exportPageSize is the number of items fetched per request when exporting
+const exportPageSize = 100
+
+// runImport imports content from JSON, JSON Lines or Markdown files.
+// Directories are searched for Markdown files.
+func runImport(ctx context.Context, b backend, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	var tags stringList
+	contentType := fs.String("type", "", "Content type for Markdown files, or to override JSON items")
+	fs.Var(&tags, "tag", "Tag to add to every imported item (repeatable)")
+
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) == 0 {
+		return fmt.Errorf("usage: pkb import [-type TYPE] [-tag TAG] FILE|DIR|-...")
+	}
+
+	var items []db.Content
+	for _, path := range positional {
+		loaded, err := loadImport(path)
+		if err != nil {
+			return err
+		}
+		items = append(items, loaded...)
+	}
+
+	imported := 0
+	for _, item := range items {
+		if *contentType != "" {
+			item.Type = *contentType
+		}
+		if item.Type == "" {
+			item.Type = string(models.ContentTypeNote)
+		}
+		item.ID = 0
+		item.Tags = append(item.Tags, tags...)
+
+		created, err := b.Create(ctx, &item)
+		if err != nil {
+			return fmt.Errorf("imported %d of %d items, failed on %q: %w", imported, len(items), item.Title, err)
+		}
+		imported++
+		fmt.Printf("Imported %d: %s\n", created.ID, created.Title)
+	}
+
+	fmt.Printf("Imported %d items\n", imported)
+	return nil
+}
+
+// loadImport reads the content items in a file, directory or stdin ("-")
+func loadImport(path string) ([]db.Content, error) {
+	if path == "-" {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read stdin: %w", err)
+		}
+		return parseJSONItems(data)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		var items []db.Content
+		err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() || !isMarkdown(p) {
+				return err
+			}
+			item, err := loadMarkdown(p)
+			if err != nil {
+				return err
+			}
+			items = append(items, item)
+			return nil
+		})
+		return items, err
+	}
+
+	if isMarkdown(path) {
+		item, err := loadMarkdown(path)
+		if err != nil {
+			return nil, err
+		}
+		return []db.Content{item}, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	items, err := parseJSONItems(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return items, nil
+}
+
+// parseJSONItems parses a JSON array, a single JSON object or JSON Lines
+func parseJSONItems(data []byte) ([]db.Content, error) {
+	trimmed := strings.TrimSpace(string(data))
+	if strings.HasPrefix(trimmed, "[") {
+		var items []db.Content
+		if err := json.Unmarshal([]byte(trimmed), &items); err != nil {
+			return nil, fmt.Errorf("invalid JSON: %w", err)
+		}
+		return items, nil
+	}
+
+	var items []db.Content
+	decoder := json.NewDecoder(strings.NewReader(trimmed))
+	for decoder.More() {
+		var item db.Content
+		if err := decoder.Decode(&item); err != nil {
+			return nil, fmt.Errorf("invalid JSON: %w", err)
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// isMarkdown reports whether a path looks like a Markdown or text file
+func isMarkdown(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".md", ".markdown", ".txt":
+		return true
+	}
+	return false
+}
+
+// loadMarkdown reads a Markdown file as a note. The title is taken from the
+// front matter or the first heading, falling back to the file name.
+func loadMarkdown(path string) (db.Content, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return db.Content{}, err
+	}
+
+	item := db.Content{
+		Type:     string(models.ContentTypeNote),
+		Body:     string(data),
+		FilePath: path,
+	}
+	parseFrontMatter(&item)
+
+	scanner := bufio.NewScanner(strings.NewReader(item.Body))
+	for item.Title == "" && scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") {
+			item.Title = strings.TrimSpace(strings.TrimLeft(line, "#"))
+			break
+		}
+	}
+	if item.Title == "" {
+		item.Title = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+
+	return item, nil
+}
+
+// parseFrontMatter strips a front matter header, as written by export, from
+// the body and applies its title, type, language, tags and url fields
+func parseFrontMatter(item *db.Content) {
+	rest, ok := strings.CutPrefix(item.Body, "---\n")
+	if !ok {
+		return
+	}
+	header, body, ok := strings.Cut(rest, "\n---\n")
+	if !ok {
+		return
+	}
+
+	for _, line := range strings.Split(header, "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "title":
+			item.Title = value
+		case "type":
+			item.Type = value
+		case "url":
+			item.SourceURL = value
+		case "language":
+			item.Language = value
+		case "tags":
+			for _, tag := range strings.Split(strings.Trim(value, "[]"), ",") {
+				if tag = db.NormalizeTagName(tag); tag != "" {
+					item.Tags = append(item.Tags, tag)
+				}
+			}
+		}
+	}
+
+	item.Body = strings.TrimLeft(body, "\n")
+}
+
+// runExport writes every content item to stdout or a file, or one Markdown
+// file per item into a directory
+func runExport(ctx context.Context, b backend, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := fs.String("format", "json", "Output format: json, jsonl or markdown")
+	output := fs.String("o", "", "Output file (json, jsonl) or directory (markdown); defaults to stdout")
+	contentType := fs.String("type", "", "Only export this content type")
+
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+
+	var items []db.Content
+	filter := db.ContentFilter{Type: *contentType, Limit: exportPageSize}
+	for {
+		page, err := b.List(ctx, filter)
+		if err != nil {
+			return err
+		}
+		items = append(items, page.Items...)
+		if page.NextCursor == "" {
+			break
+		}
+		filter.Cursor = page.NextCursor
+	}
+
+	switch *format {
+	case "json", "jsonl":
+		w := io.Writer(os.Stdout)
+		if *output != "" {
+			file, err := os.Create(*output)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			w = file
+		}
+
+		encoder := json.NewEncoder(w)
+		if *format == "jsonl" {
+			for _, item := range items {
+				if err := encoder.Encode(item); err != nil {
+					return err
+				}
+			}
+			break
+		}
+		encoder.SetIndent("", "  ")
+		if items == nil {
+			items = []db.Content{}
+		}
+		if err := encoder.Encode(items); err != nil {
+			return err
+		}
+	case "markdown":
+		if *output == "" {
+			return fmt.Errorf("markdown export needs an output directory (-o)")
+		}
+		if err := os.MkdirAll(*output, 0755); err != nil {
+			return err
+		}
+		for _, item := range items {
+			name := fmt.Sprintf("%d-%s.md", item.ID, slugify(item.Title))
+			if err := os.WriteFile(filepath.Join(*output, name), []byte(formatMarkdown(item)), 0644); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unknown export format %q", *format)
+	}
+
+	if *output != "" {
+		fmt.Fprintf(os.Stderr, "Exported %d items to %s\n", len(items), *output)
+	}
+	return nil
+}
+
+// formatMarkdown renders a content item as Markdown with a front matter header
+func formatMarkdown(item db.Content) string {
+	var b strings.Builder
+	b.WriteString("---\n")
+	fmt.Fprintf(&b, "id: %d\n", item.ID)
+	fmt.Fprintf(&b, "title: %s\n", strings.ReplaceAll(item.Title, "\n", " "))
+	fmt.Fprintf(&b, "type: %s\n", item.Type)
+	if item.Language != "" {
+		fmt.Fprintf(&b, "language: %s\n", item.Language)
+	}
+	if len(item.Tags) > 0 {
+		fmt.Fprintf(&b, "tags: [%s]\n", strings.Join(item.Tags, ", "))
+	}
+	if item.SourceURL != "" {
+		fmt.Fprintf(&b, "url: %s\n", item.SourceURL)
+	}
+	fmt.Fprintf(&b, "created_at: %s\n", item.CreatedAt)
+	fmt.Fprintf(&b, "updated_at: %s\n", item.UpdatedAt)
+	b.WriteString("---\n\n")
+	b.WriteString(item.Body)
+	if !strings.HasSuffix(item.Body, "\n") {
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+var slugPattern = regexp.MustCompile(`[^a-z0-9]+`)
+
+// slugify turns a title into a file-name-safe slug
+func slugify(title string) string {
+	slug := strings.Trim(slugPattern.ReplaceAllString(strings.ToLower(title), "-"), "-")
+	if len(slug) > 50 {
+		slug = strings.TrimRight(slug[:50], "-")
+	}
+	if slug == "" {
+		slug = "untitled"
+	}
+	return slug
+}
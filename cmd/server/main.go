@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log"
 	"os"
-	"path/filepath"
+	"os/signal"
+	"syscall"
 
+	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
 	"github.com/rgehrsitz/me/internal/api"
+	"github.com/rgehrsitz/me/internal/config"
 	"github.com/rgehrsitz/me/internal/db"
 )
 
@@ -17,50 +22,177 @@ func main() {
 		log.Println("No .env file found, using environment variables")
 	}
 
-	// Parse command line flags
+	// Parse command line flags. Flags override the config file and the
+	// environment, so they have no defaults of their own.
 	var (
-		dbPath   = flag.String("db", "", "Path to SQLite database file")
-		port     = flag.String("port", "8080", "Port to run the server on")
-		dataDir  = flag.String("data", "", "Directory to store data files")
+		configPath = flag.String("config", "", "Path to the config file (env PKB_CONFIG, default ~/.pkb/config.toml)")
+		addr       = flag.String("addr", "", "Address to listen on, e.g. :8080")
+		port       = flag.String("port", "", "Port to listen on; shorthand for -addr :PORT")
+		dbPath     = flag.String("db", "", "Path to SQLite database file")
+		dataDir    = flag.String("data", "", "Directory to store data files")
+		devProxy   = flag.String("dev-proxy", "", "Proxy the frontend to a Vite dev server at this URL")
+		keyFile    = flag.String("key-file", "", "File holding the passphrase that unlocks an encrypted database (env PKB_KEY_FILE)")
+		mcpStdio   = flag.Bool("mcp", false, "Serve the Model Context Protocol over stdin/stdout instead of HTTP")
 	)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] [config print | token bootstrap]\n\nOptions:\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
-	// Set default paths if not provided
-	if *dbPath == "" {
-		homeDir, err := os.UserHomeDir()
-		if err != nil {
-			log.Fatalf("Failed to get user home directory: %v", err)
-		}
-		defaultDataDir := filepath.Join(homeDir, ".pkb")
-		*dbPath = filepath.Join(defaultDataDir, "pkb.db")
-		
-		if *dataDir == "" {
-			*dataDir = defaultDataDir
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "addr":
+			cfg.Server.Addr = *addr
+		case "port":
+			cfg.Server.Addr = ":" + *port
+		case "db":
+			cfg.Storage.DBPath = *dbPath
+		case "data":
+			cfg.Storage.DataDir = *dataDir
+		case "dev-proxy":
+			cfg.Server.DevProxy = *devProxy
+		case "key-file":
+			cfg.Storage.KeyFile = *keyFile
 		}
+	})
+
+	bootstrap := false
+	switch args := flag.Args(); {
+	case len(args) == 0:
+	case len(args) == 2 && args[0] == "config" && args[1] == "print":
+		printConfig(cfg)
+		return
+	case len(args) == 2 && args[0] == "token" && args[1] == "bootstrap":
+		bootstrap = true
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid config:\n%v", err)
 	}
 
 	// Ensure data directory exists
-	if *dataDir != "" {
-		if err := os.MkdirAll(*dataDir, 0755); err != nil {
+	if cfg.Storage.DataDir != "" {
+		if err := os.MkdirAll(cfg.Storage.DataDir, 0755); err != nil {
 			log.Fatalf("Failed to create data directory: %v", err)
 		}
 	}
 
 	// Initialize database
-	database, err := db.New(*dbPath)
+	database, err := db.New(cfg.Storage.DBPath)
 	if err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
-	defer database.Close()
+
+	if bootstrap {
+		err = bootstrapToken(database)
+	} else {
+		err = serve(database, cfg, *mcpStdio)
+	}
+
+	// Close the database only after the server and its background jobs have
+	// stopped writing to it
+	if closeErr := database.Close(); closeErr != nil {
+		log.Printf("Failed to close database: %v", closeErr)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// serve runs the server over HTTP, or MCP over stdio, until SIGINT or SIGTERM
+func serve(database *db.DB, cfg *config.Config, mcpStdio bool) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// stdout carries MCP messages, so keep gin's output off it
+	if mcpStdio {
+		gin.DefaultWriter = os.Stderr
+	}
 
 	// Initialize and run API server
-	server, err := api.NewServer(database, *dataDir)
+	server, err := api.NewServer(database, cfg)
+	if err != nil {
+		return fmt.Errorf("failed to initialize server: %w", err)
+	}
+
+	if mcpStdio {
+		log.Println("Serving MCP over stdio")
+		if err := server.ServeMCP(ctx, os.Stdin, os.Stdout); err != nil {
+			return fmt.Errorf("failed to serve MCP: %w", err)
+		}
+		return nil
+	}
+
+	log.Printf("Starting server on %s", cfg.Server.Addr)
+	if err := server.Run(ctx); err != nil {
+		return fmt.Errorf("failed to run server: %w", err)
+	}
+	log.Println("Server stopped")
+	return nil
+}
+
+// bootstrapToken creates the first admin API token and prints it. The token
+// belongs to the first user, who is created as "admin" if there are no users
+// yet. It refuses to run once any token exists; further users and tokens are
+// managed through the API.
+func bootstrapToken(database *db.DB) error {
+	count, err := database.CountAPITokens()
+	if err != nil {
+		return fmt.Errorf("failed to count API tokens: %w", err)
+	}
+	if count > 0 {
+		return fmt.Errorf("API tokens already exist; create more with POST /api/tokens")
+	}
+
+	users, err := database.CountUsers()
+	if err != nil {
+		return fmt.Errorf("failed to count users: %w", err)
+	}
+
+	var userID int64
+	if users == 0 {
+		userID, err = database.CreateUser("admin", "")
+	} else {
+		userID, err = database.DefaultUserID()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set up admin user: %w", err)
+	}
+
+	user, err := database.GetUser(userID)
+	if err != nil {
+		return fmt.Errorf("failed to get admin user: %w", err)
+	}
+
+	token, _, err := database.CreateAPIToken(user.ID, "bootstrap", []string{db.ScopeAdmin})
+	if err != nil {
+		return fmt.Errorf("failed to create API token: %w", err)
+	}
+
+	fmt.Println(token)
+	fmt.Fprintf(os.Stderr, "Store this admin token for user %q now; it will not be shown again.\n", user.Username)
+	return nil
+}
+
+// printConfig writes the effective config with secrets redacted, followed by
+// any validation problems
+func printConfig(cfg *config.Config) {
+	out, err := cfg.Redacted().Print()
 	if err != nil {
-		log.Fatalf("Failed to initialize server: %v", err)
+		log.Fatalf("Failed to print config: %v", err)
 	}
+	os.Stdout.Write(out)
 
-	log.Printf("Starting server on port %s", *port)
-	if err := server.Run(":" + *port); err != nil {
-		log.Fatalf("Failed to run server: %v", err)
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "\nInvalid config:\n%v\n", err)
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,104 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rgehrsitz/me/internal/db"
+)
+
+// GetAttachment handles downloading the file attached to a content item
+func (s *Server) GetAttachment(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	attachment, err := s.db.GetAttachment(s.userID(c), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to get attachment: %v", err)})
+		return
+	}
+
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Name}))
+	c.Data(http.StatusOK, attachment.MediaType, attachment.Data)
+}
+
+// SetAttachment handles attaching a file, sent as the request body, to a
+// content item. The file name is given with ?name=.
+func (s *Server) SetAttachment(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	name := filepath.Base(c.Query("name"))
+	if name == "." || name == "/" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A file name is required (?name=)"})
+		return
+	}
+
+	data, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Failed to read file: %v", err)})
+		return
+	}
+	mediaType := c.ContentType()
+	if mediaType == "" || mediaType == "application/x-www-form-urlencoded" {
+		mediaType = http.DetectContentType(data)
+	}
+
+	attachment := &db.Attachment{ContentID: id, Name: name, MediaType: mediaType, Data: data}
+	err = s.db.SetAttachment(s.userID(c), attachment)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Content not found"})
+		return
+	}
+	if errors.Is(err, db.ErrForbidden) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Content is shared with you read-only"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to attach file: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"content_id": id, "name": name, "media_type": mediaType, "size": len(data)})
+}
+
+// DeleteAttachment handles removing the file attached to a content item
+func (s *Server) DeleteAttachment(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	err = s.db.DeleteAttachment(s.userID(c), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+		return
+	}
+	if errors.Is(err, db.ErrForbidden) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Content is shared with you read-only"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to delete attachment: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Attachment deleted successfully"})
+}
@@ -0,0 +1,178 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rgehrsitz/me/internal/db"
+)
+
+// tokenContextKey holds the authenticated token in the gin context
+const tokenContextKey = "apiToken"
+
+// userContextKey holds the ID of the user the request acts as
+const userContextKey = "userID"
+
+// readOnlyPOSTs are POST routes that only read data
+var readOnlyPOSTs = map[string]bool{
+	"/api/search": true,
+}
+
+// requestTokenKey holds the authenticated token in the request context,
+// which, unlike the gin context, is kept when a vault's router takes over the
+// request, so the token is only looked up once
+type requestTokenKey struct{}
+
+// authenticate returns middleware that requires a bearer token for every
+// request. GET requests need the read scope and everything else the write
+// scope, unless a stricter scope is given. The request then acts as the
+// token's user, or as the default user when authentication is disabled.
+func (s *Server) authenticate(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !s.config.Auth.Enabled {
+			c.Set(userContextKey, s.defaultUser)
+			c.Next()
+			return
+		}
+
+		token, ok := c.Request.Context().Value(requestTokenKey{}).(*db.APIToken)
+		if !ok {
+			if token = s.lookupToken(c); token == nil {
+				return
+			}
+			c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), requestTokenKey{}, token))
+		}
+
+		required := scope
+		if required == "" {
+			required = db.ScopeWrite
+			if c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead || readOnlyPOSTs[c.FullPath()] {
+				required = db.ScopeRead
+			}
+		}
+		if !token.HasScope(required) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("API token lacks the %s scope", required)})
+			return
+		}
+
+		if err := s.syncUser(token.UserID); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to set up user in vault: %v", err)})
+			return
+		}
+
+		c.Set(tokenContextKey, token)
+		c.Set(userContextKey, token.UserID)
+		c.Next()
+	}
+}
+
+// lookupToken returns the token the request's bearer token stands for. It
+// aborts the request and returns nil if there is none or it is invalid.
+func (s *Server) lookupToken(c *gin.Context) *db.APIToken {
+	header := c.GetHeader("Authorization")
+	raw, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok || raw == "" {
+		c.Header("WWW-Authenticate", `Bearer realm="pkb"`)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "API token required"})
+		return nil
+	}
+
+	token, err := s.users.AuthenticateAPIToken(strings.TrimSpace(raw))
+	if errors.Is(err, db.ErrInvalidToken) {
+		c.Header("WWW-Authenticate", `Bearer realm="pkb", error="invalid_token"`)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return nil
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to check API token: %v", err)})
+		return nil
+	}
+	return token
+}
+
+// userID returns the ID of the user the request acts as
+func (s *Server) userID(c *gin.Context) int64 {
+	return c.GetInt64(userContextKey)
+}
+
+// ListTokens handles listing API tokens
+func (s *Server) ListTokens(c *gin.Context) {
+	tokens, err := s.users.ListAPITokens()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to list tokens: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, tokens)
+}
+
+// CreateToken handles creating an API token for the requesting user, or for
+// another user given by user_id or username. The response is the only time
+// the token itself is shown.
+func (s *Server) CreateToken(c *gin.Context) {
+	var req struct {
+		Name     string   `json:"name" binding:"required"`
+		Scopes   []string `json:"scopes"`
+		UserID   int64    `json:"user_id"`
+		Username string   `json:"username"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(req.Scopes) == 0 {
+		req.Scopes = []string{db.ScopeRead}
+	}
+	if err := db.ValidateScopes(req.Scopes); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID := s.userID(c)
+	if req.UserID != 0 || req.Username != "" {
+		user, err := s.lookupUser(req.UserID, req.Username)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		userID = user.ID
+	}
+
+	token, record, err := s.users.CreateAPIToken(userID, req.Name, req.Scopes)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to create token: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"token":     token,
+		"api_token": record,
+	})
+}
+
+// RevokeToken handles revoking an API token
+func (s *Server) RevokeToken(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	err = s.users.RevokeAPIToken(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Token not found or already revoked"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to revoke token: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Token revoked successfully"})
+}
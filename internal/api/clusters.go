@@ -0,0 +1,62 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ListClusters handles listing topic clusters with their members
+func (s *Server) ListClusters(c *gin.Context) {
+	includeMembers := c.DefaultQuery("members", "true") != "false"
+
+	clusters, err := s.db.ListClusters(s.userID(c), includeMembers)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to list clusters: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, clusters)
+}
+
+// GetCluster handles getting a single cluster with its members
+func (s *Server) GetCluster(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	cluster, err := s.db.GetCluster(s.userID(c), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Cluster not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to get cluster: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, cluster)
+}
+
+// RebuildClusters handles running a full clustering pass
+func (s *Server) RebuildClusters(c *gin.Context) {
+	k, err := strconv.Atoi(c.DefaultQuery("k", "0"))
+	if err != nil || k < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cluster count"})
+		return
+	}
+
+	clusters, err := s.clusterService.Recluster(c.Request.Context(), s.userID(c), k)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to rebuild clusters: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, clusters)
+}
@@ -0,0 +1,253 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rgehrsitz/me/internal/db"
+	"github.com/rgehrsitz/me/internal/models"
+)
+
+// ListCollections handles listing the collection tree
+func (s *Server) ListCollections(c *gin.Context) {
+	tree, err := s.db.CollectionTree(s.userID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to list collections: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, tree)
+}
+
+// CreateCollection handles creating a new collection
+func (s *Server) CreateCollection(c *gin.Context) {
+	var collection db.Collection
+	if err := c.ShouldBindJSON(&collection); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if collection.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Collection name is required"})
+		return
+	}
+
+	userID := s.userID(c)
+	id, err := s.db.CreateCollection(userID, &collection)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Parent collection not found"})
+		return
+	}
+	if errors.Is(err, db.ErrForbidden) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Parent collection is shared with you read-only"})
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to create collection: %v", err)})
+		return
+	}
+
+	created, err := s.db.GetCollection(userID, id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Collection created but failed to retrieve: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusCreated, created)
+}
+
+// GetCollection handles getting a collection with its direct children
+func (s *Server) GetCollection(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	collection, err := s.db.GetCollection(s.userID(c), id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Collection not found: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, collection)
+}
+
+// UpdateCollection handles renaming a collection or changing its description
+func (s *Server) UpdateCollection(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	var collection db.Collection
+	if err := c.ShouldBindJSON(&collection); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if collection.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Collection name is required"})
+		return
+	}
+
+	collection.ID = id
+	err = s.db.UpdateCollection(s.userID(c), &collection)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Collection not found"})
+		return
+	}
+	if errors.Is(err, db.ErrForbidden) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Collection is shared with you read-only"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to update collection: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Collection updated successfully"})
+}
+
+// MoveCollection handles moving a collection to a new parent or position
+func (s *Server) MoveCollection(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	var req models.MoveCollectionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	position := -1
+	if req.Position != nil {
+		position = *req.Position
+	}
+
+	err = s.db.MoveCollection(s.userID(c), id, req.ParentID, position)
+	if errors.Is(err, db.ErrCollectionCycle) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Collection not found"})
+		return
+	}
+	if errors.Is(err, db.ErrForbidden) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the owner can move a collection"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to move collection: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Collection moved successfully"})
+}
+
+// DeleteCollection handles deleting a collection. The mode query parameter
+// selects whether sub-collections are reparented (default) or deleted.
+func (s *Server) DeleteCollection(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	mode := c.DefaultQuery("mode", db.DeleteReparent)
+	if mode != db.DeleteReparent && mode != db.DeleteCascade {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid mode %q, expected reparent or cascade", mode)})
+		return
+	}
+
+	err = s.db.DeleteCollection(s.userID(c), id, mode)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Collection not found"})
+		return
+	}
+	if errors.Is(err, db.ErrForbidden) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the owner can delete a collection"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to delete collection: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Collection deleted successfully"})
+}
+
+// AddCollectionItem handles filing a content item in a collection
+func (s *Server) AddCollectionItem(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	var req models.CollectionItemRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	position := -1
+	if req.Position != nil {
+		position = *req.Position
+	}
+
+	err = s.db.AddCollectionItem(s.userID(c), id, req.ContentID, position)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Collection or content not found"})
+		return
+	}
+	if errors.Is(err, db.ErrForbidden) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Collection is shared with you read-only"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to add item: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Item added successfully"})
+}
+
+// RemoveCollectionItem handles removing a content item from a collection
+func (s *Server) RemoveCollectionItem(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	contentID, err := strconv.ParseInt(c.Param("content_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid content ID"})
+		return
+	}
+
+	err = s.db.RemoveCollectionItem(s.userID(c), id, contentID)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not in collection"})
+		return
+	}
+	if errors.Is(err, db.ErrForbidden) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Collection is shared with you read-only"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to remove item: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Item removed successfully"})
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rgehrsitz/me/internal/db"
+	"github.com/rgehrsitz/me/internal/models"
+	"github.com/rgehrsitz/me/internal/services"
+)
+
+// ListDuplicates handles scanning for candidate duplicate groups
+func (s *Server) ListDuplicates(c *gin.Context) {
+	threshold := services.DefaultDuplicateThreshold
+	if raw := c.Query("threshold"); raw != "" {
+		value, err := strconv.ParseFloat(raw, 64)
+		if err != nil || value <= 0 || value > 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid threshold, expected a value in (0, 1]"})
+			return
+		}
+		threshold = value
+	}
+
+	approximate, _ := strconv.ParseBool(c.Query("approximate"))
+
+	groups, err := s.duplicateService.FindDuplicates(s.userID(c), threshold, approximate)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to scan for duplicates: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, groups)
+}
+
+// MergeContent handles merging a group of content items into one
+func (s *Server) MergeContent(c *gin.Context) {
+	var req models.MergeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID := s.userID(c)
+	err := s.db.MergeContent(userID, req.TargetID, req.ContentIDs)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Failed to merge content: %v", err)})
+		return
+	}
+	if errors.Is(err, db.ErrForbidden) {
+		c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("Only the owner can merge content: %v", err)})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to merge content: %v", err)})
+		return
+	}
+
+	merged, err := s.db.GetContent(userID, req.TargetID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Content merged but failed to retrieve: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, merged)
+}
+
+// ListRevisions handles listing the revision history of a content item
+func (s *Server) ListRevisions(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	revisions, err := s.db.ListRevisions(s.userID(c), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Content not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to list revisions: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, revisions)
+}
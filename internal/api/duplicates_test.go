@@ -0,0 +1,44 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/rgehrsitz/me/internal/db"
+)
+
+func TestMergeAndRedirect(t *testing.T) {
+	s, userID := newTestServer(t, false)
+	var ids []int64
+	for _, title := range []string{"kept", "merged"} {
+		id, err := s.db.CreateContent(userID, &db.Content{Type: "note", Title: title, Body: "same"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	kept, merged := strconv.FormatInt(ids[0], 10), strconv.FormatInt(ids[1], 10)
+
+	for _, body := range []string{
+		`{"target_id": ` + kept + `, "content_ids": [` + merged + `, 9999]}`,
+		`{"target_id": 9999, "content_ids": [` + merged + `]}`,
+	} {
+		if w := do(s, "POST", "/api/duplicates/merge", "", body); w.Code != http.StatusNotFound {
+			t.Errorf("merge %s: status %d, want 404: %s", body, w.Code, w.Body)
+		}
+	}
+
+	w := do(s, "POST", "/api/duplicates/merge", "", `{"target_id": `+kept+`, "content_ids": [`+merged+`]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("merge: status %d: %s", w.Code, w.Body)
+	}
+
+	w = do(s, "GET", "/api/content/"+merged, "", "")
+	if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "/api/content/"+kept {
+		t.Errorf("GET of the merged item: status %d, location %q, want a redirect to %s", w.Code, w.Header().Get("Location"), kept)
+	}
+	if w := do(s, "GET", "/api/content/9999", "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET of a missing item: status %d, want 404", w.Code)
+	}
+}
@@ -0,0 +1,115 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rgehrsitz/me/internal/services"
+)
+
+// ListEmbeddingModels handles listing the models embeddings are stored for,
+// along with the model search uses and the one being switched to
+func (s *Server) ListEmbeddingModels(c *gin.Context) {
+	models, err := s.db.ListEmbeddingModels()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to list embedding models: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"active": s.embeddingService.Model(),
+		"next":   s.nextModel(),
+		"models": models,
+	})
+}
+
+// DeleteEmbeddingModel handles deleting the embeddings of a model that is no
+// longer used, such as the old model after a switch
+func (s *Server) DeleteEmbeddingModel(c *gin.Context) {
+	model := c.Param("model")
+	if model == s.embeddingService.Model() || model == s.nextModel() {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Model %s is in use", model)})
+		return
+	}
+
+	deleted, err := s.db.DeleteEmbeddings(model)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to delete embeddings: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"deleted": deleted})
+}
+
+// GetReembed handles reporting the progress of the current or last
+// re-embedding job
+func (s *Server) GetReembed(c *gin.Context) {
+	progress := s.reembedService.Progress()
+	if progress == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No re-embedding job has run"})
+		return
+	}
+
+	c.JSON(http.StatusOK, progress)
+}
+
+// StartReembed handles starting a background job that embeds content with
+// the active model or the one being switched to, the default during a
+// switch. Only items without an embedding from that model are embedded
+// unless all is set.
+func (s *Server) StartReembed(c *gin.Context) {
+	model := c.Query("model")
+	all, err := strconv.ParseBool(c.DefaultQuery("all", "false"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid all parameter"})
+		return
+	}
+
+	// The next model is what needs filling in during a switch
+	embeddingService := s.nextEmbeddingService
+	if embeddingService == nil || model == s.embeddingService.Model() {
+		embeddingService = s.embeddingService
+	}
+	if model != "" && model != embeddingService.Model() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Model %s is neither ai.embedding_model nor ai.next_embedding_model", model)})
+		return
+	}
+
+	run, err := s.reembedService.Start(embeddingService, all)
+	if errors.Is(err, services.ErrReembedRunning) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to start re-embedding: %v", err)})
+		return
+	}
+	// Like the periodic jobs, stop as soon as shutdown starts
+	s.background(func(context.Context) {
+		run(s.periodicCtx)
+	})
+
+	c.JSON(http.StatusAccepted, s.reembedService.Progress())
+}
+
+// CancelReembed handles stopping the running re-embedding job
+func (s *Server) CancelReembed(c *gin.Context) {
+	if !s.reembedService.Cancel() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No re-embedding job is running"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Re-embedding cancelled"})
+}
+
+// nextModel returns the model being switched to, or ""
+func (s *Server) nextModel() string {
+	if s.nextEmbeddingService == nil {
+		return ""
+	}
+	return s.nextEmbeddingService.Model()
+}
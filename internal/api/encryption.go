@@ -0,0 +1,159 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rgehrsitz/me/internal/config"
+	"github.com/rgehrsitz/me/internal/db"
+)
+
+// lockedError is the response while an encrypted knowledge base is locked
+var lockedError = gin.H{"error": "Knowledge base is locked; unlock it with POST /api/encryption/unlock"}
+
+// autoUnlock unlocks an encrypted database with the passphrase from the
+// environment or key file, if one is configured. A wrong passphrase leaves
+// the database locked.
+func autoUnlock(database *db.DB, cfg *config.Config, name string) error {
+	if !database.Encrypted() {
+		return nil
+	}
+
+	passphrase, err := cfg.Storage.Passphrase()
+	if err != nil {
+		return err
+	}
+	if passphrase == "" {
+		log.Printf("%s is encrypted and locked until unlocked with POST /api/encryption/unlock", name)
+		return nil
+	}
+
+	err = database.Unlock(passphrase)
+	if errors.Is(err, db.ErrWrongPassphrase) {
+		log.Printf("%s is encrypted and the configured passphrase does not unlock it; it stays locked", name)
+		return nil
+	}
+	return err
+}
+
+// requireUnlocked rejects requests while the knowledge base is locked, since
+// titles and bodies can be neither read nor written
+func (s *Server) requireUnlocked(c *gin.Context) {
+	if s.db.Locked() {
+		c.AbortWithStatusJSON(http.StatusLocked, lockedError)
+		return
+	}
+	c.Next()
+}
+
+// passphraseRequest carries the passphrase for an encryption operation
+type passphraseRequest struct {
+	Passphrase string `json:"passphrase" binding:"required"`
+}
+
+// GetEncryption handles reporting whether the knowledge base is encrypted and
+// whether it is locked
+func (s *Server) GetEncryption(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"encrypted": s.db.Encrypted(),
+		"locked":    s.db.Locked(),
+	})
+}
+
+// EnableEncryption handles encrypting the knowledge base with a passphrase
+func (s *Server) EnableEncryption(c *gin.Context) {
+	var req passphraseRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := s.db.EnableEncryption(req.Passphrase)
+	if errors.Is(err, db.ErrAlreadyEncrypted) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, db.ErrEmptyPassphrase) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to encrypt knowledge base: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Knowledge base encrypted successfully"})
+}
+
+// UnlockEncryption handles unlocking an encrypted knowledge base
+func (s *Server) UnlockEncryption(c *gin.Context) {
+	var req passphraseRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := s.db.Unlock(req.Passphrase)
+	if errors.Is(err, db.ErrNotEncrypted) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, db.ErrWrongPassphrase) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Wrong passphrase"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to unlock knowledge base: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Knowledge base unlocked successfully"})
+}
+
+// LockEncryption handles locking an encrypted knowledge base, forgetting its
+// key until it is unlocked again
+func (s *Server) LockEncryption(c *gin.Context) {
+	if !s.db.Encrypted() {
+		c.JSON(http.StatusConflict, gin.H{"error": db.ErrNotEncrypted.Error()})
+		return
+	}
+	s.db.Lock()
+
+	c.JSON(http.StatusOK, gin.H{"message": "Knowledge base locked successfully"})
+}
+
+// RekeyEncryption handles changing the passphrase of an unlocked knowledge
+// base, optionally re-encrypting everything under a new data key
+func (s *Server) RekeyEncryption(c *gin.Context) {
+	var req struct {
+		Passphrase string `json:"passphrase" binding:"required"`
+		Rotate     bool   `json:"rotate"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := s.db.Rekey(req.Passphrase, req.Rotate)
+	if errors.Is(err, db.ErrNotEncrypted) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, db.ErrLocked) {
+		c.JSON(http.StatusLocked, lockedError)
+		return
+	}
+	if errors.Is(err, db.ErrEmptyPassphrase) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to re-key knowledge base: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Knowledge base re-keyed successfully"})
+}
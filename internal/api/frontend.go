@@ -0,0 +1,102 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Cache policies for the frontend. Vite fingerprints everything under
+// assets/, so those files never change; index.html must always be
+// revalidated so a new build is picked up.
+const (
+	cacheImmutable = "public, max-age=31536000, immutable"
+	cacheStatic    = "public, max-age=3600"
+	cacheNone      = "no-cache"
+)
+
+// newDevProxy forwards frontend requests to a Vite dev server, e.g.
+// http://localhost:5173, instead of serving the embedded build
+func newDevProxy(target string) (*httputil.ReverseProxy, error) {
+	u, err := url.Parse(target)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid dev proxy URL %q", target)
+	}
+	return httputil.NewSingleHostReverseProxy(u), nil
+}
+
+// serveFrontend serves the single-page app for any route not handled by the
+// API. Paths that are not files, such as /edit/42, get index.html so the
+// client-side router can handle them.
+func (s *Server) serveFrontend(c *gin.Context) {
+	p := c.Request.URL.Path
+	if p == "/api" || strings.HasPrefix(p, "/api/") || p == "/mcp" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	}
+	if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+		c.Status(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if s.devProxy != nil {
+		s.devProxy.ServeHTTP(c.Writer, c.Request)
+		return
+	}
+
+	name := strings.TrimPrefix(path.Clean(p), "/")
+	if name != "" && name != "index.html" {
+		if info, err := fs.Stat(s.frontend, name); err == nil && !info.IsDir() {
+			cache := cacheStatic
+			if strings.HasPrefix(name, "assets/") {
+				cache = cacheImmutable
+			}
+			s.serveFrontendFile(c, name, cache)
+			return
+		}
+
+		// A missing fingerprinted asset must not turn into index.html
+		if strings.HasPrefix(name, "assets/") {
+			c.Status(http.StatusNotFound)
+			return
+		}
+	}
+
+	if _, err := fs.Stat(s.frontend, "index.html"); err != nil {
+		c.String(http.StatusNotFound, "Frontend not built. Run `npm run build` in web/ and rebuild the server.")
+		return
+	}
+	s.serveFrontendFile(c, "index.html", cacheNone)
+}
+
+// serveFrontendFile writes a file from the embedded frontend
+func (s *Server) serveFrontendFile(c *gin.Context, name, cache string) {
+	f, err := s.frontend.Open(name)
+	if err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	c.Header("Cache-Control", cache)
+	http.ServeContent(c.Writer, c.Request, name, info.ModTime(), content)
+}
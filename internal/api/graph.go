@@ -0,0 +1,103 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rgehrsitz/me/internal/models"
+	"github.com/rgehrsitz/me/internal/services"
+)
+
+// sqliteTimeFormat is the format SQLite uses for CURRENT_TIMESTAMP
+const sqliteTimeFormat = "2006-01-02 15:04:05"
+
+// GetGraph handles exporting the knowledge graph as JSON, GraphML or DOT
+func (s *Server) GetGraph(c *gin.Context) {
+	opts := models.GraphOptions{
+		Types:    splitList(c.Query("type")),
+		Tags:     splitList(c.Query("tag")),
+		Semantic: c.Query("semantic") == "true",
+	}
+
+	if raw := c.Query("threshold"); raw != "" {
+		threshold, err := strconv.ParseFloat(raw, 64)
+		if err != nil || threshold <= 0 || threshold > 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid threshold, expected a value in (0, 1]"})
+			return
+		}
+		opts.Threshold = threshold
+	}
+
+	var err error
+	if opts.From, err = parseDateParam(c.Query("from"), false); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid from date: %v", err)})
+		return
+	}
+	if opts.To, err = parseDateParam(c.Query("to"), true); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid to date: %v", err)})
+		return
+	}
+
+	graph, err := s.graphService.Build(s.userID(c), opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to build graph: %v", err)})
+		return
+	}
+
+	switch format := c.DefaultQuery("format", "json"); format {
+	case "json":
+		c.JSON(http.StatusOK, graph)
+	case "graphml":
+		c.Header("Content-Disposition", `attachment; filename="pkb.graphml"`)
+		c.Header("Content-Type", "application/graphml+xml")
+		c.Status(http.StatusOK)
+		if err := services.WriteGraphML(c.Writer, graph); err != nil {
+			c.Error(err)
+		}
+	case "dot":
+		c.Header("Content-Disposition", `attachment; filename="pkb.dot"`)
+		c.Header("Content-Type", "text/vnd.graphviz")
+		c.Status(http.StatusOK)
+		if err := services.WriteDOT(c.Writer, graph); err != nil {
+			c.Error(err)
+		}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unknown format %q, expected json, graphml or dot", format)})
+	}
+}
+
+// splitList splits a comma-separated query parameter
+func splitList(raw string) []string {
+	var items []string
+	for _, item := range strings.Split(raw, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseDateParam parses a YYYY-MM-DD or RFC 3339 date into the format stored
+// by SQLite. A bare end date is made inclusive by moving it to the next day.
+func parseDateParam(raw string, end bool) (string, error) {
+	if raw == "" {
+		return "", nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return t.UTC().Format(sqliteTimeFormat), nil
+	}
+
+	t, err := time.Parse("2006-01-02", raw)
+	if err != nil {
+		return "", fmt.Errorf("expected YYYY-MM-DD or RFC 3339, got %q", raw)
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t.Format(sqliteTimeFormat), nil
+}
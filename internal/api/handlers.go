@@ -2,13 +2,20 @@ package api
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/rgehrsitz/me/internal/code"
 	"github.com/rgehrsitz/me/internal/db"
 	"github.com/rgehrsitz/me/internal/models"
+	"github.com/rgehrsitz/me/internal/search"
 )
 
 // CreateContent handles the creation of new content
@@ -19,7 +26,8 @@ func (s *Server) CreateContent(c *gin.Context) {
 		return
 	}
 
-	id, err := s.db.CreateContent(&content)
+	userID := s.userID(c)
+	id, err := s.db.CreateContent(userID, &content)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to create content: %v", err)})
 		return
@@ -27,29 +35,11 @@ func (s *Server) CreateContent(c *gin.Context) {
 
 	// Generate embedding if text is present
 	if content.Body != "" {
-		go func() {
-			ctx := context.Background()
-			embedding, err := s.embeddingService.GenerateEmbedding(ctx, content.Body)
-			if err != nil {
-				fmt.Printf("Failed to generate embedding: %v\n", err)
-				return
-			}
-
-			embeddingBytes, err := s.embeddingService.SerializeEmbedding(embedding)
-			if err != nil {
-				fmt.Printf("Failed to serialize embedding: %v\n", err)
-				return
-			}
-
-			_, err = s.db.StoreEmbedding(id, embeddingBytes, "openai-ada-002", len(embedding))
-			if err != nil {
-				fmt.Printf("Failed to store embedding: %v\n", err)
-			}
-		}()
+		s.embedInBackground(id, content.Body)
 	}
 
 	// Get the created content with ID
-	createdContent, err := s.db.GetContent(id)
+	createdContent, err := s.db.GetContent(userID, id)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Content created but failed to retrieve: %v", err)})
 		return
@@ -60,17 +50,48 @@ func (s *Server) CreateContent(c *gin.Context) {
 
 // ListContent handles listing all content
 func (s *Server) ListContent(c *gin.Context) {
-	contentType := c.Query("type")
-	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
-	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	filter := db.ContentFilter{
+		Type:      c.Query("type"),
+		Recursive: c.Query("recursive") == "true",
+	}
+	filter.Limit, _ = strconv.Atoi(c.Query("limit"))
+	filter.Limit = s.config.Limits.PageSize(filter.Limit)
+	filter.Offset, _ = strconv.Atoi(c.DefaultQuery("offset", "0"))
+	filter.Cursor = c.Query("cursor")
+
+	if raw := c.Query("collection"); raw != "" {
+		collectionID, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid collection ID"})
+			return
+		}
+		filter.CollectionID = collectionID
+	}
 
-	contents, err := s.db.ListContent(contentType, limit, offset)
+	page, err := s.db.ListContent(s.userID(c), filter)
+	if errors.Is(err, db.ErrInvalidCursor) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to list content: %v", err)})
 		return
 	}
 
-	c.JSON(http.StatusOK, contents)
+	if page.NextCursor != "" {
+		page.Next = s.nextURL(c, page.NextCursor)
+	}
+	c.JSON(http.StatusOK, page)
+}
+
+// nextURL returns the URL of the request with its offset replaced by a
+// cursor, for the next page. The path is the one the client asked for, which
+// for a vault includes the vault.
+func (s *Server) nextURL(c *gin.Context, cursor string) string {
+	params := c.Request.URL.Query()
+	params.Del("offset")
+	params.Set("cursor", cursor)
+	return s.apiPath(strings.TrimPrefix(c.Request.URL.Path, "/api")) + "?" + params.Encode()
 }
 
 // GetContent handles getting a single content item
@@ -81,8 +102,14 @@ func (s *Server) GetContent(c *gin.Context) {
 		return
 	}
 
-	content, err := s.db.GetContent(id)
+	userID := s.userID(c)
+	content, err := s.db.GetContent(userID, id)
 	if err != nil {
+		// Content merged into another item redirects to the survivor
+		if newID, redirectErr := s.db.ResolveRedirect(userID, id); redirectErr == nil {
+			c.Redirect(http.StatusMovedPermanently, s.apiPath(fmt.Sprintf("/content/%d", newID)))
+			return
+		}
 		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Content not found: %v", err)})
 		return
 	}
@@ -90,6 +117,32 @@ func (s *Server) GetContent(c *gin.Context) {
 	c.JSON(http.StatusOK, content)
 }
 
+// HighlightContent handles rendering a snippet's code as syntax highlighted
+// HTML
+func (s *Server) HighlightContent(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	content, err := s.db.GetContent(s.userID(c), id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Content not found: %v", err)})
+		return
+	}
+	if content.Type != string(models.ContentTypeSnippet) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Only snippets can be highlighted"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":       content.ID,
+		"language": content.Language,
+		"html":     code.Highlight(content.Body, content.Language),
+	})
+}
+
 // UpdateContent handles updating a content item
 func (s *Server) UpdateContent(c *gin.Context) {
 	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
@@ -105,7 +158,15 @@ func (s *Server) UpdateContent(c *gin.Context) {
 	}
 
 	content.ID = id
-	err = s.db.UpdateContent(&content)
+	rewritten, err := s.db.UpdateContent(s.userID(c), &content)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Content not found"})
+		return
+	}
+	if errors.Is(err, db.ErrForbidden) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Content is shared with you read-only"})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to update content: %v", err)})
 		return
@@ -113,25 +174,10 @@ func (s *Server) UpdateContent(c *gin.Context) {
 
 	// Re-generate embedding if text changed
 	if content.Body != "" {
-		go func() {
-			ctx := context.Background()
-			embedding, err := s.embeddingService.GenerateEmbedding(ctx, content.Body)
-			if err != nil {
-				fmt.Printf("Failed to generate embedding: %v\n", err)
-				return
-			}
-
-			embeddingBytes, err := s.embeddingService.SerializeEmbedding(embedding)
-			if err != nil {
-				fmt.Printf("Failed to serialize embedding: %v\n", err)
-				return
-			}
-
-			_, err = s.db.StoreEmbedding(id, embeddingBytes, "openai-ada-002", len(embedding))
-			if err != nil {
-				fmt.Printf("Failed to store embedding: %v\n", err)
-			}
-		}()
+		s.embedInBackground(id, content.Body)
+	}
+	for _, target := range rewritten {
+		s.embedInBackground(target.ID, target.Body)
 	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "Content updated successfully"})
@@ -145,7 +191,15 @@ func (s *Server) DeleteContent(c *gin.Context) {
 		return
 	}
 
-	err = s.db.DeleteContent(id)
+	err = s.db.DeleteContent(s.userID(c), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Content not found"})
+		return
+	}
+	if errors.Is(err, db.ErrForbidden) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the owner can delete content"})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to delete content: %v", err)})
 		return
@@ -154,6 +208,82 @@ func (s *Server) DeleteContent(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "Content deleted successfully"})
 }
 
+// embedBatchDelay is how long new content waits to be embedded, so that
+// items saved in quick succession, as by an import, share API requests
+const embedBatchDelay = 200 * time.Millisecond
+
+// embedInBackground queues a content item to be embedded by a background job
+// so the request that saved it can return immediately
+func (s *Server) embedInBackground(id int64, body string) {
+	s.embedMu.Lock()
+	s.pendingEmbeds = append(s.pendingEmbeds, db.EmbedTarget{ID: id, Body: body})
+	start := !s.embedding
+	s.embedding = true
+	s.embedMu.Unlock()
+
+	if start {
+		s.background(s.embedPending)
+	}
+}
+
+// embedPending embeds the queued content in batches until the queue is
+// empty
+func (s *Server) embedPending(ctx context.Context) {
+	for {
+		timer := time.NewTimer(embedBatchDelay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+		case <-timer.C:
+		}
+
+		s.embedMu.Lock()
+		pending := s.pendingEmbeds
+		s.pendingEmbeds = nil
+		if len(pending) == 0 {
+			s.embedding = false
+			s.embedMu.Unlock()
+			return
+		}
+		s.embedMu.Unlock()
+
+		if ctx.Err() != nil {
+			log.Printf("Skipped embedding %d items on shutdown", len(pending))
+			continue
+		}
+		s.embedContents(ctx, pending)
+	}
+}
+
+// embedContents generates and stores the embeddings for content items, which
+// files each under its nearest topic cluster. During a switch to another
+// embedding model the items are embedded with that model too.
+func (s *Server) embedContents(ctx context.Context, targets []db.EmbedTarget) {
+	// An item saved twice while queued only needs its latest body embedded
+	latest := make(map[int64]int)
+	for i, target := range targets {
+		latest[target.ID] = i
+	}
+	unique := targets[:0]
+	for i, target := range targets {
+		if latest[target.ID] == i {
+			unique = append(unique, target)
+		}
+	}
+
+	if s.nextEmbeddingService != nil {
+		_, failed := s.nextEmbeddingService.EmbedContents(ctx, s.db, unique)
+		for id, err := range failed {
+			log.Printf("Failed to embed content %d with %s: %v", id, s.nextEmbeddingService.Model(), err)
+		}
+	}
+
+	_, failed := s.embeddingService.EmbedContents(ctx, s.db, unique)
+	for id, err := range failed {
+		log.Printf("Failed to embed content %d: %v", id, err)
+	}
+}
+
 // GenerateEmbedding handles generating an embedding for a content item
 func (s *Server) GenerateEmbedding(c *gin.Context) {
 	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
@@ -162,7 +292,7 @@ func (s *Server) GenerateEmbedding(c *gin.Context) {
 		return
 	}
 
-	content, err := s.db.GetContent(id)
+	content, err := s.db.GetContent(s.userID(c), id)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Content not found: %v", err)})
 		return
@@ -174,21 +304,9 @@ func (s *Server) GenerateEmbedding(c *gin.Context) {
 	}
 
 	ctx := c.Request.Context()
-	embedding, err := s.embeddingService.GenerateEmbedding(ctx, content.Body)
+	embedding, embeddingID, err := s.embeddingService.EmbedContent(ctx, s.db, id, content.Body)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to generate embedding: %v", err)})
-		return
-	}
-
-	embeddingBytes, err := s.embeddingService.SerializeEmbedding(embedding)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to serialize embedding: %v", err)})
-		return
-	}
-
-	embeddingID, err := s.db.StoreEmbedding(id, embeddingBytes, "openai-ada-002", len(embedding))
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to store embedding: %v", err)})
+		c.JSON(aiErrorStatus(err), gin.H{"error": fmt.Sprintf("Failed to generate embedding: %v", err)})
 		return
 	}
 
@@ -207,14 +325,25 @@ func (s *Server) Search(c *gin.Context) {
 		return
 	}
 
+	query.Limit = s.config.Limits.PageSize(query.Limit)
+
 	ctx := c.Request.Context()
-	results, err := s.searchService.Search(ctx, query)
+	response, err := s.searchService.Search(ctx, s.userID(c), query)
+	var syntaxErr *search.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": syntaxErr.Error(), "position": syntaxErr.Pos})
+		return
+	}
+	if errors.Is(err, search.ErrInvalidFilter) || errors.Is(err, search.ErrInvalidSort) || errors.Is(err, db.ErrInvalidCursor) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Search failed: %v", err)})
+		c.JSON(aiErrorStatus(err), gin.H{"error": fmt.Sprintf("Search failed: %v", err)})
 		return
 	}
 
-	c.JSON(http.StatusOK, results)
+	c.JSON(http.StatusOK, response)
 }
 
 // SummarizeContent handles summarizing a content item
@@ -225,7 +354,7 @@ func (s *Server) SummarizeContent(c *gin.Context) {
 		return
 	}
 
-	content, err := s.db.GetContent(id)
+	content, err := s.db.GetContent(s.userID(c), id)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Content not found: %v", err)})
 		return
@@ -237,9 +366,9 @@ func (s *Server) SummarizeContent(c *gin.Context) {
 	}
 
 	ctx := c.Request.Context()
-	summary, err := s.summarizeService.Summarize(ctx, content.Body)
+	summary, err := s.summarizeService.Summarize(ctx, id, content.Body)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to generate summary: %v", err)})
+		c.JSON(aiErrorStatus(err), gin.H{"error": fmt.Sprintf("Failed to generate summary: %v", err)})
 		return
 	}
 
@@ -248,49 +377,3 @@ func (s *Server) SummarizeContent(c *gin.Context) {
 		"summary":    summary,
 	})
 }
-
-// ListTags handles listing all tags
-func (s *Server) ListTags(c *gin.Context) {
-	rows, err := s.db.Query("SELECT id, name FROM tags ORDER BY name")
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to list tags: %v", err)})
-		return
-	}
-	defer rows.Close()
-
-	tags := []models.Tag{}
-	for rows.Next() {
-		var tag models.Tag
-		if err := rows.Scan(&tag.ID, &tag.Name); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to scan tag: %v", err)})
-			return
-		}
-		tags = append(tags, tag)
-	}
-
-	c.JSON(http.StatusOK, tags)
-}
-
-// CreateTag handles creating a new tag
-func (s *Server) CreateTag(c *gin.Context) {
-	var tag models.Tag
-	if err := c.ShouldBindJSON(&tag); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
-
-	res, err := s.db.Exec("INSERT INTO tags (name) VALUES (?)", tag.Name)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to create tag: %v", err)})
-		return
-	}
-
-	id, err := res.LastInsertId()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to get tag ID: %v", err)})
-		return
-	}
-
-	tag.ID = id
-	c.JSON(http.StatusCreated, tag)
-}
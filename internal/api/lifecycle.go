@@ -0,0 +1,168 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rgehrsitz/me/internal/db"
+	"github.com/rgehrsitz/me/internal/mcp"
+)
+
+// Run serves HTTP on the configured address until ctx is cancelled, then
+// shuts down gracefully: it stops accepting connections, waits for in-flight
+// requests and background jobs, and gives up once the shutdown timeout
+// expires
+func (s *Server) Run(ctx context.Context) error {
+	s.httpServer = &http.Server{
+		Addr:    s.config.Server.Addr,
+		Handler: s.router,
+	}
+	s.startJobs()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- s.httpServer.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		// The listener failed, e.g. the address is in use
+		s.cancelJobs()
+		s.jobs.Wait()
+		if closeErr := s.closeVaults(context.Background()); closeErr != nil {
+			log.Printf("Failed to close vaults: %v", closeErr)
+		}
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Println("Shutting down server...")
+	return s.shutdown()
+}
+
+// ServeMCP answers Model Context Protocol requests read from r on w until r
+// is closed or ctx is cancelled, for assistants that launch the server as a
+// subprocess. Requests act as the default user.
+func (s *Server) ServeMCP(ctx context.Context, r io.Reader, w io.Writer) error {
+	userID, err := s.db.DefaultUserID()
+	if err != nil {
+		return err
+	}
+	ctx = mcp.WithUser(ctx, userID)
+
+	s.startJobs()
+
+	// Reading stdin blocks, so don't wait for it once ctx is cancelled
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- s.mcpServer.ServeStdio(ctx, r, w)
+	}()
+
+	select {
+	case err = <-serveErr:
+	case <-ctx.Done():
+	}
+
+	if shutdownErr := s.shutdown(); err == nil {
+		err = shutdownErr
+	}
+	return err
+}
+
+// serveMCP answers Model Context Protocol requests over HTTP as the
+// authenticated user, with the tools the token's scopes allow
+func (s *Server) serveMCP(c *gin.Context) {
+	ctx := mcp.WithUser(c.Request.Context(), s.userID(c))
+	if token, ok := c.Get(tokenContextKey); ok {
+		ctx = mcp.WithToken(ctx, token.(*db.APIToken))
+	}
+	s.mcpServer.ServeHTTP(c.Writer, c.Request.WithContext(ctx))
+}
+
+// startJobs starts the enabled periodic jobs, including those of the open
+// vaults
+func (s *Server) startJobs() {
+	if interval := s.config.Jobs.ClusterInterval.Duration; interval > 0 {
+		s.background(func(context.Context) {
+			s.clusterService.RunPeriodic(s.periodicCtx, interval)
+		})
+	}
+	for _, name := range s.vaultNames() {
+		if vault := s.vault(name); vault != nil {
+			vault.startJobs()
+		}
+	}
+}
+
+// background runs fn as a tracked background job. fn should return promptly
+// once its context is cancelled.
+func (s *Server) background(fn func(ctx context.Context)) {
+	s.jobs.Add(1)
+	go func() {
+		defer s.jobs.Done()
+		fn(s.jobsCtx)
+	}()
+}
+
+// shutdown drains in-flight requests and background jobs, cancelling them if
+// they are still running when the shutdown timeout expires, and closes the
+// vaults
+func (s *Server) shutdown() error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.Server.ShutdownTimeout.Duration)
+	defer cancel()
+
+	var errs []error
+	if s.httpServer != nil {
+		if err := s.httpServer.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("failed to drain requests: %w", err))
+		}
+	}
+
+	// Vault jobs are cancelled along with this server's, so drain them first
+	if err := s.closeVaults(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	if err := s.drainJobs(ctx); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// cancelGrace is how long drainJobs waits for background jobs to return once
+// they are cancelled
+const cancelGrace = 5 * time.Second
+
+// drainJobs stops the periodic jobs and waits for background jobs,
+// cancelling them if ctx expires first and then waiting a little longer for
+// them to return, so the database is not closed under them
+func (s *Server) drainJobs(ctx context.Context) error {
+	s.stopPeriodic()
+
+	done := make(chan struct{})
+	go func() {
+		s.jobs.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		s.cancelJobs()
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.cancelJobs()
+	select {
+	case <-done:
+		return errors.New("background jobs were cancelled at the shutdown timeout")
+	case <-time.After(cancelGrace):
+		return errors.New("background jobs did not stop after being cancelled at the shutdown timeout")
+	}
+}
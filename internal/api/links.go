@@ -0,0 +1,64 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ListBacklinks handles listing the items that link to a content item
+func (s *Server) ListBacklinks(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	links, err := s.db.ListBacklinks(s.userID(c), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Content not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to list backlinks: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, links)
+}
+
+// ListOutlinks handles listing the links found in a content item
+func (s *Server) ListOutlinks(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	links, err := s.db.ListOutlinks(s.userID(c), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Content not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to list outlinks: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, links)
+}
+
+// ListBrokenLinks handles listing links whose target does not exist
+func (s *Server) ListBrokenLinks(c *gin.Context) {
+	links, err := s.db.ListBrokenLinks(s.userID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to list broken links: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, links)
+}
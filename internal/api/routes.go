@@ -1,90 +1,306 @@
 package api
 
 import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"github.com/rgehrsitz/me/internal/config"
 	"github.com/rgehrsitz/me/internal/db"
+	"github.com/rgehrsitz/me/internal/mcp"
 	"github.com/rgehrsitz/me/internal/services"
+	"github.com/rgehrsitz/me/internal/vector"
+	"github.com/rgehrsitz/me/web"
 )
 
 // Server represents the API server
 type Server struct {
-	db              *db.DB
-	dataDir         string
-	router          *gin.Engine
+	db *db.DB
+	// users holds users, API tokens and the vault list. It is the main
+	// database, which for a vault's server differs from db.
+	users            *db.DB
+	config           *config.Config
+	router           *gin.Engine
 	embeddingService *services.EmbeddingService
-	searchService    *services.SearchService
-	summarizeService *services.SummarizeService
+	// nextEmbeddingService embeds new content with the model being switched
+	// to, if any
+	nextEmbeddingService *services.EmbeddingService
+	reembedService       *services.ReembedService
+	searchService        *services.SearchService
+	summarizeService     *services.SummarizeService
+	usageService         *services.UsageService
+	duplicateService     *services.DuplicateService
+	clusterService       *services.ClusterService
+	graphService         *services.GraphService
+	mcpServer            *mcp.Server
+	frontend             fs.FS
+	// basePath is the path the API is served under: /api, or /api/v/:vault
+	// for a vault's server, whose requests arrive with the vault part
+	// stripped
+	basePath string
+	// defaultUser is the user requests act as when authentication is disabled
+	defaultUser int64
+	devProxy    *httputil.ReverseProxy
+	httpServer  *http.Server
+
+	// vaults are the open vaults by name, each with its own server. Only
+	// the main server has vaults.
+	vaults   map[string]*Server
+	vaultsMu sync.RWMutex
+	// syncedUsers records the users a vault's database has copies of
+	syncedUsers sync.Map
+
+	// pendingEmbeds is the content waiting to be embedded, and embedding
+	// whether a job is embedding it
+	pendingEmbeds []db.EmbedTarget
+	embedding     bool
+	embedMu       sync.Mutex
+
+	// jobs tracks background work such as embedding new content. jobsCtx
+	// is cancelled when shutdown runs out of time.
+	jobs       sync.WaitGroup
+	jobsCtx    context.Context
+	cancelJobs context.CancelFunc
+	// periodicCtx stops the periodic jobs as soon as shutdown starts
+	periodicCtx  context.Context
+	stopPeriodic context.CancelFunc
 }
 
-// NewServer creates a new API server
-func NewServer(db *db.DB, dataDir string) (*Server, error) {
-	// Initialize services
-	embeddingService, err := services.NewEmbeddingService()
+// NewServer creates a new API server for the main database and the vaults
+// it lists
+func NewServer(database *db.DB, cfg *config.Config) (*Server, error) {
+	server, err := newServer(database, database, cfg, context.Background(), services.NewUsageService(database, cfg.AI))
 	if err != nil {
 		return nil, err
 	}
+	server.frontend = web.Dist()
+	server.vaults = make(map[string]*Server)
 
-	summarizeService, err := services.NewSummarizeService()
-	if err != nil {
+	if err := autoUnlock(database, cfg, "The database"); err != nil {
 		return nil, err
 	}
 
-	searchService := services.NewSearchService(db, embeddingService)
+	if cfg.Server.DevProxy != "" {
+		if server.devProxy, err = newDevProxy(cfg.Server.DevProxy); err != nil {
+			return nil, err
+		}
+	}
 
-	server := &Server{
-		db:               db,
-		dataDir:          dataDir,
-		embeddingService: embeddingService,
-		searchService:    searchService,
-		summarizeService: summarizeService,
+	if err := server.openVaults(); err != nil {
+		return nil, err
 	}
 
 	router := gin.Default()
 
 	// Configure CORS
 	router.Use(cors.New(cors.Config{
-		AllowOrigins:     []string{"http://localhost:5173", "http://localhost:8080"},
+		AllowOrigins:     cfg.Server.CORSOrigins,
 		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
 		AllowHeaders:     []string{"Origin", "Content-Type", "Content-Length", "Accept-Encoding", "Authorization"},
-		AllowCredentials: true,
+		AllowCredentials: false, // tokens are sent as headers, not cookies
 	}))
 
-	// Serve frontend static files from the dist directory
-	// Use a more specific path to avoid conflicts with API routes
-	router.Static("/assets", "./web/dist/assets")
-	router.StaticFile("/", "./web/dist/index.html")
-	router.StaticFile("/favicon.ico", "./web/dist/favicon.ico")
+	// Bound request bodies
+	router.Use(func(c *gin.Context) {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, cfg.Limits.MaxBodyBytes)
+		c.Next()
+	})
+
+	// Serve the embedded frontend, falling back to index.html for
+	// client-side routes
+	router.NoRoute(server.serveFrontend)
+
+	server.registerRoutes(router)
+
+	// User, API token and vault management
+	admin := router.Group("/api", server.authenticate(db.ScopeAdmin))
+	{
+		admin.POST("/users", server.CreateUser)
+		admin.GET("/tokens", server.ListTokens)
+		admin.POST("/tokens", server.CreateToken)
+		admin.DELETE("/tokens/:id", server.RevokeToken)
+		admin.POST("/vaults", server.CreateVault)
+		admin.POST("/vaults/:name/archive", server.ArchiveVault)
+		admin.POST("/vaults/:name/restore", server.RestoreVault)
+	}
+	router.GET("/api/vaults", server.authenticate(""), server.ListVaults)
+
+	// Vault-scoped API and MCP endpoints, answered by the vault's server
+	router.Any("/api/v/:vault/*path", server.authenticate(db.ScopeRead), server.serveVault)
+	router.POST("/mcp/v/:vault", server.authenticate(db.ScopeRead), server.serveVault)
+
+	server.router = router
+	return server, nil
+}
+
+// newServer creates the services for one knowledge base. users is the main
+// database, jobsCtx bounds the server's background jobs and usageService
+// records the AI calls they make.
+func newServer(database, users *db.DB, cfg *config.Config, jobsCtx context.Context, usageService *services.UsageService) (*Server, error) {
+	// Initialize services
+	embeddingService, err := services.NewEmbeddingService(cfg.AI, usageService)
+	if err != nil {
+		return nil, err
+	}
+
+	summarizeService, err := services.NewSummarizeService(cfg.AI, usageService)
+	if err != nil {
+		return nil, err
+	}
+
+	quantization, err := vector.ParseKind(cfg.AI.EmbeddingQuantization)
+	if err != nil {
+		return nil, err
+	}
+	requantized, err := database.SetEmbeddingQuantization(quantization)
+	if err != nil {
+		return nil, fmt.Errorf("failed to quantize embeddings: %w", err)
+	}
+	if requantized > 0 {
+		log.Printf("Updated the quantized copies of %d embeddings (quantization %s)", requantized, quantization)
+	}
+
+	var nextEmbeddingService *services.EmbeddingService
+	if cfg.AI.NextEmbeddingModel != "" {
+		if nextEmbeddingService, err = embeddingService.WithModel(cfg.AI.NextEmbeddingModel); err != nil {
+			return nil, err
+		}
+	}
+
+	searchService := services.NewSearchService(database, embeddingService)
+	duplicateService := services.NewDuplicateService(database, embeddingService)
+	clusterService := services.NewClusterService(database, embeddingService, summarizeService)
+	embeddingService.OnStore(clusterService.AssignContent)
+	graphService := services.NewGraphService(database, embeddingService)
+
+	server := &Server{
+		db:                   database,
+		users:                users,
+		config:               cfg,
+		embeddingService:     embeddingService,
+		nextEmbeddingService: nextEmbeddingService,
+		reembedService:       services.NewReembedService(database),
+		searchService:        searchService,
+		summarizeService:     summarizeService,
+		usageService:         usageService,
+		duplicateService:     duplicateService,
+		clusterService:       clusterService,
+		graphService:         graphService,
+		basePath:             "/api",
+	}
+	server.jobsCtx, server.cancelJobs = context.WithCancel(jobsCtx)
+	server.periodicCtx, server.stopPeriodic = context.WithCancel(server.jobsCtx)
+	server.mcpServer = mcp.NewServer(database, searchService, server.embedInBackground)
+
+	if !cfg.Auth.Enabled {
+		if server.defaultUser, err = users.DefaultUserID(); err != nil {
+			return nil, err
+		}
+		if err := server.syncUser(server.defaultUser); err != nil {
+			return nil, err
+		}
+	}
+
+	return server, nil
+}
 
+// registerRoutes adds the knowledge base API and MCP endpoints to router
+func (s *Server) registerRoutes(router *gin.Engine) {
 	// API routes
-	api := router.Group("/api")
+	api := router.Group("/api", s.authenticate(""), s.requireUnlocked)
 	{
 		// Content endpoints
-		api.POST("/content", server.CreateContent)
-		api.GET("/content", server.ListContent)
-		api.GET("/content/:id", server.GetContent)
-		api.PUT("/content/:id", server.UpdateContent)
-		api.DELETE("/content/:id", server.DeleteContent)
-		
+		api.POST("/content", s.CreateContent)
+		api.GET("/content", s.ListContent)
+		api.GET("/content/:id", s.GetContent)
+		api.PUT("/content/:id", s.UpdateContent)
+		api.DELETE("/content/:id", s.DeleteContent)
+		api.GET("/content/:id/revisions", s.ListRevisions)
+		api.GET("/content/:id/backlinks", s.ListBacklinks)
+		api.GET("/content/:id/outlinks", s.ListOutlinks)
+		api.GET("/content/:id/highlight", s.HighlightContent)
+		api.GET("/content/:id/file", s.GetAttachment)
+		api.PUT("/content/:id/file", s.SetAttachment)
+		api.DELETE("/content/:id/file", s.DeleteAttachment)
+		api.GET("/links/broken", s.ListBrokenLinks)
+
+		// Sharing endpoints
+		api.GET("/content/:id/shares", s.ListContentShares)
+		api.POST("/content/:id/shares", s.ShareContent)
+		api.DELETE("/content/:id/shares/:user_id", s.UnshareContent)
+		api.GET("/collections/:id/shares", s.ListCollectionShares)
+		api.POST("/collections/:id/shares", s.ShareCollection)
+		api.DELETE("/collections/:id/shares/:user_id", s.UnshareCollection)
+
+		// Duplicate detection endpoints
+		api.GET("/duplicates", s.ListDuplicates)
+		api.POST("/duplicates/merge", s.MergeContent)
+
+		// Topic cluster endpoints
+		api.GET("/clusters", s.ListClusters)
+		api.GET("/clusters/:id", s.GetCluster)
+		api.POST("/clusters/rebuild", s.RebuildClusters)
+
+		// Collection endpoints
+		api.GET("/collections", s.ListCollections)
+		api.POST("/collections", s.CreateCollection)
+		api.GET("/collections/:id", s.GetCollection)
+		api.PUT("/collections/:id", s.UpdateCollection)
+		api.DELETE("/collections/:id", s.DeleteCollection)
+		api.POST("/collections/:id/move", s.MoveCollection)
+		api.POST("/collections/:id/items", s.AddCollectionItem)
+		api.DELETE("/collections/:id/items/:content_id", s.RemoveCollectionItem)
+
+		// Knowledge graph endpoints
+		api.GET("/graph", s.GetGraph)
+
 		// Embedding endpoints
-		api.POST("/content/:id/embed", server.GenerateEmbedding)
-		
+		api.POST("/content/:id/embed", s.GenerateEmbedding)
+
 		// Search endpoints
-		api.POST("/search", server.Search)
-		
+		api.POST("/search", s.Search)
+
 		// Summarization endpoints
-		api.POST("/content/:id/summarize", server.SummarizeContent)
-		
+		api.POST("/content/:id/summarize", s.SummarizeContent)
+
 		// Tags endpoints
-		api.GET("/tags", server.ListTags)
-		api.POST("/tags", server.CreateTag)
+		api.GET("/tags", s.ListTags)
+		api.POST("/tags", s.CreateTag)
+		api.POST("/tags/merge", s.MergeTags)
+		api.PUT("/tags/:id", s.RenameTag)
+		api.DELETE("/tags/:id", s.DeleteTag)
 	}
 
-	server.router = router
-	return server, nil
-}
+	// User and encryption endpoints, which also work while locked
+	unlocked := router.Group("/api", s.authenticate(""))
+	{
+		unlocked.GET("/users", s.ListUsers)
+		unlocked.GET("/users/me", s.GetCurrentUser)
+		unlocked.GET("/encryption", s.GetEncryption)
+		unlocked.POST("/encryption/unlock", s.UnlockEncryption)
+	}
+	embeddings := router.Group("/api/embeddings", s.authenticate(db.ScopeAdmin), s.requireUnlocked)
+	{
+		embeddings.GET("/models", s.ListEmbeddingModels)
+		embeddings.DELETE("/models/:model", s.DeleteEmbeddingModel)
+		embeddings.GET("/reembed", s.GetReembed)
+		embeddings.POST("/reembed", s.StartReembed)
+		embeddings.DELETE("/reembed", s.CancelReembed)
+	}
+	router.GET("/api/usage", s.authenticate(db.ScopeAdmin), s.GetUsage)
+	keys := router.Group("/api/encryption", s.authenticate(db.ScopeAdmin))
+	{
+		keys.POST("", s.EnableEncryption)
+		keys.POST("/lock", s.LockEncryption)
+		keys.POST("/rekey", s.RekeyEncryption)
+	}
 
-// Run starts the API server
-func (s *Server) Run(addr string) error {
-	return s.router.Run(addr)
+	// Model Context Protocol endpoint for AI assistants
+	router.POST("/mcp", s.authenticate(db.ScopeRead), s.requireUnlocked, s.serveMCP)
 }
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rgehrsitz/me/internal/config"
+	"github.com/rgehrsitz/me/internal/db"
+)
+
+// newTestServer returns a server on a new database, and the user requests
+// act as when authentication is disabled
+func newTestServer(t *testing.T, auth bool) (*Server, int64) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	dir := t.TempDir()
+	database, err := db.New(filepath.Join(dir, "pkb.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+
+	cfg, err := config.Default()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Storage.DBPath = filepath.Join(dir, "pkb.db")
+	cfg.Storage.DataDir = dir
+	cfg.Auth.Enabled = auth
+	cfg.AI.APIKey = "unused"
+	cfg.AI.BaseURL = "http://127.0.0.1:1/v1" // embedding in the background fails at once
+	cfg.Jobs.ClusterInterval = config.Duration{}
+
+	s, err := NewServer(database, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.shutdown() })
+	userID, err := database.DefaultUserID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, userID
+}
+
+// do sends a request to the server, with the API token if there is one, and
+// returns the recorded response
+func do(s *Server, method, path, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	return w
+}
+
+func TestMCPScopes(t *testing.T) {
+	s, userID := newTestServer(t, true)
+	tokens := make(map[string]string)
+	for _, scope := range []string{db.ScopeRead, db.ScopeWrite, db.ScopeAdmin} {
+		token, _, err := s.users.CreateAPIToken(userID, scope, []string{scope})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens[scope] = token
+	}
+	if w := do(s, "POST", "/api/vaults", tokens[db.ScopeAdmin], `{"name": "work"}`); w.Code != http.StatusCreated {
+		t.Fatalf("creating a vault: status %d: %s", w.Code, w.Body)
+	}
+
+	// call makes an MCP request and returns its result
+	call := func(path, token, method, params string) map[string]interface{} {
+		t.Helper()
+		w := do(s, "POST", path, token, `{"jsonrpc": "2.0", "id": 1, "method": "`+method+`", "params": `+params+`}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s %s: status %d: %s", path, method, w.Code, w.Body)
+		}
+		var resp struct {
+			Result map[string]interface{} `json:"result"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp.Result
+	}
+	failed := func(result map[string]interface{}) bool {
+		return result["isError"] == true
+	}
+	createNote := `{"name": "create_note", "arguments": {"title": "t", "body": "b"}}`
+	search := `{"name": "search", "arguments": {"query": "b"}}`
+
+	for _, path := range []string{"/mcp", "/mcp/v/work"} {
+		if w := do(s, "POST", path, "", `{}`); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s without a token: status %d, want 401", path, w.Code)
+		}
+
+		var names []string
+		for _, tool := range call(path, tokens[db.ScopeRead], "tools/list", `{}`)["tools"].([]interface{}) {
+			names = append(names, tool.(map[string]interface{})["name"].(string))
+		}
+		if strings.Contains(strings.Join(names, " "), "create_note") {
+			t.Errorf("%s: tools/list for a read token includes create_note: %v", path, names)
+		}
+
+		if result := call(path, tokens[db.ScopeRead], "tools/call", search); failed(result) {
+			t.Errorf("%s: search with a read token failed: %v", path, result)
+		}
+		if result := call(path, tokens[db.ScopeRead], "tools/call", createNote); !failed(result) {
+			t.Errorf("%s: create_note with a read token succeeded: %v", path, result)
+		}
+		if result := call(path, tokens[db.ScopeWrite], "tools/call", createNote); failed(result) {
+			t.Errorf("%s: create_note with a write token failed: %v", path, result)
+		}
+	}
+}
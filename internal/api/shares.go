@@ -0,0 +1,158 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rgehrsitz/me/internal/db"
+)
+
+// shareRequest names the user to share with and the access level
+type shareRequest struct {
+	UserID   int64  `json:"user_id"`
+	Username string `json:"username"`
+	Level    string `json:"level"`
+}
+
+// ListContentShares handles listing the users a content item is shared with
+func (s *Server) ListContentShares(c *gin.Context) {
+	s.listShares(c, s.db.ListContentShares)
+}
+
+// ShareContent handles sharing a content item with another user
+func (s *Server) ShareContent(c *gin.Context) {
+	s.share(c, s.db.ShareContent)
+}
+
+// UnshareContent handles no longer sharing a content item with a user
+func (s *Server) UnshareContent(c *gin.Context) {
+	s.unshare(c, s.db.UnshareContent)
+}
+
+// ListCollectionShares handles listing the users a collection is shared with
+func (s *Server) ListCollectionShares(c *gin.Context) {
+	s.listShares(c, s.db.ListCollectionShares)
+}
+
+// ShareCollection handles sharing a collection, with everything in it, with
+// another user
+func (s *Server) ShareCollection(c *gin.Context) {
+	s.share(c, s.db.ShareCollection)
+}
+
+// UnshareCollection handles no longer sharing a collection with a user
+func (s *Server) UnshareCollection(c *gin.Context) {
+	s.unshare(c, s.db.UnshareCollection)
+}
+
+// listShares lists the shares of the item in the :id parameter
+func (s *Server) listShares(c *gin.Context, list func(userID, id int64) ([]db.Share, error)) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	shares, err := list(s.userID(c), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return
+	}
+	if errors.Is(err, db.ErrForbidden) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the owner can see who an item is shared with"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to list shares: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, shares)
+}
+
+// share shares the item in the :id parameter with the user in the request
+func (s *Server) share(c *gin.Context, share func(userID, id, withUserID int64, level string) error) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	var req shareRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Level == "" {
+		req.Level = db.AccessRead
+	}
+	if err := db.ValidateAccessLevel(req.Level); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, err := s.lookupUser(req.UserID, req.Username)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := s.syncUser(user.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to set up user in vault: %v", err)})
+		return
+	}
+
+	err = share(s.userID(c), id, user.ID, req.Level)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return
+	}
+	if errors.Is(err, db.ErrForbidden) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the owner can share an item"})
+		return
+	}
+	if errors.Is(err, db.ErrShareWithOwner) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to share: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Shared with %s (%s)", user.Username, req.Level)})
+}
+
+// unshare stops sharing the item in the :id parameter with :user_id
+func (s *Server) unshare(c *gin.Context, unshare func(userID, id, withUserID int64) error) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	withUserID, err := strconv.ParseInt(c.Param("user_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	err = unshare(s.userID(c), id, withUserID)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found or not shared with this user"})
+		return
+	}
+	if errors.Is(err, db.ErrForbidden) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the owner can unshare an item"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to unshare: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Share removed successfully"})
+}
@@ -0,0 +1,143 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rgehrsitz/me/internal/db"
+	"github.com/rgehrsitz/me/internal/models"
+)
+
+// ListTags handles listing the user's tags with their usage counts
+func (s *Server) ListTags(c *gin.Context) {
+	tags, err := s.db.ListTags(s.userID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to list tags: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, tags)
+}
+
+// CreateTag handles creating a new tag
+func (s *Server) CreateTag(c *gin.Context) {
+	var tag models.Tag
+	if err := c.ShouldBindJSON(&tag); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tag.Name = db.NormalizeTagName(tag.Name)
+	if tag.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Tag name is required"})
+		return
+	}
+
+	id, err := s.db.CreateTag(s.userID(c), tag.Name)
+	if errors.Is(err, db.ErrTagExists) {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Tag %q already exists", tag.Name)})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to create tag: %v", err)})
+		return
+	}
+
+	tag.ID = id
+	c.JSON(http.StatusCreated, tag)
+}
+
+// RenameTag handles renaming a tag and its descendants
+func (s *Server) RenameTag(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	var tag models.Tag
+	if err := c.ShouldBindJSON(&tag); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tag.Name = db.NormalizeTagName(tag.Name)
+	if tag.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Tag name is required"})
+		return
+	}
+
+	err = s.db.RenameTag(s.userID(c), id, tag.Name)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tag not found"})
+		return
+	}
+	if errors.Is(err, db.ErrTagExists) {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Tag %q already exists, merge the tags instead", tag.Name)})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to rename tag: %v", err)})
+		return
+	}
+
+	renamed, err := s.db.GetTag(s.userID(c), id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Tag renamed but failed to retrieve: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, renamed)
+}
+
+// MergeTags handles merging several tags into one
+func (s *Server) MergeTags(c *gin.Context) {
+	var req models.MergeTagsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := s.db.MergeTags(s.userID(c), req.SourceIDs, req.TargetID)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tag not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to merge tags: %v", err)})
+		return
+	}
+
+	merged, err := s.db.GetTag(s.userID(c), req.TargetID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Tags merged but failed to retrieve: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, merged)
+}
+
+// DeleteTag handles deleting a tag
+func (s *Server) DeleteTag(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	err = s.db.DeleteTag(s.userID(c), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tag not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to delete tag: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Tag deleted successfully"})
+}
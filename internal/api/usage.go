@@ -0,0 +1,63 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rgehrsitz/me/internal/db"
+	"github.com/rgehrsitz/me/internal/services"
+)
+
+// maxUsagePeriods bounds how many days or months of usage can be requested
+const maxUsagePeriods = 366
+
+// GetUsage handles reporting AI usage and its estimated cost by day and
+// month, over the last ?days= (default 30) and ?months= (default 12), along
+// with the budgets. A vault reports its own usage, the main server every
+// vault's.
+func (s *Server) GetUsage(c *gin.Context) {
+	days, err := strconv.Atoi(c.DefaultQuery("days", "30"))
+	if err != nil || days < 1 || days > maxUsagePeriods {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid days parameter"})
+		return
+	}
+	months, err := strconv.Atoi(c.DefaultQuery("months", "12"))
+	if err != nil || months < 1 || months > maxUsagePeriods {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid months parameter"})
+		return
+	}
+
+	daily, err := s.usageService.Totals(db.UsageDay, days)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to get usage: %v", err)})
+		return
+	}
+	monthly, err := s.usageService.Totals(db.UsageMonth, months)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to get usage: %v", err)})
+		return
+	}
+	budget, err := s.usageService.Budget()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to get budget: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"daily":   daily,
+		"monthly": monthly,
+		"budget":  budget,
+	})
+}
+
+// aiErrorStatus returns the status for a failed AI call: 402 once the
+// budget is spent, otherwise 500
+func aiErrorStatus(err error) int {
+	if errors.Is(err, services.ErrBudgetExceeded) {
+		return http.StatusPaymentRequired
+	}
+	return http.StatusInternalServerError
+}
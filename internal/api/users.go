@@ -0,0 +1,104 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rgehrsitz/me/internal/db"
+)
+
+// ListUsers handles listing users, e.g. to pick someone to share with
+func (s *Server) ListUsers(c *gin.Context) {
+	users, err := s.users.ListUsers()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to list users: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, users)
+}
+
+// GetCurrentUser handles getting the user the request acts as
+func (s *Server) GetCurrentUser(c *gin.Context) {
+	user, err := s.users.GetUser(s.userID(c))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("User not found: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, user)
+}
+
+// CreateUser handles creating a user. Give the new user a token with
+// POST /api/tokens so they can sign in.
+func (s *Server) CreateUser(c *gin.Context) {
+	var req struct {
+		Username    string `json:"username" binding:"required"`
+		DisplayName string `json:"display_name"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	id, err := s.users.CreateUser(req.Username, req.DisplayName)
+	if errors.Is(err, db.ErrInvalidUsername) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, db.ErrUserExists) {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("User %q already exists", req.Username)})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to create user: %v", err)})
+		return
+	}
+
+	user, err := s.users.GetUser(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("User created but failed to retrieve: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusCreated, user)
+}
+
+// lookupUser finds a user by username, or by ID if no username is given
+func (s *Server) lookupUser(id int64, username string) (*db.User, error) {
+	var user *db.User
+	var err error
+	if username != "" {
+		user, err = s.users.GetUserByName(username)
+	} else {
+		user, err = s.users.GetUser(id)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errors.New("user not found")
+	}
+	return user, err
+}
+
+// syncUser copies a user from the main database into a vault's database the
+// first time the vault sees them
+func (s *Server) syncUser(id int64) error {
+	if s.db == s.users || id == 0 {
+		return nil
+	}
+	if _, ok := s.syncedUsers.Load(id); ok {
+		return nil
+	}
+
+	user, err := s.users.GetUser(id)
+	if err != nil {
+		return err
+	}
+	if err := s.db.SyncUser(user); err != nil {
+		return err
+	}
+	s.syncedUsers.Store(id, true)
+	return nil
+}
@@ -0,0 +1,275 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rgehrsitz/me/internal/config"
+	"github.com/rgehrsitz/me/internal/db"
+)
+
+// vaultDBName is the database file inside a vault's directory
+const vaultDBName = "pkb.db"
+
+// openVaults opens every vault that is not archived
+func (s *Server) openVaults() error {
+	vaults, err := s.users.ListVaults()
+	if err != nil {
+		return fmt.Errorf("failed to list vaults: %w", err)
+	}
+
+	for _, vault := range vaults {
+		if vault.ArchivedAt != nil {
+			continue
+		}
+		if _, err := s.openVault(vault.Name); err != nil {
+			return fmt.Errorf("failed to open vault %q: %w", vault.Name, err)
+		}
+	}
+	return nil
+}
+
+// openVault opens a vault's database, creating it if needed, applies its
+// config file and starts serving it. Its periodic jobs are not started.
+func (s *Server) openVault(name string) (*Server, error) {
+	if s.config.Storage.DataDir == "" {
+		return nil, errors.New("vaults need storage.data_dir to be set")
+	}
+
+	dir := s.config.Storage.VaultDir(name)
+	cfg, err := s.config.ForVault(filepath.Join(dir, config.FileName))
+	if err != nil {
+		return nil, err
+	}
+
+	database, err := db.New(filepath.Join(dir, vaultDBName))
+	if err != nil {
+		return nil, err
+	}
+	if err := autoUnlock(database, cfg, fmt.Sprintf("Vault %q", name)); err != nil {
+		database.Close()
+		return nil, err
+	}
+
+	vault, err := newServer(database, s.users, cfg, s.jobsCtx, s.usageService.ForVault(name, cfg.AI))
+	if err != nil {
+		database.Close()
+		return nil, err
+	}
+
+	router := gin.New()
+	router.NoRoute(func(c *gin.Context) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+	})
+	vault.registerRoutes(router)
+	vault.router = router
+	vault.basePath = "/api/v/" + name
+
+	s.vaultsMu.Lock()
+	defer s.vaultsMu.Unlock()
+	if _, ok := s.vaults[name]; ok {
+		database.Close()
+		return nil, db.ErrVaultExists
+	}
+	s.vaults[name] = vault
+	return vault, nil
+}
+
+// closeVault stops serving a vault, waits for its background jobs and closes
+// its database
+func (s *Server) closeVault(ctx context.Context, name string) error {
+	s.vaultsMu.Lock()
+	vault := s.vaults[name]
+	delete(s.vaults, name)
+	s.vaultsMu.Unlock()
+
+	if vault == nil {
+		return nil
+	}
+	err := vault.drainJobs(ctx)
+	if closeErr := vault.db.Close(); closeErr != nil {
+		err = errors.Join(err, fmt.Errorf("failed to close database: %w", closeErr))
+	}
+	return err
+}
+
+// closeVaults closes every open vault
+func (s *Server) closeVaults(ctx context.Context) error {
+	var errs []error
+	for _, name := range s.vaultNames() {
+		if err := s.closeVault(ctx, name); err != nil {
+			errs = append(errs, fmt.Errorf("vault %s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// vaultNames returns the names of the open vaults
+func (s *Server) vaultNames() []string {
+	s.vaultsMu.RLock()
+	defer s.vaultsMu.RUnlock()
+
+	names := make([]string, 0, len(s.vaults))
+	for name := range s.vaults {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// vault returns the server of an open vault, or nil
+func (s *Server) vault(name string) *Server {
+	s.vaultsMu.RLock()
+	defer s.vaultsMu.RUnlock()
+	return s.vaults[name]
+}
+
+// serveVault hands a request under /api/v/:vault or /mcp/v/:vault to the
+// vault's server, as the same request without the /v/:vault part
+func (s *Server) serveVault(c *gin.Context) {
+	name := c.Param("vault")
+	vault := s.vault(name)
+	if vault == nil {
+		record, err := s.users.GetVault(name)
+		if err == nil && record.ArchivedAt != nil {
+			c.JSON(http.StatusGone, gin.H{"error": fmt.Sprintf("Vault %q is archived", name)})
+			return
+		}
+		c.JSON(http.StatusNotFound, gin.H{"error": "Vault not found"})
+		return
+	}
+
+	c.Request.URL.Path = strings.Replace(c.Request.URL.Path, "/v/"+name, "", 1)
+	c.Request.URL.RawPath = ""
+	vault.router.HandleContext(c)
+}
+
+// apiPath returns the path clients reach an API endpoint at, given its path
+// under /api, so links from a vault stay in the vault
+func (s *Server) apiPath(path string) string {
+	return s.basePath + path
+}
+
+// ListVaults handles listing vaults, archived ones included
+func (s *Server) ListVaults(c *gin.Context) {
+	vaults, err := s.users.ListVaults()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to list vaults: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, vaults)
+}
+
+// CreateVault handles creating a vault with an empty database, served under
+// /api/v/:name
+func (s *Server) CreateVault(c *gin.Context) {
+	var req struct {
+		Name string `json:"name" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := db.ValidateVaultName(req.Name); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	_, err := s.users.GetVault(req.Name)
+	if err == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Vault %q already exists", req.Name)})
+		return
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to create vault: %v", err)})
+		return
+	}
+
+	// Open the database first so a vault that cannot be opened is never
+	// recorded
+	vault, err := s.openVault(req.Name)
+	if errors.Is(err, db.ErrVaultExists) {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Vault %q already exists", req.Name)})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to create vault: %v", err)})
+		return
+	}
+
+	record, err := s.users.CreateVault(req.Name)
+	if err != nil {
+		s.closeVault(c.Request.Context(), req.Name)
+		status := http.StatusInternalServerError
+		if errors.Is(err, db.ErrVaultExists) {
+			status = http.StatusConflict
+		}
+		c.JSON(status, gin.H{"error": fmt.Sprintf("Failed to create vault: %v", err)})
+		return
+	}
+	vault.startJobs()
+
+	c.JSON(http.StatusCreated, record)
+}
+
+// ArchiveVault handles archiving a vault. It stops being served, but its
+// files are kept and it can be restored.
+func (s *Server) ArchiveVault(c *gin.Context) {
+	name := c.Param("name")
+	err := s.users.ArchiveVault(name)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Vault not found or already archived"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to archive vault: %v", err)})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), s.config.Server.ShutdownTimeout.Duration)
+	defer cancel()
+	if err := s.closeVault(ctx, name); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Vault archived but failed to close: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Vault archived successfully"})
+}
+
+// RestoreVault handles bringing an archived vault back into use
+func (s *Server) RestoreVault(c *gin.Context) {
+	name := c.Param("name")
+	err := s.users.RestoreVault(name)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Vault not found or not archived"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to restore vault: %v", err)})
+		return
+	}
+
+	vault, err := s.openVault(name)
+	if err != nil {
+		s.users.ArchiveVault(name)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to open vault: %v", err)})
+		return
+	}
+	vault.startJobs()
+
+	record, err := s.users.GetVault(name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Vault restored but failed to retrieve: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, record)
+}
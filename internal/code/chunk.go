@@ -0,0 +1,179 @@
+package code
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// continuations are words that, starting an unindented line, carry on the
+// block before them rather than start a new one
+var continuations = map[string]bool{
+	"else": true, "elif": true, "elsif": true, "except": true, "finally": true,
+	"catch": true, "rescue": true, "ensure": true, "end": true, "fi": true,
+	"done": true, "esac": true, "then": true, "do": true,
+}
+
+// Chunk splits code into chunks of at most max bytes, breaking it only
+// between top-level declarations and statements where it can: a function,
+// a type or a statement stays whole with the comments just above it unless it
+// alone is longer than max, when it is split between lines. Blocks are told
+// by brackets, by indentation and, for SQL, by semicolons.
+func Chunk(text, lang string, max int) []string {
+	if max <= 0 {
+		max = len(text)
+	}
+	return pack(units(text, lookup(lang)), max)
+}
+
+// units splits code into its top-level declarations and statements
+func units(text string, l *language) []string {
+	lines := strings.Split(text, "\n")
+	starts := lineStarts(text, l)
+	sql := l != nil && l.name == "sql"
+
+	var units []string
+	unitStart := 0
+	prev := "" // the last non-blank line
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" {
+			continue
+		}
+		if i > unitStart && startsUnit(line, prev, starts[i], l, sql) {
+			units = append(units, strings.Join(lines[unitStart:i], "\n"))
+			unitStart = i
+		}
+		prev = trimmed
+	}
+	return append(units, strings.Join(lines[unitStart:], "\n"))
+}
+
+// lineState is how a line of code starts
+type lineState struct {
+	// depth is how many brackets are open
+	depth int
+	// inside marks lines that start within a string or comment
+	inside bool
+}
+
+// lineStarts returns the state each line of code starts in
+func lineStarts(text string, l *language) []lineState {
+	states := []lineState{{}}
+	depth := 0
+	for _, t := range tokenize(text, l) {
+		for i := 0; i < len(t.text); i++ {
+			c := t.text[i]
+			if c == '\n' {
+				states = append(states, lineState{depth: depth, inside: t.kind != plain})
+				continue
+			}
+			if t.kind != plain {
+				continue
+			}
+			switch c {
+			case '{', '(', '[':
+				depth++
+			case '}', ')', ']':
+				if depth > 0 {
+					depth--
+				}
+			}
+		}
+	}
+	return states
+}
+
+// startsUnit reports whether a non-blank line starts a new top-level unit,
+// given the last non-blank line before it
+func startsUnit(line, prev string, state lineState, l *language, sql bool) bool {
+	if state.inside || state.depth > 0 {
+		return false
+	}
+	if sql {
+		return strings.HasSuffix(prev, ";")
+	}
+	if line[0] == ' ' || line[0] == '\t' {
+		return false
+	}
+
+	// Closing brackets and words such as else continue the unit
+	switch line[0] {
+	case '}', ')', ']':
+		return false
+	}
+	n := 0
+	for n < len(line) && isIdent(line[n]) {
+		n++
+	}
+	if continuations[line[:n]] {
+		return false
+	}
+
+	// Comments, decorators and lines left open stay with what follows them
+	if strings.HasPrefix(prev, "@") || strings.HasPrefix(prev, "#[") || isComment(prev, l) {
+		return false
+	}
+	return !strings.HasSuffix(prev, "\\") && !strings.HasSuffix(prev, ",")
+}
+
+// isComment reports whether a line is only a comment
+func isComment(line string, l *language) bool {
+	if l == nil {
+		return false
+	}
+	if hasAnyPrefix(line, l.lineComments) {
+		return true
+	}
+	start, end := l.blockComment[0], l.blockComment[1]
+	return start != "" && (strings.HasPrefix(line, start) || strings.HasSuffix(line, end))
+}
+
+// pack joins units into chunks of at most max bytes, splitting units that
+// are longer between lines
+func pack(units []string, max int) []string {
+	var chunks []string
+	var current strings.Builder
+	flush := func() {
+		if chunk := strings.Trim(current.String(), "\n"); strings.TrimSpace(chunk) != "" {
+			chunks = append(chunks, chunk)
+		}
+		current.Reset()
+	}
+	add := func(piece string) {
+		if current.Len() > 0 && current.Len()+1+len(piece) > max {
+			flush()
+		}
+		if current.Len() > 0 {
+			current.WriteByte('\n')
+		}
+		current.WriteString(piece)
+	}
+
+	for _, unit := range units {
+		if strings.TrimSpace(unit) == "" {
+			continue
+		}
+		if len(unit) <= max {
+			add(unit)
+			continue
+		}
+		flush()
+		for _, line := range strings.Split(unit, "\n") {
+			for len(line) > max {
+				cut := max
+				for cut > 0 && !utf8.RuneStart(line[cut]) {
+					cut--
+				}
+				if cut == 0 {
+					cut = max
+				}
+				add(line[:cut])
+				line = line[cut:]
+			}
+			add(line)
+		}
+		flush()
+	}
+	flush()
+	return chunks
+}
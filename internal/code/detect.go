@@ -0,0 +1,71 @@
+package code
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+const (
+	// minScore is how strongly code must suggest a language for Detect to
+	// name it
+	minScore = 3
+	// maxMatches bounds how many times each signal counts
+	maxMatches = 3
+	// detectBytes is how much of the code Detect looks at
+	detectBytes = 64 << 10
+)
+
+// Detect guesses the language of a piece of code from its shebang line or
+// from the keywords and idioms it uses. It returns "" when nothing points
+// clearly enough to one language.
+func Detect(text string) string {
+	trimmed := strings.TrimSpace(text)
+	if trimmed == "" {
+		return ""
+	}
+	if name := shebang(trimmed); name != "" {
+		return name
+	}
+	if (trimmed[0] == '{' || trimmed[0] == '[') && json.Valid([]byte(trimmed)) {
+		return "json"
+	}
+
+	if len(text) > detectBytes {
+		text = text[:detectBytes]
+	}
+	best, bestScore := "", 0
+	for _, l := range languages {
+		score := 0
+		for _, sig := range l.signals {
+			score += len(sig.re.FindAllStringIndex(text, maxMatches)) * sig.weight
+		}
+		if score > bestScore {
+			best, bestScore = l.name, score
+		}
+	}
+	if bestScore < minScore {
+		return ""
+	}
+	return best
+}
+
+// shebang returns the language named by a #! line, if the code starts with
+// one
+func shebang(text string) string {
+	if !strings.HasPrefix(text, "#!") {
+		return ""
+	}
+	line, _, _ := strings.Cut(text, "\n")
+	for _, interpreter := range []struct{ name, language string }{
+		{"python", "python"},
+		{"node", "javascript"},
+		{"ruby", "ruby"},
+		{"php", "php"},
+		{"sh", "bash"},
+	} {
+		if strings.Contains(line, interpreter.name) {
+			return interpreter.language
+		}
+	}
+	return ""
+}
@@ -0,0 +1,189 @@
+package code
+
+import (
+	"html"
+	"strings"
+)
+
+// tokenKind is what a token of code is
+type tokenKind int
+
+const (
+	plain tokenKind = iota
+	keyword
+	stringLit
+	comment
+	number
+)
+
+// classes are the CSS classes Highlight wraps tokens in
+var classes = map[tokenKind]string{
+	keyword:   "keyword",
+	stringLit: "string",
+	comment:   "comment",
+	number:    "number",
+}
+
+// token is a run of code of one kind
+type token struct {
+	kind tokenKind
+	text string
+}
+
+// generic is how code in unknown languages is tokenized: strings are
+// recognized but there are no keywords or comments
+var generic = &language{quotes: `"'`}
+
+// Highlight returns code as HTML, in a <pre class="highlight"> block whose
+// <code> element has the class language-<name>. Keywords, strings, comments
+// and numbers are wrapped in spans with the classes keyword, string, comment
+// and number, for a stylesheet to color.
+func Highlight(text, lang string) string {
+	var b strings.Builder
+	b.WriteString(`<pre class="highlight"><code`)
+	if name := Normalize(lang); name != "" {
+		b.WriteString(` class="language-`)
+		b.WriteString(html.EscapeString(name))
+		b.WriteString(`"`)
+	}
+	b.WriteString(">")
+
+	for _, t := range tokenize(text, lookup(lang)) {
+		class, ok := classes[t.kind]
+		if !ok {
+			b.WriteString(html.EscapeString(t.text))
+			continue
+		}
+		b.WriteString(`<span class="`)
+		b.WriteString(class)
+		b.WriteString(`">`)
+		b.WriteString(html.EscapeString(t.text))
+		b.WriteString("</span>")
+	}
+	b.WriteString("</code></pre>")
+	return b.String()
+}
+
+// tokenize splits code into tokens. It is a scanner rather than a parser:
+// enough to color code and to tell code from strings and comments, not to
+// check it.
+func tokenize(text string, l *language) []token {
+	if l == nil {
+		l = generic
+	}
+	keywords := make(map[string]bool, len(l.keywords))
+	for _, kw := range l.keywords {
+		if l.caseless {
+			kw = strings.ToLower(kw)
+		}
+		keywords[kw] = true
+	}
+
+	var tokens []token
+	emit := func(kind tokenKind, text string) {
+		// Merge runs of plain text
+		if kind == plain && len(tokens) > 0 && tokens[len(tokens)-1].kind == plain {
+			tokens[len(tokens)-1].text += text
+			return
+		}
+		tokens = append(tokens, token{kind, text})
+	}
+
+	for i := 0; i < len(text); {
+		rest := text[i:]
+		c := text[i]
+		n := 0
+		kind := plain
+
+		switch {
+		case hasAnyPrefix(rest, l.lineComments):
+			n = strings.IndexByte(rest, '\n')
+			if n < 0 {
+				n = len(rest)
+			}
+			kind = comment
+		case l.blockComment[0] != "" && strings.HasPrefix(rest, l.blockComment[0]):
+			start, end := l.blockComment[0], l.blockComment[1]
+			n = strings.Index(rest[len(start):], end)
+			if n < 0 {
+				n = len(rest)
+			} else {
+				n += len(start) + len(end)
+			}
+			kind = comment
+		case strings.IndexByte(l.quotes, c) >= 0:
+			n = stringLength(rest, l.tripleQuotes)
+			kind = stringLit
+		case isDigit(c) && (i == 0 || !isIdent(text[i-1])):
+			for n < len(rest) && (isIdent(rest[n]) || rest[n] == '.') {
+				n++
+			}
+			kind = number
+		case isIdentStart(c) && (i == 0 || !isIdent(text[i-1])):
+			for n < len(rest) && isIdent(rest[n]) {
+				n++
+			}
+			word := rest[:n]
+			if l.caseless {
+				word = strings.ToLower(word)
+			}
+			if keywords[word] {
+				kind = keyword
+			}
+		default:
+			n = 1
+		}
+		emit(kind, rest[:n])
+		i += n
+	}
+	return tokens
+}
+
+// stringLength returns the length of the string literal text starts with.
+// Strings end at the closing quote, skipping quotes escaped with a
+// backslash, or unless they may span lines at the end of the line.
+func stringLength(text string, tripleQuotes bool) int {
+	quote := text[0]
+	if tripleQuotes && len(text) >= 3 && text[1] == quote && text[2] == quote {
+		delim := text[:3]
+		if end := strings.Index(text[3:], delim); end >= 0 {
+			return end + 6
+		}
+		return len(text)
+	}
+
+	for n := 1; n < len(text); n++ {
+		switch text[n] {
+		case '\\':
+			n++
+		case quote:
+			return n + 1
+		case '\n':
+			if quote != '`' {
+				return n
+			}
+		}
+	}
+	return len(text)
+}
+
+func hasAnyPrefix(text string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(text, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isIdent(c byte) bool {
+	return isIdentStart(c) || isDigit(c)
+}
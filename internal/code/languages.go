@@ -0,0 +1,377 @@
+// Package code handles the source code of snippets: it names their
+// languages, detects the language of code that was saved without one,
+// highlights code as HTML and splits it into chunks at the boundaries of
+// declarations and statements.
+//
+// Languages are named by their canonical, lower case names, such as go,
+// python or cpp. Common aliases (golang, py, c++) normalize to these. Code in
+// a language this package does not know is still highlighted and chunked,
+// just without keywords.
+package code
+
+import (
+	"regexp"
+	"strings"
+)
+
+// language describes how code in a language is written
+type language struct {
+	name    string
+	aliases []string
+	// keywords are highlighted, matching case unless caseless is set
+	keywords []string
+	caseless bool
+	// lineComments start comments that run to the end of the line, and
+	// blockComment holds the delimiters of comments that may span lines
+	lineComments []string
+	blockComment [2]string
+	// quotes are the characters strings are quoted with. Strings in
+	// backquotes may span lines, as may triple quoted ones where
+	// tripleQuotes is set.
+	quotes       string
+	tripleQuotes bool
+	// signals are what Detect looks for
+	signals []signal
+}
+
+// signal is a pattern that suggests code is in a language, and how strongly
+type signal struct {
+	re     *regexp.Regexp
+	weight int
+}
+
+// s returns a signal, compiling its pattern in multi-line mode
+func s(pattern string, weight int) signal {
+	return signal{re: regexp.MustCompile("(?m)" + pattern), weight: weight}
+}
+
+var javascriptKeywords = strings.Fields(`async await break case catch class const continue
+	debugger default delete do else export extends false finally for function if import in
+	instanceof let new null of return static super switch this throw true try typeof
+	undefined var void while yield`)
+
+var javascriptSignals = []signal{
+	s(`\bconsole\.log\(`, 3),
+	s(`\bfunction\s*\w*\s*\([^)]*\)\s*\{`, 2),
+	s(`\b(const|let|var) \w+ = `, 1),
+	s(`\) => |\w => `, 1),
+	s(`===|!==`, 2),
+	s(`\brequire\(['"]`, 2),
+	s(`\bmodule\.exports\b|\bexport (default|const|function)\b`, 2),
+	s(`\b(document|window)\.\w+`, 2),
+}
+
+var cKeywords = strings.Fields(`auto break case char const continue default do double else
+	enum extern float for goto if int long register return short signed sizeof static struct
+	switch typedef union unsigned void volatile while NULL`)
+
+// languages are the known languages. Detect prefers the earlier of two
+// languages that score the same, so more general ones come first.
+var languages = []*language{
+	{
+		name:    "go",
+		aliases: []string{"golang"},
+		keywords: strings.Fields(`break case chan const continue default defer else
+			fallthrough for func go goto if import interface map package range return select
+			struct switch type var nil true false iota`),
+		lineComments: []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       "\"'`",
+		signals: []signal{
+			s(`^package \w+\s*$`, 3),
+			s(`^func (\([^)]*\) )?\w+(\[.*\])?\(`, 3),
+			s(`\w+ := `, 1),
+			s(`\berr != nil\b`, 3),
+			s(`\bfmt\.\w+\(`, 2),
+			s(`^import \($`, 2),
+		},
+	},
+	{
+		name:    "python",
+		aliases: []string{"py", "python3"},
+		keywords: strings.Fields(`and as assert async await break class continue def del elif
+			else except False finally for from global if import in is lambda None nonlocal not
+			or pass raise return True try while with yield self`),
+		lineComments: []string{"#"},
+		quotes:       `"'`,
+		tripleQuotes: true,
+		signals: []signal{
+			s(`^\s*def \w+\(.*\)( -> .+)?:\s*$`, 3),
+			s(`^\s*class \w+(\(.*\))?:\s*$`, 3),
+			s(`^\s*(from [\w.]+ )?import [\w.]+( as \w+)?\s*$`, 1),
+			s(`\bself\.\w+`, 2),
+			s(`^\s*elif .*:\s*$`, 3),
+			s(`^\s*(if|for|while|with|try|else|except)\b.*:\s*$`, 1),
+			s(`__name__ == `, 3),
+			s(`\bprint\(`, 1),
+		},
+	},
+	{
+		name:         "javascript",
+		aliases:      []string{"js", "jsx", "mjs", "node", "nodejs"},
+		keywords:     javascriptKeywords,
+		lineComments: []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       "\"'`",
+		signals:      javascriptSignals,
+	},
+	{
+		name:    "typescript",
+		aliases: []string{"ts", "tsx"},
+		keywords: append(strings.Fields(`abstract any as boolean declare enum implements
+			interface keyof namespace never number private protected public readonly string
+			type unknown`), javascriptKeywords...),
+		lineComments: []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       "\"'`",
+		signals: append([]signal{
+			s(`\b\w+\??: (string|number|boolean|any|void|unknown)\b`, 3),
+			s(`^\s*(export )?interface \w+`, 3),
+			s(`^\s*(export )?type \w+(<.*>)? = `, 3),
+			s(`\bas (string|number|const)\b`, 2),
+		}, javascriptSignals...),
+	},
+	{
+		name: "java",
+		keywords: strings.Fields(`abstract boolean break byte case catch char class continue
+			default do double else enum extends false final finally float for if implements
+			import instanceof int interface long new null package private protected public
+			return short static super switch this throw throws true try var void volatile
+			while`),
+		lineComments: []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       `"'`,
+		signals: []signal{
+			s(`\bpublic (static )?(final )?(class|interface|void|int|String|boolean)\b`, 2),
+			s(`\bSystem\.out\.print`, 3),
+			s(`^import java\.`, 3),
+			s(`@Override\b`, 2),
+			s(`\bString\[\] args\b`, 3),
+		},
+	},
+	{
+		name:         "c",
+		aliases:      []string{"h"},
+		keywords:     cKeywords,
+		lineComments: []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       `"'`,
+		signals: []signal{
+			s(`^#include <\w+\.h>`, 3),
+			s(`\bprintf\(`, 2),
+			s(`\bint main\(`, 2),
+			s(`\b(malloc|free|sizeof)\(`, 2),
+			s(`^#define \w+`, 2),
+		},
+	},
+	{
+		name:    "cpp",
+		aliases: []string{"c++", "cc", "cxx", "hpp"},
+		keywords: append(strings.Fields(`bool catch class constexpr delete false friend inline
+			namespace new nullptr operator private protected public template this throw true
+			try typename using virtual`), cKeywords...),
+		lineComments: []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       `"'`,
+		signals: []signal{
+			s(`^#include <\w+>`, 3),
+			s(`\bstd::`, 3),
+			s(`\b(cout|cin|endl)\b`, 2),
+			s(`\btemplate\s*<`, 3),
+			s(`\bnullptr\b`, 2),
+		},
+	},
+	{
+		name:    "csharp",
+		aliases: []string{"c#", "cs"},
+		keywords: strings.Fields(`abstract as async await base bool break case catch class
+			const continue decimal default delegate do double else enum event false finally
+			float for foreach get if in int interface internal is long namespace new null
+			object out override private protected public readonly ref return sealed set static
+			string struct switch this throw true try using var virtual void while`),
+		lineComments: []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       `"'`,
+		signals: []signal{
+			s(`^using System`, 3),
+			s(`\bConsole\.Write`, 3),
+			s(`\{ get; (private )?set; \}`, 3),
+			s(`^\s*namespace [\w.]+`, 2),
+			s(`\bvar \w+ = new\b`, 1),
+		},
+	},
+	{
+		name:    "rust",
+		aliases: []string{"rs"},
+		keywords: strings.Fields(`as async await break const continue crate else enum extern
+			false fn for if impl in let loop match mod move mut pub ref return self Self static
+			struct super trait true type unsafe use where while`),
+		lineComments: []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       `"`,
+		signals: []signal{
+			s(`\bfn \w+(<.*>)?\(`, 2),
+			s(`\blet mut\b`, 3),
+			s(`\bimpl\b.*\{`, 2),
+			s(`\b\w+!\(`, 1),
+			s(`^use \w+(::\w+)+`, 3),
+			s(`&(mut )?(str|self)\b`, 2),
+			s(`\bpub (fn|struct|enum)\b`, 2),
+		},
+	},
+	{
+		name:    "ruby",
+		aliases: []string{"rb"},
+		keywords: strings.Fields(`alias and begin break case class def do else elsif end
+			ensure false for if in module next nil not or redo rescue retry return self super
+			then true undef unless until when while yield require`),
+		lineComments: []string{"#"},
+		quotes:       `"'`,
+		signals: []signal{
+			s(`^\s*def \w+[?!]?(\(.*\))?\s*$`, 2),
+			s(`^\s*end\s*$`, 2),
+			s(`\bputs\b`, 2),
+			s(`\.each do\b|\bdo \|\w+(, \w+)*\|`, 3),
+			s(`\battr_(accessor|reader|writer)\b`, 3),
+			s(`^\s*require ['"]`, 2),
+			s(`^\s*module \w+\s*$`, 2),
+		},
+	},
+	{
+		name: "php",
+		keywords: strings.Fields(`abstract and array as break case catch class const continue
+			declare default do echo else elseif empty extends false final finally for foreach
+			function global if implements include interface isset namespace new null or print
+			private protected public require return static switch this throw true try use var
+			while`),
+		lineComments: []string{"//", "#"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       `"'`,
+		signals: []signal{
+			s(`<\?php`, 6),
+			s(`\$\w+ = `, 1),
+			s(`\bfunction \w+\(\$`, 3),
+			s(`\$this->`, 3),
+		},
+	},
+	{
+		name:    "bash",
+		aliases: []string{"sh", "shell", "zsh"},
+		keywords: strings.Fields(`if then else elif fi case esac for while until do done in
+			function return local export readonly echo exit set unset source shift`),
+		lineComments: []string{"#"},
+		quotes:       `"'`,
+		signals: []signal{
+			s(`^\s*(if \[\[? .*|fi|then|done|esac|do)\s*$`, 2),
+			s(`^\s*(export )?[A-Z_][A-Z0-9_]*=\S`, 1),
+			s(`\$\{\w+[^}]*\}|"\$\w+"`, 2),
+			s(`\|\s*(grep|awk|sed|xargs|sort|head|tail|wc|cut)\b`, 2),
+			s(`^\s*(sudo|apt-get|apt|brew|npm|yarn|pip|git|docker|kubectl|curl|wget|cd|ls|mkdir|rm|cp|mv|chmod|cat|echo) `, 1),
+		},
+	},
+	{
+		name:    "sql",
+		aliases: []string{"sqlite", "mysql", "postgres", "postgresql", "psql"},
+		keywords: strings.Fields(`select from where and or not insert into values update set
+			delete create table index view drop alter add primary key foreign references join
+			left right inner outer on group by order having limit offset as distinct union all
+			null is in like between exists case when then else end begin commit rollback
+			transaction default unique if integer text real blob varchar int`),
+		caseless:     true,
+		lineComments: []string{"--"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       `"'`,
+		signals: []signal{
+			s(`(?i)^\s*select\s+.+\s+from\s+\w+`, 3),
+			s(`(?i)^\s*(select|from)\b`, 1),
+			s(`(?i)\binsert\s+into\b`, 3),
+			s(`(?i)\bcreate\s+(table|(unique\s+)?index|view)\b`, 3),
+			s(`(?i)^\s*update\s+\w+\s+set\b`, 3),
+			s(`(?i)^\s*(where|group by|order by|having)\b`, 1),
+			s(`(?i)\bjoin\s+\w+.*\bon\b`, 2),
+		},
+	},
+	{
+		name:         "html",
+		aliases:      []string{"htm", "xhtml"},
+		blockComment: [2]string{"<!--", "-->"},
+		quotes:       `"'`,
+		signals: []signal{
+			s(`(?i)<!doctype html`, 6),
+			s(`(?i)</?(html|head|body|div|span|p|a|ul|ol|li|table|tr|td|script|style|form|input|h[1-6])\b[^>]*>`, 1),
+		},
+	},
+	{
+		name:         "css",
+		aliases:      []string{"scss", "less"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       `"'`,
+		signals: []signal{
+			s(`^\s*[\w.#:\[\]="'\-, >+~*]+\s*\{\s*$`, 1),
+			s(`^\s+[a-z-]+: [^;{}()]+;\s*$`, 2),
+			s(`@(media|import|keyframes)\b`, 3),
+			s(`\d(px|em|rem|vh|vw|%);`, 2),
+		},
+	},
+	{
+		name:     "json",
+		keywords: []string{"true", "false", "null"},
+		quotes:   `"`,
+	},
+	{
+		name:         "yaml",
+		aliases:      []string{"yml"},
+		keywords:     []string{"true", "false", "null", "yes", "no"},
+		lineComments: []string{"#"},
+		quotes:       `"'`,
+		signals: []signal{
+			s(`^---\s*$`, 2),
+			s(`^[\w-]+:\s*$`, 1),
+			s(`^\s*- [\w"']`, 1),
+			s(`^\s*[\w-]+: [^\s{(].*$`, 1),
+		},
+	},
+}
+
+// byName finds known languages by name and alias
+var byName = func() map[string]*language {
+	names := make(map[string]*language)
+	for _, l := range languages {
+		names[l.name] = l
+		for _, alias := range l.aliases {
+			names[alias] = l
+		}
+	}
+	return names
+}()
+
+// Normalize returns the canonical name of a language, given its name or an
+// alias in any case. Names this package does not know are returned trimmed
+// and in lower case.
+func Normalize(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if l, ok := byName[name]; ok {
+		return l.name
+	}
+	return name
+}
+
+// Known reports whether a language is one this package knows
+func Known(name string) bool {
+	_, ok := byName[Normalize(name)]
+	return ok
+}
+
+// Names returns the canonical names of the known languages
+func Names() []string {
+	names := make([]string, len(languages))
+	for i, l := range languages {
+		names[i] = l.name
+	}
+	return names
+}
+
+// lookup returns a known language, or nil
+func lookup(name string) *language {
+	return byName[Normalize(name)]
+}
@@ -0,0 +1,501 @@
+// Package config loads the server configuration from defaults, a TOML file,
+// environment variables and command-line flags, in increasing precedence.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"github.com/rgehrsitz/me/internal/vector"
+	"github.com/sashabaranov/go-openai"
+)
+
+// FileName is the name of the config file inside the data directory
+const FileName = "config.toml"
+
+// redacted replaces secrets when printing the config
+const redacted = "<redacted>"
+
+// Config is the complete server configuration
+type Config struct {
+	Server  ServerConfig  `toml:"server"`
+	Storage StorageConfig `toml:"storage"`
+	Auth    AuthConfig    `toml:"auth"`
+	AI      AIConfig      `toml:"ai"`
+	Limits  LimitsConfig  `toml:"limits"`
+	Jobs    JobsConfig    `toml:"jobs"`
+}
+
+// ServerConfig configures the HTTP listener
+type ServerConfig struct {
+	Addr        string   `toml:"addr"`
+	CORSOrigins []string `toml:"cors_origins"`
+	// DevProxy forwards frontend requests to a Vite dev server when set
+	DevProxy string `toml:"dev_proxy"`
+	// ShutdownTimeout bounds how long shutdown waits for in-flight requests
+	// and background jobs
+	ShutdownTimeout Duration `toml:"shutdown_timeout"`
+}
+
+// StorageConfig configures where data is kept
+type StorageConfig struct {
+	DBPath string `toml:"db_path"`
+	// DataDir also holds the vaults, each in vaults/<name>
+	DataDir string `toml:"data_dir"`
+	// KeyFile holds the passphrase that unlocks an encrypted database on
+	// startup; $PKB_PASSPHRASE takes precedence
+	KeyFile string `toml:"key_file"`
+}
+
+// Passphrase returns the passphrase for encrypted databases from
+// $PKB_PASSPHRASE or the key file, or "" if neither is set
+func (s *StorageConfig) Passphrase() (string, error) {
+	if passphrase := os.Getenv("PKB_PASSPHRASE"); passphrase != "" {
+		return passphrase, nil
+	}
+	if s.KeyFile == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(s.KeyFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read key file: %w", err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// VaultDir returns the directory holding a vault's database and config file
+func (s *StorageConfig) VaultDir(name string) string {
+	return filepath.Join(s.DataDir, "vaults", name)
+}
+
+// AuthConfig configures API authentication
+type AuthConfig struct {
+	// Enabled requires an API token for every API request
+	Enabled bool `toml:"enabled"`
+}
+
+// AIConfig configures the AI provider used for embeddings and summaries
+type AIConfig struct {
+	Provider string `toml:"provider"`
+	APIKey   string `toml:"api_key"`
+	// BaseURL points at an OpenAI-compatible API; empty uses the default
+	BaseURL        string `toml:"base_url"`
+	EmbeddingModel string `toml:"embedding_model"`
+	// NextEmbeddingModel, during a switch to another embedding model, also
+	// embeds new content with that model while search keeps using
+	// EmbeddingModel
+	NextEmbeddingModel string `toml:"next_embedding_model"`
+	ChatModel          string `toml:"chat_model"`
+	// EmbeddingQuantization stores a compact copy of each embedding for
+	// semantic search to scan: "none", "int8" or "binary"
+	EmbeddingQuantization string `toml:"embedding_quantization"`
+	// EmbeddingCacheTTL is how long an embedding stays cached by text
+	// after it was last used, so unchanged text and repeated search queries
+	// are not embedded again; 0 disables the cache
+	EmbeddingCacheTTL Duration `toml:"embedding_cache_ttl"`
+	// DailyBudget and MonthlyBudget cap the estimated AI spend, in US
+	// dollars, per UTC day and month. Once spent, AI calls fail until the
+	// period ends. 0 means no limit. The budgets are shared by all vaults,
+	// so only the main config file sets them.
+	DailyBudget   float64 `toml:"daily_budget"`
+	MonthlyBudget float64 `toml:"monthly_budget"`
+	// Prices sets or overrides the price of models by name, for estimating
+	// what calls cost
+	Prices map[string]ModelPrice `toml:"prices"`
+}
+
+// ModelPrice is what a model costs, in US dollars per million tokens
+type ModelPrice struct {
+	Input  float64 `toml:"input"`
+	Output float64 `toml:"output"`
+}
+
+// LimitsConfig bounds request sizes and result pages
+type LimitsConfig struct {
+	MaxBodyBytes    int64 `toml:"max_body_bytes"`
+	DefaultPageSize int   `toml:"default_page_size"`
+	MaxPageSize     int   `toml:"max_page_size"`
+}
+
+// JobsConfig configures background jobs
+type JobsConfig struct {
+	// ClusterInterval is how often topic clusters are checked for rebuilding;
+	// zero disables the job
+	ClusterInterval Duration `toml:"cluster_interval"`
+}
+
+// Duration is a time.Duration written as a string such as "1h30m"
+type Duration struct {
+	time.Duration
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+// DefaultDir returns ~/.pkb, where the database and config file live by default
+func DefaultDir() (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get user home directory: %w", err)
+	}
+	return filepath.Join(homeDir, ".pkb"), nil
+}
+
+// Default returns the built-in configuration
+func Default() (*Config, error) {
+	dir, err := DefaultDir()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Config{
+		Server: ServerConfig{
+			Addr:            ":8080",
+			CORSOrigins:     []string{"http://localhost:5173", "http://localhost:8080"},
+			ShutdownTimeout: Duration{30 * time.Second},
+		},
+		Storage: StorageConfig{
+			DBPath:  filepath.Join(dir, "pkb.db"),
+			DataDir: dir,
+		},
+		Auth: AuthConfig{
+			Enabled: true,
+		},
+		AI: AIConfig{
+			Provider:              "openai",
+			EmbeddingModel:        "text-embedding-ada-002",
+			ChatModel:             openai.GPT3Dot5Turbo,
+			EmbeddingQuantization: "none",
+			EmbeddingCacheTTL:     Duration{30 * 24 * time.Hour},
+		},
+		Limits: LimitsConfig{
+			MaxBodyBytes:    16 << 20,
+			DefaultPageSize: 10,
+			MaxPageSize:     1000,
+		},
+		Jobs: JobsConfig{
+			ClusterInterval: Duration{time.Hour},
+		},
+	}, nil
+}
+
+// DefaultPath returns the config file to read when none is given: $PKB_CONFIG
+// or ~/.pkb/config.toml
+func DefaultPath() (string, error) {
+	if path := os.Getenv("PKB_CONFIG"); path != "" {
+		return path, nil
+	}
+	dir, err := DefaultDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, FileName), nil
+}
+
+// Load builds the configuration from the defaults, the file at path and the
+// environment. A missing file is only an error when path was given
+// explicitly. Flags are applied by the caller before calling Validate.
+func Load(path string) (*Config, error) {
+	cfg, err := Default()
+	if err != nil {
+		return nil, err
+	}
+
+	explicit := path != ""
+	if !explicit {
+		if path, err = DefaultPath(); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := decode(path, data, cfg); err != nil {
+			return nil, err
+		}
+	case errors.Is(err, os.ErrNotExist) && !explicit && os.Getenv("PKB_CONFIG") == "":
+	default:
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// vaultSettings are the sections a vault's own config file may override
+type vaultSettings struct {
+	AI     AIConfig     `toml:"ai"`
+	Limits LimitsConfig `toml:"limits"`
+	Jobs   JobsConfig   `toml:"jobs"`
+}
+
+// ForVault returns a copy of the config with the [ai], [limits] and [jobs]
+// settings from a vault's config file at path applied on top. A missing file
+// leaves the copy unchanged.
+func (c *Config) ForVault(path string) (*Config, error) {
+	vault := *c
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &vault, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read vault config: %w", err)
+	}
+
+	settings := vaultSettings{AI: c.AI, Limits: c.Limits, Jobs: c.Jobs}
+	// Decoding adds to maps in place, so the vault gets its own
+	settings.AI.Prices = maps.Clone(c.AI.Prices)
+	if err := decode(path, data, &settings); err != nil {
+		return nil, err
+	}
+	if settings.AI.DailyBudget != c.AI.DailyBudget || settings.AI.MonthlyBudget != c.AI.MonthlyBudget {
+		return nil, fmt.Errorf("invalid vault config %s: ai.daily_budget and ai.monthly_budget are shared by all vaults and can only be set in the main config", path)
+	}
+	vault.AI, vault.Limits, vault.Jobs = settings.AI, settings.Limits, settings.Jobs
+
+	if err := vault.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid vault config %s:\n%w", path, err)
+	}
+	return &vault, nil
+}
+
+// decode parses TOML from the file at path into v, rejecting unknown settings
+func decode(path string, data []byte, v interface{}) error {
+	decoder := toml.NewDecoder(bytes.NewReader(data)).DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		var strict *toml.StrictMissingError
+		if errors.As(err, &strict) {
+			return fmt.Errorf("unknown settings in %s:\n%s", path, strict.String())
+		}
+		return fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return nil
+}
+
+// envVars maps environment variables onto config fields
+var envVars = []struct {
+	name  string
+	apply func(c *Config, value string) error
+}{
+	{"PKB_ADDR", func(c *Config, v string) error { c.Server.Addr = v; return nil }},
+	{"PKB_CORS_ORIGINS", func(c *Config, v string) error { c.Server.CORSOrigins = SplitList(v); return nil }},
+	{"PKB_DEV_PROXY", func(c *Config, v string) error { c.Server.DevProxy = v; return nil }},
+	{"PKB_SHUTDOWN_TIMEOUT", func(c *Config, v string) error {
+		return c.Server.ShutdownTimeout.UnmarshalText([]byte(v))
+	}},
+	{"PKB_DB", func(c *Config, v string) error { c.Storage.DBPath = v; return nil }},
+	{"PKB_DATA_DIR", func(c *Config, v string) error { c.Storage.DataDir = v; return nil }},
+	{"PKB_KEY_FILE", func(c *Config, v string) error { c.Storage.KeyFile = v; return nil }},
+	{"PKB_AUTH_ENABLED", func(c *Config, v string) (err error) {
+		c.Auth.Enabled, err = strconv.ParseBool(v)
+		return err
+	}},
+	{"PKB_AI_PROVIDER", func(c *Config, v string) error { c.AI.Provider = v; return nil }},
+	{"OPENAI_API_KEY", func(c *Config, v string) error { c.AI.APIKey = v; return nil }},
+	{"OPENAI_BASE_URL", func(c *Config, v string) error { c.AI.BaseURL = v; return nil }},
+	{"PKB_EMBEDDING_MODEL", func(c *Config, v string) error { c.AI.EmbeddingModel = v; return nil }},
+	{"PKB_NEXT_EMBEDDING_MODEL", func(c *Config, v string) error { c.AI.NextEmbeddingModel = v; return nil }},
+	{"PKB_CHAT_MODEL", func(c *Config, v string) error { c.AI.ChatModel = v; return nil }},
+	{"PKB_EMBEDDING_QUANTIZATION", func(c *Config, v string) error { c.AI.EmbeddingQuantization = v; return nil }},
+	{"PKB_EMBEDDING_CACHE_TTL", func(c *Config, v string) error {
+		return c.AI.EmbeddingCacheTTL.UnmarshalText([]byte(v))
+	}},
+	{"PKB_DAILY_BUDGET", func(c *Config, v string) (err error) {
+		c.AI.DailyBudget, err = strconv.ParseFloat(v, 64)
+		return err
+	}},
+	{"PKB_MONTHLY_BUDGET", func(c *Config, v string) (err error) {
+		c.AI.MonthlyBudget, err = strconv.ParseFloat(v, 64)
+		return err
+	}},
+	{"PKB_MAX_BODY_BYTES", func(c *Config, v string) (err error) {
+		c.Limits.MaxBodyBytes, err = strconv.ParseInt(v, 10, 64)
+		return err
+	}},
+	{"PKB_DEFAULT_PAGE_SIZE", func(c *Config, v string) (err error) {
+		c.Limits.DefaultPageSize, err = strconv.Atoi(v)
+		return err
+	}},
+	{"PKB_MAX_PAGE_SIZE", func(c *Config, v string) (err error) {
+		c.Limits.MaxPageSize, err = strconv.Atoi(v)
+		return err
+	}},
+	{"PKB_CLUSTER_INTERVAL", func(c *Config, v string) error {
+		return c.Jobs.ClusterInterval.UnmarshalText([]byte(v))
+	}},
+}
+
+// applyEnv overrides the config with any environment variables that are set
+func (c *Config) applyEnv() error {
+	for _, env := range envVars {
+		value, ok := os.LookupEnv(env.name)
+		if !ok || value == "" {
+			continue
+		}
+		if err := env.apply(c, value); err != nil {
+			return fmt.Errorf("invalid %s: %w", env.name, err)
+		}
+	}
+	return nil
+}
+
+// Validate checks that the configuration is usable. A missing AI API key is
+// reported by the AI services instead, so that commands which never call the
+// API, such as token bootstrap, work without one.
+func (c *Config) Validate() error {
+	var errs []error
+
+	if _, _, err := net.SplitHostPort(c.Server.Addr); err != nil {
+		errs = append(errs, fmt.Errorf("server.addr: %w", err))
+	}
+	for _, origin := range c.Server.CORSOrigins {
+		if err := checkURL(origin); err != nil {
+			errs = append(errs, fmt.Errorf("server.cors_origins: %w", err))
+		}
+	}
+	if c.Server.DevProxy != "" {
+		if err := checkURL(c.Server.DevProxy); err != nil {
+			errs = append(errs, fmt.Errorf("server.dev_proxy: %w", err))
+		}
+	}
+
+	if c.Server.ShutdownTimeout.Duration <= 0 {
+		errs = append(errs, errors.New("server.shutdown_timeout must be positive"))
+	}
+
+	if c.Storage.DBPath == "" {
+		errs = append(errs, errors.New("storage.db_path must be set"))
+	}
+
+	if c.AI.Provider != "openai" {
+		errs = append(errs, fmt.Errorf("ai.provider: unsupported provider %q, expected \"openai\"", c.AI.Provider))
+	}
+	if c.AI.BaseURL != "" {
+		if err := checkURL(c.AI.BaseURL); err != nil {
+			errs = append(errs, fmt.Errorf("ai.base_url: %w", err))
+		}
+	}
+	// UnmarshalText accepts any name, mapping unknown ones to Unknown
+	var model openai.EmbeddingModel
+	if model.UnmarshalText([]byte(c.AI.EmbeddingModel)); model == openai.Unknown {
+		errs = append(errs, fmt.Errorf("ai.embedding_model: unknown model %q", c.AI.EmbeddingModel))
+	}
+	if c.AI.NextEmbeddingModel != "" {
+		if model.UnmarshalText([]byte(c.AI.NextEmbeddingModel)); model == openai.Unknown {
+			errs = append(errs, fmt.Errorf("ai.next_embedding_model: unknown model %q", c.AI.NextEmbeddingModel))
+		} else if c.AI.NextEmbeddingModel == c.AI.EmbeddingModel {
+			errs = append(errs, errors.New("ai.next_embedding_model must differ from ai.embedding_model"))
+		}
+	}
+	if c.AI.ChatModel == "" {
+		errs = append(errs, errors.New("ai.chat_model must be set"))
+	}
+	if _, err := vector.ParseKind(c.AI.EmbeddingQuantization); err != nil {
+		errs = append(errs, fmt.Errorf("ai.embedding_quantization: %w", err))
+	}
+	if c.AI.EmbeddingCacheTTL.Duration < 0 {
+		errs = append(errs, errors.New("ai.embedding_cache_ttl must not be negative"))
+	}
+	if c.AI.DailyBudget < 0 {
+		errs = append(errs, errors.New("ai.daily_budget must not be negative"))
+	}
+	if c.AI.MonthlyBudget < 0 {
+		errs = append(errs, errors.New("ai.monthly_budget must not be negative"))
+	}
+	for model, price := range c.AI.Prices {
+		if price.Input < 0 || price.Output < 0 {
+			errs = append(errs, fmt.Errorf("ai.prices.%s: prices must not be negative", model))
+		}
+	}
+
+	if c.Limits.MaxBodyBytes <= 0 {
+		errs = append(errs, errors.New("limits.max_body_bytes must be positive"))
+	}
+	if c.Limits.DefaultPageSize <= 0 {
+		errs = append(errs, errors.New("limits.default_page_size must be positive"))
+	}
+	if c.Limits.MaxPageSize < c.Limits.DefaultPageSize {
+		errs = append(errs, errors.New("limits.max_page_size must be at least limits.default_page_size"))
+	}
+
+	if c.Jobs.ClusterInterval.Duration < 0 {
+		errs = append(errs, errors.New("jobs.cluster_interval must not be negative"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Redacted returns a copy of the config with secrets hidden
+func (c *Config) Redacted() *Config {
+	copied := *c
+	copied.Server.CORSOrigins = append([]string(nil), c.Server.CORSOrigins...)
+	if copied.AI.APIKey != "" {
+		copied.AI.APIKey = redacted
+	}
+	return &copied
+}
+
+// Print writes the config as TOML
+func (c *Config) Print() ([]byte, error) {
+	return toml.Marshal(c)
+}
+
+// PageSize applies the default and maximum page size to a requested limit
+func (c *LimitsConfig) PageSize(limit int) int {
+	if limit <= 0 {
+		return c.DefaultPageSize
+	}
+	if limit > c.MaxPageSize {
+		return c.MaxPageSize
+	}
+	return limit
+}
+
+// SplitList splits a comma-separated list, dropping empty entries
+func SplitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// checkURL ensures a value is an absolute http(s) URL
+func checkURL(value string) error {
+	u, err := url.Parse(value)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%q is not an http(s) URL", value)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package db
+
+import "database/sql"
+
+// Attachment is a file attached to a content item
+type Attachment struct {
+	ContentID int64  `json:"content_id"`
+	Name      string `json:"name"`
+	MediaType string `json:"media_type"`
+	Size      int    `json:"size"`
+	Data      []byte `json:"-"`
+	CreatedAt string `json:"created_at"`
+}
+
+// SetAttachment attaches a file to a content item the user may write to,
+// replacing the file attached before, if any
+func (db *DB) SetAttachment(userID int64, attachment *Attachment) error {
+	sl, done, err := db.sealing()
+	if err != nil {
+		return err
+	}
+	defer done()
+	name, err := sl.seal(attachment.Name)
+	if err != nil {
+		return err
+	}
+	data, err := sl.sealBlob(attachment.Data)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := contentAccess(tx, userID, attachment.ContentID, AccessWrite); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT OR REPLACE INTO attachments (content_id, name, media_type, size, data)
+		VALUES (?, ?, ?, ?, ?)`,
+		attachment.ContentID, name, attachment.MediaType, len(attachment.Data), data)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetAttachment retrieves the file attached to a content item the user may
+// read. It returns sql.ErrNoRows if there is none.
+func (db *DB) GetAttachment(userID, contentID int64) (*Attachment, error) {
+	if err := contentAccess(db, userID, contentID, AccessRead); err != nil {
+		return nil, err
+	}
+	sl, err := db.crypter()
+	if err != nil {
+		return nil, err
+	}
+
+	attachment := Attachment{ContentID: contentID}
+	err = db.QueryRow(`
+		SELECT name, media_type, size, data, created_at
+		FROM attachments
+		WHERE content_id = ?`, contentID).Scan(
+		&attachment.Name,
+		&attachment.MediaType,
+		&attachment.Size,
+		&attachment.Data,
+		&attachment.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if attachment.Name, err = sl.open(attachment.Name); err != nil {
+		return nil, err
+	}
+	if attachment.Data, err = sl.openBlob(attachment.Data); err != nil {
+		return nil, err
+	}
+	return &attachment, nil
+}
+
+// DeleteAttachment removes the file attached to a content item the user may
+// write to. It returns sql.ErrNoRows if there is none.
+func (db *DB) DeleteAttachment(userID, contentID int64) error {
+	if err := contentAccess(db, userID, contentID, AccessWrite); err != nil {
+		return err
+	}
+	res, err := db.Exec("DELETE FROM attachments WHERE content_id = ?", contentID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
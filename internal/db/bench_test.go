@@ -0,0 +1,58 @@
+package db_test
+
+import (
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/rgehrsitz/me/internal/db"
+	"github.com/rgehrsitz/me/internal/db/dbtest"
+)
+
+// benchItems is the size of the knowledge base the benchmarks run against
+const benchItems = 10000
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	dbtest.Cleanup()
+	os.Exit(code)
+}
+
+func BenchmarkListContent(b *testing.B) {
+	kb := dbtest.Seeded(b, benchItems)
+	middle, err := kb.DB.ListContent(kb.UserID, db.ContentFilter{Limit: benchItems / 2})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, bm := range []struct {
+		name   string
+		filter db.ContentFilter
+	}{
+		{"first", db.ContentFilter{Limit: 50}},
+		{"offset-middle", db.ContentFilter{Limit: 50, Offset: benchItems / 2}},
+		{"cursor-middle", db.ContentFilter{Limit: 50, Cursor: middle.NextCursor}},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := kb.DB.ListContent(kb.UserID, bm.filter); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkGetContent(b *testing.B) {
+	kb := dbtest.Seeded(b, benchItems)
+	rng := rand.New(rand.NewSource(1))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := kb.DB.GetContent(kb.UserID, kb.IDs[rng.Intn(len(kb.IDs))]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
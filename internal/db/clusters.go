@@ -0,0 +1,245 @@
+package db
+
+import (
+	"database/sql"
+	"sort"
+)
+
+// Cluster represents a topic cluster of content
+type Cluster struct {
+	ID        int64           `json:"id"`
+	Name      string          `json:"name"`
+	Size      int             `json:"size"`
+	Centroid  []byte          `json:"-"`
+	CreatedAt string          `json:"created_at"`
+	UpdatedAt string          `json:"updated_at"`
+	Members   []ClusterMember `json:"members,omitempty"`
+}
+
+// ClusterMember represents a content item that belongs to a cluster
+type ClusterMember struct {
+	ContentID int64  `json:"content_id"`
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+}
+
+// ReplaceClusters discards the user's existing clusters and stores the given
+// ones. members[i] holds the content IDs assigned to clusters[i].
+func (db *DB) ReplaceClusters(userID int64, clusters []Cluster, members [][]int64) error {
+	sl, done, err := db.sealing()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM clusters WHERE owner_id = ?", userID); err != nil {
+		return err
+	}
+
+	for i, cluster := range clusters {
+		// Names are made from the members' titles, so they are sealed too
+		name, err := sl.seal(cluster.Name)
+		if err != nil {
+			return err
+		}
+		res, err := tx.Exec("INSERT INTO clusters (owner_id, name, centroid) VALUES (?, ?, ?)", userID, name, cluster.Centroid)
+		if err != nil {
+			return err
+		}
+
+		clusterID, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+
+		for _, contentID := range members[i] {
+			_, err := tx.Exec(`
+				INSERT OR REPLACE INTO content_clusters (content_id, cluster_id, incremental)
+				VALUES (?, ?, 0)`, contentID, clusterID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// AssignCluster adds a content item to a cluster and stores the cluster's
+// updated centroid
+func (db *DB) AssignCluster(contentID, clusterID int64, centroid []byte) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT OR REPLACE INTO content_clusters (content_id, cluster_id, incremental)
+		VALUES (?, ?, 1)`, contentID, clusterID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE clusters
+		SET centroid = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?`, centroid, clusterID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ContentCluster returns the cluster a content item belongs to.
+// It returns sql.ErrNoRows if the item has not been clustered.
+func (db *DB) ContentCluster(contentID int64) (int64, error) {
+	var clusterID int64
+	err := db.QueryRow("SELECT cluster_id FROM content_clusters WHERE content_id = ?", contentID).Scan(&clusterID)
+	return clusterID, err
+}
+
+// ClusterStats returns the number of the user's clustered items and how many
+// of them were assigned incrementally since the last full clustering run
+func (db *DB) ClusterStats(userID int64) (total, incremental int, err error) {
+	err = db.QueryRow(`
+		SELECT COUNT(*), COALESCE(SUM(cc.incremental), 0)
+		FROM content_clusters cc
+		JOIN clusters cl ON cl.id = cc.cluster_id
+		WHERE cl.owner_id = ?`, userID).Scan(&total, &incremental)
+	return total, incremental, err
+}
+
+// ListClusters retrieves the user's clusters, largest first, optionally with
+// members
+func (db *DB) ListClusters(userID int64, includeMembers bool) ([]Cluster, error) {
+	sl, err := db.crypter()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`
+		SELECT cl.id, cl.name, cl.centroid, cl.created_at, cl.updated_at, COUNT(cc.content_id)
+		FROM clusters cl
+		LEFT JOIN content_clusters cc ON cc.cluster_id = cl.id
+		WHERE cl.owner_id = ?
+		GROUP BY cl.id`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	clusters := []Cluster{}
+	for rows.Next() {
+		var cluster Cluster
+		err := rows.Scan(
+			&cluster.ID,
+			&cluster.Name,
+			&cluster.Centroid,
+			&cluster.CreatedAt,
+			&cluster.UpdatedAt,
+			&cluster.Size,
+		)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if cluster.Name, err = sl.open(cluster.Name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		clusters = append(clusters, cluster)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Encrypted names cannot be sorted in SQL
+	sort.Slice(clusters, func(i, j int) bool {
+		if clusters[i].Size != clusters[j].Size {
+			return clusters[i].Size > clusters[j].Size
+		}
+		return clusters[i].Name < clusters[j].Name
+	})
+
+	if includeMembers {
+		for i := range clusters {
+			clusters[i].Members, err = db.clusterMembers(clusters[i].ID)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return clusters, nil
+}
+
+// GetCluster retrieves one of the user's clusters with its members
+func (db *DB) GetCluster(userID, id int64) (*Cluster, error) {
+	var cluster Cluster
+	err := db.QueryRow(`
+		SELECT id, name, centroid, created_at, updated_at
+		FROM clusters
+		WHERE id = ? AND owner_id = ?`, id, userID).Scan(
+		&cluster.ID,
+		&cluster.Name,
+		&cluster.Centroid,
+		&cluster.CreatedAt,
+		&cluster.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if cluster.Name, err = db.Decrypt(cluster.Name); err != nil {
+		return nil, err
+	}
+
+	cluster.Members, err = db.clusterMembers(id)
+	if err != nil {
+		return nil, err
+	}
+	cluster.Size = len(cluster.Members)
+
+	return &cluster, nil
+}
+
+// clusterMembers retrieves the content items assigned to a cluster
+func (db *DB) clusterMembers(clusterID int64) ([]ClusterMember, error) {
+	sl, err := db.crypter()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`
+		SELECT c.id, c.type, c.title
+		FROM content_clusters cc
+		JOIN content c ON c.id = cc.content_id
+		WHERE cc.cluster_id = ?
+		ORDER BY c.created_at DESC`, clusterID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []ClusterMember{}
+	for rows.Next() {
+		var member ClusterMember
+		var title sql.NullString
+		if err := rows.Scan(&member.ContentID, &member.Type, &title); err != nil {
+			return nil, err
+		}
+		if member.Title, err = sl.openNull(title); err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+
+	return members, rows.Err()
+}
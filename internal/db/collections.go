@@ -0,0 +1,475 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// Collection delete modes
+const (
+	// DeleteReparent moves sub-collections up to the deleted collection's parent
+	DeleteReparent = "reparent"
+	// DeleteCascade deletes the whole subtree of collections
+	DeleteCascade = "cascade"
+)
+
+// ErrCollectionCycle is returned when a move would make a collection its own ancestor
+var ErrCollectionCycle = errors.New("cannot move a collection into itself or one of its descendants")
+
+// Collection represents a node in the collection tree
+type Collection struct {
+	ID          int64        `json:"id"`
+	OwnerID     int64        `json:"owner_id"`
+	ParentID    *int64       `json:"parent_id"`
+	Name        string       `json:"name"`
+	Description string       `json:"description"`
+	Position    int          `json:"position"`
+	ItemCount   int          `json:"item_count"`
+	CreatedAt   string       `json:"created_at"`
+	UpdatedAt   string       `json:"updated_at"`
+	Children    []Collection `json:"children,omitempty"`
+}
+
+// collectionSubtreeSQL selects the IDs of a collection and all of its
+// descendants. It takes the root collection ID as its only argument.
+const collectionSubtreeSQL = `
+	WITH RECURSIVE subtree(id) AS (
+		SELECT ?
+		UNION
+		SELECT cl.id FROM collections cl JOIN subtree s ON cl.parent_id = s.id
+	)
+	SELECT id FROM subtree`
+
+// InCollectionSQL returns a condition restricting the given content ID column
+// to items filed in a collection, optionally including its descendants. The
+// condition takes the collection ID as its only argument.
+func InCollectionSQL(column string, recursive bool) string {
+	if recursive {
+		return fmt.Sprintf(`%s IN (
+			SELECT ci.content_id FROM collection_items ci
+			WHERE ci.collection_id IN (%s))`, column, collectionSubtreeSQL)
+	}
+	return fmt.Sprintf(`%s IN (
+		SELECT ci.content_id FROM collection_items ci
+		WHERE ci.collection_id = ?)`, column)
+}
+
+// CreateCollection creates a collection at the end of its parent's children.
+// A top-level collection belongs to the user; a sub-collection belongs to the
+// owner of its parent, which the user needs write access to.
+func (db *DB) CreateCollection(userID int64, collection *Collection) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	ownerID := userID
+	if collection.ParentID != nil {
+		if err := collectionAccess(tx, userID, *collection.ParentID, AccessWrite); err != nil {
+			return 0, err
+		}
+		if err := tx.QueryRow("SELECT owner_id FROM collections WHERE id = ?", *collection.ParentID).Scan(&ownerID); err != nil {
+			return 0, err
+		}
+	}
+
+	position, err := siblingCount(tx, ownerID, collection.ParentID)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := tx.Exec(`
+		INSERT INTO collections (owner_id, parent_id, name, description, position)
+		VALUES (?, ?, ?, ?, ?)`,
+		ownerID, collection.ParentID, collection.Name, collection.Description, position)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// GetCollection retrieves a collection the user may read with its direct
+// children
+func (db *DB) GetCollection(userID, id int64) (*Collection, error) {
+	if err := collectionAccess(db, userID, id, AccessRead); err != nil {
+		return nil, err
+	}
+
+	collections, err := db.queryCollections(`
+		SELECT cl.id, cl.owner_id, cl.parent_id, cl.name, cl.description, cl.position, cl.created_at, cl.updated_at,
+			(SELECT COUNT(*) FROM collection_items ci WHERE ci.collection_id = cl.id)
+		FROM collections cl
+		WHERE cl.id = ? OR cl.parent_id = ?
+		ORDER BY cl.position, cl.id`, id, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var collection *Collection
+	children := []Collection{}
+	for i := range collections {
+		if collections[i].ID == id {
+			collection = &collections[i]
+		} else {
+			children = append(children, collections[i])
+		}
+	}
+	if collection == nil {
+		return nil, sql.ErrNoRows
+	}
+
+	collection.Children = children
+	return collection, nil
+}
+
+// CollectionTree retrieves every collection the user may read arranged as a
+// tree. The user's own top-level collections and the collections shared with
+// them form the roots.
+func (db *DB) CollectionTree(userID int64) ([]Collection, error) {
+	access, args := CollectionAccessSQL("cl.id", userID, AccessRead)
+	collections, err := db.queryCollections(`
+		SELECT cl.id, cl.owner_id, cl.parent_id, cl.name, cl.description, cl.position, cl.created_at, cl.updated_at,
+			(SELECT COUNT(*) FROM collection_items ci WHERE ci.collection_id = cl.id)
+		FROM collections cl
+		WHERE `+access+`
+		ORDER BY cl.position, cl.id`, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	visible := make(map[int64]bool, len(collections))
+	for _, collection := range collections {
+		visible[collection.ID] = true
+	}
+
+	children := make(map[int64][]Collection)
+	roots := []Collection{}
+	for _, collection := range collections {
+		if collection.ParentID == nil || !visible[*collection.ParentID] {
+			roots = append(roots, collection)
+		} else {
+			children[*collection.ParentID] = append(children[*collection.ParentID], collection)
+		}
+	}
+
+	var attach func(nodes []Collection)
+	attach = func(nodes []Collection) {
+		for i := range nodes {
+			nodes[i].Children = children[nodes[i].ID]
+			attach(nodes[i].Children)
+		}
+	}
+	attach(roots)
+
+	return roots, nil
+}
+
+// UpdateCollection updates the name and description of a collection the user
+// may write to
+func (db *DB) UpdateCollection(userID int64, collection *Collection) error {
+	if err := collectionAccess(db, userID, collection.ID, AccessWrite); err != nil {
+		return err
+	}
+
+	res, err := db.Exec(`
+		UPDATE collections
+		SET name = ?, description = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?`,
+		collection.Name, collection.Description, collection.ID)
+	if err != nil {
+		return err
+	}
+	return expectRow(res)
+}
+
+// MoveCollection moves a collection under a new parent (nil for the top
+// level) at the given position among its new siblings. The user must own both
+// the collection and its new parent.
+func (db *DB) MoveCollection(userID, id int64, parentID *int64, position int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := collectionAccess(tx, userID, id, AccessOwner); err != nil {
+		return err
+	}
+
+	var oldParent sql.NullInt64
+	var oldPosition int
+	err = tx.QueryRow("SELECT parent_id, position FROM collections WHERE id = ?", id).Scan(&oldParent, &oldPosition)
+	if err != nil {
+		return err
+	}
+
+	if parentID != nil {
+		if err := collectionAccess(tx, userID, *parentID, AccessOwner); err != nil {
+			return err
+		}
+
+		var inSubtree int
+		err := tx.QueryRow(`SELECT COUNT(*) FROM (`+collectionSubtreeSQL+`) WHERE id = ?`, id, *parentID).Scan(&inSubtree)
+		if err != nil {
+			return err
+		}
+		if inSubtree > 0 {
+			return ErrCollectionCycle
+		}
+	}
+
+	// Close the gap left among the old siblings
+	_, err = tx.Exec(`
+		UPDATE collections SET position = position - 1
+		WHERE owner_id = ? AND parent_id IS ? AND position > ?`, userID, oldParent, oldPosition)
+	if err != nil {
+		return err
+	}
+
+	// Make room among the new siblings
+	count, err := siblingCount(tx, userID, parentID)
+	if err != nil {
+		return err
+	}
+	if oldParent.Valid == (parentID != nil) && (parentID == nil || oldParent.Int64 == *parentID) {
+		count-- // the collection itself is still counted
+	}
+	if position < 0 || position > count {
+		position = count
+	}
+
+	_, err = tx.Exec(`
+		UPDATE collections SET position = position + 1
+		WHERE owner_id = ? AND parent_id IS ? AND position >= ? AND id != ?`, userID, parentID, position, id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE collections
+		SET parent_id = ?, position = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?`, parentID, position, id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeleteCollection deletes a collection owned by the user. Content is never
+// deleted, only removed from the collection. With DeleteReparent the
+// collection's children move up to its parent; with DeleteCascade the whole
+// subtree is deleted.
+func (db *DB) DeleteCollection(userID, id int64, mode string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := collectionAccess(tx, userID, id, AccessOwner); err != nil {
+		return err
+	}
+
+	var parent sql.NullInt64
+	var position int
+	err = tx.QueryRow("SELECT parent_id, position FROM collections WHERE id = ?", id).Scan(&parent, &position)
+	if err != nil {
+		return err
+	}
+
+	switch mode {
+	case DeleteCascade:
+		// Sub-collections are removed by ON DELETE CASCADE
+	case DeleteReparent, "":
+		count, err := siblingCount(tx, userID, nullableID(parent))
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`
+			UPDATE collections
+			SET parent_id = ?, position = position + ?, updated_at = CURRENT_TIMESTAMP
+			WHERE parent_id = ?`, parent, count, id)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown delete mode %q", mode)
+	}
+
+	if _, err := tx.Exec("DELETE FROM collections WHERE id = ?", id); err != nil {
+		return err
+	}
+
+	// Close the gap left among the siblings
+	_, err = tx.Exec(`
+		UPDATE collections SET position = position - 1
+		WHERE owner_id = ? AND parent_id IS ? AND position > ?`, userID, parent, position)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// AddCollectionItem files a content item in a collection at the given
+// position, or at the end if position is negative. Adding an item that is
+// already in the collection moves it. The user needs write access to the
+// collection and must be able to read the item.
+func (db *DB) AddCollectionItem(userID, collectionID, contentID int64, position int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := collectionAccess(tx, userID, collectionID, AccessWrite); err != nil {
+		return err
+	}
+
+	if err := contentAccess(tx, userID, contentID, AccessRead); err != nil {
+		return err
+	}
+
+	if err := removeCollectionItem(tx, collectionID, contentID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	var count int
+	err = tx.QueryRow("SELECT COUNT(*) FROM collection_items WHERE collection_id = ?", collectionID).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if position < 0 || position > count {
+		position = count
+	}
+
+	_, err = tx.Exec(`
+		UPDATE collection_items SET position = position + 1
+		WHERE collection_id = ? AND position >= ?`, collectionID, position)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO collection_items (collection_id, content_id, position)
+		VALUES (?, ?, ?)`, collectionID, contentID, position)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RemoveCollectionItem removes a content item from a collection the user may
+// write to
+func (db *DB) RemoveCollectionItem(userID, collectionID, contentID int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := collectionAccess(tx, userID, collectionID, AccessWrite); err != nil {
+		return err
+	}
+
+	if err := removeCollectionItem(tx, collectionID, contentID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// removeCollectionItem removes an item and closes the gap it leaves
+func removeCollectionItem(tx *sql.Tx, collectionID, contentID int64) error {
+	var position int
+	err := tx.QueryRow(`
+		SELECT position FROM collection_items
+		WHERE collection_id = ? AND content_id = ?`, collectionID, contentID).Scan(&position)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM collection_items WHERE collection_id = ? AND content_id = ?", collectionID, contentID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE collection_items SET position = position - 1
+		WHERE collection_id = ? AND position > ?`, collectionID, position)
+	return err
+}
+
+// queryCollections runs a collection query and scans the results
+func (db *DB) queryCollections(query string, args ...interface{}) ([]Collection, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	collections := []Collection{}
+	for rows.Next() {
+		var collection Collection
+		var parentID sql.NullInt64
+		err := rows.Scan(
+			&collection.ID,
+			&collection.OwnerID,
+			&parentID,
+			&collection.Name,
+			&collection.Description,
+			&collection.Position,
+			&collection.CreatedAt,
+			&collection.UpdatedAt,
+			&collection.ItemCount,
+		)
+		if err != nil {
+			return nil, err
+		}
+		collection.ParentID = nullableID(parentID)
+		collections = append(collections, collection)
+	}
+
+	return collections, rows.Err()
+}
+
+// siblingCount returns the number of an owner's collections under a parent
+func siblingCount(tx *sql.Tx, ownerID int64, parentID *int64) (int, error) {
+	var count int
+	err := tx.QueryRow("SELECT COUNT(*) FROM collections WHERE owner_id = ? AND parent_id IS ?", ownerID, parentID).Scan(&count)
+	return count, err
+}
+
+// nullableID converts a nullable column into an optional ID
+func nullableID(id sql.NullInt64) *int64 {
+	if !id.Valid {
+		return nil
+	}
+	return &id.Int64
+}
+
+// expectRow returns sql.ErrNoRows if a statement affected no rows
+func expectRow(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,657 @@
+package db
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Encryption at rest. Titles, bodies, link text, cluster names and attached
+// files are encrypted with AES-256-GCM under a random data key. The data key
+// is stored encrypted with a key derived from the passphrase by Argon2id, so
+// changing the passphrase does not touch the content. Everything else,
+// including tags, URLs, file paths and embeddings, stays in plain text.
+
+// encryptedPrefix marks encrypted values in text columns
+const encryptedPrefix = "enc:v1:"
+
+// Argon2id parameters for newly derived keys
+const (
+	kdfTime    = 3
+	kdfMemory  = 64 * 1024 // KiB
+	kdfThreads = 4
+	keySize    = 32
+	saltSize   = 16
+)
+
+var (
+	// ErrLocked is returned when reading or writing encrypted text before the
+	// knowledge base is unlocked
+	ErrLocked = errors.New("knowledge base is locked")
+	// ErrWrongPassphrase is returned when a passphrase does not unlock the
+	// data key
+	ErrWrongPassphrase = errors.New("wrong passphrase")
+	// ErrEmptyPassphrase is returned when encrypting with an empty passphrase
+	ErrEmptyPassphrase = errors.New("passphrase must not be empty")
+	// ErrNotEncrypted is returned when unlocking or re-keying a knowledge base
+	// that is not encrypted
+	ErrNotEncrypted = errors.New("knowledge base is not encrypted")
+	// ErrAlreadyEncrypted is returned when encrypting twice
+	ErrAlreadyEncrypted = errors.New("knowledge base is already encrypted")
+)
+
+// sealedColumns lists the encrypted text columns, with the column holding
+// the lookup key of the first one, if any
+var sealedColumns = []struct {
+	table     string
+	columns   []string
+	keyColumn string
+}{
+	{"content", []string{"title", "body"}, "title_key"},
+	{"content_revisions", []string{"title", "body"}, ""},
+	{"content_links", []string{"target_ref"}, "target_key"},
+	{"clusters", []string{"name"}, ""},
+	{"attachments", []string{"name"}, ""},
+}
+
+// sealedBlobs lists the encrypted binary columns
+var sealedBlobs = []struct{ table, column string }{
+	{"attachments", "data"},
+}
+
+// keyring tracks whether the database is encrypted and holds the data key
+// while it is unlocked
+type keyring struct {
+	mu        sync.RWMutex
+	encrypted bool
+	sealer    *sealer // nil while locked
+}
+
+// sealer encrypts and decrypts text with a data key. A nil sealer stands for
+// an unencrypted database and leaves text unchanged.
+type sealer struct {
+	key      []byte
+	aead     cipher.AEAD
+	indexKey []byte
+}
+
+// newSealer creates a sealer for a data key
+func newSealer(key []byte) (*sealer, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("pkb lookup key"))
+	return &sealer{key: key, aead: aead, indexKey: mac.Sum(nil)}, nil
+}
+
+// seal encrypts text for storage
+func (s *sealer) seal(text string) (string, error) {
+	if s == nil {
+		return text, nil
+	}
+	sealed, err := sealBytes(s.aead, []byte(text))
+	if err != nil {
+		return "", err
+	}
+	return encryptedPrefix + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// open decrypts stored text. Values without the encrypted prefix are
+// returned as they are.
+func (s *sealer) open(stored string) (string, error) {
+	encoded, ok := strings.CutPrefix(stored, encryptedPrefix)
+	if s == nil || !ok {
+		return stored, nil
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode encrypted text: %w", err)
+	}
+	plain, err := openBytes(s.aead, sealed)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt text: %w", err)
+	}
+	return string(plain), nil
+}
+
+// sealBlob encrypts binary data for storage
+func (s *sealer) sealBlob(data []byte) ([]byte, error) {
+	if s == nil {
+		return data, nil
+	}
+	sealed, err := sealBytes(s.aead, data)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(encryptedPrefix), sealed...), nil
+}
+
+// openBlob decrypts stored binary data. Data without the encrypted prefix is
+// returned as it is.
+func (s *sealer) openBlob(stored []byte) ([]byte, error) {
+	sealed, ok := bytes.CutPrefix(stored, []byte(encryptedPrefix))
+	if s == nil || !ok {
+		return stored, nil
+	}
+	plain, err := openBytes(s.aead, sealed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt data: %w", err)
+	}
+	return plain, nil
+}
+
+// openNull decrypts a nullable stored value
+func (s *sealer) openNull(stored sql.NullString) (string, error) {
+	return s.open(stored.String)
+}
+
+// lookupKey returns a keyed hash of text, ignoring case, that stands in for
+// the text in equality lookups on encrypted columns. It is NULL for an
+// unencrypted database.
+func (s *sealer) lookupKey(text string) interface{} {
+	if s == nil {
+		return nil
+	}
+	mac := hmac.New(sha256.New, s.indexKey)
+	mac.Write([]byte(strings.ToLower(text)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// textHash returns a hash identifying text exactly, keyed when the
+// database is encrypted so it reveals nothing about the text
+func (s *sealer) textHash(text string) string {
+	if s == nil {
+		sum := sha256.Sum256([]byte(text))
+		return hex.EncodeToString(sum[:])
+	}
+	mac := hmac.New(sha256.New, s.indexKey)
+	mac.Write([]byte("text\x00"))
+	mac.Write([]byte(text))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// matchSQL returns a condition matching column against text ignoring case,
+// comparing lookup keys in keyColumn when the database is encrypted
+func (s *sealer) matchSQL(column, keyColumn, text string) (string, interface{}) {
+	if s == nil {
+		return column + " = ? COLLATE NOCASE", text
+	}
+	return keyColumn + " = ?", s.lookupKey(text)
+}
+
+// Encrypted reports whether titles and bodies are encrypted
+func (db *DB) Encrypted() bool {
+	db.keys.mu.RLock()
+	defer db.keys.mu.RUnlock()
+	return db.keys.encrypted
+}
+
+// Locked reports whether the database is encrypted and not unlocked, so
+// titles and bodies can be neither read nor written
+func (db *DB) Locked() bool {
+	db.keys.mu.RLock()
+	defer db.keys.mu.RUnlock()
+	return db.keys.encrypted && db.keys.sealer == nil
+}
+
+// crypter returns the sealer for titles and bodies: nil for an unencrypted
+// database, ErrLocked while an encrypted one is locked
+func (db *DB) crypter() (*sealer, error) {
+	db.keys.mu.RLock()
+	defer db.keys.mu.RUnlock()
+	if db.keys.encrypted && db.keys.sealer == nil {
+		return nil, ErrLocked
+	}
+	return db.keys.sealer, nil
+}
+
+// sealing returns the sealer for a write transaction, like crypter, together
+// with a function to call once the transaction is over. Until then the key
+// stays in place: encrypting or re-keying waits, so nothing is written under
+// a key being replaced. Neither crypter nor sealing may be called in between.
+func (db *DB) sealing() (*sealer, func(), error) {
+	db.keys.mu.RLock()
+	if db.keys.encrypted && db.keys.sealer == nil {
+		db.keys.mu.RUnlock()
+		return nil, nil, ErrLocked
+	}
+	return db.keys.sealer, db.keys.mu.RUnlock, nil
+}
+
+// Decrypt returns the plain text of a title or body read directly from the
+// content table
+func (db *DB) Decrypt(stored string) (string, error) {
+	s, err := db.crypter()
+	if err != nil {
+		return "", err
+	}
+	return s.open(stored)
+}
+
+// loadEncryption reads whether the database is encrypted, leaving it locked
+func (db *DB) loadEncryption() error {
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM encryption").Scan(&count); err != nil {
+		return err
+	}
+	db.keys = &keyring{encrypted: count > 0}
+	return nil
+}
+
+// Unlock derives the key from the passphrase and unlocks the data key, so
+// titles and bodies can be read and written
+func (db *DB) Unlock(passphrase string) error {
+	var params kdfParams
+	var wrapped []byte
+	err := db.QueryRow("SELECT salt, kdf_time, kdf_memory, kdf_threads, wrapped_key FROM encryption WHERE id = 1").
+		Scan(&params.salt, &params.time, &params.memory, &params.threads, &wrapped)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotEncrypted
+	}
+	if err != nil {
+		return err
+	}
+
+	key, err := unwrapKey(params.derive(passphrase), wrapped)
+	if err != nil {
+		return err
+	}
+	s, err := newSealer(key)
+	if err != nil {
+		return err
+	}
+
+	db.keys.mu.Lock()
+	defer db.keys.mu.Unlock()
+	if err := sealClusterNames(db, s); err != nil {
+		return fmt.Errorf("failed to encrypt cluster names: %w", err)
+	}
+	db.keys.sealer = s
+	return nil
+}
+
+// sealClusterNames encrypts cluster names left in plain text by versions
+// that did not encrypt them
+func sealClusterNames(db *DB, s *sealer) error {
+	rows, err := db.Query("SELECT id, name FROM clusters WHERE name NOT LIKE ?", encryptedPrefix+"%")
+	if err != nil {
+		return err
+	}
+	names := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			rows.Close()
+			return err
+		}
+		names[id] = name
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, name := range names {
+		sealed, err := s.seal(name)
+		if err != nil {
+			return err
+		}
+		if _, err := db.Exec("UPDATE clusters SET name = ? WHERE id = ?", sealed, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Lock forgets the data key until the next Unlock
+func (db *DB) Lock() {
+	db.keys.mu.Lock()
+	defer db.keys.mu.Unlock()
+	db.keys.sealer = nil
+}
+
+// EnableEncryption encrypts every title, body, link text, cluster name and
+// attached file under a new data key protected by the passphrase. The database stays unlocked afterwards.
+func (db *DB) EnableEncryption(passphrase string) error {
+	if passphrase == "" {
+		return ErrEmptyPassphrase
+	}
+
+	// Hold the keyring so no plain text is written meanwhile
+	db.keys.mu.Lock()
+	defer db.keys.mu.Unlock()
+	if db.keys.encrypted {
+		return ErrAlreadyEncrypted
+	}
+
+	key, err := randomBytes(keySize)
+	if err != nil {
+		return err
+	}
+	s, err := newSealer(key)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := storeKey(tx, passphrase, key); err != nil {
+		return err
+	}
+	if err := reseal(tx, nil, s); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	db.keys.encrypted = true
+	db.keys.sealer = s
+	return db.scrub()
+}
+
+// Rekey protects the data key with a new passphrase. With rotate, it also
+// replaces the data key and re-encrypts everything under the new one.
+func (db *DB) Rekey(passphrase string, rotate bool) error {
+	if passphrase == "" {
+		return ErrEmptyPassphrase
+	}
+
+	db.keys.mu.Lock()
+	defer db.keys.mu.Unlock()
+	if !db.keys.encrypted {
+		return ErrNotEncrypted
+	}
+	if db.keys.sealer == nil {
+		return ErrLocked
+	}
+
+	s := db.keys.sealer
+	if rotate {
+		key, err := randomBytes(keySize)
+		if err != nil {
+			return err
+		}
+		if s, err = newSealer(key); err != nil {
+			return err
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := storeKey(tx, passphrase, s.key); err != nil {
+		return err
+	}
+	if rotate {
+		if err := reseal(tx, db.keys.sealer, s); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	db.keys.sealer = s
+	if rotate {
+		return db.scrub()
+	}
+	return nil
+}
+
+// scrub clears the copies of rows overwritten by resealing from the database
+// files: until then the old plain text, or the text encrypted with a
+// discarded key, lingers in the write-ahead log and in free pages. The log is
+// emptied, the database rebuilt without free pages by VACUUM, and the log,
+// which VACUUM writes through, emptied again.
+func (db *DB) scrub() error {
+	for _, statement := range []string{"PRAGMA wal_checkpoint(TRUNCATE)", "VACUUM", "PRAGMA wal_checkpoint(TRUNCATE)"} {
+		if _, err := db.Exec(statement); err != nil {
+			return fmt.Errorf("re-encrypted, but old copies may remain on disk: %s failed: %w", statement, err)
+		}
+	}
+	return nil
+}
+
+// storeKey saves the data key encrypted with a key freshly derived from the
+// passphrase
+func storeKey(tx *sql.Tx, passphrase string, key []byte) error {
+	params, err := newKDFParams()
+	if err != nil {
+		return err
+	}
+	wrapped, err := wrapKey(params.derive(passphrase), key)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO encryption (id, salt, kdf_time, kdf_memory, kdf_threads, wrapped_key)
+		VALUES (1, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			salt = excluded.salt, kdf_time = excluded.kdf_time, kdf_memory = excluded.kdf_memory,
+			kdf_threads = excluded.kdf_threads, wrapped_key = excluded.wrapped_key,
+			rekeyed_at = CURRENT_TIMESTAMP`,
+		params.salt, params.time, params.memory, params.threads, wrapped)
+	return err
+}
+
+// reseal re-encrypts every sealed column from one sealer to another and
+// recomputes the lookup keys. A nil from reads plain text.
+func reseal(tx *sql.Tx, from, to *sealer) error {
+	for _, t := range sealedColumns {
+		rows, err := tx.Query("SELECT rowid, " + strings.Join(t.columns, ", ") + " FROM " + t.table)
+		if err != nil {
+			return err
+		}
+
+		type row struct {
+			id     int64
+			values []sql.NullString
+		}
+		var all []row
+		for rows.Next() {
+			r := row{values: make([]sql.NullString, len(t.columns))}
+			dest := []interface{}{&r.id}
+			for i := range r.values {
+				dest = append(dest, &r.values[i])
+			}
+			if err := rows.Scan(dest...); err != nil {
+				rows.Close()
+				return err
+			}
+			all = append(all, r)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		assignments := make([]string, len(t.columns))
+		for i, column := range t.columns {
+			assignments[i] = column + " = ?"
+		}
+		if t.keyColumn != "" {
+			assignments = append(assignments, t.keyColumn+" = ?")
+		}
+		update := "UPDATE " + t.table + " SET " + strings.Join(assignments, ", ") + " WHERE rowid = ?"
+
+		for _, r := range all {
+			args := make([]interface{}, 0, len(r.values)+2)
+			var lookupKey interface{}
+			for i, value := range r.values {
+				if !value.Valid {
+					args = append(args, nil)
+					continue
+				}
+				plain, err := from.open(value.String)
+				if err != nil {
+					return err
+				}
+				if i == 0 {
+					lookupKey = to.lookupKey(plain)
+				}
+				sealed, err := to.seal(plain)
+				if err != nil {
+					return err
+				}
+				args = append(args, sealed)
+			}
+			if t.keyColumn != "" {
+				args = append(args, lookupKey)
+			}
+			if _, err := tx.Exec(update, append(args, r.id)...); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Files are re-encrypted one at a time rather than all held in memory
+	for _, b := range sealedBlobs {
+		var ids []int64
+		rows, err := tx.Query("SELECT rowid FROM " + b.table)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			var stored []byte
+			if err := tx.QueryRow("SELECT "+b.column+" FROM "+b.table+" WHERE rowid = ?", id).Scan(&stored); err != nil {
+				return err
+			}
+			plain, err := from.openBlob(stored)
+			if err != nil {
+				return err
+			}
+			sealed, err := to.sealBlob(plain)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec("UPDATE "+b.table+" SET "+b.column+" = ? WHERE rowid = ?", sealed, id); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Text hashes are keyed by the sealer, so the old ones mean nothing now
+	if _, err := tx.Exec("DELETE FROM embedding_cache"); err != nil {
+		return err
+	}
+	_, err := tx.Exec("UPDATE embeddings SET text_hash = NULL")
+	return err
+}
+
+// kdfParams are the Argon2id settings a key was derived with
+type kdfParams struct {
+	salt    []byte
+	time    uint32
+	memory  uint32
+	threads uint8
+}
+
+// newKDFParams returns the current settings with a fresh salt
+func newKDFParams() (kdfParams, error) {
+	salt, err := randomBytes(saltSize)
+	if err != nil {
+		return kdfParams{}, err
+	}
+	return kdfParams{salt: salt, time: kdfTime, memory: kdfMemory, threads: kdfThreads}, nil
+}
+
+// derive derives the key that protects the data key from a passphrase
+func (p kdfParams) derive(passphrase string) []byte {
+	return argon2.IDKey([]byte(passphrase), p.salt, p.time, p.memory, p.threads, keySize)
+}
+
+// wrapKey encrypts the data key with the passphrase key
+func wrapKey(passphraseKey, key []byte) ([]byte, error) {
+	aead, err := newAEAD(passphraseKey)
+	if err != nil {
+		return nil, err
+	}
+	return sealBytes(aead, key)
+}
+
+// unwrapKey decrypts the data key, failing with ErrWrongPassphrase if the
+// passphrase key does not match
+func unwrapKey(passphraseKey, wrapped []byte) ([]byte, error) {
+	aead, err := newAEAD(passphraseKey)
+	if err != nil {
+		return nil, err
+	}
+	key, err := openBytes(aead, wrapped)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return key, nil
+}
+
+// newAEAD creates an AES-GCM cipher for a 256-bit key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealBytes encrypts data under a random nonce, which is prepended
+func sealBytes(aead cipher.AEAD, data []byte) ([]byte, error) {
+	nonce, err := randomBytes(aead.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, data, nil), nil
+}
+
+// openBytes decrypts data produced by sealBytes
+func openBytes(aead cipher.AEAD, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, data := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, data, nil)
+}
+
+// randomBytes returns n cryptographically random bytes
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
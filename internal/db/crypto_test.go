@@ -0,0 +1,263 @@
+package db_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rgehrsitz/me/internal/db"
+	"github.com/rgehrsitz/me/internal/vector"
+)
+
+// marker is in every encrypted field of the fixture, so finding it in the
+// database files means plain text was left behind
+const marker = "plugh"
+
+// fixture is content in every kind of encrypted field
+type fixture struct {
+	userID int64
+	a, b   int64
+}
+
+func newFixture(t *testing.T, database *db.DB) fixture {
+	t.Helper()
+	userID, err := database.DefaultUserID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := fixture{userID: userID}
+	if f.b, err = database.CreateContent(userID, &db.Content{Type: "note", Title: "Beta", Body: "first " + marker}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.UpdateContent(userID, &db.Content{ID: f.b, Type: "note", Title: "Beta", Body: "second " + marker}); err != nil {
+		t.Fatal(err)
+	}
+	body := "see [[Beta]] and [[Missing " + marker + "]]"
+	if f.a, err = database.CreateContent(userID, &db.Content{Type: "note", Title: "Alpha", Body: body}); err != nil {
+		t.Fatal(err)
+	}
+	clusters := []db.Cluster{{Name: "Cluster " + marker, Centroid: vector.Encode([]float32{1, 0})}}
+	if err := database.ReplaceClusters(userID, clusters, [][]int64{{f.a, f.b}}); err != nil {
+		t.Fatal(err)
+	}
+	attachment := &db.Attachment{ContentID: f.a, Name: marker + ".txt", MediaType: "text/plain", Data: []byte("attached " + marker)}
+	if err := database.SetAttachment(userID, attachment); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// check fails the test unless every field of the fixture reads back as written
+func (f fixture) check(t *testing.T, database *db.DB) {
+	t.Helper()
+	content, err := database.GetContent(f.userID, f.a)
+	if err != nil {
+		t.Fatalf("GetContent failed: %v", err)
+	}
+	if content.Title != "Alpha" || content.Body != "see [[Beta]] and [[Missing "+marker+"]]" {
+		t.Errorf("content reads as %q, %q", content.Title, content.Body)
+	}
+
+	revisions, err := database.ListRevisions(f.userID, f.b)
+	if err != nil {
+		t.Fatalf("ListRevisions failed: %v", err)
+	}
+	if len(revisions) != 1 || revisions[0].Body != "first "+marker {
+		t.Errorf("revisions read as %+v", revisions)
+	}
+
+	links, err := database.ListOutlinks(f.userID, f.a)
+	if err != nil {
+		t.Fatalf("ListOutlinks failed: %v", err)
+	}
+	if len(links) != 2 || links[0].TargetTitle != "Beta" || links[1].Ref != "Missing "+marker || !links[1].Broken {
+		t.Errorf("links read as %+v", links)
+	}
+
+	clusters, err := database.ListClusters(f.userID, false)
+	if err != nil {
+		t.Fatalf("ListClusters failed: %v", err)
+	}
+	if len(clusters) != 1 || clusters[0].Name != "Cluster "+marker {
+		t.Errorf("clusters read as %+v", clusters)
+	}
+
+	attachment, err := database.GetAttachment(f.userID, f.a)
+	if err != nil {
+		t.Fatalf("GetAttachment failed: %v", err)
+	}
+	if attachment.Name != marker+".txt" || string(attachment.Data) != "attached "+marker {
+		t.Errorf("attachment reads as %q, %q", attachment.Name, attachment.Data)
+	}
+}
+
+// checkSealed fails the test if the marker is anywhere in the database files
+func checkSealed(t *testing.T, path string) {
+	t.Helper()
+	for _, name := range []string{path, path + "-wal"} {
+		data, err := os.ReadFile(name)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(data, []byte(marker)) {
+			t.Errorf("%s contains plain text", filepath.Base(name))
+		}
+	}
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pkb.db")
+	database, err := db.New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { database.Close() }()
+	f := newFixture(t, database)
+	f.check(t, database)
+
+	if err := database.EnableEncryption(""); !errors.Is(err, db.ErrEmptyPassphrase) {
+		t.Errorf("EnableEncryption with no passphrase = %v, want ErrEmptyPassphrase", err)
+	}
+	if err := database.EnableEncryption("first"); err != nil {
+		t.Fatalf("EnableEncryption failed: %v", err)
+	}
+	if err := database.EnableEncryption("first"); !errors.Is(err, db.ErrAlreadyEncrypted) {
+		t.Errorf("EnableEncryption again = %v, want ErrAlreadyEncrypted", err)
+	}
+	f.check(t, database)
+	checkSealed(t, path)
+
+	database.Lock()
+	if _, err := database.GetContent(f.userID, f.a); !errors.Is(err, db.ErrLocked) {
+		t.Errorf("GetContent while locked = %v, want ErrLocked", err)
+	}
+	if _, err := database.CreateContent(f.userID, &db.Content{Type: "note", Title: "Gamma"}); !errors.Is(err, db.ErrLocked) {
+		t.Errorf("CreateContent while locked = %v, want ErrLocked", err)
+	}
+	if _, err := database.GetAttachment(f.userID, f.a); !errors.Is(err, db.ErrLocked) {
+		t.Errorf("GetAttachment while locked = %v, want ErrLocked", err)
+	}
+	if err := database.Rekey("second", false); !errors.Is(err, db.ErrLocked) {
+		t.Errorf("Rekey while locked = %v, want ErrLocked", err)
+	}
+	if err := database.Unlock("wrong"); !errors.Is(err, db.ErrWrongPassphrase) {
+		t.Errorf("Unlock with a wrong passphrase = %v, want ErrWrongPassphrase", err)
+	}
+	if err := database.Unlock("first"); err != nil {
+		t.Fatalf("Unlock failed: %v", err)
+	}
+	f.check(t, database)
+
+	// A new passphrase replaces the old one, which no longer unlocks
+	if err := database.Rekey("second", false); err != nil {
+		t.Fatalf("Rekey failed: %v", err)
+	}
+	database.Close()
+	if database, err = db.New(path); err != nil {
+		t.Fatal(err)
+	}
+	if !database.Locked() {
+		t.Fatal("reopened database is not locked")
+	}
+	if err := database.Unlock("first"); !errors.Is(err, db.ErrWrongPassphrase) {
+		t.Errorf("Unlock with the old passphrase = %v, want ErrWrongPassphrase", err)
+	}
+	if err := database.Unlock("second"); err != nil {
+		t.Fatalf("Unlock with the new passphrase failed: %v", err)
+	}
+	f.check(t, database)
+
+	// Rotating re-encrypts what was stored under the old data key
+	var before, after string
+	if err := database.QueryRow("SELECT body FROM content WHERE id = ?", f.a).Scan(&before); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.Rekey("third", true); err != nil {
+		t.Fatalf("Rekey with rotate failed: %v", err)
+	}
+	if err := database.QueryRow("SELECT body FROM content WHERE id = ?", f.a).Scan(&after); err != nil {
+		t.Fatal(err)
+	}
+	if after == before {
+		t.Error("rotating the data key left the body as it was")
+	}
+	f.check(t, database)
+	checkSealed(t, path)
+
+	database.Close()
+	if database, err = db.New(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.Unlock("third"); err != nil {
+		t.Fatalf("Unlock after rotating failed: %v", err)
+	}
+	f.check(t, database)
+}
+
+func TestUnlockUnencrypted(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "pkb.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	if err := database.Unlock("any"); !errors.Is(err, db.ErrNotEncrypted) {
+		t.Errorf("Unlock = %v, want ErrNotEncrypted", err)
+	}
+	if err := database.Rekey("any", true); !errors.Is(err, db.ErrNotEncrypted) {
+		t.Errorf("Rekey = %v, want ErrNotEncrypted", err)
+	}
+}
+
+func TestRotateWhileWriting(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "pkb.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	userID, err := database.DefaultUserID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.EnableEncryption("first"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Items written while the key is replaced end up under one key or the
+	// other, and all of them decrypt afterwards
+	ids := make(chan int64, 100)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(ids)
+		for i := 0; i < cap(ids); i++ {
+			id, err := database.CreateContent(userID, &db.Content{Type: "note", Title: "written", Body: marker})
+			if err != nil {
+				errs <- err
+				return
+			}
+			ids <- id
+		}
+	}()
+	if err := database.Rekey("second", true); err != nil {
+		t.Fatalf("Rekey with rotate failed: %v", err)
+	}
+	for id := range ids {
+		content, err := database.GetContent(userID, id)
+		if err != nil {
+			t.Fatalf("GetContent of item %d failed: %v", id, err)
+		}
+		if content.Body != marker {
+			t.Errorf("item %d reads as %q", id, content.Body)
+		}
+	}
+	select {
+	case err := <-errs:
+		t.Fatalf("CreateContent failed: %v", err)
+	default:
+	}
+}
@@ -0,0 +1,69 @@
+package db
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrInvalidCursor is returned for cursors that cannot be decoded or were
+// made for another order
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// TimeLayout is how SQLite's CURRENT_TIMESTAMP stores times, and so the
+// form timestamps are compared in
+const TimeLayout = "2006-01-02 15:04:05"
+
+// Cursor marks the last item of a page, for the next page to continue after
+// it. Keyed on the item's sort value and ID rather than an offset, it stays
+// put while items are added or removed ahead of it. Clients only see it
+// encoded, as an opaque string.
+type Cursor struct {
+	// By names the order the cursor was made for
+	By string `json:"by"`
+	// Key is the item's sort value: a timestamp in TimeLayout, a title or a
+	// collection position. Hybrid search keeps how deep it ranked here.
+	Key string `json:"key,omitempty"`
+	// Score is the item's relevance, for orders by score
+	Score float64 `json:"score,omitempty"`
+	ID    int64   `json:"id"`
+}
+
+// Encode returns the cursor as an opaque, URL safe string
+func (c Cursor) Encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// ParseCursor decodes a cursor, which must have been made for the given
+// order
+func ParseCursor(encoded, by string) (*Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var c Cursor
+	if err := json.Unmarshal(data, &c); err != nil || c.ID == 0 {
+		return nil, ErrInvalidCursor
+	}
+	if c.By != by {
+		return nil, fmt.Errorf("%w: it was made for a different sort order", ErrInvalidCursor)
+	}
+	return &c, nil
+}
+
+// FormatTime formats a time as SQLite stores timestamps
+func FormatTime(t time.Time) string {
+	return t.UTC().Format(TimeLayout)
+}
+
+// storedTime turns a timestamp scanned from the database back into the form
+// it is stored in
+func storedTime(value string) string {
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return FormatTime(t)
+	}
+	return value
+}
@@ -7,7 +7,11 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 
+	"github.com/rgehrsitz/me/internal/code"
+	"github.com/rgehrsitz/me/internal/vector"
 	_ "modernc.org/sqlite"
 )
 
@@ -17,6 +21,9 @@ var schemaFS embed.FS
 // DB is the database connection
 type DB struct {
 	*sql.DB
+	keys *keyring
+	// quantization is how embeddings are quantized as they are stored
+	quantization vector.Kind
 }
 
 // New creates a new database connection
@@ -27,21 +34,13 @@ func New(dbPath string) (*DB, error) {
 		return nil, fmt.Errorf("failed to create database directory: %w", err)
 	}
 
-	// Open SQLite database
-	db, err := sql.Open("sqlite", dbPath)
+	// Open SQLite database. Pragmas given in the name are set on every
+	// connection the pool opens, not just the first.
+	db, err := sql.Open("sqlite", dbPath+"?_pragma=foreign_keys(1)&_pragma=journal_mode(WAL)")
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
 
-	// Set pragmas for better performance
-	if _, err := db.Exec("PRAGMA foreign_keys = ON"); err != nil {
-		return nil, fmt.Errorf("failed to set foreign_keys pragma: %w", err)
-	}
-
-	if _, err := db.Exec("PRAGMA journal_mode = WAL"); err != nil {
-		return nil, fmt.Errorf("failed to set journal_mode pragma: %w", err)
-	}
-
 	// Initialize schema
 	schemaSQL, err := schemaFS.ReadFile("schema.sql")
 	if err != nil {
@@ -52,75 +51,217 @@ func New(dbPath string) (*DB, error) {
 		return nil, fmt.Errorf("failed to initialize schema: %w", err)
 	}
 
+	if err := migrate(db); err != nil {
+		return nil, fmt.Errorf("failed to migrate schema: %w", err)
+	}
+
+	database := &DB{DB: db}
+	if err := database.loadEncryption(); err != nil {
+		return nil, fmt.Errorf("failed to read encryption settings: %w", err)
+	}
+
 	log.Println("Database initialized successfully")
-	return &DB{db}, nil
+	return database, nil
 }
 
-// Close closes the database connection
+// Close checkpoints the write-ahead log into the main database file, so no
+// -wal file is left behind, and closes the database connection
 func (db *DB) Close() error {
+	if _, err := db.Exec("PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+		log.Printf("Failed to checkpoint WAL: %v", err)
+	}
 	return db.DB.Close()
 }
 
-// GetContent retrieves a content item by ID
-func (db *DB) GetContent(id int64) (*Content, error) {
-	row := db.QueryRow(`
-		SELECT id, type, title, body, source_url, file_path, created_at, updated_at 
-		FROM content 
-		WHERE id = ?`, id)
+// GetContent retrieves a content item by ID if the user may read it
+func (db *DB) GetContent(userID, id int64) (*Content, error) {
+	access, args := ContentAccessSQL("c.id", userID, AccessRead)
+	content, err := db.scanContent(db.QueryRow(`
+		SELECT `+ContentColumns+`
+		FROM content c
+		WHERE c.id = ? AND `+access, append([]interface{}{id}, args...)...))
+	if err != nil {
+		return nil, err
+	}
+
+	tags, err := db.ContentTags([]int64{id})
+	if err != nil {
+		return nil, err
+	}
+	content.Tags = tags[id]
+	return &content, nil
+}
+
+// ContentColumns are the columns of content c that QueryContent reads
+const ContentColumns = "c.id, c.owner_id, c.type, c.title, c.body, c.source_url, c.file_path, COALESCE(c.language, ''), c.created_at, c.updated_at"
+
+// rowScanner is a *sql.Row or *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
 
+// scanContent scans a row of ContentColumns into a content item and
+// decrypts it
+func (db *DB) scanContent(row rowScanner) (Content, error) {
 	var content Content
 	err := row.Scan(
 		&content.ID,
+		&content.OwnerID,
 		&content.Type,
 		&content.Title,
 		&content.Body,
 		&content.SourceURL,
 		&content.FilePath,
+		&content.Language,
 		&content.CreatedAt,
 		&content.UpdatedAt,
 	)
 	if err != nil {
-		return nil, err
+		return content, err
 	}
+	return content, db.openContent(&content)
+}
 
-	// Get tags for this content
-	rows, err := db.Query(`
-		SELECT t.name 
-		FROM tags t 
-		JOIN content_tags ct ON t.id = ct.tag_id 
-		WHERE ct.content_id = ?`, id)
+// QueryContent runs a query selecting ContentColumns and returns the content
+// items it finds, decrypted but without their tags. The rows are read to the
+// end and closed before it returns, so the caller is free to run further
+// queries.
+func (db *DB) QueryContent(query string, args ...interface{}) ([]Content, error) {
+	rows, err := db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	content.Tags = []string{}
+	contents := []Content{}
 	for rows.Next() {
-		var tag string
-		if err := rows.Scan(&tag); err != nil {
+		content, err := db.scanContent(rows)
+		if err != nil {
 			return nil, err
 		}
-		content.Tags = append(content.Tags, tag)
+		contents = append(contents, content)
 	}
+	return contents, rows.Err()
+}
 
-	return &content, nil
+// maxQueryIDs bounds how many IDs are bound in one IN list
+const maxQueryIDs = 500
+
+// ContentTags retrieves the tags of content items, by item. Every item
+// asked for gets a list, empty if it has no tags.
+func (db *DB) ContentTags(ids []int64) (map[int64][]string, error) {
+	tags := make(map[int64][]string, len(ids))
+	for _, id := range ids {
+		tags[id] = []string{}
+	}
+
+	for start := 0; start < len(ids); start += maxQueryIDs {
+		chunk := ids[start:min(start+maxQueryIDs, len(ids))]
+		args := make([]interface{}, len(chunk))
+		for i, id := range chunk {
+			args[i] = id
+		}
+
+		rows, err := db.Query(`
+			SELECT ct.content_id, t.name
+			FROM content_tags ct
+			JOIN tags t ON t.id = ct.tag_id
+			WHERE ct.content_id IN (`+placeholders(len(chunk))+`)
+			ORDER BY ct.content_id, ct.tag_id`, args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var id int64
+			var tag string
+			if err := rows.Scan(&id, &tag); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			tags[id] = append(tags[id], tag)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return tags, nil
+}
+
+// attachTags loads the tags of content items into them
+func (db *DB) attachTags(contents []Content) error {
+	ids := make([]int64, len(contents))
+	for i, content := range contents {
+		ids[i] = content.ID
+	}
+	tags, err := db.ContentTags(ids)
+	if err != nil {
+		return err
+	}
+	for i := range contents {
+		contents[i].Tags = tags[contents[i].ID]
+	}
+	return nil
+}
+
+// ContentByIDs retrieves content items, with their tags, by ID. Access is
+// not checked, so the IDs must come from a query that did. Items that no
+// longer exist are left out.
+func (db *DB) ContentByIDs(ids []int64) (map[int64]Content, error) {
+	found := make(map[int64]Content, len(ids))
+	for start := 0; start < len(ids); start += maxQueryIDs {
+		chunk := ids[start:min(start+maxQueryIDs, len(ids))]
+		args := make([]interface{}, len(chunk))
+		for i, id := range chunk {
+			args[i] = id
+		}
+
+		contents, err := db.QueryContent(`
+			SELECT `+ContentColumns+`
+			FROM content c
+			WHERE c.id IN (`+placeholders(len(chunk))+`)`, args...)
+		if err != nil {
+			return nil, err
+		}
+		if err := db.attachTags(contents); err != nil {
+			return nil, err
+		}
+		for _, content := range contents {
+			found[content.ID] = content
+		}
+	}
+	return found, nil
 }
 
 // Content represents a piece of content in the PKB
 type Content struct {
 	ID        int64  `json:"id"`
+	OwnerID   int64  `json:"owner_id"`
 	Type      string `json:"type"`
 	Title     string `json:"title"`
 	Body      string `json:"body"`
 	SourceURL string `json:"source_url,omitempty"`
 	FilePath  string `json:"file_path,omitempty"`
-	CreatedAt string `json:"created_at"`
-	UpdatedAt string `json:"updated_at"`
+	// Language is the language of a snippet's code
+	Language  string   `json:"language,omitempty"`
+	CreatedAt string   `json:"created_at"`
+	UpdatedAt string   `json:"updated_at"`
 	Tags      []string `json:"tags,omitempty"`
 }
 
-// CreateContent creates a new content item
-func (db *DB) CreateContent(content *Content) (int64, error) {
+// CreateContent creates a new content item owned by the user
+func (db *DB) CreateContent(userID int64, content *Content) (int64, error) {
+	sl, done, err := db.sealing()
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+	title, body, err := sealContent(sl, content)
+	if err != nil {
+		return 0, err
+	}
+	content.Language = snippetLanguage(content)
+
 	tx, err := db.Begin()
 	if err != nil {
 		return 0, err
@@ -128,9 +269,9 @@ func (db *DB) CreateContent(content *Content) (int64, error) {
 	defer tx.Rollback()
 
 	res, err := tx.Exec(`
-		INSERT INTO content (type, title, body, source_url, file_path) 
-		VALUES (?, ?, ?, ?, ?)`,
-		content.Type, content.Title, content.Body, content.SourceURL, content.FilePath)
+		INSERT INTO content (owner_id, type, title, body, source_url, file_path, language, title_key) 
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		userID, content.Type, title, body, content.SourceURL, content.FilePath, content.Language, sl.lookupKey(content.Title))
 	if err != nil {
 		return 0, err
 	}
@@ -140,28 +281,16 @@ func (db *DB) CreateContent(content *Content) (int64, error) {
 		return 0, err
 	}
 
-	// Add tags if any
-	if len(content.Tags) > 0 {
-		for _, tag := range content.Tags {
-			// Insert tag if it doesn't exist
-			_, err := tx.Exec("INSERT OR IGNORE INTO tags (name) VALUES (?)", tag)
-			if err != nil {
-				return 0, err
-			}
-
-			// Get tag ID
-			var tagID int64
-			row := tx.QueryRow("SELECT id FROM tags WHERE name = ?", tag)
-			if err := row.Scan(&tagID); err != nil {
-				return 0, err
-			}
+	if err := addContentTags(tx, userID, id, content.Tags); err != nil {
+		return 0, err
+	}
 
-			// Link tag to content
-			_, err = tx.Exec("INSERT INTO content_tags (content_id, tag_id) VALUES (?, ?)", id, tagID)
-			if err != nil {
-				return 0, err
-			}
-		}
+	// Record [[links]] and resolve links that were waiting for this title
+	if err := syncLinks(tx, sl, userID, id, content.Body); err != nil {
+		return 0, err
+	}
+	if err := resolveBrokenLinks(tx, sl, userID, id, content.Title); err != nil {
+		return 0, err
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -171,128 +300,299 @@ func (db *DB) CreateContent(content *Content) (int64, error) {
 	return id, nil
 }
 
-// ListContent retrieves a list of content items with optional filtering
-func (db *DB) ListContent(contentType string, limit, offset int) ([]Content, error) {
-	query := `
-		SELECT id, type, title, body, source_url, file_path, created_at, updated_at 
-		FROM content`
-	args := []interface{}{}
-
-	if contentType != "" {
-		query += " WHERE type = ?"
-		args = append(args, contentType)
+// snippetLanguage returns the language to store for a content item: for a
+// snippet the language it was given, normalized, or else the one detected in
+// its code, and nothing for other types
+func snippetLanguage(content *Content) string {
+	if content.Type != "snippet" {
+		return ""
+	}
+	if content.Language != "" {
+		return code.Normalize(content.Language)
 	}
+	return code.Detect(content.Body)
+}
 
-	query += " ORDER BY created_at DESC LIMIT ? OFFSET ?"
-	args = append(args, limit, offset)
+// sealContent returns the title and body of a content item as stored
+func sealContent(sl *sealer, content *Content) (string, string, error) {
+	title, err := sl.seal(content.Title)
+	if err != nil {
+		return "", "", err
+	}
+	body, err := sl.seal(content.Body)
+	if err != nil {
+		return "", "", err
+	}
+	return title, body, nil
+}
 
-	rows, err := db.Query(query, args...)
+// openContent decrypts the title and body of a content item read from the
+// database
+func (db *DB) openContent(content *Content) error {
+	sl, err := db.crypter()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer rows.Close()
+	if content.Title, err = sl.open(content.Title); err != nil {
+		return err
+	}
+	content.Body, err = sl.open(content.Body)
+	return err
+}
 
-	contents := []Content{}
-	for rows.Next() {
-		var content Content
-		err := rows.Scan(
-			&content.ID,
-			&content.Type,
-			&content.Title,
-			&content.Body,
-			&content.SourceURL,
-			&content.FilePath,
-			&content.CreatedAt,
-			&content.UpdatedAt,
-		)
+// addContentTags links tags from the owner's namespace to a content item,
+// creating any that do not exist yet
+func addContentTags(tx *sql.Tx, ownerID, contentID int64, tags []string) error {
+	for _, tag := range tags {
+		tag = NormalizeTagName(tag)
+		if tag == "" {
+			continue
+		}
+
+		// Insert tag if it doesn't exist
+		_, err := tx.Exec("INSERT OR IGNORE INTO tags (owner_id, name) VALUES (?, ?)", ownerID, tag)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		// Get tags for this content
-		tagRows, err := db.Query(`
-			SELECT t.name 
-			FROM tags t 
-			JOIN content_tags ct ON t.id = ct.tag_id 
-			WHERE ct.content_id = ?`, content.ID)
+		// Get tag ID
+		var tagID int64
+		row := tx.QueryRow("SELECT id FROM tags WHERE owner_id = ? AND name = ?", ownerID, tag)
+		if err := row.Scan(&tagID); err != nil {
+			return err
+		}
+
+		// Link tag to content
+		_, err = tx.Exec("INSERT OR IGNORE INTO content_tags (content_id, tag_id) VALUES (?, ?)", contentID, tagID)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		defer tagRows.Close()
+	}
+	return nil
+}
 
-		content.Tags = []string{}
-		for tagRows.Next() {
-			var tag string
-			if err := tagRows.Scan(&tag); err != nil {
-				return nil, err
+// ContentFilter narrows the content returned by ListContent
+type ContentFilter struct {
+	Type         string
+	CollectionID int64
+	Recursive    bool // include items filed in sub-collections
+	Limit        int
+	Offset       int
+	// Cursor continues the listing after the page it was returned with, in
+	// place of Offset
+	Cursor string
+}
+
+// ContentPage is a page of listed content
+type ContentPage struct {
+	Items []Content `json:"items"`
+	// Total is how many items there are on all pages
+	Total int `json:"total"`
+	// NextCursor continues the listing after this page; it is empty on the
+	// last page
+	NextCursor string `json:"next_cursor,omitempty"`
+	// Next is the URL of the next page, set by the API
+	Next string `json:"next,omitempty"`
+}
+
+// positionSQL is the position of content in the collection given as its
+// argument
+const positionSQL = `(
+	SELECT position FROM collection_items
+	WHERE collection_id = ? AND content_id = c.id)`
+
+// ListContent retrieves a page of the content items the user may read, with
+// optional filtering, newest first. A single collection keeps its own
+// ordering.
+func (db *DB) ListContent(userID int64, filter ContentFilter) (*ContentPage, error) {
+	access, args := ContentAccessSQL("c.id", userID, AccessRead)
+	conditions := []string{access}
+
+	if filter.Type != "" {
+		conditions = append(conditions, "c.type = ?")
+		args = append(args, filter.Type)
+	}
+
+	if filter.CollectionID != 0 {
+		conditions = append(conditions, InCollectionSQL("c.id", filter.Recursive))
+		args = append(args, filter.CollectionID)
+	}
+
+	page := &ContentPage{}
+	err := db.QueryRow("SELECT COUNT(*) FROM content c WHERE "+strings.Join(conditions, " AND "), args...).Scan(&page.Total)
+	if err != nil {
+		return nil, err
+	}
+
+	byPosition := filter.CollectionID != 0 && !filter.Recursive
+	by := "created"
+	if byPosition {
+		by = "position"
+	}
+
+	// Continue after the cursor's item: the next position, or the next
+	// oldest
+	if filter.Cursor != "" {
+		after, err := ParseCursor(filter.Cursor, by)
+		if err != nil {
+			return nil, err
+		}
+		if byPosition {
+			position, err := strconv.Atoi(after.Key)
+			if err != nil {
+				return nil, ErrInvalidCursor
 			}
-			content.Tags = append(content.Tags, tag)
+			conditions = append(conditions, "("+positionSQL+" > ? OR ("+positionSQL+" = ? AND c.id > ?))")
+			args = append(args, filter.CollectionID, position, filter.CollectionID, position, after.ID)
+		} else {
+			conditions = append(conditions, "(c.created_at < ? OR (c.created_at = ? AND c.id < ?))")
+			args = append(args, after.Key, after.Key, after.ID)
 		}
+		filter.Offset = 0
+	}
 
-		contents = append(contents, content)
+	query := `
+		SELECT ` + ContentColumns + `
+		FROM content c
+		WHERE ` + strings.Join(conditions, " AND ")
+	if byPosition {
+		query += " ORDER BY " + positionSQL + ", c.id"
+		args = append(args, filter.CollectionID)
+	} else {
+		query += " ORDER BY c.created_at DESC, c.id DESC"
 	}
 
-	return contents, nil
+	// One more item than asked for tells whether there is a next page
+	query += " LIMIT ? OFFSET ?"
+	args = append(args, filter.Limit+1, filter.Offset)
+
+	contents, err := db.QueryContent(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(contents) > filter.Limit {
+		contents = contents[:filter.Limit]
+		last := contents[len(contents)-1]
+		next := Cursor{By: by, Key: storedTime(last.CreatedAt), ID: last.ID}
+		if byPosition {
+			var position int
+			err := db.QueryRow("SELECT position FROM collection_items WHERE collection_id = ? AND content_id = ?",
+				filter.CollectionID, last.ID).Scan(&position)
+			if err != nil {
+				return nil, err
+			}
+			next.Key = strconv.Itoa(position)
+		}
+		page.NextCursor = next.Encode()
+	}
+	if err := db.attachTags(contents); err != nil {
+		return nil, err
+	}
+	page.Items = contents
+	return page, nil
 }
 
-// UpdateContent updates an existing content item
-func (db *DB) UpdateContent(content *Content) error {
+// UpdateContent updates an existing content item the user may write to. Its
+// tags are taken from the owner's namespace. When the item is renamed, the
+// [[links]] to it in other items are rewritten, and those items are returned
+// to be embedded again.
+func (db *DB) UpdateContent(userID int64, content *Content) ([]EmbedTarget, error) {
+	sl, done, err := db.sealing()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	title, body, err := sealContent(sl, content)
+	if err != nil {
+		return nil, err
+	}
+	content.Language = snippetLanguage(content)
+
 	tx, err := db.Begin()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer tx.Rollback()
 
+	if err := contentAccess(tx, userID, content.ID, AccessWrite); err != nil {
+		return nil, err
+	}
+
+	var ownerID int64
+	var storedTitle sql.NullString
+	err = tx.QueryRow("SELECT owner_id, title FROM content WHERE id = ?", content.ID).Scan(&ownerID, &storedTitle)
+	if err != nil {
+		return nil, err
+	}
+	oldTitle, err := sl.openNull(storedTitle)
+	if err != nil {
+		return nil, err
+	}
+
+	// Snapshot the current version before overwriting it
 	_, err = tx.Exec(`
-		UPDATE content 
-		SET type = ?, title = ?, body = ?, source_url = ?, file_path = ?, updated_at = CURRENT_TIMESTAMP 
+		INSERT INTO content_revisions (content_id, type, title, body, source_url, file_path)
+		SELECT id, type, title, body, source_url, file_path FROM content WHERE id = ?`, content.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE content
+		SET type = ?, title = ?, body = ?, source_url = ?, file_path = ?, language = ?, title_key = ?, updated_at = CURRENT_TIMESTAMP 
 		WHERE id = ?`,
-		content.Type, content.Title, content.Body, content.SourceURL, content.FilePath, content.ID)
+		content.Type, title, body, content.SourceURL, content.FilePath, content.Language, sl.lookupKey(content.Title), content.ID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Delete existing tag links
 	_, err = tx.Exec("DELETE FROM content_tags WHERE content_id = ?", content.ID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// Add tags if any
-	if len(content.Tags) > 0 {
-		for _, tag := range content.Tags {
-			// Insert tag if it doesn't exist
-			_, err := tx.Exec("INSERT OR IGNORE INTO tags (name) VALUES (?)", tag)
-			if err != nil {
-				return err
-			}
-
-			// Get tag ID
-			var tagID int64
-			row := tx.QueryRow("SELECT id FROM tags WHERE name = ?", tag)
-			if err := row.Scan(&tagID); err != nil {
-				return err
-			}
+	if err := addContentTags(tx, ownerID, content.ID, content.Tags); err != nil {
+		return nil, err
+	}
 
-			// Link tag to content
-			_, err = tx.Exec("INSERT INTO content_tags (content_id, tag_id) VALUES (?, ?)", content.ID, tagID)
-			if err != nil {
-				return err
-			}
+	// Keep [[links]] in sync, following renames of this item
+	if err := syncLinks(tx, sl, ownerID, content.ID, content.Body); err != nil {
+		return nil, err
+	}
+	var rewritten []EmbedTarget
+	if !strings.EqualFold(oldTitle, content.Title) {
+		if rewritten, err = rewriteLinks(tx, sl, content.ID, oldTitle, content.Title); err != nil {
+			return nil, err
+		}
+		if err := resolveBrokenLinks(tx, sl, ownerID, content.ID, content.Title); err != nil {
+			return nil, err
 		}
 	}
 
-	return tx.Commit()
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return rewritten, nil
 }
 
-// DeleteContent deletes a content item by ID
-func (db *DB) DeleteContent(id int64) error {
+// DeleteContent deletes a content item owned by the user
+func (db *DB) DeleteContent(userID, id int64) error {
+	if err := contentAccess(db, userID, id, AccessOwner); err != nil {
+		return err
+	}
 	_, err := db.Exec("DELETE FROM content WHERE id = ?", id)
 	return err
 }
 
-// StoreEmbedding stores an embedding for a content item
-func (db *DB) StoreEmbedding(contentID int64, embedding []byte, model string, dimensions int) (int64, error) {
+// StoreEmbedding stores an embedding for a content item, along with a
+// quantized copy if quantization is enabled and the hash of the text
+// embedded
+func (db *DB) StoreEmbedding(contentID int64, embedding []float32, model, textHash string) (int64, error) {
+	encoded := vector.Encode(embedding)
+	quantized := db.quantize(embedding)
+
 	// Check if embedding already exists for this content
 	var embeddingID int64
 	row := db.QueryRow("SELECT id FROM embeddings WHERE content_id = ? AND model = ?", contentID, model)
@@ -301,20 +601,82 @@ func (db *DB) StoreEmbedding(contentID int64, embedding []byte, model string, di
 		// Update existing embedding
 		_, err = db.Exec(`
 			UPDATE embeddings 
-			SET embedding = ?, dimensions = ? 
+			SET embedding = ?, dimensions = ?, quantized = ?, text_hash = ? 
 			WHERE id = ?`,
-			embedding, dimensions, embeddingID)
+			encoded, len(embedding), quantized, textHash, embeddingID)
 		return embeddingID, err
 	}
 
 	// Insert new embedding
 	res, err := db.Exec(`
-		INSERT INTO embeddings (content_id, embedding, model, dimensions) 
-		VALUES (?, ?, ?, ?)`,
-		contentID, embedding, model, dimensions)
+		INSERT INTO embeddings (content_id, embedding, model, dimensions, quantized, text_hash) 
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		contentID, encoded, model, len(embedding), quantized, textHash)
 	if err != nil {
 		return 0, err
 	}
 
 	return res.LastInsertId()
 }
+
+// quantize returns the quantized copy of an embedding to store, or nil when
+// quantization is off
+func (db *DB) quantize(embedding []float32) []byte {
+	if db.quantization == vector.Float32 {
+		return nil
+	}
+	return vector.Quantize(embedding, db.quantization)
+}
+
+// SetEmbeddingQuantization sets how embeddings are quantized for semantic
+// search and brings the stored quantized copies in line with it. It returns
+// the number of embeddings updated.
+func (db *DB) SetEmbeddingQuantization(kind vector.Kind) (int, error) {
+	db.quantization = kind
+	if kind == vector.Float32 {
+		res, err := db.Exec("UPDATE embeddings SET quantized = NULL WHERE quantized IS NOT NULL")
+		if err != nil {
+			return 0, err
+		}
+		n, err := res.RowsAffected()
+		return int(n), err
+	}
+
+	rows, err := db.Query(`
+		SELECT id, embedding FROM embeddings
+		WHERE quantized IS NULL OR hex(substr(quantized, 3, 1)) != ?`, fmt.Sprintf("%02X", byte(kind)))
+	if err != nil {
+		return 0, err
+	}
+	quantized := make(map[int64][]byte)
+	for rows.Next() {
+		var id int64
+		var data []byte
+		if err := rows.Scan(&id, &data); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		embedding, err := vector.Decode(data)
+		if err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("embedding %d: %w", id, err)
+		}
+		quantized[id] = vector.Quantize(embedding, kind)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	for id, data := range quantized {
+		if _, err := tx.Exec("UPDATE embeddings SET quantized = ? WHERE id = ?", data, id); err != nil {
+			return 0, err
+		}
+	}
+	return len(quantized), tx.Commit()
+}
@@ -0,0 +1,46 @@
+package db_test
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/rgehrsitz/me/internal/db"
+)
+
+func TestConnectionPragmas(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "pkb.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	// Hold several connections at once, so the pool has to open new ones
+	ctx := context.Background()
+	var conns []*sql.Conn
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		conn, err := database.Conn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+
+		var foreignKeys int
+		var journalMode string
+		if err := conn.QueryRowContext(ctx, "PRAGMA foreign_keys").Scan(&foreignKeys); err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.QueryRowContext(ctx, "PRAGMA journal_mode").Scan(&journalMode); err != nil {
+			t.Fatal(err)
+		}
+		if foreignKeys != 1 || journalMode != "wal" {
+			t.Errorf("connection %d has foreign_keys %d and journal_mode %s, want 1 and wal", i, foreignKeys, journalMode)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+// Package dbtest builds knowledge bases of generated content for tests and
+// benchmarks
+package dbtest
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/rgehrsitz/me/internal/db"
+)
+
+const (
+	// EmbeddingModel is the model generated embeddings are stored for
+	EmbeddingModel = "text-embedding-ada-002"
+	// Dimensions is the size of generated embeddings
+	Dimensions = 1536
+	// Word is mentioned by a tenth of the generated items
+	Word = "alpha"
+)
+
+// words make up the generated titles and bodies; each item mentions one of
+// the first ten, so a search for one of them matches about a tenth
+var words = strings.Fields(`alpha bravo charlie delta echo foxtrot golf hotel india juliet
+	channel goroutine select mutex context deadline buffer slice map interface
+	closure pointer struct method embedding vector cosine index query cursor`)
+
+// KB is a knowledge base of generated content
+type KB struct {
+	DB     *db.DB
+	UserID int64
+	IDs    []int64
+
+	dir string
+}
+
+var (
+	mu     sync.Mutex
+	seeded = make(map[int]*KB)
+)
+
+// Seeded returns a knowledge base of n generated items, each with three tags
+// and a random embedding. Seeding 10,000 items takes a while, so knowledge
+// bases are shared by the tests and benchmarks of a package, which must call
+// Cleanup when they are done, as from TestMain. Tests must not change them.
+func Seeded(tb testing.TB, n int) *KB {
+	tb.Helper()
+	mu.Lock()
+	defer mu.Unlock()
+
+	if kb, ok := seeded[n]; ok {
+		return kb
+	}
+	kb, err := seed(n)
+	if err != nil {
+		tb.Fatalf("Failed to seed %d items: %v", n, err)
+	}
+	seeded[n] = kb
+	return kb
+}
+
+// Cleanup closes and removes the knowledge bases Seeded made
+func Cleanup() {
+	mu.Lock()
+	defer mu.Unlock()
+
+	for n, kb := range seeded {
+		kb.DB.Close()
+		os.RemoveAll(kb.dir)
+		delete(seeded, n)
+	}
+}
+
+// seed fills a new knowledge base in a temporary directory with n items
+func seed(n int) (*KB, error) {
+	dir, err := os.MkdirTemp("", "pkb-dbtest")
+	if err != nil {
+		return nil, err
+	}
+	kb := &KB{dir: dir}
+	if kb.DB, err = db.New(filepath.Join(dir, "pkb.db")); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	fail := func(err error) (*KB, error) {
+		kb.DB.Close()
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	if kb.UserID, err = kb.DB.DefaultUserID(); err != nil {
+		return fail(err)
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < n; i++ {
+		body := make([]string, 60)
+		body[0] = words[i%10]
+		for j := 1; j < len(body); j++ {
+			body[j] = words[10+rng.Intn(len(words)-10)]
+		}
+		content := &db.Content{
+			Type:  "note",
+			Title: fmt.Sprintf("Note %d about %s", i, body[1]),
+			Body:  strings.Join(body, " "),
+			Tags:  []string{fmt.Sprintf("tag%d", i%50), fmt.Sprintf("tag%d", rng.Intn(50)), "bench"},
+		}
+		id, err := kb.DB.CreateContent(kb.UserID, content)
+		if err != nil {
+			return fail(err)
+		}
+		if _, err := kb.DB.StoreEmbedding(id, RandomVector(rng, Dimensions), EmbeddingModel, ""); err != nil {
+			return fail(err)
+		}
+		kb.IDs = append(kb.IDs, id)
+	}
+	return kb, nil
+}
+
+// RandomVector returns a random vector with values around zero
+func RandomVector(rng *rand.Rand, dims int) []float32 {
+	v := make([]float32, dims)
+	for i := range v {
+		v[i] = float32(rng.NormFloat64())
+	}
+	return v
+}
@@ -0,0 +1,309 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rgehrsitz/me/internal/vector"
+)
+
+// EmbeddingModel summarizes the stored embeddings of one model
+type EmbeddingModel struct {
+	Model      string `json:"model"`
+	Count      int    `json:"count"`
+	Dimensions int    `json:"dimensions"`
+}
+
+// EmbedTarget is a content item whose body is to be embedded
+type EmbedTarget struct {
+	ID   int64
+	Body string
+}
+
+// ListEmbeddingModels retrieves the models embeddings are stored for, with
+// how many each has
+func (db *DB) ListEmbeddingModels() ([]EmbeddingModel, error) {
+	rows, err := db.Query(`
+		SELECT model, COUNT(*), MAX(dimensions)
+		FROM embeddings
+		GROUP BY model
+		ORDER BY model`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	models := []EmbeddingModel{}
+	for rows.Next() {
+		var model EmbeddingModel
+		if err := rows.Scan(&model.Model, &model.Count, &model.Dimensions); err != nil {
+			return nil, err
+		}
+		models = append(models, model)
+	}
+	return models, rows.Err()
+}
+
+// DeleteEmbeddings deletes every embedding of a model and returns how many
+// there were
+func (db *DB) DeleteEmbeddings(model string) (int64, error) {
+	res, err := db.Exec("DELETE FROM embeddings WHERE model = ?", model)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// missingEmbeddingSQL restricts content to items with a body and, unless
+// every item is wanted, no embedding from the model
+const missingEmbeddingSQL = `
+	body IS NOT NULL AND body != ''
+	AND (? OR NOT EXISTS (SELECT 1 FROM embeddings e WHERE e.content_id = content.id AND e.model = ?))`
+
+// CountContentToEmbed counts the content items ListContentToEmbed goes
+// through
+func (db *DB) CountContentToEmbed(model string, all bool) (int, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM content WHERE "+missingEmbeddingSQL, all, model).Scan(&count)
+	return count, err
+}
+
+// ListContentToEmbed retrieves, in ID order, up to limit content items after
+// afterID that have no embedding from the model, or every item with a body
+// if all is set, and the ID to continue after. Bodies are decrypted; items
+// whose body is empty are left out.
+func (db *DB) ListContentToEmbed(model string, all bool, afterID int64, limit int) ([]EmbedTarget, int64, error) {
+	sl, err := db.crypter()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := db.Query(`
+		SELECT id, body FROM content
+		WHERE id > ? AND `+missingEmbeddingSQL+`
+		ORDER BY id
+		LIMIT ?`, afterID, all, model, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	targets := []EmbedTarget{}
+	lastID := afterID
+	for rows.Next() {
+		var target EmbedTarget
+		if err := rows.Scan(&target.ID, &target.Body); err != nil {
+			return nil, 0, err
+		}
+		lastID = target.ID
+		if target.Body, err = sl.open(target.Body); err != nil {
+			return nil, 0, err
+		}
+		if target.Body != "" {
+			targets = append(targets, target)
+		}
+	}
+	return targets, lastID, rows.Err()
+}
+
+// TextHash returns the hash embeddings of text are cached and compared
+// under. It is keyed when the database is encrypted.
+func (db *DB) TextHash(text string) (string, error) {
+	sl, err := db.crypter()
+	if err != nil {
+		return "", err
+	}
+	return sl.textHash(text), nil
+}
+
+// EmbeddingHashes retrieves the text hashes of the given content items'
+// embeddings from a model, for the items that have one
+func (db *DB) EmbeddingHashes(model string, ids []int64) (map[int64]string, error) {
+	hashes := make(map[int64]string)
+	if len(ids) == 0 {
+		return hashes, nil
+	}
+
+	args := []interface{}{model}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	rows, err := db.Query(`
+		SELECT content_id, text_hash FROM embeddings
+		WHERE model = ? AND text_hash IS NOT NULL
+			AND content_id IN (`+placeholders(len(ids))+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var hash string
+		if err := rows.Scan(&id, &hash); err != nil {
+			return nil, err
+		}
+		hashes[id] = hash
+	}
+	return hashes, rows.Err()
+}
+
+// EmbeddingsByIDs retrieves full precision embeddings by embedding ID.
+// Embeddings that no longer exist are left out.
+func (db *DB) EmbeddingsByIDs(ids []int64) (map[int64][]byte, error) {
+	found := make(map[int64][]byte, len(ids))
+	for start := 0; start < len(ids); start += maxQueryIDs {
+		chunk := ids[start:min(start+maxQueryIDs, len(ids))]
+		args := make([]interface{}, len(chunk))
+		for i, id := range chunk {
+			args[i] = id
+		}
+
+		rows, err := db.Query("SELECT id, embedding FROM embeddings WHERE id IN ("+placeholders(len(chunk))+")", args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var id int64
+			var data []byte
+			if err := rows.Scan(&id, &data); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			found[id] = data
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return found, nil
+}
+
+// SnippetLanguages retrieves the languages of the snippets among the given
+// content items, "" for snippets whose language is unknown. Items that are
+// not snippets are left out.
+func (db *DB) SnippetLanguages(ids []int64) (map[int64]string, error) {
+	languages := make(map[int64]string)
+	if len(ids) == 0 {
+		return languages, nil
+	}
+
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	rows, err := db.Query(`
+		SELECT id, COALESCE(language, '') FROM content
+		WHERE type = 'snippet' AND id IN (`+placeholders(len(ids))+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var language string
+		if err := rows.Scan(&id, &language); err != nil {
+			return nil, err
+		}
+		languages[id] = language
+	}
+	return languages, rows.Err()
+}
+
+// CachedEmbeddings retrieves the cached embeddings from a model of the texts
+// with the given hashes that were used within maxAge, and marks them used
+func (db *DB) CachedEmbeddings(model string, hashes []string, maxAge time.Duration) (map[string][]float32, error) {
+	cached := make(map[string][]float32)
+	if len(hashes) == 0 {
+		return cached, nil
+	}
+
+	since := fmt.Sprintf("-%d seconds", int64(maxAge.Seconds()))
+	args := []interface{}{model, since}
+	for _, hash := range hashes {
+		args = append(args, hash)
+	}
+	rows, err := db.Query(`
+		SELECT text_hash, embedding FROM embedding_cache
+		WHERE model = ? AND used_at >= datetime('now', ?)
+			AND text_hash IN (`+placeholders(len(hashes))+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var hash string
+		var data []byte
+		if err := rows.Scan(&hash, &data); err != nil {
+			return nil, err
+		}
+		embedding, err := vector.Decode(data)
+		if err != nil {
+			return nil, err
+		}
+		cached[hash] = embedding
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	if len(cached) > 0 {
+		args := []interface{}{model}
+		for hash := range cached {
+			args = append(args, hash)
+		}
+		_, err := db.Exec(`
+			UPDATE embedding_cache SET used_at = CURRENT_TIMESTAMP
+			WHERE model = ? AND text_hash IN (`+placeholders(len(cached))+`)`, args...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cached, nil
+}
+
+// CacheEmbeddings caches embeddings from a model by text hash
+func (db *DB) CacheEmbeddings(model string, embeddings map[string][]float32) error {
+	if len(embeddings) == 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for hash, embedding := range embeddings {
+		_, err := tx.Exec(`
+			INSERT INTO embedding_cache (model, text_hash, embedding) VALUES (?, ?, ?)
+			ON CONFLICT (model, text_hash) DO UPDATE SET
+				embedding = excluded.embedding, used_at = CURRENT_TIMESTAMP`,
+			model, hash, vector.Encode(embedding))
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// PruneEmbeddingCache deletes the cached embeddings not used within maxAge
+// and returns how many there were
+func (db *DB) PruneEmbeddingCache(maxAge time.Duration) (int64, error) {
+	res, err := db.Exec("DELETE FROM embedding_cache WHERE used_at < datetime('now', ?)",
+		fmt.Sprintf("-%d seconds", int64(maxAge.Seconds())))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// placeholders returns n comma separated query placeholders
+func placeholders(n int) string {
+	return strings.Repeat("?,", n-1) + "?"
+}
@@ -0,0 +1,287 @@
+package db
+
+import (
+	"database/sql"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// linkPattern matches [[Title]] and [[id:123]] references
+var linkPattern = regexp.MustCompile(`\[\[([^\[\]\n]+)\]\]`)
+
+// Link represents a [[link]] from one content item to another
+type Link struct {
+	SourceID    int64  `json:"source_id"`
+	SourceTitle string `json:"source_title,omitempty"`
+	TargetID    *int64 `json:"target_id,omitempty"`
+	TargetTitle string `json:"target_title,omitempty"`
+	Ref         string `json:"ref"`
+	Broken      bool   `json:"broken"`
+}
+
+// ParseLinks returns the distinct link references in a body, in order of
+// first appearance
+func ParseLinks(body string) []string {
+	refs := []string{}
+	seen := make(map[string]bool)
+	for _, match := range linkPattern.FindAllStringSubmatch(body, -1) {
+		ref := strings.TrimSpace(match[1])
+		if ref == "" || seen[ref] {
+			continue
+		}
+		seen[ref] = true
+		refs = append(refs, ref)
+	}
+	return refs
+}
+
+// syncLinks replaces the stored outgoing links of a content item with the
+// links found in its body. Title links resolve among the owner's content.
+func syncLinks(tx *sql.Tx, sl *sealer, ownerID, sourceID int64, body string) error {
+	if _, err := tx.Exec("DELETE FROM content_links WHERE source_id = ?", sourceID); err != nil {
+		return err
+	}
+
+	for _, ref := range ParseLinks(body) {
+		targetID, err := resolveLink(tx, sl, ownerID, ref)
+		if err != nil {
+			return err
+		}
+		storedRef, err := sl.seal(ref)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO content_links (source_id, target_id, target_ref, target_key)
+			VALUES (?, ?, ?, ?)`, sourceID, targetID, storedRef, sl.lookupKey(ref))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// resolveLink finds the content item a reference points to. It returns a
+// NULL ID when the target does not exist.
+func resolveLink(tx *sql.Tx, sl *sealer, ownerID int64, ref string) (sql.NullInt64, error) {
+	var id sql.NullInt64
+
+	if rawID, ok := strings.CutPrefix(ref, "id:"); ok {
+		targetID, err := strconv.ParseInt(strings.TrimSpace(rawID), 10, 64)
+		if err != nil {
+			return id, nil
+		}
+
+		// Follow merges so links to merged-away items keep working
+		err = tx.QueryRow(`
+			SELECT id FROM content WHERE id = COALESCE(
+				(SELECT new_id FROM content_redirects WHERE old_id = ?), ?)`,
+			targetID, targetID).Scan(&id)
+		if err == sql.ErrNoRows {
+			return id, nil
+		}
+		return id, err
+	}
+
+	match, arg := sl.matchSQL("title", "title_key", ref)
+	err := tx.QueryRow(`
+		SELECT id FROM content
+		WHERE owner_id = ? AND `+match+`
+		ORDER BY id
+		LIMIT 1`, ownerID, arg).Scan(&id)
+	if err == sql.ErrNoRows {
+		return id, nil
+	}
+	return id, err
+}
+
+// resolveBrokenLinks points the owner's broken title links at a newly titled
+// item
+func resolveBrokenLinks(tx *sql.Tx, sl *sealer, ownerID, id int64, title string) error {
+	if title == "" {
+		return nil
+	}
+	match, arg := sl.matchSQL("target_ref", "target_key", title)
+	_, err := tx.Exec(`
+		UPDATE content_links
+		SET target_id = ?
+		WHERE target_id IS NULL AND `+match+`
+			AND source_id IN (SELECT id FROM content WHERE owner_id = ?)`, id, arg, ownerID)
+	return err
+}
+
+// rewriteLinks updates [[oldTitle]] references to [[newTitle]] in the bodies
+// of every item linking to the given content item, keeping a revision of
+// each as an edit would. It returns the items rewritten, to embed again.
+func rewriteLinks(tx *sql.Tx, sl *sealer, id int64, oldTitle, newTitle string) ([]EmbedTarget, error) {
+	if oldTitle == "" || newTitle == "" || oldTitle == newTitle {
+		return nil, nil
+	}
+
+	match, arg := sl.matchSQL("l.target_ref", "l.target_key", oldTitle)
+	rows, err := tx.Query(`
+		SELECT c.id, c.owner_id, c.body
+		FROM content_links l
+		JOIN content c ON c.id = l.source_id
+		WHERE l.target_id = ? AND `+match, id, arg)
+	if err != nil {
+		return nil, err
+	}
+
+	type source struct {
+		id, ownerID int64
+		body        string
+	}
+	sources := []source{}
+	for rows.Next() {
+		var src source
+		if err := rows.Scan(&src.id, &src.ownerID, &src.body); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		var err error
+		if src.body, err = sl.open(src.body); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		sources = append(sources, src)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	pattern := regexp.MustCompile(`(?i)\[\[\s*` + regexp.QuoteMeta(oldTitle) + `\s*\]\]`)
+	rewritten := []EmbedTarget{}
+	for _, src := range sources {
+		body := pattern.ReplaceAllLiteralString(src.body, "[["+newTitle+"]]")
+		if body == src.body {
+			continue
+		}
+		storedBody, err := sl.seal(body)
+		if err != nil {
+			return nil, err
+		}
+
+		// An item linking to itself was just snapshotted by its own edit
+		if src.id != id {
+			_, err = tx.Exec(`
+				INSERT INTO content_revisions (content_id, type, title, body, source_url, file_path)
+				SELECT id, type, title, body, source_url, file_path FROM content WHERE id = ?`, src.id)
+			if err != nil {
+				return nil, err
+			}
+		}
+		_, err = tx.Exec("UPDATE content SET body = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?", storedBody, src.id)
+		if err != nil {
+			return nil, err
+		}
+		if err := syncLinks(tx, sl, src.ownerID, src.id, body); err != nil {
+			return nil, err
+		}
+		rewritten = append(rewritten, EmbedTarget{ID: src.id, Body: body})
+	}
+
+	return rewritten, nil
+}
+
+// ListBacklinks retrieves the links pointing at a content item from items the
+// user may read
+func (db *DB) ListBacklinks(userID, id int64) ([]Link, error) {
+	if err := contentAccess(db, userID, id, AccessRead); err != nil {
+		return nil, err
+	}
+	access, args := ContentAccessSQL("s.id", userID, AccessRead)
+	return db.queryLinks(`
+		SELECT l.source_id, s.title, l.target_id, t.title, l.target_ref
+		FROM content_links l
+		JOIN content s ON s.id = l.source_id
+		LEFT JOIN content t ON t.id = l.target_id
+		WHERE l.target_id = ? AND `+access+`
+		ORDER BY s.title`, append([]interface{}{id}, args...)...)
+}
+
+// ListOutlinks retrieves the links found in a content item's body. Links to
+// items the user may not read are reported as broken.
+func (db *DB) ListOutlinks(userID, id int64) ([]Link, error) {
+	if err := contentAccess(db, userID, id, AccessRead); err != nil {
+		return nil, err
+	}
+	access, args := ContentAccessSQL("t.id", userID, AccessRead)
+	return db.queryLinks(`
+		SELECT l.source_id, s.title, t.id, t.title, l.target_ref
+		FROM content_links l
+		JOIN content s ON s.id = l.source_id
+		LEFT JOIN content t ON t.id = l.target_id AND `+access+`
+		WHERE l.source_id = ?
+		ORDER BY l.target_ref`, append(args, id)...)
+}
+
+// ListBrokenLinks retrieves every link in the user's content whose target
+// does not exist
+func (db *DB) ListBrokenLinks(userID int64) ([]Link, error) {
+	return db.queryLinks(`
+		SELECT l.source_id, s.title, l.target_id, NULL, l.target_ref
+		FROM content_links l
+		JOIN content s ON s.id = l.source_id
+		WHERE l.target_id IS NULL AND s.owner_id = ?
+		ORDER BY s.title, l.target_ref`, userID)
+}
+
+// queryLinks runs a link query and scans the results. Encrypted titles
+// cannot be sorted in SQL, so those results are sorted by source title and
+// reference here.
+func (db *DB) queryLinks(query string, args ...interface{}) ([]Link, error) {
+	sl, err := db.crypter()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := []Link{}
+	for rows.Next() {
+		var link Link
+		var sourceTitle, targetTitle sql.NullString
+		var targetID sql.NullInt64
+		if err := rows.Scan(&link.SourceID, &sourceTitle, &targetID, &targetTitle, &link.Ref); err != nil {
+			return nil, err
+		}
+		if link.SourceTitle, err = sl.openNull(sourceTitle); err != nil {
+			return nil, err
+		}
+		if link.TargetTitle, err = sl.openNull(targetTitle); err != nil {
+			return nil, err
+		}
+		if link.Ref, err = sl.open(link.Ref); err != nil {
+			return nil, err
+		}
+		if targetID.Valid {
+			link.TargetID = &targetID.Int64
+		} else {
+			link.Broken = true
+		}
+		links = append(links, link)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if sl != nil {
+		sort.SliceStable(links, func(i, j int) bool {
+			if links[i].SourceTitle != links[j].SourceTitle {
+				return links[i].SourceTitle < links[j].SourceTitle
+			}
+			return links[i].Ref < links[j].Ref
+		})
+	}
+	return links, nil
+}
@@ -0,0 +1,194 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// Revision represents a snapshot of a content item
+type Revision struct {
+	ID        int64  `json:"id"`
+	ContentID int64  `json:"content_id"`
+	SourceID  *int64 `json:"source_id,omitempty"`
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Body      string `json:"body"`
+	SourceURL string `json:"source_url,omitempty"`
+	FilePath  string `json:"file_path,omitempty"`
+	CreatedAt string `json:"created_at"`
+}
+
+// ListRevisions retrieves the revision history of a content item the user may
+// read, newest first
+func (db *DB) ListRevisions(userID, contentID int64) ([]Revision, error) {
+	if err := contentAccess(db, userID, contentID, AccessRead); err != nil {
+		return nil, err
+	}
+	sl, err := db.crypter()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`
+		SELECT id, content_id, source_id, type, title, body, source_url, file_path, created_at
+		FROM content_revisions
+		WHERE content_id = ?
+		ORDER BY created_at DESC, id DESC`, contentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := []Revision{}
+	for rows.Next() {
+		var rev Revision
+		var sourceID sql.NullInt64
+		err := rows.Scan(
+			&rev.ID,
+			&rev.ContentID,
+			&sourceID,
+			&rev.Type,
+			&rev.Title,
+			&rev.Body,
+			&rev.SourceURL,
+			&rev.FilePath,
+			&rev.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if rev.Title, err = sl.open(rev.Title); err != nil {
+			return nil, err
+		}
+		if rev.Body, err = sl.open(rev.Body); err != nil {
+			return nil, err
+		}
+		if sourceID.Valid {
+			rev.SourceID = &sourceID.Int64
+		}
+		revisions = append(revisions, rev)
+	}
+
+	return revisions, rows.Err()
+}
+
+// ResolveRedirect returns the ID a merged-away content item now lives under.
+// It returns sql.ErrNoRows if the ID was never redirected, or if the user may
+// not read the item it lives under, so redirects reveal nothing else.
+func (db *DB) ResolveRedirect(userID, oldID int64) (int64, error) {
+	var newID int64
+	err := db.QueryRow("SELECT new_id FROM content_redirects WHERE old_id = ?", oldID).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+	if err := contentAccess(db, userID, newID, AccessRead); err != nil {
+		return 0, err
+	}
+	return newID, nil
+}
+
+// MergeContent merges the given content items into the target item. The target
+// receives the union of all tags, the merged items (and their revision history)
+// are kept as revisions of the target, and their IDs redirect to the target.
+// The user must own every item involved.
+func (db *DB) MergeContent(userID, targetID int64, ids []int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := mergeAccess(tx, userID, targetID); err != nil {
+		return fmt.Errorf("target %w", err)
+	}
+
+	for _, id := range ids {
+		if id == targetID {
+			continue
+		}
+
+		if err := mergeAccess(tx, userID, id); err != nil {
+			return err
+		}
+
+		// Union of tags
+		_, err = tx.Exec(`
+			INSERT OR IGNORE INTO content_tags (content_id, tag_id)
+			SELECT ?, tag_id FROM content_tags WHERE content_id = ?`, targetID, id)
+		if err != nil {
+			return err
+		}
+
+		// Union of collection memberships
+		_, err = tx.Exec(`
+			INSERT OR IGNORE INTO collection_items (collection_id, content_id, position)
+			SELECT collection_id, ?, position FROM collection_items WHERE content_id = ?`, targetID, id)
+		if err != nil {
+			return err
+		}
+
+		// Carry over the merged item's history, then snapshot the item itself
+		_, err = tx.Exec(`
+			UPDATE content_revisions
+			SET content_id = ?, source_id = COALESCE(source_id, ?)
+			WHERE content_id = ?`, targetID, id, id)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO content_revisions (content_id, source_id, type, title, body, source_url, file_path)
+			SELECT ?, id, type, title, body, source_url, file_path FROM content WHERE id = ?`, targetID, id)
+		if err != nil {
+			return err
+		}
+
+		// The target keeps its own file if it has one
+		_, err = tx.Exec("UPDATE OR IGNORE attachments SET content_id = ? WHERE content_id = ?", targetID, id)
+		if err != nil {
+			return err
+		}
+
+		// Redirect the merged ID, and anything that already pointed at it
+		_, err = tx.Exec("UPDATE content_redirects SET new_id = ? WHERE new_id = ?", targetID, id)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("INSERT OR REPLACE INTO content_redirects (old_id, new_id) VALUES (?, ?)", id, targetID)
+		if err != nil {
+			return err
+		}
+
+		// Links to the merged item now point at the target
+		_, err = tx.Exec("UPDATE content_links SET target_id = ? WHERE target_id = ?", targetID, id)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("DELETE FROM content WHERE id = ?", id)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("UPDATE content SET updated_at = CURRENT_TIMESTAMP WHERE id = ?", targetID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// mergeAccess checks that the user owns a content item about to be merged
+func mergeAccess(tx *sql.Tx, userID, id int64) error {
+	err := contentAccess(tx, userID, id, AccessOwner)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("content %d not found: %w", id, err)
+	}
+	if errors.Is(err, ErrForbidden) {
+		return fmt.Errorf("content %d: %w", id, ErrForbidden)
+	}
+	return err
+}
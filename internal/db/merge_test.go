@@ -0,0 +1,118 @@
+package db_test
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/rgehrsitz/me/internal/db"
+)
+
+func TestMergeContent(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "pkb.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	userID, err := database.DefaultUserID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherID, err := database.CreateUser("other", "Other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	create := func(owner int64, content *db.Content) int64 {
+		id, err := database.CreateContent(owner, content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+
+	target := create(userID, &db.Content{Type: "note", Title: "Go notes", Body: "channels", Tags: []string{"go"}})
+	dup := create(userID, &db.Content{Type: "note", Title: "Go notes (copy)", Body: "draft", Tags: []string{"draft"}})
+	if _, err := database.UpdateContent(userID, &db.Content{ID: dup, Type: "note", Title: "Go notes (copy)", Body: "channels", Tags: []string{"draft"}}); err != nil {
+		t.Fatal(err)
+	}
+	source := create(userID, &db.Content{Type: "note", Title: "Index", Body: "see [[Go notes (copy)]]"})
+	foreign := create(otherID, &db.Content{Type: "note", Title: "theirs", Body: "private"})
+
+	// Missing and unowned items are not found, and nothing is merged
+	if err := database.MergeContent(userID, target, []int64{dup, 9999}); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("merging a missing item = %v, want sql.ErrNoRows", err)
+	}
+	if err := database.MergeContent(userID, 9999, []int64{dup}); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("merging into a missing item = %v, want sql.ErrNoRows", err)
+	}
+	if err := database.MergeContent(userID, target, []int64{foreign}); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("merging another user's item = %v, want sql.ErrNoRows", err)
+	}
+	if _, err := database.GetContent(userID, dup); err != nil {
+		t.Fatalf("failed merge removed the item: %v", err)
+	}
+
+	if err := database.MergeContent(userID, target, []int64{target, dup}); err != nil {
+		t.Fatalf("MergeContent failed: %v", err)
+	}
+
+	merged, err := database.GetContent(userID, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(merged.Tags)
+	if !reflect.DeepEqual(merged.Tags, []string{"draft", "go"}) {
+		t.Errorf("merged tags are %v, want the union", merged.Tags)
+	}
+	if _, err := database.GetContent(userID, dup); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GetContent of the merged item = %v, want sql.ErrNoRows", err)
+	}
+
+	// The merged item and its own revision become revisions of the target
+	revisions, err := database.ListRevisions(userID, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bodies []string
+	for _, rev := range revisions {
+		if rev.SourceID == nil || *rev.SourceID != dup {
+			t.Errorf("revision %d comes from %v, want %d", rev.ID, rev.SourceID, dup)
+		}
+		bodies = append(bodies, rev.Body)
+	}
+	if !reflect.DeepEqual(bodies, []string{"channels", "draft"}) {
+		t.Errorf("revision bodies are %q", bodies)
+	}
+
+	links, err := database.ListOutlinks(userID, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 1 || links[0].TargetID == nil || *links[0].TargetID != target {
+		t.Errorf("link to the merged item is %+v, want it to point at %d", links, target)
+	}
+
+	// Redirects follow later merges, and only to users who may read the item
+	if id, err := database.ResolveRedirect(userID, dup); err != nil || id != target {
+		t.Errorf("ResolveRedirect = %d, %v, want %d", id, err, target)
+	}
+	if _, err := database.ResolveRedirect(otherID, dup); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("ResolveRedirect for another user = %v, want sql.ErrNoRows", err)
+	}
+	if _, err := database.ResolveRedirect(userID, target); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("ResolveRedirect of an item never merged = %v, want sql.ErrNoRows", err)
+	}
+
+	final := create(userID, &db.Content{Type: "note", Title: "All Go notes", Body: "everything"})
+	if err := database.MergeContent(userID, final, []int64{target}); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []int64{dup, target} {
+		if newID, err := database.ResolveRedirect(userID, id); err != nil || newID != final {
+			t.Errorf("ResolveRedirect(%d) after a second merge = %d, %v, want %d", id, newID, err, final)
+		}
+	}
+}
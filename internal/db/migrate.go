@@ -0,0 +1,216 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/rgehrsitz/me/internal/vector"
+)
+
+// addedColumns lists columns added to existing tables since they were first
+// created. CREATE TABLE IF NOT EXISTS leaves older tables alone, so migrate
+// adds these where they are missing.
+var addedColumns = []struct {
+	table, column, definition string
+}{
+	{"content", "owner_id", "INTEGER REFERENCES users(id) ON DELETE CASCADE"},
+	{"collections", "owner_id", "INTEGER REFERENCES users(id) ON DELETE CASCADE"},
+	{"clusters", "owner_id", "INTEGER REFERENCES users(id) ON DELETE CASCADE"},
+	{"api_tokens", "user_id", "INTEGER REFERENCES users(id) ON DELETE CASCADE"},
+	{"content", "title_key", "TEXT"},
+	{"content_links", "target_key", "TEXT"},
+	{"embeddings", "quantized", "BLOB"},
+	{"embeddings", "text_hash", "TEXT"},
+	{"content", "language", "TEXT"},
+}
+
+// addedIndexesSQL indexes the added columns. It runs after migrate since the
+// columns may not exist when the schema is first applied.
+const addedIndexesSQL = `
+	CREATE INDEX IF NOT EXISTS idx_content_owner_id ON content(owner_id);
+	CREATE INDEX IF NOT EXISTS idx_collections_owner_id ON collections(owner_id);
+	CREATE INDEX IF NOT EXISTS idx_clusters_owner_id ON clusters(owner_id);
+	CREATE INDEX IF NOT EXISTS idx_api_tokens_user_id ON api_tokens(user_id);
+	CREATE INDEX IF NOT EXISTS idx_content_title_key ON content(owner_id, title_key);
+	CREATE INDEX IF NOT EXISTS idx_content_links_target_key ON content_links(target_key);
+	CREATE INDEX IF NOT EXISTS idx_content_language ON content(language);`
+
+// migrate brings a database created by an older version up to date with
+// schema.sql
+func migrate(db *sql.DB) error {
+	for _, c := range addedColumns {
+		exists, err := hasColumn(db, c.table, c.column)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", c.table, c.column, c.definition)); err != nil {
+			return fmt.Errorf("failed to add %s.%s: %w", c.table, c.column, err)
+		}
+	}
+
+	// Tag names used to be unique across the whole database
+	exists, err := hasColumn(db, "tags", "owner_id")
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if err := rebuildTags(db); err != nil {
+			return fmt.Errorf("failed to migrate tags: %w", err)
+		}
+	}
+
+	// Usage used to be recorded in each vault's own database
+	exists, err = hasColumn(db, "usage", "vault")
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if err := rebuildUsage(db); err != nil {
+			return fmt.Errorf("failed to migrate usage: %w", err)
+		}
+	}
+
+	if err := convertVectors(db); err != nil {
+		return fmt.Errorf("failed to convert embeddings: %w", err)
+	}
+
+	_, err = db.Exec(addedIndexesSQL)
+	return err
+}
+
+// hasColumn reports whether a table has the given column
+func hasColumn(db *sql.DB, table, column string) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column).Scan(&count)
+	return count > 0, err
+}
+
+// rebuildTags recreates the tags table with a per-user unique constraint.
+// SQLite cannot alter constraints in place, so the table is copied. Foreign
+// keys are off meanwhile so dropping the old table keeps content_tags intact.
+func rebuildTags(db *sql.DB) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "PRAGMA foreign_keys = OFF"); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, "PRAGMA foreign_keys = ON")
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		CREATE TABLE tags_new (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			owner_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+			name TEXT NOT NULL,
+			UNIQUE (owner_id, name)
+		);
+		INSERT INTO tags_new (id, name) SELECT id, name FROM tags WHERE name IS NOT NULL;
+		DROP TABLE tags;
+		ALTER TABLE tags_new RENAME TO tags;`)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// rebuildUsage recreates the usage table with a vault column and without
+// the foreign key on content_id, which may now name an item in a vault
+func rebuildUsage(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		CREATE TABLE usage_new (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			vault TEXT NOT NULL DEFAULT '',
+			provider TEXT NOT NULL,
+			model TEXT NOT NULL,
+			operation TEXT NOT NULL,
+			content_id INTEGER,
+			inputs INTEGER NOT NULL DEFAULT 1,
+			prompt_tokens INTEGER NOT NULL,
+			completion_tokens INTEGER NOT NULL DEFAULT 0,
+			cost REAL NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		INSERT INTO usage_new (id, provider, model, operation, content_id, inputs, prompt_tokens, completion_tokens, cost, created_at)
+			SELECT id, provider, model, operation, content_id, inputs, prompt_tokens, completion_tokens, cost, created_at FROM usage;
+		DROP TABLE usage;
+		ALTER TABLE usage_new RENAME TO usage;
+		CREATE INDEX IF NOT EXISTS idx_usage_created_at ON usage(created_at);`)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// jsonVectorSQL matches vectors stored as JSON arrays, which they were before
+// the binary encoding
+const jsonVectorSQL = "hex(substr(%s, 1, 1)) = '5B'"
+
+// convertVectors re-encodes embeddings and cluster centroids stored as JSON
+// arrays in the binary format
+func convertVectors(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, c := range []struct{ table, column string }{
+		{"embeddings", "embedding"},
+		{"clusters", "centroid"},
+	} {
+		rows, err := tx.Query(fmt.Sprintf("SELECT id, %s FROM %s WHERE "+jsonVectorSQL, c.column, c.table, c.column))
+		if err != nil {
+			return err
+		}
+
+		converted := make(map[int64][]byte)
+		for rows.Next() {
+			var id int64
+			var data []byte
+			if err := rows.Scan(&id, &data); err != nil {
+				rows.Close()
+				return err
+			}
+			v, err := vector.Decode(data)
+			if err != nil {
+				rows.Close()
+				return fmt.Errorf("%s %d: %w", c.table, id, err)
+			}
+			converted[id] = vector.Encode(v)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for id, data := range converted {
+			if _, err := tx.Exec(fmt.Sprintf("UPDATE %s SET %s = ? WHERE id = ?", c.table, c.column), data, id); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
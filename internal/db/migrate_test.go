@@ -0,0 +1,59 @@
+package db_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/rgehrsitz/me/internal/db"
+	"github.com/rgehrsitz/me/internal/vector"
+)
+
+func TestConvertJSONVectors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pkb.db")
+	database, err := db.New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID, err := database.DefaultUserID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := database.CreateContent(userID, &db.Content{Type: "note", Title: "legacy", Body: "stored before the binary format"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = database.Exec(`
+		INSERT INTO embeddings (content_id, embedding, model, dimensions)
+		VALUES (?, ?, 'text-embedding-ada-002', 3)`, id, []byte(`[0.5,-1,0.25]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	database.Close()
+
+	// Opening the database again converts the vector
+	if database, err = db.New(path); err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	var data []byte
+	if err := database.QueryRow("SELECT embedding FROM embeddings WHERE content_id = ?", id).Scan(&data); err != nil {
+		t.Fatal(err)
+	}
+	if kind, err := vector.KindOf(data); err != nil || kind != vector.Float32 {
+		t.Fatalf("converted embedding is %v, %v, want a full precision vector", kind, err)
+	}
+	v, err := vector.Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []float32{0.5, -1, 0.25}
+	if len(v) != len(want) {
+		t.Fatalf("converted embedding is %v, want %v", v, want)
+	}
+	for i := range want {
+		if v[i] != want[i] {
+			t.Errorf("converted value %d is %v, want %v", i, v[i], want[i])
+		}
+	}
+}
@@ -1,11 +1,22 @@
+-- Table: Users. Every content item, tag and collection belongs to one.
+CREATE TABLE IF NOT EXISTS users (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    username TEXT NOT NULL UNIQUE COLLATE NOCASE,
+    display_name TEXT NOT NULL DEFAULT '',
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
 -- Table: Content (for notes/snippets/bookmarks/docs)
 CREATE TABLE IF NOT EXISTS content (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
+    owner_id INTEGER REFERENCES users(id) ON DELETE CASCADE, -- NULL until claimed by the first user
     type TEXT NOT NULL,               -- note, snippet, bookmark, doc
     title TEXT,
     body TEXT,
     source_url TEXT,                  -- for bookmarks/docs
     file_path TEXT,                   -- for local docs
+    title_key TEXT,                   -- keyed hash of the title for lookups while encrypted
+    language TEXT,                    -- for snippets, the language of the code
     created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
     updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
 );
@@ -14,16 +25,20 @@ CREATE TABLE IF NOT EXISTS content (
 CREATE TABLE IF NOT EXISTS embeddings (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
     content_id INTEGER NOT NULL,
-    embedding BLOB NOT NULL,          -- store as binary or array of floats
+    embedding BLOB NOT NULL,          -- full precision vector (see internal/vector)
     model TEXT NOT NULL,              -- which embedding model was used
     dimensions INTEGER NOT NULL,      -- number of dimensions in the embedding
+    quantized BLOB,                   -- int8 or binary copy scanned by semantic search, if enabled
+    text_hash TEXT,                   -- hash of the text embedded, to skip unchanged text
     FOREIGN KEY (content_id) REFERENCES content(id) ON DELETE CASCADE
 );
 
--- Optional: Tags table (for organization)
+-- Optional: Tags table (for organization). Each user has their own tag names.
 CREATE TABLE IF NOT EXISTS tags (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
-    name TEXT UNIQUE
+    owner_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    UNIQUE (owner_id, name)
 );
 
 CREATE TABLE IF NOT EXISTS content_tags (
@@ -37,4 +52,186 @@ CREATE TABLE IF NOT EXISTS content_tags (
 -- Create indexes for faster querying
 CREATE INDEX IF NOT EXISTS idx_content_type ON content(type);
 CREATE INDEX IF NOT EXISTS idx_content_title ON content(title);
+CREATE INDEX IF NOT EXISTS idx_content_created ON content(created_at, id);
 CREATE INDEX IF NOT EXISTS idx_embeddings_content_id ON embeddings(content_id);
+
+-- Table: Embeddings of texts by hash, so unchanged content and repeated
+-- search queries are not embedded again
+CREATE TABLE IF NOT EXISTS embedding_cache (
+    model TEXT NOT NULL,
+    text_hash TEXT NOT NULL,          -- keyed hash when the database is encrypted
+    embedding BLOB NOT NULL,
+    used_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (model, text_hash)
+);
+
+CREATE INDEX IF NOT EXISTS idx_embedding_cache_used_at ON embedding_cache(used_at);
+
+-- Table: Content revisions (snapshots taken before updates and merges)
+CREATE TABLE IF NOT EXISTS content_revisions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    content_id INTEGER NOT NULL,      -- item the revision belongs to
+    source_id INTEGER,                -- original item ID when merged in from a duplicate
+    type TEXT NOT NULL,
+    title TEXT,
+    body TEXT,
+    source_url TEXT,
+    file_path TEXT,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (content_id) REFERENCES content(id) ON DELETE CASCADE
+);
+
+-- Table: Redirects from merged-away content IDs to the surviving item
+CREATE TABLE IF NOT EXISTS content_redirects (
+    old_id INTEGER PRIMARY KEY,
+    new_id INTEGER NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (new_id) REFERENCES content(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_content_revisions_content_id ON content_revisions(content_id);
+CREATE INDEX IF NOT EXISTS idx_content_redirects_new_id ON content_redirects(new_id);
+
+-- Table: Topic clusters computed over the embeddings
+CREATE TABLE IF NOT EXISTS clusters (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    owner_id INTEGER REFERENCES users(id) ON DELETE CASCADE, -- clusters are computed per user
+    name TEXT NOT NULL,
+    centroid BLOB NOT NULL,           -- serialized centroid vector
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS content_clusters (
+    content_id INTEGER PRIMARY KEY,
+    cluster_id INTEGER NOT NULL,
+    incremental BOOLEAN NOT NULL DEFAULT 0, -- assigned since the last full clustering run
+    FOREIGN KEY (content_id) REFERENCES content(id) ON DELETE CASCADE,
+    FOREIGN KEY (cluster_id) REFERENCES clusters(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_content_clusters_cluster_id ON content_clusters(cluster_id);
+
+-- Table: Wiki-style [[links]] between content items
+CREATE TABLE IF NOT EXISTS content_links (
+    source_id INTEGER NOT NULL,
+    target_id INTEGER,                -- NULL while the link is broken
+    target_ref TEXT NOT NULL,         -- text inside the brackets, e.g. "Title" or "id:123"
+    target_key TEXT,                  -- keyed hash of target_ref for lookups while encrypted
+    PRIMARY KEY (source_id, target_ref),
+    FOREIGN KEY (source_id) REFERENCES content(id) ON DELETE CASCADE,
+    FOREIGN KEY (target_id) REFERENCES content(id) ON DELETE SET NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_content_links_target_id ON content_links(target_id);
+
+-- Table: Collections (nested notebooks of content)
+CREATE TABLE IF NOT EXISTS collections (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    owner_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    parent_id INTEGER,                -- NULL for top-level collections
+    name TEXT NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    position INTEGER NOT NULL DEFAULT 0, -- order among siblings
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (parent_id) REFERENCES collections(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS collection_items (
+    collection_id INTEGER NOT NULL,
+    content_id INTEGER NOT NULL,
+    position INTEGER NOT NULL DEFAULT 0, -- order within the collection
+    added_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (collection_id, content_id),
+    FOREIGN KEY (collection_id) REFERENCES collections(id) ON DELETE CASCADE,
+    FOREIGN KEY (content_id) REFERENCES content(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_collections_parent_id ON collections(parent_id);
+CREATE INDEX IF NOT EXISTS idx_collection_items_content_id ON collection_items(content_id);
+
+-- Table: Personal API tokens. Only a hash of each token is stored.
+CREATE TABLE IF NOT EXISTS api_tokens (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,  -- hex SHA-256 of the token
+    prefix TEXT NOT NULL,             -- first characters of the token, to tell tokens apart
+    scopes TEXT NOT NULL,             -- comma-separated: read, write, admin
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    last_used_at DATETIME,
+    revoked_at DATETIME               -- NULL while the token is valid
+);
+
+-- Table: Content items and collections shared with other users. Sharing a
+-- collection shares its sub-collections and every item filed in them.
+CREATE TABLE IF NOT EXISTS shares (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,         -- user the item is shared with
+    content_id INTEGER,
+    collection_id INTEGER,
+    level TEXT NOT NULL,              -- read or write
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    CHECK ((content_id IS NULL) != (collection_id IS NULL)),
+    UNIQUE (user_id, content_id),
+    UNIQUE (user_id, collection_id),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (content_id) REFERENCES content(id) ON DELETE CASCADE,
+    FOREIGN KEY (collection_id) REFERENCES collections(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_shares_content_id ON shares(content_id);
+CREATE INDEX IF NOT EXISTS idx_shares_collection_id ON shares(collection_id);
+
+-- Table: Vaults, separate knowledge bases served alongside this one. Each has
+-- its own database file; users and API tokens stay in this one.
+CREATE TABLE IF NOT EXISTS vaults (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL UNIQUE,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    archived_at DATETIME             -- NULL while the vault is in use
+);
+
+-- Table: Encryption at rest. While this row exists, titles, bodies, link
+-- text, cluster names and attached files are encrypted with a random data key, which is stored here encrypted
+-- with a key derived from the passphrase.
+CREATE TABLE IF NOT EXISTS encryption (
+    id INTEGER PRIMARY KEY CHECK (id = 1),
+    salt BLOB NOT NULL,
+    kdf_time INTEGER NOT NULL,        -- Argon2id passes
+    kdf_memory INTEGER NOT NULL,      -- Argon2id memory in KiB
+    kdf_threads INTEGER NOT NULL,     -- Argon2id parallelism
+    wrapped_key BLOB NOT NULL,        -- data key encrypted with the passphrase key
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    rekeyed_at DATETIME
+);
+
+-- Table: Files attached to content items, one per item. The name and data
+-- are encrypted like bodies.
+CREATE TABLE IF NOT EXISTS attachments (
+    content_id INTEGER PRIMARY KEY,
+    name TEXT NOT NULL,
+    media_type TEXT NOT NULL,
+    size INTEGER NOT NULL,            -- bytes before encryption
+    data BLOB NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (content_id) REFERENCES content(id) ON DELETE CASCADE
+);
+
+-- Table: AI API usage, one row per call, for cost reporting and budgets
+CREATE TABLE IF NOT EXISTS usage (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    vault TEXT NOT NULL DEFAULT '',   -- vault the call was for, '' for the main knowledge base
+    provider TEXT NOT NULL,
+    model TEXT NOT NULL,
+    operation TEXT NOT NULL,          -- embed, search, summarize or name_cluster
+    content_id INTEGER,               -- item the call was for, if a single one, in the vault's database
+    inputs INTEGER NOT NULL DEFAULT 1, -- texts sent in the call
+    prompt_tokens INTEGER NOT NULL,
+    completion_tokens INTEGER NOT NULL DEFAULT 0,
+    cost REAL NOT NULL,               -- estimated, in US dollars
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_usage_created_at ON usage(created_at);
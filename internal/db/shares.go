@@ -0,0 +1,237 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// Access levels. Content and collections can be shared at the read or write
+// level; only the owner may delete, merge or share them.
+const (
+	AccessRead  = "read"
+	AccessWrite = "write"
+	AccessOwner = "owner"
+)
+
+var (
+	// ErrForbidden is returned when a user can see an item but lacks the
+	// access level an operation needs
+	ErrForbidden = errors.New("permission denied")
+	// ErrShareWithOwner is returned when sharing an item with its own owner
+	ErrShareWithOwner = errors.New("cannot share an item with its owner")
+)
+
+// Share grants a user access to another user's content item or collection
+type Share struct {
+	ID           int64  `json:"id"`
+	UserID       int64  `json:"user_id"`
+	Username     string `json:"username"`
+	ContentID    *int64 `json:"content_id,omitempty"`
+	CollectionID *int64 `json:"collection_id,omitempty"`
+	Level        string `json:"level"`
+	CreatedAt    string `json:"created_at"`
+}
+
+// ValidateAccessLevel checks that a share level is read or write
+func ValidateAccessLevel(level string) error {
+	if level != AccessRead && level != AccessWrite {
+		return fmt.Errorf("unknown access level %q, expected read or write", level)
+	}
+	return nil
+}
+
+// queryer is satisfied by both *DB and *sql.Tx
+type queryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// sharedCollectionsSQL selects the collections shared with a user at the given
+// level, along with all of their descendants
+func sharedCollectionsSQL(userID int64, level string) (string, []interface{}) {
+	return `
+		WITH RECURSIVE shared(id) AS (
+			SELECT collection_id FROM shares
+			WHERE user_id = ? AND collection_id IS NOT NULL AND (level = 'write' OR ? = 'read')
+			UNION
+			SELECT cl.id FROM collections cl JOIN shared s ON cl.parent_id = s.id
+		)
+		SELECT id FROM shared`, []interface{}{userID, level}
+}
+
+// ContentAccessSQL returns a condition restricting the given content ID column
+// to items the user owns or has been granted the access level on, directly or
+// through a shared collection
+func ContentAccessSQL(column string, userID int64, level string) (string, []interface{}) {
+	if level == AccessOwner {
+		return column + " IN (SELECT id FROM content WHERE owner_id = ?)", []interface{}{userID}
+	}
+
+	collections, collectionArgs := sharedCollectionsSQL(userID, level)
+	args := append([]interface{}{userID, userID, level}, collectionArgs...)
+	return column + ` IN (
+			SELECT id FROM content WHERE owner_id = ?
+			UNION
+			SELECT content_id FROM shares
+			WHERE user_id = ? AND content_id IS NOT NULL AND (level = 'write' OR ? = 'read')
+			UNION
+			SELECT ci.content_id FROM collection_items ci
+			WHERE ci.collection_id IN (` + collections + `)
+		)`, args
+}
+
+// CollectionAccessSQL returns a condition restricting the given collection ID
+// column to collections the user owns or has been granted the access level on
+func CollectionAccessSQL(column string, userID int64, level string) (string, []interface{}) {
+	if level == AccessOwner {
+		return column + " IN (SELECT id FROM collections WHERE owner_id = ?)", []interface{}{userID}
+	}
+
+	collections, collectionArgs := sharedCollectionsSQL(userID, level)
+	return `(` + column + ` IN (SELECT id FROM collections WHERE owner_id = ?)
+		OR ` + column + ` IN (` + collections + `))`, append([]interface{}{userID}, collectionArgs...)
+}
+
+// contentAccess returns nil if the user has the given access level on a
+// content item, sql.ErrNoRows if they cannot see it at all and ErrForbidden if
+// they can see it but lack the level
+func contentAccess(q queryer, userID, contentID int64, level string) error {
+	return checkAccess(q, "content", ContentAccessSQL, userID, contentID, level)
+}
+
+// collectionAccess is contentAccess for collections
+func collectionAccess(q queryer, userID, collectionID int64, level string) error {
+	return checkAccess(q, "collections", CollectionAccessSQL, userID, collectionID, level)
+}
+
+// checkAccess implements contentAccess and collectionAccess
+func checkAccess(q queryer, table string, accessSQL func(string, int64, string) (string, []interface{}), userID, id int64, level string) error {
+	canRead, readArgs := accessSQL("id", userID, AccessRead)
+	canAct, actArgs := accessSQL("id", userID, level)
+	args := append(append(readArgs, actArgs...), id)
+
+	var readable, allowed bool
+	err := q.QueryRow("SELECT "+canRead+", "+canAct+" FROM "+table+" WHERE id = ?", args...).Scan(&readable, &allowed)
+	if err != nil {
+		return err
+	}
+	if !readable {
+		return sql.ErrNoRows
+	}
+	if !allowed {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// ShareContent shares a content item owned by userID with another user,
+// replacing any earlier share with that user
+func (db *DB) ShareContent(userID, contentID, withUserID int64, level string) error {
+	if err := contentAccess(db, userID, contentID, AccessOwner); err != nil {
+		return err
+	}
+	return db.share("content_id", contentID, userID, withUserID, level)
+}
+
+// UnshareContent stops sharing a content item with a user
+func (db *DB) UnshareContent(userID, contentID, withUserID int64) error {
+	if err := contentAccess(db, userID, contentID, AccessOwner); err != nil {
+		return err
+	}
+	return db.unshare("content_id", contentID, withUserID)
+}
+
+// ListContentShares retrieves the users a content item is shared with
+func (db *DB) ListContentShares(userID, contentID int64) ([]Share, error) {
+	if err := contentAccess(db, userID, contentID, AccessOwner); err != nil {
+		return nil, err
+	}
+	return db.queryShares("content_id", contentID)
+}
+
+// ShareCollection shares a collection owned by userID, with everything filed
+// in it and its sub-collections, with another user
+func (db *DB) ShareCollection(userID, collectionID, withUserID int64, level string) error {
+	if err := collectionAccess(db, userID, collectionID, AccessOwner); err != nil {
+		return err
+	}
+	return db.share("collection_id", collectionID, userID, withUserID, level)
+}
+
+// UnshareCollection stops sharing a collection with a user
+func (db *DB) UnshareCollection(userID, collectionID, withUserID int64) error {
+	if err := collectionAccess(db, userID, collectionID, AccessOwner); err != nil {
+		return err
+	}
+	return db.unshare("collection_id", collectionID, withUserID)
+}
+
+// ListCollectionShares retrieves the users a collection is shared with
+func (db *DB) ListCollectionShares(userID, collectionID int64) ([]Share, error) {
+	if err := collectionAccess(db, userID, collectionID, AccessOwner); err != nil {
+		return nil, err
+	}
+	return db.queryShares("collection_id", collectionID)
+}
+
+// share inserts or updates a share of the item in the given column
+func (db *DB) share(column string, id, ownerID, withUserID int64, level string) error {
+	if err := ValidateAccessLevel(level); err != nil {
+		return err
+	}
+	if withUserID == ownerID {
+		return ErrShareWithOwner
+	}
+
+	_, err := db.Exec(`
+		INSERT INTO shares (user_id, `+column+`, level) VALUES (?, ?, ?)
+		ON CONFLICT (user_id, `+column+`) DO UPDATE SET level = excluded.level`,
+		withUserID, id, level)
+	return err
+}
+
+// unshare deletes the share of the item in the given column with a user
+func (db *DB) unshare(column string, id, withUserID int64) error {
+	res, err := db.Exec("DELETE FROM shares WHERE user_id = ? AND "+column+" = ?", withUserID, id)
+	if err != nil {
+		return err
+	}
+	return expectRow(res)
+}
+
+// queryShares retrieves the shares of the item in the given column
+func (db *DB) queryShares(column string, id int64) ([]Share, error) {
+	rows, err := db.Query(`
+		SELECT s.id, s.user_id, u.username, s.content_id, s.collection_id, s.level, s.created_at
+		FROM shares s
+		JOIN users u ON u.id = s.user_id
+		WHERE s.`+column+` = ?
+		ORDER BY u.username`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	shares := []Share{}
+	for rows.Next() {
+		var share Share
+		var contentID, collectionID sql.NullInt64
+		err := rows.Scan(
+			&share.ID,
+			&share.UserID,
+			&share.Username,
+			&contentID,
+			&collectionID,
+			&share.Level,
+			&share.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		share.ContentID = nullableID(contentID)
+		share.CollectionID = nullableID(collectionID)
+		shares = append(shares, share)
+	}
+
+	return shares, rows.Err()
+}
@@ -0,0 +1,216 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+)
+
+// TagSeparator separates the levels of a hierarchical tag such as "lang/go"
+const TagSeparator = "/"
+
+// ErrTagExists is returned when a tag name is already taken
+var ErrTagExists = errors.New("tag already exists")
+
+// Tag represents a tag with its usage counts
+type Tag struct {
+	ID     int64  `json:"id"`
+	Name   string `json:"name"`
+	Parent string `json:"parent,omitempty"`
+	// Count is the number of items tagged with exactly this tag
+	Count int `json:"count"`
+	// TotalCount also includes items tagged with any descendant tag
+	TotalCount int `json:"total_count"`
+}
+
+// NormalizeTagName trims whitespace and empty levels from a tag name
+func NormalizeTagName(name string) string {
+	parts := []string{}
+	for _, part := range strings.Split(name, TagSeparator) {
+		if part = strings.TrimSpace(part); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, TagSeparator)
+}
+
+// parentTagName returns the name of a tag's parent, or "" for a top-level tag
+func parentTagName(name string) string {
+	if i := strings.LastIndex(name, TagSeparator); i >= 0 {
+		return name[:i]
+	}
+	return ""
+}
+
+// TagFilterSQL returns a condition restricting the given content ID column to
+// items tagged with the tag or any of its descendants
+func TagFilterSQL(column, tag string) (string, []interface{}) {
+	return column + ` IN (
+			SELECT ct.content_id
+			FROM content_tags ct
+			JOIN tags t ON ct.tag_id = t.id
+			WHERE t.name = ? OR substr(t.name, 1, length(?) + 1) = ? || '` + TagSeparator + `'
+		)`, []interface{}{tag, tag, tag}
+}
+
+// TagMatches reports whether a content tag satisfies a tag filter, that is
+// whether it is the filter tag or one of its descendants
+func TagMatches(contentTag, filterTag string) bool {
+	return contentTag == filterTag || strings.HasPrefix(contentTag, filterTag+TagSeparator)
+}
+
+// ListTags retrieves the user's tags with their usage counts
+func (db *DB) ListTags(userID int64) ([]Tag, error) {
+	rows, err := db.Query(`
+		SELECT t.id, t.name,
+			(SELECT COUNT(*) FROM content_tags ct WHERE ct.tag_id = t.id),
+			(SELECT COUNT(DISTINCT ct.content_id)
+				FROM content_tags ct
+				JOIN tags d ON d.id = ct.tag_id
+				WHERE d.owner_id = t.owner_id
+					AND (d.name = t.name OR substr(d.name, 1, length(t.name) + 1) = t.name || '`+TagSeparator+`'))
+		FROM tags t
+		WHERE t.owner_id = ?
+		ORDER BY t.name`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := []Tag{}
+	for rows.Next() {
+		var tag Tag
+		if err := rows.Scan(&tag.ID, &tag.Name, &tag.Count, &tag.TotalCount); err != nil {
+			return nil, err
+		}
+		tag.Parent = parentTagName(tag.Name)
+		tags = append(tags, tag)
+	}
+
+	return tags, rows.Err()
+}
+
+// GetTag retrieves one of the user's tags with its usage counts
+func (db *DB) GetTag(userID, id int64) (*Tag, error) {
+	tags, err := db.ListTags(userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, tag := range tags {
+		if tag.ID == id {
+			return &tag, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+// CreateTag creates a new tag in the user's namespace
+func (db *DB) CreateTag(userID int64, name string) (int64, error) {
+	var existing int64
+	err := db.QueryRow("SELECT id FROM tags WHERE owner_id = ? AND name = ?", userID, name).Scan(&existing)
+	if err == nil {
+		return 0, ErrTagExists
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+
+	res, err := db.Exec("INSERT INTO tags (owner_id, name) VALUES (?, ?)", userID, name)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.LastInsertId()
+}
+
+// RenameTag renames one of the user's tags. Descendant tags are renamed along
+// with it, so renaming "lang" to "language" turns "lang/go" into "language/go".
+func (db *DB) RenameTag(userID, id int64, name string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var oldName string
+	if err := tx.QueryRow("SELECT name FROM tags WHERE id = ? AND owner_id = ?", id, userID).Scan(&oldName); err != nil {
+		return err
+	}
+	if oldName == name {
+		return nil
+	}
+
+	// Refuse renames that would collide with an existing tag
+	var conflicts int
+	err = tx.QueryRow(`
+		SELECT COUNT(*) FROM tags t
+		WHERE t.owner_id = ? AND t.name IN (
+			SELECT ? || substr(d.name, length(?) + 1)
+			FROM tags d
+			WHERE d.owner_id = ? AND (d.name = ? OR substr(d.name, 1, length(?) + 1) = ? || '`+TagSeparator+`')
+		)`, userID, name, oldName, userID, oldName, oldName, oldName).Scan(&conflicts)
+	if err != nil {
+		return err
+	}
+	if conflicts > 0 {
+		return ErrTagExists
+	}
+
+	_, err = tx.Exec(`
+		UPDATE tags
+		SET name = ? || substr(name, length(?) + 1)
+		WHERE owner_id = ? AND (name = ? OR substr(name, 1, length(?) + 1) = ? || '`+TagSeparator+`')`,
+		name, oldName, userID, oldName, oldName, oldName)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// MergeTags relinks all content tagged with any of the source tags to the
+// target tag and deletes the source tags. All of them must be the user's.
+func (db *DB) MergeTags(userID int64, sourceIDs []int64, targetID int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var found int64
+	if err := tx.QueryRow("SELECT id FROM tags WHERE id = ? AND owner_id = ?", targetID, userID).Scan(&found); err != nil {
+		return err
+	}
+
+	for _, sourceID := range sourceIDs {
+		if sourceID == targetID {
+			continue
+		}
+
+		if err := tx.QueryRow("SELECT id FROM tags WHERE id = ? AND owner_id = ?", sourceID, userID).Scan(&found); err != nil {
+			return err
+		}
+
+		_, err := tx.Exec(`
+			INSERT OR IGNORE INTO content_tags (content_id, tag_id)
+			SELECT content_id, ? FROM content_tags WHERE tag_id = ?`, targetID, sourceID)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec("DELETE FROM tags WHERE id = ?", sourceID); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// DeleteTag deletes one of the user's tags and unlinks it from all content
+func (db *DB) DeleteTag(userID, id int64) error {
+	res, err := db.Exec("DELETE FROM tags WHERE id = ? AND owner_id = ?", id, userID)
+	if err != nil {
+		return err
+	}
+	return expectRow(res)
+}
@@ -0,0 +1,206 @@
+package db
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Token scopes. Each scope includes the ones before it, so a write token can
+// also read and an admin token can do everything.
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+	ScopeAdmin = "admin"
+)
+
+// scopeLevels orders the scopes from least to most privileged
+var scopeLevels = map[string]int{
+	ScopeRead:  1,
+	ScopeWrite: 2,
+	ScopeAdmin: 3,
+}
+
+// tokenPrefix marks strings as PKB API tokens
+const tokenPrefix = "pkb_"
+
+// ErrInvalidToken is returned for unknown or revoked tokens
+var ErrInvalidToken = errors.New("invalid or revoked API token")
+
+// APIToken represents a personal API token. The token itself is only
+// available when it is created.
+type APIToken struct {
+	ID         int64    `json:"id"`
+	UserID     int64    `json:"user_id"`
+	Name       string   `json:"name"`
+	Prefix     string   `json:"prefix"`
+	Scopes     []string `json:"scopes"`
+	CreatedAt  string   `json:"created_at"`
+	LastUsedAt *string  `json:"last_used_at"`
+	RevokedAt  *string  `json:"revoked_at,omitempty"`
+}
+
+// HasScope reports whether the token grants the given scope
+func (t *APIToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if scopeLevels[s] >= scopeLevels[scope] {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateScopes checks that every scope is known
+func ValidateScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return errors.New("at least one scope is required")
+	}
+	for _, scope := range scopes {
+		if _, ok := scopeLevels[scope]; !ok {
+			return fmt.Errorf("unknown scope %q, expected read, write or admin", scope)
+		}
+	}
+	return nil
+}
+
+// hashToken returns the stored form of a token
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateAPIToken generates a new token acting as the given user with the given
+// scopes. It returns the token, which cannot be retrieved again, along with
+// its record.
+func (db *DB) CreateAPIToken(userID int64, name string, scopes []string) (string, *APIToken, error) {
+	if err := ValidateScopes(scopes); err != nil {
+		return "", nil, err
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, err
+	}
+	token := tokenPrefix + base64.RawURLEncoding.EncodeToString(secret)
+	prefix := token[:len(tokenPrefix)+6]
+
+	res, err := db.Exec(`
+		INSERT INTO api_tokens (user_id, name, token_hash, prefix, scopes)
+		VALUES (?, ?, ?, ?, ?)`,
+		userID, name, hashToken(token), prefix, strings.Join(scopes, ","))
+	if err != nil {
+		return "", nil, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return "", nil, err
+	}
+
+	created, err := db.GetAPIToken(id)
+	if err != nil {
+		return "", nil, err
+	}
+	return token, created, nil
+}
+
+// GetAPIToken retrieves a token record by ID
+func (db *DB) GetAPIToken(id int64) (*APIToken, error) {
+	tokens, err := db.queryAPITokens("WHERE id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &tokens[0], nil
+}
+
+// ListAPITokens retrieves all token records, including revoked ones
+func (db *DB) ListAPITokens() ([]APIToken, error) {
+	return db.queryAPITokens("ORDER BY id")
+}
+
+// CountAPITokens returns the number of tokens that have not been revoked
+func (db *DB) CountAPITokens() (int, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM api_tokens WHERE revoked_at IS NULL").Scan(&count)
+	return count, err
+}
+
+// RevokeAPIToken revokes a token so it can no longer be used
+func (db *DB) RevokeAPIToken(id int64) error {
+	res, err := db.Exec(`
+		UPDATE api_tokens SET revoked_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND revoked_at IS NULL`, id)
+	if err != nil {
+		return err
+	}
+	return expectRow(res)
+}
+
+// AuthenticateAPIToken looks up a valid token and records that it was used
+func (db *DB) AuthenticateAPIToken(token string) (*APIToken, error) {
+	if !strings.HasPrefix(token, tokenPrefix) {
+		return nil, ErrInvalidToken
+	}
+
+	tokens, err := db.queryAPITokens("WHERE token_hash = ? AND revoked_at IS NULL", hashToken(token))
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, ErrInvalidToken
+	}
+
+	if _, err := db.Exec("UPDATE api_tokens SET last_used_at = CURRENT_TIMESTAMP WHERE id = ?", tokens[0].ID); err != nil {
+		return nil, err
+	}
+	return &tokens[0], nil
+}
+
+// queryAPITokens runs a token query with the given WHERE/ORDER BY clause
+func (db *DB) queryAPITokens(clause string, args ...interface{}) ([]APIToken, error) {
+	rows, err := db.Query(`
+		SELECT id, COALESCE(user_id, 0), name, prefix, scopes, created_at, last_used_at, revoked_at
+		FROM api_tokens `+clause, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []APIToken{}
+	for rows.Next() {
+		var token APIToken
+		var scopes string
+		var lastUsedAt, revokedAt sql.NullString
+		err := rows.Scan(
+			&token.ID,
+			&token.UserID,
+			&token.Name,
+			&token.Prefix,
+			&scopes,
+			&token.CreatedAt,
+			&lastUsedAt,
+			&revokedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		token.Scopes = strings.Split(scopes, ",")
+		if lastUsedAt.Valid {
+			token.LastUsedAt = &lastUsedAt.String
+		}
+		if revokedAt.Valid {
+			token.RevokedAt = &revokedAt.String
+		}
+		tokens = append(tokens, token)
+	}
+
+	return tokens, rows.Err()
+}
@@ -0,0 +1,112 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Usage records one AI API call
+type Usage struct {
+	// Vault is the vault the call was for, "" for the main knowledge base
+	Vault            string
+	Provider         string
+	Model            string
+	Operation        string
+	ContentID        int64
+	Inputs           int
+	PromptTokens     int
+	CompletionTokens int
+	Cost             float64
+}
+
+// UsageTotal sums the AI API calls of one operation and model in a period
+type UsageTotal struct {
+	Vault            string  `json:"vault,omitempty"`
+	Period           string  `json:"period"`
+	Operation        string  `json:"operation"`
+	Model            string  `json:"model"`
+	Calls            int     `json:"calls"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	Cost             float64 `json:"cost"`
+}
+
+// Usage periods
+const (
+	UsageDay   = "day"
+	UsageMonth = "month"
+)
+
+// usagePeriodFormats maps periods to the strftime format grouping them
+var usagePeriodFormats = map[string]string{
+	UsageDay:   "%Y-%m-%d",
+	UsageMonth: "%Y-%m",
+}
+
+// RecordUsage stores an AI API call
+func (db *DB) RecordUsage(usage Usage) error {
+	contentID := sql.NullInt64{Int64: usage.ContentID, Valid: usage.ContentID != 0}
+	_, err := db.Exec(`
+		INSERT INTO usage (vault, provider, model, operation, content_id, inputs, prompt_tokens, completion_tokens, cost)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		usage.Vault, usage.Provider, usage.Model, usage.Operation, contentID, usage.Inputs,
+		usage.PromptTokens, usage.CompletionTokens, usage.Cost)
+	return err
+}
+
+// UsageCost returns the estimated cost of the AI API calls made since the
+// start of the current (UTC) day or month, across all vaults
+func (db *DB) UsageCost(period string) (float64, error) {
+	start := "start of day"
+	if period == UsageMonth {
+		start = "start of month"
+	}
+
+	var cost float64
+	err := db.QueryRow("SELECT COALESCE(SUM(cost), 0) FROM usage WHERE created_at >= datetime('now', ?)", start).Scan(&cost)
+	return cost, err
+}
+
+// UsageTotals sums the AI API calls by vault, day or month, operation and
+// model over the last n periods, including the current one, newest first.
+// Given a vault, only its calls are summed; otherwise every vault's are.
+func (db *DB) UsageTotals(period string, n int, vault string) ([]UsageTotal, error) {
+	format, ok := usagePeriodFormats[period]
+	if !ok {
+		return nil, fmt.Errorf("unknown usage period %q", period)
+	}
+	since := fmt.Sprintf("datetime('now', 'start of day', '-%d days')", n-1)
+	if period == UsageMonth {
+		since = fmt.Sprintf("datetime('now', 'start of month', '-%d months')", n-1)
+	}
+
+	condition := "created_at >= " + since
+	args := []interface{}{format}
+	if vault != "" {
+		condition += " AND vault = ?"
+		args = append(args, vault)
+	}
+
+	rows, err := db.Query(`
+		SELECT vault, strftime(?, created_at) AS period, operation, model, COUNT(*),
+			SUM(prompt_tokens), SUM(completion_tokens), SUM(cost)
+		FROM usage
+		WHERE `+condition+`
+		GROUP BY vault, period, operation, model
+		ORDER BY period DESC, vault, operation, model`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	totals := []UsageTotal{}
+	for rows.Next() {
+		var total UsageTotal
+		if err := rows.Scan(&total.Vault, &total.Period, &total.Operation, &total.Model, &total.Calls,
+			&total.PromptTokens, &total.CompletionTokens, &total.Cost); err != nil {
+			return nil, err
+		}
+		totals = append(totals, total)
+	}
+	return totals, rows.Err()
+}
@@ -0,0 +1,190 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+)
+
+// DefaultUsername names the user created for single-user setups
+const DefaultUsername = "local"
+
+var (
+	// ErrUserExists is returned when a username is already taken
+	ErrUserExists = errors.New("user already exists")
+	// ErrInvalidUsername is returned for empty usernames or ones containing whitespace
+	ErrInvalidUsername = errors.New("username must be non-empty and contain no whitespace")
+)
+
+// User represents a person with their own content, tags and collections
+type User struct {
+	ID          int64  `json:"id"`
+	Username    string `json:"username"`
+	DisplayName string `json:"display_name,omitempty"`
+	CreatedAt   string `json:"created_at"`
+}
+
+// unownedTables lists the tables whose rows predate users, with the column
+// naming their owner
+var unownedTables = []struct{ table, column string }{
+	{"content", "owner_id"},
+	{"tags", "owner_id"},
+	{"collections", "owner_id"},
+	{"clusters", "owner_id"},
+	{"api_tokens", "user_id"},
+}
+
+// CreateUser creates a user. The first user also takes ownership of
+// everything created before the knowledge base had users.
+func (db *DB) CreateUser(username, displayName string) (int64, error) {
+	username = strings.TrimSpace(username)
+	if username == "" || strings.ContainsAny(username, " \t\r\n") {
+		return 0, ErrInvalidUsername
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	id, err := createUser(tx, username, displayName)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// createUser inserts a user and claims unowned rows if it is the first one
+func createUser(tx *sql.Tx, username, displayName string) (int64, error) {
+	var existing int64
+	err := tx.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&existing)
+	if err == nil {
+		return 0, ErrUserExists
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+
+	res, err := tx.Exec("INSERT INTO users (username, display_name) VALUES (?, ?)", username, displayName)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM users").Scan(&count); err != nil {
+		return 0, err
+	}
+	if count == 1 {
+		for _, t := range unownedTables {
+			if _, err := tx.Exec("UPDATE "+t.table+" SET "+t.column+" = ? WHERE "+t.column+" IS NULL", id); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return id, nil
+}
+
+// DefaultUserID returns the user that acts when authentication is disabled or
+// the database is opened directly: the first user, or a new "local" user if
+// there are none yet
+func (db *DB) DefaultUserID() (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var id int64
+	err = tx.QueryRow("SELECT id FROM users ORDER BY id LIMIT 1").Scan(&id)
+	if err == nil {
+		return id, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+
+	if id, err = createUser(tx, DefaultUsername, ""); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// SyncUser stores a copy of a user from another database under the same ID.
+// Vaults keep such copies of the users from the main database so ownership
+// and shares can refer to them.
+func (db *DB) SyncUser(user *User) error {
+	_, err := db.Exec(`
+		INSERT INTO users (id, username, display_name, created_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET username = excluded.username, display_name = excluded.display_name`,
+		user.ID, user.Username, user.DisplayName, user.CreatedAt)
+	return err
+}
+
+// GetUser retrieves a user by ID
+func (db *DB) GetUser(id int64) (*User, error) {
+	users, err := db.queryUsers("WHERE id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &users[0], nil
+}
+
+// GetUserByName retrieves a user by username, ignoring case
+func (db *DB) GetUserByName(username string) (*User, error) {
+	users, err := db.queryUsers("WHERE username = ?", strings.TrimSpace(username))
+	if err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &users[0], nil
+}
+
+// ListUsers retrieves all users
+func (db *DB) ListUsers() ([]User, error) {
+	return db.queryUsers("ORDER BY id")
+}
+
+// CountUsers returns the number of users
+func (db *DB) CountUsers() (int, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM users").Scan(&count)
+	return count, err
+}
+
+// queryUsers runs a user query with the given WHERE/ORDER BY clause
+func (db *DB) queryUsers(clause string, args ...interface{}) ([]User, error) {
+	rows, err := db.Query("SELECT id, username, display_name, created_at FROM users "+clause, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		var user User
+		if err := rows.Scan(&user.ID, &user.Username, &user.DisplayName, &user.CreatedAt); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
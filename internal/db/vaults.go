@@ -0,0 +1,114 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"regexp"
+)
+
+var (
+	// ErrVaultExists is returned when a vault name is already taken
+	ErrVaultExists = errors.New("vault already exists")
+	// ErrInvalidVaultName is returned for names that are not safe as a
+	// directory name and URL segment
+	ErrInvalidVaultName = errors.New("vault name must be 1-64 lowercase letters, digits, '-' or '_', starting with a letter or digit")
+)
+
+// vaultNamePattern matches valid vault names
+var vaultNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// Vault is a separate knowledge base with its own database file
+type Vault struct {
+	ID         int64   `json:"id"`
+	Name       string  `json:"name"`
+	CreatedAt  string  `json:"created_at"`
+	ArchivedAt *string `json:"archived_at,omitempty"`
+}
+
+// ValidateVaultName checks that a vault name can be used as a directory name
+// and URL segment
+func ValidateVaultName(name string) error {
+	if !vaultNamePattern.MatchString(name) {
+		return ErrInvalidVaultName
+	}
+	return nil
+}
+
+// CreateVault records a new vault
+func (db *DB) CreateVault(name string) (*Vault, error) {
+	if err := ValidateVaultName(name); err != nil {
+		return nil, err
+	}
+
+	_, err := db.GetVault(name)
+	if err == nil {
+		return nil, ErrVaultExists
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	if _, err := db.Exec("INSERT INTO vaults (name) VALUES (?)", name); err != nil {
+		return nil, err
+	}
+	return db.GetVault(name)
+}
+
+// GetVault retrieves a vault by name
+func (db *DB) GetVault(name string) (*Vault, error) {
+	vaults, err := db.queryVaults("WHERE name = ?", name)
+	if err != nil {
+		return nil, err
+	}
+	if len(vaults) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &vaults[0], nil
+}
+
+// ListVaults retrieves all vaults, archived ones included
+func (db *DB) ListVaults() ([]Vault, error) {
+	return db.queryVaults("ORDER BY name")
+}
+
+// ArchiveVault marks a vault as archived. Its database file is kept.
+func (db *DB) ArchiveVault(name string) error {
+	res, err := db.Exec("UPDATE vaults SET archived_at = CURRENT_TIMESTAMP WHERE name = ? AND archived_at IS NULL", name)
+	if err != nil {
+		return err
+	}
+	return expectRow(res)
+}
+
+// RestoreVault brings an archived vault back into use
+func (db *DB) RestoreVault(name string) error {
+	res, err := db.Exec("UPDATE vaults SET archived_at = NULL WHERE name = ? AND archived_at IS NOT NULL", name)
+	if err != nil {
+		return err
+	}
+	return expectRow(res)
+}
+
+// queryVaults runs a vault query with the given WHERE/ORDER BY clause
+func (db *DB) queryVaults(clause string, args ...interface{}) ([]Vault, error) {
+	rows, err := db.Query("SELECT id, name, created_at, archived_at FROM vaults "+clause, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	vaults := []Vault{}
+	for rows.Next() {
+		var vault Vault
+		var archivedAt sql.NullString
+		if err := rows.Scan(&vault.ID, &vault.Name, &vault.CreatedAt, &archivedAt); err != nil {
+			return nil, err
+		}
+		if archivedAt.Valid {
+			vault.ArchivedAt = &archivedAt.String
+		}
+		vaults = append(vaults, vault)
+	}
+
+	return vaults, rows.Err()
+}
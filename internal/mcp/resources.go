@@ -0,0 +1,139 @@
+package mcp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/rgehrsitz/me/internal/db"
+)
+
+// contentURIPrefix prefixes the URI of every content resource
+const contentURIPrefix = "pkb://content/"
+
+// resourcePageSize is the number of resources returned per resources/list page
+const resourcePageSize = 100
+
+// resource describes a content item in resources/list
+type resource struct {
+	URI         string `json:"uri"`
+	Name        string `json:"name"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	MimeType    string `json:"mimeType"`
+}
+
+// resourceTemplates lets clients address any content item by ID
+var resourceTemplates = []map[string]interface{}{
+	{
+		"uriTemplate": contentURIPrefix + "{id}",
+		"name":        "content",
+		"title":       "Content item",
+		"description": "A note, snippet, bookmark or document in the knowledge base",
+		"mimeType":    "text/markdown",
+	},
+}
+
+// listResources lists content items, newest first. The cursor is the one
+// ListContent returns for the next page.
+func (s *Server) listResources(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p struct {
+		Cursor string `json:"cursor"`
+	}
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, &rpcError{Code: codeInvalidParams, Message: err.Error()}
+		}
+	}
+
+	page, err := s.db.ListContent(userFrom(ctx), db.ContentFilter{Limit: resourcePageSize, Cursor: p.Cursor})
+	if errors.Is(err, db.ErrInvalidCursor) {
+		return nil, &rpcError{Code: codeInvalidParams, Message: "invalid cursor"}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	resources := make([]resource, 0, len(page.Items))
+	for _, content := range page.Items {
+		resources = append(resources, resource{
+			URI:         contentURI(content.ID),
+			Name:        content.Title,
+			Title:       content.Title,
+			Description: fmt.Sprintf("%s, updated %s", content.Type, content.UpdatedAt),
+			MimeType:    "text/markdown",
+		})
+	}
+
+	result := map[string]interface{}{"resources": resources}
+	if page.NextCursor != "" {
+		result["nextCursor"] = page.NextCursor
+	}
+	return result, nil
+}
+
+// readResource returns a content item as Markdown
+func (s *Server) readResource(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p struct {
+		URI string `json:"uri"`
+	}
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, &rpcError{Code: codeInvalidParams, Message: err.Error()}
+	}
+
+	id, err := strconv.ParseInt(strings.TrimPrefix(p.URI, contentURIPrefix), 10, 64)
+	if err != nil || !strings.HasPrefix(p.URI, contentURIPrefix) {
+		return nil, &rpcError{Code: codeInvalidParams, Message: fmt.Sprintf("unknown resource: %s", p.URI)}
+	}
+
+	content, err := s.getContent(userFrom(ctx), id)
+	if err != nil {
+		return nil, &rpcError{Code: codeInvalidParams, Message: err.Error()}
+	}
+
+	return map[string]interface{}{
+		"contents": []map[string]interface{}{
+			{
+				"uri":      p.URI,
+				"mimeType": "text/markdown",
+				"text":     renderMarkdown(content),
+			},
+		},
+	}, nil
+}
+
+// contentURI returns the resource URI of a content item
+func contentURI(id int64) string {
+	return contentURIPrefix + strconv.FormatInt(id, 10)
+}
+
+// renderMarkdown formats a content item with its metadata as a header
+func renderMarkdown(content *db.Content) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n", content.Title)
+	fmt.Fprintf(&b, "- Type: %s\n", content.Type)
+	if content.Language != "" {
+		fmt.Fprintf(&b, "- Language: %s\n", content.Language)
+	}
+	if len(content.Tags) > 0 {
+		fmt.Fprintf(&b, "- Tags: %s\n", strings.Join(content.Tags, ", "))
+	}
+	if content.SourceURL != "" {
+		fmt.Fprintf(&b, "- Source: %s\n", content.SourceURL)
+	}
+	fmt.Fprintf(&b, "- Updated: %s\n\n", content.UpdatedAt)
+	if content.Type == "snippet" {
+		// Fence the code, with a fence longer than any run of backquotes in it
+		fence := "```"
+		for strings.Contains(content.Body, fence) {
+			fence += "`"
+		}
+		fmt.Fprintf(&b, "%s%s\n%s\n%s\n", fence, content.Language, strings.TrimRight(content.Body, "\n"), fence)
+		return b.String()
+	}
+	b.WriteString(content.Body)
+	return b.String()
+}
@@ -0,0 +1,267 @@
+// Package mcp exposes the knowledge base to AI assistants over the Model
+// Context Protocol, using JSON-RPC 2.0 over stdio or HTTP.
+package mcp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/rgehrsitz/me/internal/db"
+	"github.com/rgehrsitz/me/internal/services"
+)
+
+// ProtocolVersion is the MCP revision this server implements
+const ProtocolVersion = "2025-06-18"
+
+// Version is reported to clients in serverInfo and may be set at build time
+// with -ldflags "-X github.com/rgehrsitz/me/internal/mcp.Version=..."
+var Version = "dev"
+
+// supportedVersions lists the protocol revisions a client may negotiate
+var supportedVersions = map[string]bool{
+	"2024-11-05": true,
+	"2025-03-26": true,
+	"2025-06-18": true,
+}
+
+// JSON-RPC error codes
+const (
+	codeParseError     = -32700
+	codeInvalidRequest = -32600
+	codeMethodNotFound = -32601
+	codeInvalidParams  = -32602
+	codeInternalError  = -32603
+)
+
+// Server answers MCP requests against the knowledge base
+type Server struct {
+	db            *db.DB
+	searchService *services.SearchService
+	// onCreate is called after a note is created, e.g. to embed it. It must
+	// not block; slow work belongs in a goroutine.
+	onCreate func(id int64, body string)
+}
+
+// userKey is the context key holding the ID of the user a request acts as
+type userKey struct{}
+
+// WithUser returns a context in which MCP requests act as the given user
+func WithUser(ctx context.Context, userID int64) context.Context {
+	return context.WithValue(ctx, userKey{}, userID)
+}
+
+// userFrom returns the user a request acts as
+func userFrom(ctx context.Context) int64 {
+	userID, _ := ctx.Value(userKey{}).(int64)
+	return userID
+}
+
+// tokenKey is the context key holding the API token a request was made with
+type tokenKey struct{}
+
+// WithToken returns a context in which MCP requests may only call the tools
+// the token's scopes allow. Without a token, as over stdio or with
+// authentication disabled, every tool may be called.
+func WithToken(ctx context.Context, token *db.APIToken) context.Context {
+	return context.WithValue(ctx, tokenKey{}, token)
+}
+
+// allowed reports whether a request may use something needing the scope
+func allowed(ctx context.Context, scope string) bool {
+	token, _ := ctx.Value(tokenKey{}).(*db.APIToken)
+	return token == nil || token.HasScope(scope)
+}
+
+// NewServer creates a new MCP server. onCreate may be nil.
+func NewServer(db *db.DB, searchService *services.SearchService, onCreate func(id int64, body string)) *Server {
+	return &Server{
+		db:            db,
+		searchService: searchService,
+		onCreate:      onCreate,
+	}
+}
+
+// request is a JSON-RPC request or notification
+type request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+// response is a JSON-RPC response
+type response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+// rpcError is a JSON-RPC error object
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+// Handle processes a single JSON-RPC message and returns the encoded
+// response, or nil for notifications
+func (s *Server) Handle(ctx context.Context, message []byte) []byte {
+	var req request
+	if err := json.Unmarshal(message, &req); err != nil {
+		return encode(response{
+			JSONRPC: "2.0",
+			ID:      json.RawMessage("null"),
+			Error:   &rpcError{Code: codeParseError, Message: fmt.Sprintf("parse error: %v", err)},
+		})
+	}
+
+	// Notifications carry no ID and get no response
+	if len(req.ID) == 0 {
+		return nil
+	}
+
+	resp := response{JSONRPC: "2.0", ID: req.ID}
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		resp.Error = &rpcError{Code: codeInvalidRequest, Message: "invalid JSON-RPC 2.0 request"}
+		return encode(resp)
+	}
+
+	result, err := s.dispatch(ctx, req.Method, req.Params)
+	if err != nil {
+		rpcErr, ok := err.(*rpcError)
+		if !ok {
+			rpcErr = &rpcError{Code: codeInternalError, Message: err.Error()}
+		}
+		resp.Error = rpcErr
+	} else {
+		resp.Result = result
+	}
+
+	return encode(resp)
+}
+
+// dispatch routes a request to its method handler
+func (s *Server) dispatch(ctx context.Context, method string, params json.RawMessage) (interface{}, error) {
+	switch method {
+	case "initialize":
+		return s.initialize(params)
+	case "ping":
+		return struct{}{}, nil
+	case "tools/list":
+		return map[string]interface{}{"tools": listTools(ctx)}, nil
+	case "tools/call":
+		return s.callTool(ctx, params)
+	case "resources/list":
+		return s.listResources(ctx, params)
+	case "resources/templates/list":
+		return map[string]interface{}{"resourceTemplates": resourceTemplates}, nil
+	case "resources/read":
+		return s.readResource(ctx, params)
+	default:
+		return nil, &rpcError{Code: codeMethodNotFound, Message: fmt.Sprintf("method not found: %s", method)}
+	}
+}
+
+// initialize negotiates the protocol version and advertises capabilities
+func (s *Server) initialize(params json.RawMessage) (interface{}, error) {
+	var p struct {
+		ProtocolVersion string `json:"protocolVersion"`
+	}
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, &rpcError{Code: codeInvalidParams, Message: err.Error()}
+		}
+	}
+
+	version := ProtocolVersion
+	if supportedVersions[p.ProtocolVersion] {
+		version = p.ProtocolVersion
+	}
+
+	return map[string]interface{}{
+		"protocolVersion": version,
+		"capabilities": map[string]interface{}{
+			"tools":     map[string]interface{}{},
+			"resources": map[string]interface{}{},
+		},
+		"serverInfo": map[string]interface{}{
+			"name":    "pkb",
+			"version": Version,
+		},
+		"instructions": "Personal knowledge base of notes, code snippets, bookmarks and documents. " +
+			"Use search to find items, get_content to read one, related to explore similar items, " +
+			"and create_note to save new knowledge.",
+	}, nil
+}
+
+// ServeStdio reads newline-delimited JSON-RPC messages from r and writes
+// responses to w until r is exhausted or ctx is cancelled
+func (s *Server) ServeStdio(ctx context.Context, r io.Reader, w io.Writer) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+
+	for scanner.Scan() {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		if resp := s.Handle(ctx, line); resp != nil {
+			if _, err := w.Write(append(resp, '\n')); err != nil {
+				return err
+			}
+		}
+	}
+
+	return scanner.Err()
+}
+
+// ServeHTTP implements the Streamable HTTP transport for clients that send
+// one JSON-RPC message per POST and accept a JSON response
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "MCP endpoint only accepts POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	message, err := io.ReadAll(io.LimitReader(r.Body, 16*1024*1024))
+	if err != nil {
+		http.Error(w, "failed to read request", http.StatusBadRequest)
+		return
+	}
+
+	resp := s.Handle(r.Context(), message)
+	if resp == nil {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
+
+// encode marshals a response, which cannot fail for the types used here
+func encode(resp response) []byte {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		data, _ = json.Marshal(response{
+			JSONRPC: "2.0",
+			ID:      resp.ID,
+			Error:   &rpcError{Code: codeInternalError, Message: err.Error()},
+		})
+	}
+	return data
+}
@@ -0,0 +1,309 @@
+package mcp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/rgehrsitz/me/internal/db"
+	"github.com/rgehrsitz/me/internal/models"
+)
+
+// tool describes a tool advertised by tools/list
+type tool struct {
+	Name        string                 `json:"name"`
+	Title       string                 `json:"title,omitempty"`
+	Description string                 `json:"description"`
+	InputSchema map[string]interface{} `json:"inputSchema"`
+	// scope is the API token scope needed to call the tool
+	scope string
+}
+
+// toolDefinitions lists the tools this server provides
+var toolDefinitions = []tool{
+	{
+		Name:        "search",
+		Title:       "Search knowledge base",
+		Description: "Search notes, snippets, bookmarks and documents by keyword, meaning (semantic) or both (hybrid).",
+		InputSchema: objectSchema(map[string]interface{}{
+			"query":      stringProperty(`Text to search for. Supports "exact phrases", -excluded words and filters such as tag:go, -tag:draft, type:snippet, language:go, title:word, url:github.com and created:>2024-01 or updated:2024-01..2024-03`),
+			"mode":       enumProperty("Search mode, defaults to keyword", "keyword", "semantic", "hybrid"),
+			"type":       enumProperty("Only return content of this type", "note", "snippet", "bookmark", "document"),
+			"language":   stringProperty("Only return snippets in this language, e.g. go or sql"),
+			"tags":       arrayProperty("Only return content carrying all of these tags"),
+			"collection": integerProperty("Only return content filed in this collection"),
+			"sort":       enumProperty("Order of the results, defaults to relevance", "relevance", "created", "updated", "title"),
+			"limit":      integerProperty("Maximum number of results, defaults to 10"),
+			"cursor":     stringProperty("The next_cursor of a previous search with the same query, to get the next page of results"),
+		}, "query"),
+		scope: db.ScopeRead,
+	},
+	{
+		Name:        "get_content",
+		Title:       "Get content item",
+		Description: "Get the full text, tags and metadata of a content item by ID.",
+		InputSchema: objectSchema(map[string]interface{}{
+			"id": integerProperty("ID of the content item"),
+		}, "id"),
+		scope: db.ScopeRead,
+	},
+	{
+		Name:        "create_note",
+		Title:       "Create note",
+		Description: "Save a new note to the knowledge base. The body may be Markdown and may link other items with [[Title]].",
+		InputSchema: objectSchema(map[string]interface{}{
+			"title": stringProperty("Title of the note"),
+			"body":  stringProperty("Body of the note"),
+			"tags":  arrayProperty("Tags for the note, e.g. \"lang/go\""),
+		}, "title", "body"),
+		scope: db.ScopeWrite,
+	},
+	{
+		Name:        "list_tags",
+		Title:       "List tags",
+		Description: "List all tags with the number of items using each one.",
+		InputSchema: objectSchema(map[string]interface{}{}),
+		scope:       db.ScopeRead,
+	},
+	{
+		Name:        "related",
+		Title:       "Find related content",
+		Description: "Find the content most similar in meaning to a given item.",
+		InputSchema: objectSchema(map[string]interface{}{
+			"id":    integerProperty("ID of the content item"),
+			"limit": integerProperty("Maximum number of results, defaults to 10"),
+		}, "id"),
+		scope: db.ScopeRead,
+	},
+}
+
+// callTool runs a tool. Failures of the tool itself are reported in the
+// result so the model can see them, not as protocol errors.
+func (s *Server) callTool(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	}
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, &rpcError{Code: codeInvalidParams, Message: err.Error()}
+	}
+	if len(p.Arguments) == 0 || string(p.Arguments) == "null" {
+		p.Arguments = json.RawMessage("{}")
+	}
+
+	def, ok := findTool(p.Name)
+	if !ok {
+		return nil, &rpcError{Code: codeInvalidParams, Message: fmt.Sprintf("unknown tool: %s", p.Name)}
+	}
+	if !allowed(ctx, def.scope) {
+		return toolResult(fmt.Sprintf("The API token lacks the %s scope needed by %s", def.scope, def.Name), true), nil
+	}
+
+	var (
+		result interface{}
+		err    error
+	)
+	switch p.Name {
+	case "search":
+		result, err = s.searchTool(ctx, p.Arguments)
+	case "get_content":
+		result, err = s.getContentTool(ctx, p.Arguments)
+	case "create_note":
+		result, err = s.createNoteTool(ctx, p.Arguments)
+	case "list_tags":
+		result, err = s.db.ListTags(userFrom(ctx))
+	case "related":
+		result, err = s.relatedTool(ctx, p.Arguments)
+	default:
+		return nil, &rpcError{Code: codeInvalidParams, Message: fmt.Sprintf("unknown tool: %s", p.Name)}
+	}
+
+	if err != nil {
+		return toolResult(err.Error(), true), nil
+	}
+
+	text, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return toolResult(string(text), false), nil
+}
+
+// findTool returns the definition of the named tool
+func findTool(name string) (tool, bool) {
+	for _, t := range toolDefinitions {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return tool{}, false
+}
+
+// listTools returns the tools the request's token may call
+func listTools(ctx context.Context) []tool {
+	tools := []tool{}
+	for _, t := range toolDefinitions {
+		if allowed(ctx, t.scope) {
+			tools = append(tools, t)
+		}
+	}
+	return tools
+}
+
+// searchTool runs a search through the search service
+func (s *Server) searchTool(ctx context.Context, arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		Query      string   `json:"query"`
+		Mode       string   `json:"mode"`
+		Type       string   `json:"type"`
+		Language   string   `json:"language"`
+		Tags       []string `json:"tags"`
+		Collection int64    `json:"collection"`
+		Sort       string   `json:"sort"`
+		Limit      int      `json:"limit"`
+		Cursor     string   `json:"cursor"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, fmt.Errorf("invalid arguments: %w", err)
+	}
+	if args.Query == "" {
+		return nil, fmt.Errorf("query is required")
+	}
+	if args.Limit <= 0 {
+		args.Limit = 10
+	}
+
+	query := models.SearchQuery{
+		Query:      args.Query,
+		Type:       args.Type,
+		Language:   args.Language,
+		Tags:       args.Tags,
+		Collection: args.Collection,
+		Recursive:  true,
+		Sort:       args.Sort,
+		Limit:      args.Limit,
+		Cursor:     args.Cursor,
+	}
+	switch args.Mode {
+	case "", "keyword":
+	case "semantic":
+		query.Semantic = true
+	case "hybrid":
+		query.Hybrid = true
+	default:
+		return nil, fmt.Errorf("unknown search mode %q", args.Mode)
+	}
+
+	return s.searchService.Search(ctx, userFrom(ctx), query)
+}
+
+// getContentTool fetches a single content item, following merge redirects
+func (s *Server) getContentTool(ctx context.Context, arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		ID int64 `json:"id"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, fmt.Errorf("invalid arguments: %w", err)
+	}
+
+	return s.getContent(userFrom(ctx), args.ID)
+}
+
+// createNoteTool saves a new note
+func (s *Server) createNoteTool(ctx context.Context, arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		Title string   `json:"title"`
+		Body  string   `json:"body"`
+		Tags  []string `json:"tags"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, fmt.Errorf("invalid arguments: %w", err)
+	}
+	if args.Title == "" {
+		return nil, fmt.Errorf("title is required")
+	}
+
+	userID := userFrom(ctx)
+	id, err := s.db.CreateContent(userID, &db.Content{
+		Type:  string(models.ContentTypeNote),
+		Title: args.Title,
+		Body:  args.Body,
+		Tags:  args.Tags,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create note: %w", err)
+	}
+
+	if s.onCreate != nil && args.Body != "" {
+		s.onCreate(id, args.Body)
+	}
+
+	return s.db.GetContent(userID, id)
+}
+
+// relatedTool finds content similar to a given item
+func (s *Server) relatedTool(ctx context.Context, arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		ID    int64 `json:"id"`
+		Limit int   `json:"limit"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, fmt.Errorf("invalid arguments: %w", err)
+	}
+
+	return s.searchService.Related(ctx, userFrom(ctx), args.ID, args.Limit)
+}
+
+// getContent fetches a content item the user may read, following the
+// redirect left behind when it was merged into another item
+func (s *Server) getContent(userID, id int64) (*db.Content, error) {
+	content, err := s.db.GetContent(userID, id)
+	if err != nil {
+		if newID, redirectErr := s.db.ResolveRedirect(userID, id); redirectErr == nil {
+			return s.db.GetContent(userID, newID)
+		}
+		return nil, fmt.Errorf("content %d not found", id)
+	}
+	return content, nil
+}
+
+// toolResult wraps text in a tools/call result
+func toolResult(text string, isError bool) map[string]interface{} {
+	return map[string]interface{}{
+		"content": []map[string]interface{}{
+			{"type": "text", "text": text},
+		},
+		"isError": isError,
+	}
+}
+
+func objectSchema(properties map[string]interface{}, required ...string) map[string]interface{} {
+	schema := map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+	}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+func stringProperty(description string) map[string]interface{} {
+	return map[string]interface{}{"type": "string", "description": description}
+}
+
+func integerProperty(description string) map[string]interface{} {
+	return map[string]interface{}{"type": "integer", "description": description}
+}
+
+func arrayProperty(description string) map[string]interface{} {
+	return map[string]interface{}{
+		"type":        "array",
+		"items":       map[string]interface{}{"type": "string"},
+		"description": description,
+	}
+}
+
+func enumProperty(description string, values ...string) map[string]interface{} {
+	return map[string]interface{}{"type": "string", "enum": values, "description": description}
+}
@@ -22,6 +22,7 @@ type Content struct {
 	Body      string      `json:"body"`
 	SourceURL string      `json:"source_url,omitempty"`
 	FilePath  string      `json:"file_path,omitempty"`
+	Language  string      `json:"language,omitempty"` // of a snippet's code
 	CreatedAt time.Time   `json:"created_at"`
 	UpdatedAt time.Time   `json:"updated_at"`
 	Tags      []string    `json:"tags,omitempty"`
@@ -43,19 +44,153 @@ type Tag struct {
 	Name string `json:"name"`
 }
 
-// SearchQuery represents a search query
+// SearchQuery represents a search query. Query is written in the search
+// query language; Type and Tags add to its filters.
 type SearchQuery struct {
-	Query     string   `json:"query"`
-	Type      string   `json:"type,omitempty"`
-	Tags      []string `json:"tags,omitempty"`
-	Limit     int      `json:"limit,omitempty"`
-	Offset    int      `json:"offset,omitempty"`
-	Semantic  bool     `json:"semantic"`
+	Query      string   `json:"query"`
+	Type       string   `json:"type,omitempty"`
+	Language   string   `json:"language,omitempty"`
+	Tags       []string `json:"tags,omitempty"`
+	Collection int64    `json:"collection,omitempty"`
+	Recursive  bool     `json:"recursive,omitempty"` // include sub-collections
+	Limit      int      `json:"limit,omitempty"`
+	Offset     int      `json:"offset,omitempty"`
+	Semantic   bool     `json:"semantic"`
+	Hybrid     bool     `json:"hybrid,omitempty"` // combine keyword and semantic ranking
+	// Cursor continues the search after the page it was returned with, in
+	// place of Offset
+	Cursor string `json:"cursor,omitempty"`
+	// CreatedFrom to UpdatedTo bound the dates items were created and
+	// updated, inclusively, as YYYY, YYYY-MM or YYYY-MM-DD
+	CreatedFrom string `json:"created_from,omitempty"`
+	CreatedTo   string `json:"created_to,omitempty"`
+	UpdatedFrom string `json:"updated_from,omitempty"`
+	UpdatedTo   string `json:"updated_to,omitempty"`
+	// Sort orders the results by relevance (the default), created, updated
+	// or title, and Order by asc or desc
+	Sort  string `json:"sort,omitempty"`
+	Order string `json:"order,omitempty"`
+	// Facets asks for counts of the matching items by type, tag, snippet
+	// language and month
+	Facets bool `json:"facets,omitempty"`
 }
 
 // SearchResult represents a search result
 type SearchResult struct {
-	Content  Content `json:"content"`
-	Score    float64 `json:"score,omitempty"`
-	Snippet  string  `json:"snippet,omitempty"`
+	Content Content `json:"content"`
+	Score   float64 `json:"score,omitempty"`
+	Snippet string  `json:"snippet,omitempty"`
+}
+
+// SearchResponse represents the results of a search
+type SearchResponse struct {
+	// Query is the query in normal form, with the type and tags filters
+	// folded in
+	Query   string         `json:"query"`
+	Results []SearchResult `json:"results"`
+	// Total is how many results there are on all pages. Hybrid search, and
+	// semantic search with filters matched after decryption, can only
+	// estimate it.
+	Total          int  `json:"total"`
+	TotalEstimated bool `json:"total_estimated,omitempty"`
+	// NextCursor continues the search after this page; it is empty on the
+	// last page
+	NextCursor string        `json:"next_cursor,omitempty"`
+	Facets     *SearchFacets `json:"facets,omitempty"`
+}
+
+// SearchFacets counts the items matching a search by type, tag and month
+// created, for drilling down into the results
+type SearchFacets struct {
+	Types     []FacetCount `json:"types"`
+	Tags      []FacetCount `json:"tags"`
+	Months    []FacetCount `json:"months"`
+	Languages []FacetCount `json:"languages"`
+}
+
+// FacetCount is how many matching items have a facet value
+type FacetCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// Reasons two content items were grouped as duplicates
+const (
+	DuplicateReasonHash      = "content_hash"
+	DuplicateReasonURL       = "url"
+	DuplicateReasonEmbedding = "embedding"
+)
+
+// DuplicateGroup represents a set of content items that look like duplicates
+type DuplicateGroup struct {
+	ContentIDs []int64  `json:"content_ids"`
+	Reasons    []string `json:"reasons"`
+	Similarity float64  `json:"similarity,omitempty"`
+}
+
+// MergeRequest represents a request to merge content into a single item
+type MergeRequest struct {
+	TargetID   int64   `json:"target_id" binding:"required"`
+	ContentIDs []int64 `json:"content_ids" binding:"required"`
+}
+
+// Graph node and edge kinds
+const (
+	GraphNodeContent = "content"
+	GraphNodeTag     = "tag"
+
+	GraphEdgeLink    = "link"
+	GraphEdgeTag     = "tag"
+	GraphEdgeSimilar = "similar"
+)
+
+// GraphNode represents a content item or tag in the knowledge graph
+type GraphNode struct {
+	ID        string `json:"id"`
+	Kind      string `json:"kind"`
+	Label     string `json:"label"`
+	Type      string `json:"type,omitempty"`
+	CreatedAt string `json:"created_at,omitempty"`
+}
+
+// GraphEdge represents a relationship between two graph nodes
+type GraphEdge struct {
+	Source string  `json:"source"`
+	Target string  `json:"target"`
+	Kind   string  `json:"kind"`
+	Weight float64 `json:"weight,omitempty"`
+}
+
+// Graph represents the knowledge graph
+type Graph struct {
+	Nodes []GraphNode `json:"nodes"`
+	Edges []GraphEdge `json:"edges"`
+}
+
+// GraphOptions filters the knowledge graph
+type GraphOptions struct {
+	Types     []string
+	Tags      []string
+	From      string
+	To        string
+	Semantic  bool
+	Threshold float64
+}
+
+// MoveCollectionRequest represents a request to move a collection
+type MoveCollectionRequest struct {
+	ParentID *int64 `json:"parent_id"`
+	Position *int   `json:"position"`
+}
+
+// CollectionItemRequest represents a request to file content in a collection
+type CollectionItemRequest struct {
+	ContentID int64 `json:"content_id" binding:"required"`
+	Position  *int  `json:"position"`
+}
+
+// MergeTagsRequest represents a request to merge tags into one
+type MergeTagsRequest struct {
+	SourceIDs []int64 `json:"source_ids" binding:"required"`
+	TargetID  int64   `json:"target_id" binding:"required"`
 }
@@ -0,0 +1,364 @@
+// Package search parses the query language of the search box. A query is a
+// list of terms separated by spaces:
+//
+//	word              text that must appear in the title or body
+//	"exact phrase"    a phrase that must appear as written
+//	field:value       a filter, with the value quoted if it has spaces
+//	-term             any of the above, negated
+//
+// The filters are tag:, type:, title:, url: (a substring of the source URL),
+// language: (of a snippet, by name or alias such as golang) and created: and
+// updated:, which take a date (2024, 2024-01 or
+// 2024-01-15) optionally prefixed with >, >=, < or <=, or a range such as
+// 2024-01..2024-03. Dates are UTC. Words with a colon that is not a known
+// field, such as URLs, are plain text.
+package search
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/rgehrsitz/me/internal/code"
+	"github.com/rgehrsitz/me/internal/models"
+)
+
+// Filter fields
+const (
+	FieldTag      = "tag"
+	FieldType     = "type"
+	FieldTitle    = "title"
+	FieldURL      = "url"
+	FieldLanguage = "language"
+	FieldCreated  = "created"
+	FieldUpdated  = "updated"
+)
+
+// fields are the known filter fields
+var fields = map[string]bool{
+	FieldTag:      true,
+	FieldType:     true,
+	FieldTitle:    true,
+	FieldURL:      true,
+	FieldLanguage: true,
+	FieldCreated:  true,
+	FieldUpdated:  true,
+}
+
+// contentTypes are the values type: accepts
+var contentTypes = []models.ContentType{
+	models.ContentTypeNote,
+	models.ContentTypeSnippet,
+	models.ContentTypeBookmark,
+	models.ContentTypeDocument,
+}
+
+// Query is a parsed search query
+type Query struct {
+	Terms []Term
+}
+
+// Term is a word, phrase or filter of a query
+type Term struct {
+	// Field is the filter field, or "" for text
+	Field string
+	Value string
+	// Phrase marks text that was quoted
+	Phrase  bool
+	Negated bool
+	// From and To bound the dates created: and updated: match, To being
+	// exclusive. A zero time is unbounded.
+	From, To time.Time
+}
+
+// SyntaxError describes what is wrong with a query and where
+type SyntaxError struct {
+	// Pos is the 1-based position, in characters, the error was found at
+	Pos int
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("syntax error at position %d: %s", e.Pos, e.Msg)
+}
+
+// Parse parses a query
+func Parse(input string) (*Query, error) {
+	p := &parser{input: []rune(input)}
+	q := &Query{Terms: []Term{}}
+	for {
+		p.skipSpace()
+		if p.done() {
+			return q, nil
+		}
+		term, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		q.Terms = append(q.Terms, term)
+	}
+}
+
+// Text returns the words and phrases a query searches for, leaving out
+// negated ones and filters
+func (q *Query) Text() string {
+	var words []string
+	for _, term := range q.Terms {
+		if term.Field == "" && !term.Negated {
+			words = append(words, term.Value)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// String returns the query in normal form, which parses back to the same
+// query
+func (q *Query) String() string {
+	terms := make([]string, len(q.Terms))
+	for i, term := range q.Terms {
+		terms[i] = term.String()
+	}
+	return strings.Join(terms, " ")
+}
+
+// String returns the term in normal form
+func (t Term) String() string {
+	var b strings.Builder
+	if t.Negated {
+		b.WriteByte('-')
+	}
+	if t.Field != "" {
+		b.WriteString(t.Field)
+		b.WriteByte(':')
+	}
+
+	value := t.Value
+	if t.Phrase || needsQuotes(value, t.Negated && t.Field == "") {
+		value = `"` + value + `"`
+	}
+	b.WriteString(value)
+	return b.String()
+}
+
+// needsQuotes reports whether a value has to be quoted to parse back as
+// one term with the same meaning. The word of a negated term may start with
+// a dash of its own, as in --x, since only the first dash negates.
+func needsQuotes(value string, negatedWord bool) bool {
+	if value == "" || value[0] == '-' && !negatedWord {
+		return true
+	}
+	if i := strings.IndexByte(value, ':'); i > 0 && fields[strings.ToLower(value[:i])] {
+		return true
+	}
+	return strings.IndexFunc(value, func(r rune) bool { return unicode.IsSpace(r) || r == '"' }) >= 0
+}
+
+// parser reads terms from a query
+type parser struct {
+	input []rune
+	pos   int
+}
+
+func (p *parser) done() bool {
+	return p.pos >= len(p.input)
+}
+
+func (p *parser) skipSpace() {
+	for !p.done() && unicode.IsSpace(p.input[p.pos]) {
+		p.pos++
+	}
+}
+
+// errorf returns a syntax error at a position
+func (p *parser) errorf(pos int, format string, args ...interface{}) error {
+	return &SyntaxError{Pos: pos + 1, Msg: fmt.Sprintf(format, args...)}
+}
+
+// term reads one term
+func (p *parser) term() (Term, error) {
+	var term Term
+	if p.input[p.pos] == '-' {
+		term.Negated = true
+		p.pos++
+		if p.done() || unicode.IsSpace(p.input[p.pos]) {
+			return term, p.errorf(p.pos-1, "expected a word, phrase or filter after -")
+		}
+	}
+
+	if p.input[p.pos] == '"' {
+		phrase, err := p.quoted()
+		if err != nil {
+			return term, err
+		}
+		term.Value, term.Phrase = phrase, true
+		return term, nil
+	}
+
+	start := p.pos
+	word := p.word()
+	colon := strings.IndexByte(word, ':')
+	if colon <= 0 || !fields[strings.ToLower(word[:colon])] {
+		term.Value = word
+		return term, nil
+	}
+
+	// A filter: the value is the rest of the word, or a quoted string
+	term.Field = strings.ToLower(word[:colon])
+	valueStart := start + len([]rune(word[:colon])) + 1
+	value := word[colon+1:]
+	if value == "" && !p.done() && p.input[p.pos] == '"' {
+		quoted, err := p.quoted()
+		if err != nil {
+			return term, err
+		}
+		value = quoted
+	}
+	if strings.TrimSpace(value) == "" {
+		return term, p.errorf(start, "missing value for %s:", term.Field)
+	}
+	term.Value = value
+
+	if err := term.check(); err != nil {
+		return term, p.errorf(valueStart, "%s", err)
+	}
+	return term, nil
+}
+
+// word reads up to the next space or quote
+func (p *parser) word() string {
+	start := p.pos
+	for !p.done() && !unicode.IsSpace(p.input[p.pos]) && p.input[p.pos] != '"' {
+		p.pos++
+	}
+	return string(p.input[start:p.pos])
+}
+
+// quoted reads a quoted string, which runs to the next quote
+func (p *parser) quoted() (string, error) {
+	start := p.pos
+	p.pos++
+	for !p.done() && p.input[p.pos] != '"' {
+		p.pos++
+	}
+	if p.done() {
+		return "", p.errorf(start, "unterminated quote")
+	}
+	value := string(p.input[start+1 : p.pos])
+	p.pos++
+	if strings.TrimSpace(value) == "" {
+		return "", p.errorf(start, "empty quotes")
+	}
+	return value, nil
+}
+
+// check validates a filter's value and normalizes it
+func (t *Term) check() error {
+	switch t.Field {
+	case FieldType:
+		t.Value = strings.ToLower(t.Value)
+		for _, contentType := range contentTypes {
+			if t.Value == string(contentType) {
+				return nil
+			}
+		}
+		return fmt.Errorf("unknown type %q (want note, snippet, bookmark or document)", t.Value)
+	case FieldLanguage:
+		t.Value = code.Normalize(t.Value)
+	case FieldCreated, FieldUpdated:
+		var err error
+		t.From, t.To, err = parseDateRange(t.Value)
+		return err
+	}
+	return nil
+}
+
+// dateLayouts are the date forms accepted, from least to most precise
+var dateLayouts = []string{"2006", "2006-01", "2006-01-02"}
+
+// parseDateRange parses a date filter value into the range of times it
+// matches
+func parseDateRange(value string) (from, to time.Time, err error) {
+	if first, last, ok := strings.Cut(value, ".."); ok {
+		if first == "" && last == "" {
+			return from, to, fmt.Errorf("invalid date range %q", value)
+		}
+		if first != "" {
+			if from, _, err = parseDate(first); err != nil {
+				return from, to, err
+			}
+		}
+		if last != "" {
+			if _, to, err = parseDate(last); err != nil {
+				return from, to, err
+			}
+		}
+		if !from.IsZero() && !to.IsZero() && !from.Before(to) {
+			return from, to, fmt.Errorf("date range %q ends before it starts", value)
+		}
+		return from, to, nil
+	}
+
+	for _, op := range []string{">=", "<=", ">", "<", "="} {
+		date, ok := strings.CutPrefix(value, op)
+		if !ok {
+			continue
+		}
+		start, end, err := parseDate(date)
+		if err != nil {
+			return from, to, err
+		}
+		switch op {
+		case ">=":
+			return start, to, nil
+		case "<=":
+			return from, end, nil
+		case ">":
+			return end, to, nil
+		case "<":
+			return from, start, nil
+		}
+		return start, end, nil
+	}
+	return parseDate(value)
+}
+
+// parseDate parses a year, month or day into the times it spans
+func parseDate(value string) (start, end time.Time, err error) {
+	for i, layout := range dateLayouts {
+		if len(value) != len(layout) {
+			continue
+		}
+		if start, err = time.Parse(layout, value); err != nil {
+			break
+		}
+		switch i {
+		case 0:
+			return start, start.AddDate(1, 0, 0), nil
+		case 1:
+			return start, start.AddDate(0, 1, 0), nil
+		}
+		return start, start.AddDate(0, 0, 1), nil
+	}
+	return start, end, fmt.Errorf("invalid date %q (want YYYY, YYYY-MM or YYYY-MM-DD)", value)
+}
+
+// ErrInvalidFilter is returned for filters given outside a query that have
+// an invalid value
+var ErrInvalidFilter = errors.New("invalid search filter")
+
+// NewFilter returns a filter term, as though field:value had been parsed
+func NewFilter(field, value string) (Term, error) {
+	term := Term{Field: field, Value: value}
+	if !fields[field] {
+		return term, fmt.Errorf("%w: unknown field %q", ErrInvalidFilter, field)
+	}
+	if strings.TrimSpace(value) == "" {
+		return term, fmt.Errorf("%w: missing value for %s:", ErrInvalidFilter, field)
+	}
+	if err := term.check(); err != nil {
+		return term, fmt.Errorf("%w: %s", ErrInvalidFilter, err)
+	}
+	return term, nil
+}
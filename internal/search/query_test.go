@@ -0,0 +1,191 @@
+package search
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// day returns midnight UTC on a date
+func day(year int, month time.Month, d int) time.Time {
+	return time.Date(year, month, d, 0, 0, 0, 0, time.UTC)
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []Term
+	}{
+		{"", []Term{}},
+		{"   ", []Term{}},
+		{"go", []Term{{Value: "go"}}},
+		{"go  channels", []Term{{Value: "go"}, {Value: "channels"}}},
+		{`"exact phrase"`, []Term{{Value: "exact phrase", Phrase: true}}},
+		{`-"exact phrase"`, []Term{{Value: "exact phrase", Phrase: true, Negated: true}}},
+		{"-draft", []Term{{Value: "draft", Negated: true}}},
+		{"--x", []Term{{Value: "-x", Negated: true}}},
+		{"tag:go", []Term{{Field: FieldTag, Value: "go"}}},
+		{"-tag:draft", []Term{{Field: FieldTag, Value: "draft", Negated: true}}},
+		{`tag:"reading list"`, []Term{{Field: FieldTag, Value: "reading list"}}},
+		{"TAG:Go", []Term{{Field: FieldTag, Value: "Go"}}},
+		{"type:SNIPPET", []Term{{Field: FieldType, Value: "snippet"}}},
+		{"title:notes url:github.com", []Term{{Field: FieldTitle, Value: "notes"}, {Field: FieldURL, Value: "github.com"}}},
+		{"language:golang", []Term{{Field: FieldLanguage, Value: "go"}}},
+		{"created:2024-03", []Term{{Field: FieldCreated, Value: "2024-03", From: day(2024, 3, 1), To: day(2024, 4, 1)}}},
+		{"updated:>=2024-01-15", []Term{{Field: FieldUpdated, Value: ">=2024-01-15", From: day(2024, 1, 15)}}},
+		{"https://example.com/a", []Term{{Value: "https://example.com/a"}}},
+		{"foo:bar", []Term{{Value: "foo:bar"}}},
+		{`a"b"`, []Term{{Value: "a"}, {Value: "b", Phrase: true}}},
+	}
+
+	for _, tt := range tests {
+		q, err := Parse(tt.input)
+		if err != nil {
+			t.Errorf("Parse(%q) failed: %v", tt.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(q.Terms, tt.want) {
+			t.Errorf("Parse(%q) = %+v, want %+v", tt.input, q.Terms, tt.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		pos   int
+	}{
+		{"-", 1},
+		{"go -", 4},
+		{"go - x", 4},
+		{`"open`, 1},
+		{`go "open`, 4},
+		{`go ""`, 4},
+		{`"  "`, 1},
+		{"tag:", 1},
+		{"go -tag:", 5},
+		{`tag:"open`, 5},
+		{"type:video", 6},
+		{"go type:video", 9},
+		{"created:2024-13", 9},
+		// Positions count characters, not bytes
+		{"é created:2024-13", 11},
+		{"created:2024-03..2024-01", 9},
+	}
+
+	for _, tt := range tests {
+		_, err := Parse(tt.input)
+		var syntaxErr *SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("Parse(%q) error = %v, want a syntax error", tt.input, err)
+			continue
+		}
+		if syntaxErr.Pos != tt.pos {
+			t.Errorf("Parse(%q) error at position %d, want %d: %v", tt.input, syntaxErr.Pos, tt.pos, err)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"go  channels", "go channels"},
+		{`TAG:Go  -"a b"`, `tag:Go -"a b"`},
+		{"type:NOTE", "type:note"},
+		{`tag:"reading list"`, `tag:"reading list"`},
+		{`tag:"go"`, "tag:go"},
+		{`"tag:go"`, `"tag:go"`},
+		{`"-x"`, `"-x"`},
+		{"--x", "--x"},
+		{"tag:-x", `tag:"-x"`},
+		{`title:"tag:x"`, `title:"tag:x"`},
+		{"language:PY", "language:python"},
+		{"created:2024-01..2024-03", "created:2024-01..2024-03"},
+	}
+
+	for _, tt := range tests {
+		q, err := Parse(tt.input)
+		if err != nil {
+			t.Errorf("Parse(%q) failed: %v", tt.input, err)
+			continue
+		}
+		if got := q.String(); got != tt.want {
+			t.Errorf("Parse(%q).String() = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestStringRoundTrip(t *testing.T) {
+	inputs := []string{
+		"go",
+		`"exact phrase" -draft`,
+		`tag:go -tag:draft type:snippet created:>2024-01 "exact phrase" url:github.com`,
+		`tag:"reading list" title:"a: b"`,
+		`"tag:go" "-x" -"a b"`,
+		`"a\b" https://example.com/?q=1`,
+		"language:c++ updated:..2024-02-29",
+		"--x a -- b --- -tag:-x",
+	}
+
+	for _, input := range inputs {
+		q, err := Parse(input)
+		if err != nil {
+			t.Errorf("Parse(%q) failed: %v", input, err)
+			continue
+		}
+		normal := q.String()
+		again, err := Parse(normal)
+		if err != nil {
+			t.Errorf("Parse(%q) of the normal form of %q failed: %v", normal, input, err)
+			continue
+		}
+		if !reflect.DeepEqual(again, q) {
+			t.Errorf("%q parses to %+v, but its normal form %q to %+v", input, q.Terms, normal, again.Terms)
+		}
+		if again.String() != normal {
+			t.Errorf("normal form of %q is %q, then %q", input, normal, again.String())
+		}
+	}
+}
+
+func TestParseDateRange(t *testing.T) {
+	var unbounded time.Time
+	tests := []struct {
+		value    string
+		from, to time.Time
+	}{
+		{"2024", day(2024, 1, 1), day(2025, 1, 1)},
+		{"2024-02", day(2024, 2, 1), day(2024, 3, 1)},
+		{"2024-02-29", day(2024, 2, 29), day(2024, 3, 1)},
+		{"2024-12-31", day(2024, 12, 31), day(2025, 1, 1)},
+		{"=2024", day(2024, 1, 1), day(2025, 1, 1)},
+		{">=2024-02", day(2024, 2, 1), unbounded},
+		{">2024-02", day(2024, 3, 1), unbounded},
+		{"<=2024-02", unbounded, day(2024, 3, 1)},
+		{"<2024-02", unbounded, day(2024, 2, 1)},
+		{"2024-01..2024-03", day(2024, 1, 1), day(2024, 4, 1)},
+		{"2024-03-05..2024-03-05", day(2024, 3, 5), day(2024, 3, 6)},
+		{"..2024-03", unbounded, day(2024, 4, 1)},
+		{"2024..", day(2024, 1, 1), unbounded},
+	}
+
+	for _, tt := range tests {
+		from, to, err := parseDateRange(tt.value)
+		if err != nil {
+			t.Errorf("parseDateRange(%q) failed: %v", tt.value, err)
+			continue
+		}
+		if !from.Equal(tt.from) || !to.Equal(tt.to) {
+			t.Errorf("parseDateRange(%q) = %v, %v, want %v, %v", tt.value, from, to, tt.from, tt.to)
+		}
+	}
+
+	for _, value := range []string{"", "..", ">", "24", "2024-3", "2024-13", "2024-02-30", "March", "2024-03..2024-01", "2024-01..x"} {
+		if _, _, err := parseDateRange(value); err == nil {
+			t.Errorf("parseDateRange(%q) succeeded, want an error", value)
+		}
+	}
+}
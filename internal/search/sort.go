@@ -0,0 +1,51 @@
+package search
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Sort fields
+const (
+	SortRelevance = "relevance"
+	SortCreated   = "created"
+	SortUpdated   = "updated"
+	SortTitle     = "title"
+)
+
+// ErrInvalidSort is returned for unknown sort fields and orders
+var ErrInvalidSort = errors.New("invalid sort")
+
+// Sort is how search results are ordered
+type Sort struct {
+	Field     string
+	Ascending bool
+}
+
+// ParseSort parses a sort field and an order, "asc" or "desc". Dates sort
+// newest first and titles A to Z unless told otherwise; relevance always
+// sorts best first.
+func ParseSort(field, order string) (Sort, error) {
+	sort := Sort{Field: field}
+	switch field {
+	case "":
+		sort.Field = SortRelevance
+	case SortRelevance, SortCreated, SortUpdated:
+	case SortTitle:
+		sort.Ascending = true
+	default:
+		return sort, fmt.Errorf("%w: unknown field %q (want relevance, created, updated or title)", ErrInvalidSort, field)
+	}
+
+	switch order {
+	case "":
+	case "asc", "desc":
+		if sort.Field == SortRelevance && order == "asc" {
+			return sort, fmt.Errorf("%w: relevance only sorts best first", ErrInvalidSort)
+		}
+		sort.Ascending = order == "asc"
+	default:
+		return sort, fmt.Errorf("%w: unknown order %q (want asc or desc)", ErrInvalidSort, order)
+	}
+	return sort, nil
+}
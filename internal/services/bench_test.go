@@ -0,0 +1,70 @@
+package services_test
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rgehrsitz/me/internal/config"
+	"github.com/rgehrsitz/me/internal/db/dbtest"
+	"github.com/rgehrsitz/me/internal/models"
+	"github.com/rgehrsitz/me/internal/services"
+)
+
+// benchItems is the size of the knowledge base the benchmarks run against
+const benchItems = 10000
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	dbtest.Cleanup()
+	os.Exit(code)
+}
+
+// BenchmarkSearch searches generated content. Semantic and hybrid search run
+// on random embeddings, with the query's embedding cached, so no API key is
+// needed.
+func BenchmarkSearch(b *testing.B) {
+	kb := dbtest.Seeded(b, benchItems)
+
+	embeddingService, err := services.NewEmbeddingService(config.AIConfig{
+		APIKey:            "unused",
+		EmbeddingModel:    dbtest.EmbeddingModel,
+		EmbeddingCacheTTL: config.Duration{Duration: 24 * time.Hour},
+	}, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	searchService := services.NewSearchService(kb.DB, embeddingService)
+
+	// Cache the query's embedding so searching never calls the API
+	hash, err := kb.DB.TextHash(dbtest.Word)
+	if err != nil {
+		b.Fatal(err)
+	}
+	query := dbtest.RandomVector(rand.New(rand.NewSource(2)), dbtest.Dimensions)
+	if err := kb.DB.CacheEmbeddings(dbtest.EmbeddingModel, map[string][]float32{hash: query}); err != nil {
+		b.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for _, bm := range []struct {
+		name  string
+		query models.SearchQuery
+	}{
+		{"keyword", models.SearchQuery{Query: dbtest.Word, Limit: 50}},
+		{"keyword-tag", models.SearchQuery{Query: "tag:tag7 " + dbtest.Word, Limit: 50}},
+		{"semantic", models.SearchQuery{Query: dbtest.Word, Semantic: true, Limit: 50}},
+		{"hybrid", models.SearchQuery{Query: dbtest.Word, Hybrid: true, Limit: 50}},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := searchService.Search(ctx, kb.UserID, bm.query); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,440 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/rgehrsitz/me/internal/db"
+)
+
+const (
+	// maxClusters caps the number of clusters picked automatically
+	maxClusters = 50
+	// maxKMeansIterations bounds a single clustering run
+	maxKMeansIterations = 50
+	// clusterNameSamples is the number of member titles sent to the summarizer
+	clusterNameSamples = 8
+	// reclusterRatio is the share of incrementally assigned items that
+	// triggers a full reclustering run
+	reclusterRatio = 0.2
+)
+
+// ClusterService groups content into topics using k-means over the embeddings
+type ClusterService struct {
+	db               *db.DB
+	embeddingService *EmbeddingService
+	summarizeService *SummarizeService
+
+	// runMu serializes clustering runs
+	runMu sync.Mutex
+	// mu guards the stored clusters and pending. It is not held while
+	// clusters are named, which takes a chat completion each.
+	mu sync.Mutex
+	// pending holds the items assigned while a clustering run names its
+	// clusters, to assign again to the new clusters once they are stored. It
+	// is nil outside a run.
+	pending map[int64][]float32
+}
+
+// NewClusterService creates a new cluster service
+func NewClusterService(db *db.DB, embeddingService *EmbeddingService, summarizeService *SummarizeService) *ClusterService {
+	return &ClusterService{
+		db:               db,
+		embeddingService: embeddingService,
+		summarizeService: summarizeService,
+	}
+}
+
+// clusterPoint is a single embedded content item
+type clusterPoint struct {
+	contentID int64
+	title     string
+	vector    []float32
+}
+
+// Recluster runs a full clustering pass over every embedded item the user
+// owns. If k is not positive a cluster count is chosen from the number of
+// items.
+func (s *ClusterService) Recluster(ctx context.Context, userID int64, k int) ([]db.Cluster, error) {
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+
+	s.mu.Lock()
+	clusters, members, titles, err := s.computeClusters(userID, k)
+	if err == nil {
+		s.pending = make(map[int64][]float32)
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range clusters {
+		clusters[i].Name = s.nameCluster(ctx, titles[i], i+1)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending := s.pending
+	s.pending = nil
+
+	if err := s.db.ReplaceClusters(userID, clusters, members); err != nil {
+		return nil, fmt.Errorf("failed to store clusters: %w", err)
+	}
+	for contentID, vector := range pending {
+		if err := s.assign(contentID, vector); err != nil {
+			log.Printf("Failed to assign content %d to a cluster: %v", contentID, err)
+		}
+	}
+
+	return s.db.ListClusters(userID, false)
+}
+
+// computeClusters clusters the user's embedded items, returning the
+// clusters without names, their members and sample member titles to name
+// them from
+func (s *ClusterService) computeClusters(userID int64, k int) ([]db.Cluster, [][]int64, [][]string, error) {
+	points, err := s.loadPoints(userID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(points) == 0 {
+		return nil, nil, nil, nil
+	}
+
+	if k <= 0 {
+		k = int(math.Sqrt(float64(len(points)) / 2))
+	}
+	if k < 1 {
+		k = 1
+	}
+	if k > maxClusters {
+		k = maxClusters
+	}
+	if k > len(points) {
+		k = len(points)
+	}
+
+	centroids, assignments := kMeans(points, k)
+
+	clusters := []db.Cluster{}
+	members := [][]int64{}
+	titles := [][]string{}
+	for i, centroid := range centroids {
+		var ids []int64
+		var sample []string
+		for j, cluster := range assignments {
+			if cluster != i {
+				continue
+			}
+			ids = append(ids, points[j].contentID)
+			if len(sample) < clusterNameSamples && points[j].title != "" {
+				sample = append(sample, points[j].title)
+			}
+		}
+		if len(ids) == 0 {
+			continue
+		}
+
+		centroidBytes, err := s.embeddingService.SerializeEmbedding(centroid)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		clusters = append(clusters, db.Cluster{Centroid: centroidBytes})
+		members = append(members, ids)
+		titles = append(titles, sample)
+	}
+	return clusters, members, titles, nil
+}
+
+// AssignContent adds a newly embedded item to its owner's nearest cluster,
+// moving that cluster's centroid towards it. It does nothing before the
+// owner's first clustering run.
+func (s *ClusterService) AssignContent(contentID int64, vector []float32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pending != nil {
+		s.pending[contentID] = vector
+	}
+	return s.assign(contentID, vector)
+}
+
+// assign adds an item to its owner's nearest cluster. The caller holds mu.
+func (s *ClusterService) assign(contentID int64, vector []float32) error {
+	var ownerID int64
+	if err := s.db.QueryRow("SELECT owner_id FROM content WHERE id = ?", contentID).Scan(&ownerID); err != nil {
+		return err
+	}
+
+	clusters, err := s.db.ListClusters(ownerID, false)
+	if err != nil {
+		return fmt.Errorf("failed to list clusters: %w", err)
+	}
+	if len(clusters) == 0 {
+		return nil
+	}
+
+	// An item that was re-embedded keeps its cluster
+	if _, err := s.db.ContentCluster(contentID); err == nil {
+		return nil
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	best := -1
+	bestSimilarity := math.Inf(-1)
+	var bestCentroid []float32
+	for i, cluster := range clusters {
+		centroid, err := s.embeddingService.DeserializeEmbedding(cluster.Centroid)
+		if err != nil {
+			return err
+		}
+		similarity := cosineSimilarity(vector, centroid)
+		if similarity > bestSimilarity {
+			best, bestSimilarity, bestCentroid = i, similarity, centroid
+		}
+	}
+
+	// Running mean over the members, including the new one
+	n := float32(clusters[best].Size + 1)
+	if len(bestCentroid) == len(vector) {
+		for i := range bestCentroid {
+			bestCentroid[i] += (vector[i] - bestCentroid[i]) / n
+		}
+	}
+
+	centroidBytes, err := s.embeddingService.SerializeEmbedding(bestCentroid)
+	if err != nil {
+		return err
+	}
+
+	return s.db.AssignCluster(contentID, clusters[best].ID, centroidBytes)
+}
+
+// RunPeriodic reclusters each user's content on the given interval whenever
+// they have unclustered items and no clusters yet, or enough items have been
+// assigned incrementally that the clusters have likely drifted. It returns
+// when ctx is cancelled.
+func (s *ClusterService) RunPeriodic(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// Cluster names come from titles, which can't be read while locked
+			if s.db.Locked() {
+				continue
+			}
+			users, err := s.db.ListUsers()
+			if err != nil {
+				log.Printf("Failed to list users: %v", err)
+				continue
+			}
+			for _, user := range users {
+				stale, err := s.needsRecluster(user.ID)
+				if err != nil {
+					log.Printf("Failed to check cluster state for %s: %v", user.Username, err)
+					continue
+				}
+				if !stale {
+					continue
+				}
+				if _, err := s.Recluster(ctx, user.ID, 0); err != nil {
+					log.Printf("Failed to recluster content for %s: %v", user.Username, err)
+				}
+			}
+		}
+	}
+}
+
+// needsRecluster reports whether a full clustering run is due for a user
+func (s *ClusterService) needsRecluster(userID int64) (bool, error) {
+	total, incremental, err := s.db.ClusterStats(userID)
+	if err != nil {
+		return false, err
+	}
+
+	if total == 0 {
+		var embedded int
+		err := s.db.QueryRow(`
+			SELECT COUNT(DISTINCT e.content_id)
+			FROM embeddings e
+			JOIN content c ON c.id = e.content_id
+			WHERE c.owner_id = ? AND e.model = ?`, userID, s.embeddingService.Model()).Scan(&embedded)
+		if err != nil {
+			return false, err
+		}
+		return embedded > 0, nil
+	}
+
+	return float64(incremental) >= reclusterRatio*float64(total), nil
+}
+
+// nameCluster asks the summarizer for a topic name, falling back to a
+// numbered name when that fails
+func (s *ClusterService) nameCluster(ctx context.Context, titles []string, n int) string {
+	fallback := fmt.Sprintf("Topic %d", n)
+	if len(titles) == 0 || s.summarizeService == nil {
+		return fallback
+	}
+
+	name, err := s.summarizeService.NameCluster(ctx, titles)
+	if err != nil || name == "" {
+		if err != nil {
+			log.Printf("Failed to name cluster: %v", err)
+		}
+		return fallback
+	}
+
+	return name
+}
+
+// loadPoints loads every embedded content item the user owns
+func (s *ClusterService) loadPoints(userID int64) ([]clusterPoint, error) {
+	rows, err := s.db.Query(`
+		SELECT c.id, c.title, e.embedding
+		FROM content c
+		JOIN embeddings e ON c.id = e.content_id
+		WHERE c.owner_id = ? AND e.model = ?
+		ORDER BY c.id`, userID, s.embeddingService.Model())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load embeddings: %w", err)
+	}
+	defer rows.Close()
+
+	points := []clusterPoint{}
+	seen := make(map[int64]bool)
+	for rows.Next() {
+		var point clusterPoint
+		var title sql.NullString
+		var embeddingBytes []byte
+		if err := rows.Scan(&point.contentID, &title, &embeddingBytes); err != nil {
+			return nil, fmt.Errorf("failed to scan embedding: %w", err)
+		}
+		if seen[point.contentID] {
+			continue
+		}
+		seen[point.contentID] = true
+
+		if point.title, err = s.db.Decrypt(title.String); err != nil {
+			return nil, fmt.Errorf("failed to decrypt content %d: %w", point.contentID, err)
+		}
+		point.vector, err = s.embeddingService.DeserializeEmbedding(embeddingBytes)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, point)
+	}
+
+	return points, rows.Err()
+}
+
+// kMeans clusters the points into k groups using cosine similarity and
+// k-means++ seeding. It returns the centroids and each point's cluster index.
+func kMeans(points []clusterPoint, k int) ([][]float32, []int) {
+	// A fixed seed keeps repeated runs over the same data stable
+	rng := rand.New(rand.NewSource(1))
+	dims := len(points[0].vector)
+
+	// k-means++ seeding
+	centroids := [][]float32{copyVector(points[rng.Intn(len(points))].vector)}
+	distances := make([]float64, len(points))
+	for len(centroids) < k {
+		var sum float64
+		for i, p := range points {
+			nearest := math.Inf(1)
+			for _, c := range centroids {
+				if d := 1 - cosineSimilarity(p.vector, c); d < nearest {
+					nearest = d
+				}
+			}
+			distances[i] = nearest * nearest
+			sum += distances[i]
+		}
+		if sum == 0 {
+			break
+		}
+
+		target := rng.Float64() * sum
+		chosen := len(points) - 1
+		for i, d := range distances {
+			target -= d
+			if target <= 0 {
+				chosen = i
+				break
+			}
+		}
+		centroids = append(centroids, copyVector(points[chosen].vector))
+	}
+
+	assignments := make([]int, len(points))
+	for i := range assignments {
+		assignments[i] = -1
+	}
+
+	for iteration := 0; iteration < maxKMeansIterations; iteration++ {
+		changed := false
+		for i, p := range points {
+			best, bestSimilarity := 0, math.Inf(-1)
+			for j, c := range centroids {
+				if similarity := cosineSimilarity(p.vector, c); similarity > bestSimilarity {
+					best, bestSimilarity = j, similarity
+				}
+			}
+			if assignments[i] != best {
+				assignments[i] = best
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+
+		// Recompute centroids as the mean of their members
+		counts := make([]int, len(centroids))
+		sums := make([][]float32, len(centroids))
+		for j := range sums {
+			sums[j] = make([]float32, dims)
+		}
+		for i, p := range points {
+			if len(p.vector) != dims {
+				continue
+			}
+			j := assignments[i]
+			counts[j]++
+			for d, v := range p.vector {
+				sums[j][d] += v
+			}
+		}
+		for j := range centroids {
+			if counts[j] == 0 {
+				continue
+			}
+			for d := range sums[j] {
+				sums[j][d] /= float32(counts[j])
+			}
+			centroids[j] = sums[j]
+		}
+	}
+
+	return centroids, assignments
+}
+
+// copyVector returns a copy of the vector
+func copyVector(v []float32) []float32 {
+	out := make([]float32, len(v))
+	copy(out, v)
+	return out
+}
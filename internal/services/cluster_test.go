@@ -0,0 +1,85 @@
+package services_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rgehrsitz/me/internal/config"
+	"github.com/rgehrsitz/me/internal/db"
+	"github.com/rgehrsitz/me/internal/db/dbtest"
+	"github.com/rgehrsitz/me/internal/services"
+	"github.com/rgehrsitz/me/internal/vector"
+)
+
+// TestEmbedAssignsCluster checks that whatever embeds content, not only the
+// server's queue, files it under its nearest cluster
+func TestEmbedAssignsCluster(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "pkb.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	userID, err := database.DefaultUserID()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	embeddingService, err := services.NewEmbeddingService(config.AIConfig{
+		APIKey:            "unused",
+		EmbeddingModel:    dbtest.EmbeddingModel,
+		EmbeddingCacheTTL: config.Duration{Duration: 24 * time.Hour},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	embeddingService.OnStore(services.NewClusterService(database, embeddingService, nil).AssignContent)
+
+	// Two clusters along different axes
+	axis := func(i int) []float32 {
+		v := make([]float32, dbtest.Dimensions)
+		v[i] = 1
+		return v
+	}
+	clusters := []db.Cluster{{Name: "first", Centroid: vector.Encode(axis(0))}, {Name: "second", Centroid: vector.Encode(axis(1))}}
+	if err := database.ReplaceClusters(userID, clusters, [][]int64{nil, nil}); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := database.ListClusters(userID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clusterIDs := make(map[string]int64)
+	for _, cluster := range stored {
+		clusterIDs[cluster.Name] = cluster.ID
+	}
+
+	// Cache the body's embedding so embedding never calls the API
+	body := "closest to the second cluster"
+	id, err := database.CreateContent(userID, &db.Content{Type: "note", Title: "new", Body: body})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := database.TextHash(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	embedding := axis(1)
+	embedding[0] = 0.5
+	if err := database.CacheEmbeddings(dbtest.EmbeddingModel, map[string][]float32{hash: embedding}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, failed := embeddingService.EmbedContents(context.Background(), database, []db.EmbedTarget{{ID: id, Body: body}})
+	if len(failed) > 0 {
+		t.Fatalf("EmbedContents failed: %v", failed)
+	}
+	clusterID, err := database.ContentCluster(id)
+	if err != nil {
+		t.Fatalf("embedded item has no cluster: %v", err)
+	}
+	if clusterID != clusterIDs["second"] {
+		t.Errorf("embedded item is in cluster %d, want %d", clusterID, clusterIDs["second"])
+	}
+}
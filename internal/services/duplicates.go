@@ -0,0 +1,349 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/rgehrsitz/me/internal/db"
+	"github.com/rgehrsitz/me/internal/models"
+	"github.com/rgehrsitz/me/internal/vector"
+)
+
+// DefaultDuplicateThreshold is the cosine similarity above which two items
+// are considered near-duplicates
+const DefaultDuplicateThreshold = 0.95
+
+// DuplicateService finds candidate duplicate content
+type DuplicateService struct {
+	db               *db.DB
+	embeddingService *EmbeddingService
+}
+
+// NewDuplicateService creates a new duplicate service
+func NewDuplicateService(db *db.DB, embeddingService *EmbeddingService) *DuplicateService {
+	return &DuplicateService{
+		db:               db,
+		embeddingService: embeddingService,
+	}
+}
+
+// duplicateCandidate holds the fingerprints of a single content item
+type duplicateCandidate struct {
+	id        int64
+	hash      string
+	url       string
+	embedding []float32
+}
+
+// FindDuplicates groups the user's content that shares an exact body hash, a
+// normalized bookmark URL, or an embedding similarity at or above the
+// threshold. Only owned content is compared, since only it can be merged.
+// Embeddings are compared pairwise, so at 10,000 items there are 50 million
+// pairs. With approximate, pairs whose sign bits differ too much to be
+// expected to reach the threshold are skipped without computing their
+// similarity: the scan is several times faster, but may miss a few
+// near-duplicates.
+func (s *DuplicateService) FindDuplicates(userID int64, threshold float64, approximate bool) ([]models.DuplicateGroup, error) {
+	if threshold <= 0 || threshold > 1 {
+		threshold = DefaultDuplicateThreshold
+	}
+
+	candidates, err := s.loadCandidates(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := newUnionFind(len(candidates))
+	reasons := make(map[int]map[string]bool)
+	link := func(a, b int, reason string) {
+		groups.union(a, b)
+		for _, i := range []int{a, b} {
+			if reasons[i] == nil {
+				reasons[i] = make(map[string]bool)
+			}
+			reasons[i][reason] = true
+		}
+	}
+
+	// Exact content hashes and normalized URLs
+	byHash := make(map[string]int)
+	byURL := make(map[string]int)
+	for i, c := range candidates {
+		if c.hash != "" {
+			if j, ok := byHash[c.hash]; ok {
+				link(i, j, models.DuplicateReasonHash)
+			} else {
+				byHash[c.hash] = i
+			}
+		}
+		if c.url != "" {
+			if j, ok := byURL[c.url]; ok {
+				link(i, j, models.DuplicateReasonURL)
+			} else {
+				byURL[c.url] = i
+			}
+		}
+	}
+
+	// Embedding similarity
+	similarities := make(map[int]float64)
+	units := make([][]float32, len(candidates))
+	signs := make([][]byte, len(candidates))
+	for i, c := range candidates {
+		if c.embedding == nil {
+			continue
+		}
+		units[i] = unitVector(c.embedding)
+		if approximate {
+			signs[i] = vector.Quantize(c.embedding, vector.Binary)
+		}
+	}
+	floor := binaryFloor(threshold)
+	for i := 0; i < len(candidates); i++ {
+		if units[i] == nil {
+			continue
+		}
+		var query *vector.Query
+		if approximate {
+			query = vector.NewQuery(candidates[i].embedding)
+		}
+		for j := i + 1; j < len(candidates); j++ {
+			if units[j] == nil || len(units[j]) != len(units[i]) {
+				continue
+			}
+			if approximate {
+				if estimate, err := query.Score(signs[j]); err != nil || estimate < floor {
+					continue
+				}
+			}
+			similarity := dot(units[i], units[j])
+			if similarity >= threshold {
+				link(i, j, models.DuplicateReasonEmbedding)
+				for _, k := range []int{i, j} {
+					if similarity > similarities[k] {
+						similarities[k] = similarity
+					}
+				}
+			}
+		}
+	}
+
+	// Collect groups with more than one member
+	members := make(map[int][]int)
+	for i := range candidates {
+		root := groups.find(i)
+		members[root] = append(members[root], i)
+	}
+
+	result := []models.DuplicateGroup{}
+	for _, group := range members {
+		if len(group) < 2 {
+			continue
+		}
+
+		var dg models.DuplicateGroup
+		seen := make(map[string]bool)
+		for _, i := range group {
+			dg.ContentIDs = append(dg.ContentIDs, candidates[i].id)
+			for reason := range reasons[i] {
+				if !seen[reason] {
+					seen[reason] = true
+					dg.Reasons = append(dg.Reasons, reason)
+				}
+			}
+			if similarities[i] > dg.Similarity {
+				dg.Similarity = similarities[i]
+			}
+		}
+		sort.Slice(dg.ContentIDs, func(a, b int) bool { return dg.ContentIDs[a] < dg.ContentIDs[b] })
+		sort.Strings(dg.Reasons)
+		result = append(result, dg)
+	}
+
+	sort.Slice(result, func(a, b int) bool { return result[a].ContentIDs[0] < result[b].ContentIDs[0] })
+	return result, nil
+}
+
+// binaryMargin is how far below its expected value the sign-bit estimate of
+// a pair's similarity may fall before the pair is skipped
+const binaryMargin = 0.15
+
+// binaryFloor returns the lowest sign-bit estimate, 1 - 2*hamming/dims, that
+// a pair with a cosine similarity of threshold is expected to score. Two
+// vectors at an angle θ differ in about θ/π of their sign bits.
+func binaryFloor(threshold float64) float64 {
+	return 1 - 2*math.Acos(threshold)/math.Pi - binaryMargin
+}
+
+// unitVector returns v scaled to length 1, so the cosine similarity of two
+// vectors is their dot product. A zero vector stays zero.
+func unitVector(v []float32) []float32 {
+	var norm float64
+	for _, x := range v {
+		norm += float64(x) * float64(x)
+	}
+	unit := make([]float32, len(v))
+	if norm == 0 {
+		return unit
+	}
+	scale := 1 / math.Sqrt(norm)
+	for i, x := range v {
+		unit[i] = float32(float64(x) * scale)
+	}
+	return unit
+}
+
+// dot returns the dot product of two vectors of the same length
+func dot(a, b []float32) float64 {
+	var sum float64
+	for i := range a {
+		sum += float64(a[i]) * float64(b[i])
+	}
+	return sum
+}
+
+// loadCandidates loads the fingerprints of every content item the user owns
+func (s *DuplicateService) loadCandidates(userID int64) ([]duplicateCandidate, error) {
+	rows, err := s.db.Query(`
+		SELECT id, type, body, source_url
+		FROM content
+		WHERE owner_id = ?
+		ORDER BY id`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load content: %w", err)
+	}
+	defer rows.Close()
+
+	candidates := []duplicateCandidate{}
+	index := make(map[int64]int)
+	for rows.Next() {
+		var id int64
+		var contentType, body, sourceURL string
+		if err := rows.Scan(&id, &contentType, &body, &sourceURL); err != nil {
+			return nil, fmt.Errorf("failed to scan content: %w", err)
+		}
+		if body, err = s.db.Decrypt(body); err != nil {
+			return nil, fmt.Errorf("failed to decrypt content %d: %w", id, err)
+		}
+
+		c := duplicateCandidate{id: id, hash: contentHash(body)}
+		if contentType == string(models.ContentTypeBookmark) {
+			c.url = normalizeURL(sourceURL)
+		}
+		index[id] = len(candidates)
+		candidates = append(candidates, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	embRows, err := s.db.Query(`
+		SELECT e.content_id, e.embedding
+		FROM embeddings e
+		JOIN content c ON c.id = e.content_id
+		WHERE c.owner_id = ? AND e.model = ?`, userID, s.embeddingService.Model())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load embeddings: %w", err)
+	}
+	defer embRows.Close()
+
+	for embRows.Next() {
+		var contentID int64
+		var embeddingBytes []byte
+		if err := embRows.Scan(&contentID, &embeddingBytes); err != nil {
+			return nil, fmt.Errorf("failed to scan embedding: %w", err)
+		}
+
+		i, ok := index[contentID]
+		if !ok {
+			continue
+		}
+		embedding, err := s.embeddingService.DeserializeEmbedding(embeddingBytes)
+		if err != nil {
+			return nil, err
+		}
+		candidates[i].embedding = embedding
+	}
+
+	return candidates, embRows.Err()
+}
+
+// contentHash returns a hash of the body with surrounding whitespace and
+// line-ending differences removed. Empty bodies have no hash.
+func contentHash(body string) string {
+	body = strings.TrimSpace(strings.ReplaceAll(body, "\r\n", "\n"))
+	if body == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+// normalizeURL reduces a URL to a canonical form so that trivially different
+// links to the same page compare equal
+func normalizeURL(raw string) string {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return ""
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return strings.ToLower(raw)
+	}
+
+	host := strings.ToLower(u.Hostname())
+	host = strings.TrimPrefix(host, "www.")
+	if port := u.Port(); port != "" && port != "80" && port != "443" {
+		host += ":" + port
+	}
+
+	// Drop tracking parameters and sort the rest
+	query := u.Query()
+	for key := range query {
+		lower := strings.ToLower(key)
+		if strings.HasPrefix(lower, "utm_") || lower == "fbclid" || lower == "gclid" || lower == "ref" {
+			query.Del(key)
+		}
+	}
+
+	path := strings.TrimSuffix(u.EscapedPath(), "/")
+	normalized := host + path
+	if encoded := query.Encode(); encoded != "" {
+		normalized += "?" + encoded
+	}
+	return normalized
+}
+
+// unionFind is a minimal disjoint-set structure used to build groups
+type unionFind struct {
+	parent []int
+}
+
+func newUnionFind(n int) *unionFind {
+	parent := make([]int, n)
+	for i := range parent {
+		parent[i] = i
+	}
+	return &unionFind{parent: parent}
+}
+
+func (u *unionFind) find(i int) int {
+	for u.parent[i] != i {
+		u.parent[i] = u.parent[u.parent[i]]
+		i = u.parent[i]
+	}
+	return i
+}
+
+func (u *unionFind) union(a, b int) {
+	ra, rb := u.find(a), u.find(b)
+	if ra != rb {
+		u.parent[rb] = ra
+	}
+}
@@ -0,0 +1,102 @@
+package services_test
+
+import (
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rgehrsitz/me/internal/config"
+	"github.com/rgehrsitz/me/internal/db"
+	"github.com/rgehrsitz/me/internal/db/dbtest"
+	"github.com/rgehrsitz/me/internal/models"
+	"github.com/rgehrsitz/me/internal/services"
+)
+
+func TestFindDuplicates(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "pkb.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	userID, err := database.DefaultUserID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	create := func(content *db.Content) int64 {
+		id, err := database.CreateContent(userID, content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+
+	same1 := create(&db.Content{Type: "note", Title: "one", Body: "the same body\r\n"})
+	same2 := create(&db.Content{Type: "note", Title: "two", Body: "  the same body\n"})
+	link1 := create(&db.Content{Type: "bookmark", Title: "a", Body: "x", SourceURL: "https://www.example.com/page/?utm_source=feed"})
+	link2 := create(&db.Content{Type: "bookmark", Title: "b", Body: "y", SourceURL: "http://example.com/page"})
+	near1 := create(&db.Content{Type: "note", Title: "near", Body: "first draft"})
+	near2 := create(&db.Content{Type: "note", Title: "near", Body: "second draft"})
+	other := create(&db.Content{Type: "note", Title: "other", Body: "unrelated"})
+
+	// The near pair shares one large component and differs in small noise
+	// over all others: a cosine similarity of about 0.96, but half of the
+	// sign bits differ
+	rng := rand.New(rand.NewSource(1))
+	noisy := func() []float32 {
+		v := make([]float32, dbtest.Dimensions)
+		v[0] = 1
+		for i := 1; i < len(v); i++ {
+			v[i] = float32(rng.NormFloat64() * 0.005)
+		}
+		return v
+	}
+	embeddings := map[int64][]float32{
+		near1: noisy(),
+		near2: noisy(),
+		other: dbtest.RandomVector(rng, dbtest.Dimensions),
+	}
+	for id, embedding := range embeddings {
+		if _, err := database.StoreEmbedding(id, embedding, dbtest.EmbeddingModel, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	embeddingService, err := services.NewEmbeddingService(config.AIConfig{
+		APIKey:            "unused",
+		EmbeddingModel:    dbtest.EmbeddingModel,
+		EmbeddingCacheTTL: config.Duration{Duration: 24 * time.Hour},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	duplicateService := services.NewDuplicateService(database, embeddingService)
+
+	groups, err := duplicateService.FindDuplicates(userID, services.DefaultDuplicateThreshold, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]int64{{same1, same2}, {link1, link2}, {near1, near2}}
+	reasons := []string{models.DuplicateReasonHash, models.DuplicateReasonURL, models.DuplicateReasonEmbedding}
+	if len(groups) != len(want) {
+		t.Fatalf("FindDuplicates = %+v, want groups %v", groups, want)
+	}
+	for i, group := range groups {
+		if !reflect.DeepEqual(group.ContentIDs, want[i]) || !reflect.DeepEqual(group.Reasons, reasons[i:i+1]) {
+			t.Errorf("group %d is %+v, want %v for %s", i, group, want[i], reasons[i])
+		}
+	}
+	if similarity := groups[2].Similarity; similarity < services.DefaultDuplicateThreshold || similarity > 1 {
+		t.Errorf("similarity of the near pair is %v", similarity)
+	}
+
+	// Above the pair's similarity it is no longer a duplicate
+	groups, err = duplicateService.FindDuplicates(userID, 0.99, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 2 {
+		t.Errorf("FindDuplicates at 0.99 = %+v, want the hash and URL groups", groups)
+	}
+}
@@ -2,40 +2,132 @@ package services
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
 
+	"github.com/rgehrsitz/me/internal/code"
+	"github.com/rgehrsitz/me/internal/config"
+	"github.com/rgehrsitz/me/internal/db"
+	"github.com/rgehrsitz/me/internal/vector"
 	"github.com/sashabaranov/go-openai"
 )
 
+const (
+	// maxBatchInputs is the most texts the embeddings API takes per request
+	maxBatchInputs = 2048
+	// maxBatchTokens is the most tokens the embeddings API takes per request
+	maxBatchTokens = 300000
+	// cachePruneInterval is how often cached embeddings past their TTL are
+	// deleted
+	cachePruneInterval = time.Hour
+	// maxChunkBytes bounds the chunks snippets are embedded in
+	maxChunkBytes = 1500
+)
+
 // EmbeddingService handles generating and storing embeddings
 type EmbeddingService struct {
 	openAIClient *openai.Client
+	model        openai.EmbeddingModel
+	usage        *UsageService
+	// cacheTTL is how long embeddings stay cached by text hash; 0 disables
+	// the cache
+	cacheTTL time.Duration
+
+	pruneMu    sync.Mutex
+	lastPruned time.Time
+
+	// onStore is called with each embedding EmbedContents stores
+	onStore func(contentID int64, embedding []float32) error
+}
+
+// NewEmbeddingService creates a new embedding service. Usage is recorded
+// with the usage service, if any.
+func NewEmbeddingService(cfg config.AIConfig, usage *UsageService) (*EmbeddingService, error) {
+	if cfg.APIKey == "" {
+		return nil, errors.New("ai.api_key must be set (or OPENAI_API_KEY)")
+	}
+
+	model, err := parseEmbeddingModel(cfg.EmbeddingModel)
+	if err != nil {
+		return nil, err
+	}
+
+	return &EmbeddingService{
+		openAIClient: newOpenAIClient(cfg),
+		model:        model,
+		usage:        usage,
+		cacheTTL:     cfg.EmbeddingCacheTTL.Duration,
+	}, nil
 }
 
-// NewEmbeddingService creates a new embedding service
-func NewEmbeddingService() (*EmbeddingService, error) {
-	apiKey := os.Getenv("OPENAI_API_KEY")
-	if apiKey == "" {
-		return nil, fmt.Errorf("OPENAI_API_KEY environment variable not set")
+// parseEmbeddingModel looks up an embedding model by name
+func parseEmbeddingModel(name string) (openai.EmbeddingModel, error) {
+	// UnmarshalText accepts any name, mapping unknown ones to Unknown
+	var model openai.EmbeddingModel
+	if model.UnmarshalText([]byte(name)); model == openai.Unknown {
+		return model, fmt.Errorf("unknown embedding model %q", name)
 	}
+	return model, nil
+}
+
+// OnStore sets a function to call with each embedding EmbedContents stores,
+// such as assigning the item to a topic cluster. Errors are logged. Services
+// made by WithModel do not call it, as they embed with another model.
+func (s *EmbeddingService) OnStore(fn func(contentID int64, embedding []float32) error) {
+	s.onStore = fn
+}
 
-	client := openai.NewClient(apiKey)
+// WithModel returns a service that generates embeddings with another model
+// through the same API client
+func (s *EmbeddingService) WithModel(name string) (*EmbeddingService, error) {
+	model, err := parseEmbeddingModel(name)
+	if err != nil {
+		return nil, err
+	}
 	return &EmbeddingService{
-		openAIClient: client,
+		openAIClient: s.openAIClient,
+		model:        model,
+		usage:        s.usage,
+		cacheTTL:     s.cacheTTL,
 	}, nil
 }
 
+// newOpenAIClient creates a client for the configured OpenAI-compatible API
+func newOpenAIClient(cfg config.AIConfig) *openai.Client {
+	clientConfig := openai.DefaultConfig(cfg.APIKey)
+	if cfg.BaseURL != "" {
+		clientConfig.BaseURL = cfg.BaseURL
+	}
+	clientConfig.HTTPClient = &http.Client{
+		Transport: &retryTransport{base: http.DefaultTransport},
+	}
+	return openai.NewClientWithConfig(clientConfig)
+}
+
+// Model returns the name of the model embeddings are generated with
+func (s *EmbeddingService) Model() string {
+	return s.model.String()
+}
+
 // GenerateEmbedding generates an embedding for the given text
 func (s *EmbeddingService) GenerateEmbedding(ctx context.Context, text string) ([]float32, error) {
+	if err := s.usage.checkBudget(); err != nil {
+		return nil, err
+	}
+
 	resp, err := s.openAIClient.CreateEmbeddings(ctx, openai.EmbeddingRequest{
-		Model: openai.AdaEmbeddingV2,
+		Model: s.model,
 		Input: []string{text},
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to create embedding: %w", err)
 	}
+	s.recordUsage(ctx, []string{text}, resp.Usage)
 
 	if len(resp.Data) == 0 {
 		return nil, fmt.Errorf("no embedding data returned")
@@ -44,15 +136,409 @@ func (s *EmbeddingService) GenerateEmbedding(ctx context.Context, text string) (
 	return resp.Data[0].Embedding, nil
 }
 
-// SerializeEmbedding serializes an embedding to a byte array
+// GenerateEmbeddings generates embeddings for many texts, packing them into
+// as few requests as the API's limits allow. The results line up with the
+// texts; where a text failed its embedding is nil and errs holds the reason.
+func (s *EmbeddingService) GenerateEmbeddings(ctx context.Context, texts []string) (embeddings [][]float32, errs []error) {
+	return s.generateEmbeddings(ctx, texts, nil)
+}
+
+// generateEmbeddings is GenerateEmbeddings for texts of the content items
+// with the given IDs, if known, so requests for a single item have their
+// usage recorded against it
+func (s *EmbeddingService) generateEmbeddings(ctx context.Context, texts []string, ids []int64) (embeddings [][]float32, errs []error) {
+	embeddings = make([][]float32, len(texts))
+	errs = make([]error, len(texts))
+
+	for start := 0; start < len(texts); {
+		end, tokens := start, 0
+		for end < len(texts) && end-start < maxBatchInputs {
+			textTokens := estimateTokens(texts[end])
+			if end > start && tokens+textTokens > maxBatchTokens {
+				break
+			}
+			tokens += textTokens
+			end++
+		}
+
+		var batchIDs []int64
+		if ids != nil {
+			batchIDs = ids[start:end]
+		}
+		s.embedBatch(ctx, texts[start:end], batchIDs, embeddings[start:end], errs[start:end])
+		start = end
+	}
+
+	return embeddings, errs
+}
+
+// embedBatch embeds texts in a single request. If the API rejects the
+// request, say because one text is too long, the batch is split in halves
+// until the texts at fault are found, so the others still get embedded.
+func (s *EmbeddingService) embedBatch(ctx context.Context, texts []string, ids []int64, embeddings [][]float32, errs []error) {
+	if err := s.usage.checkBudget(); err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return
+	}
+
+	resp, err := s.openAIClient.CreateEmbeddings(ctx, openai.EmbeddingRequest{
+		Model: s.model,
+		Input: texts,
+	})
+	if err != nil {
+		if len(texts) > 1 && rejected(err) {
+			half := len(texts) / 2
+			var firstIDs, secondIDs []int64
+			if ids != nil {
+				firstIDs, secondIDs = ids[:half], ids[half:]
+			}
+			s.embedBatch(ctx, texts[:half], firstIDs, embeddings[:half], errs[:half])
+			s.embedBatch(ctx, texts[half:], secondIDs, embeddings[half:], errs[half:])
+			return
+		}
+		for i := range errs {
+			errs[i] = fmt.Errorf("failed to create embedding: %w", err)
+		}
+		return
+	}
+	if id, ok := singleID(ids); ok {
+		ctx = withCall(ctx, callFrom(ctx).operation, id)
+	}
+	s.recordUsage(ctx, texts, resp.Usage)
+
+	for _, data := range resp.Data {
+		if data.Index >= 0 && data.Index < len(embeddings) {
+			embeddings[data.Index] = data.Embedding
+		}
+	}
+	for i := range embeddings {
+		if embeddings[i] == nil {
+			errs[i] = fmt.Errorf("no embedding data returned")
+		}
+	}
+}
+
+// singleID returns the content ID shared by all the texts of a batch, when
+// they are all for one item
+func singleID(ids []int64) (int64, bool) {
+	if len(ids) == 0 {
+		return 0, false
+	}
+	for _, id := range ids[1:] {
+		if id != ids[0] {
+			return 0, false
+		}
+	}
+	return ids[0], true
+}
+
+// rejected reports whether the API refused a request as invalid, as opposed
+// to failing to handle it
+func rejected(err error) bool {
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode == http.StatusBadRequest || apiErr.StatusCode == http.StatusRequestEntityTooLarge
+	}
+	var reqErr *openai.RequestError
+	if errors.As(err, &reqErr) {
+		return reqErr.StatusCode == http.StatusBadRequest || reqErr.StatusCode == http.StatusRequestEntityTooLarge
+	}
+	return false
+}
+
+// recordUsage records the usage of an embeddings request, estimating the
+// tokens if the API does not report them
+func (s *EmbeddingService) recordUsage(ctx context.Context, texts []string, usage openai.Usage) {
+	if usage.PromptTokens == 0 {
+		for _, text := range texts {
+			usage.PromptTokens += estimateTokens(text)
+		}
+	}
+	s.usage.record(ctx, s.Model(), len(texts), usage)
+}
+
+// estimateTokens over-estimates the number of tokens in a text, at three
+// bytes per token, so batches stay under the API's token limit
+func estimateTokens(text string) int {
+	return len(text)/3 + 1
+}
+
+// EmbedContents generates embeddings for many content items in batches and
+// stores them under this service's model. Items whose stored embedding is of
+// the same text are skipped, and cached embeddings of a text are reused
+// rather than generated again. Snippets are embedded in chunks, as
+// snippetInput describes. It returns the embeddings stored, by content ID,
+// and the errors of the items that failed.
+func (s *EmbeddingService) EmbedContents(ctx context.Context, database *db.DB, targets []db.EmbedTarget) (map[int64][]float32, map[int64]error) {
+	stored := make(map[int64][]float32)
+	failed := make(map[int64]error)
+
+	inputs := contentInputs(database, targets)
+	hashes := make([]string, len(targets))
+	ids := make([]int64, len(targets))
+	for i, target := range targets {
+		hash, err := database.TextHash(inputs[i].key)
+		if err != nil {
+			for _, target := range targets {
+				failed[target.ID] = fmt.Errorf("failed to hash text: %w", err)
+			}
+			return stored, failed
+		}
+		hashes[i] = hash
+		ids[i] = target.ID
+	}
+
+	current, err := database.EmbeddingHashes(s.Model(), ids)
+	if err != nil {
+		// Embed everything rather than nothing
+		log.Printf("Failed to look up embedded text hashes: %v", err)
+		current = map[int64]string{}
+	}
+
+	// Texts repeated across items only need embedding once
+	var wanted []string
+	for i, target := range targets {
+		if current[target.ID] != hashes[i] {
+			wanted = append(wanted, hashes[i])
+		}
+	}
+	embeddings := s.cachedEmbeddings(database, wanted)
+
+	var texts, textHashes []string
+	var textIDs []int64
+	for i, target := range targets {
+		if _, ok := embeddings[hashes[i]]; ok || current[target.ID] == hashes[i] {
+			continue
+		}
+		embeddings[hashes[i]] = nil
+		for _, chunk := range inputs[i].chunks {
+			texts = append(texts, chunk)
+			textHashes = append(textHashes, hashes[i])
+			textIDs = append(textIDs, target.ID)
+		}
+	}
+
+	generated, errs := s.generateEmbeddings(ctx, texts, textIDs)
+	textErrs := make(map[string]error)
+	chunks := make(map[string][][]float32)
+	for i, hash := range textHashes {
+		if errs[i] != nil {
+			textErrs[hash] = errs[i]
+			continue
+		}
+		chunks[hash] = append(chunks[hash], generated[i])
+	}
+	fresh := make(map[string][]float32)
+	for hash, vectors := range chunks {
+		if textErrs[hash] != nil {
+			continue
+		}
+		embeddings[hash] = meanEmbedding(vectors)
+		fresh[hash] = embeddings[hash]
+	}
+	s.cacheEmbeddings(database, fresh)
+
+	for i, target := range targets {
+		if current[target.ID] == hashes[i] {
+			continue
+		}
+		if err := textErrs[hashes[i]]; err != nil {
+			failed[target.ID] = err
+			continue
+		}
+		embedding := embeddings[hashes[i]]
+		if _, err := database.StoreEmbedding(target.ID, embedding, s.Model(), hashes[i]); err != nil {
+			failed[target.ID] = fmt.Errorf("failed to store embedding: %w", err)
+			continue
+		}
+		stored[target.ID] = embedding
+		if s.onStore != nil {
+			if err := s.onStore(target.ID, embedding); err != nil {
+				log.Printf("Failed to process the embedding of content %d: %v", target.ID, err)
+			}
+		}
+	}
+	return stored, failed
+}
+
+// EmbedText returns the embedding of a text, from the cache if it was
+// embedded within the cache TTL, along with the text's hash
+func (s *EmbeddingService) EmbedText(ctx context.Context, database *db.DB, text string) ([]float32, string, error) {
+	return s.embedInput(ctx, database, textInput(text))
+}
+
+// embedInput returns the embedding of an input, from the cache if it was
+// embedded within the cache TTL, along with the hash of its key
+func (s *EmbeddingService) embedInput(ctx context.Context, database *db.DB, input embedInput) ([]float32, string, error) {
+	hash, err := database.TextHash(input.key)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to hash text: %w", err)
+	}
+	if embedding, ok := s.cachedEmbeddings(database, []string{hash})[hash]; ok {
+		return embedding, hash, nil
+	}
+
+	vectors, errs := s.generateEmbeddings(ctx, input.chunks, nil)
+	for _, err := range errs {
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	embedding := meanEmbedding(vectors)
+	s.cacheEmbeddings(database, map[string][]float32{hash: embedding})
+	return embedding, hash, nil
+}
+
+// EmbedContent generates the embedding for a content item's body, or reuses
+// a cached one, and stores it under this service's model. It returns the
+// embedding and the ID it was stored under.
+func (s *EmbeddingService) EmbedContent(ctx context.Context, database *db.DB, id int64, body string) ([]float32, int64, error) {
+	input := contentInputs(database, []db.EmbedTarget{{ID: id, Body: body}})[0]
+	embedding, hash, err := s.embedInput(withCall(ctx, UsageEmbed, id), database, input)
+	if err != nil {
+		return nil, 0, err
+	}
+	embeddingID, err := database.StoreEmbedding(id, embedding, s.Model(), hash)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to store embedding: %w", err)
+	}
+	return embedding, embeddingID, nil
+}
+
+// embedInput is what is embedded for a text: the text itself or, for a
+// snippet, chunks of its code whose embeddings are averaged. The key stands
+// for the whole input, and its hash is what stored and cached embeddings are
+// matched by.
+type embedInput struct {
+	key    string
+	chunks []string
+}
+
+// textInput embeds a text as it is
+func textInput(text string) embedInput {
+	return embedInput{key: text, chunks: []string{text}}
+}
+
+// snippetInput embeds a snippet's code in chunks split between functions
+// and statements, each labelled with the language, so every part of a long
+// snippet counts and searches can name the language
+func snippetInput(body, language string) embedInput {
+	chunks := code.Chunk(body, language, maxChunkBytes)
+	if len(chunks) == 0 {
+		return textInput(body)
+	}
+	label := "code"
+	if language != "" {
+		label = language + " code"
+	}
+	for i, chunk := range chunks {
+		chunks[i] = label + ":\n" + chunk
+	}
+	return embedInput{key: "\x00snippet\x00" + language + "\x00" + body, chunks: chunks}
+}
+
+// contentInputs returns what to embed for content items, which for snippets
+// depends on their language
+func contentInputs(database *db.DB, targets []db.EmbedTarget) []embedInput {
+	ids := make([]int64, len(targets))
+	for i, target := range targets {
+		ids[i] = target.ID
+	}
+	languages, err := database.SnippetLanguages(ids)
+	if err != nil {
+		// Embed snippets as plain text rather than not at all
+		log.Printf("Failed to look up snippet languages: %v", err)
+	}
+
+	inputs := make([]embedInput, len(targets))
+	for i, target := range targets {
+		if language, ok := languages[target.ID]; ok {
+			inputs[i] = snippetInput(target.Body, language)
+		} else {
+			inputs[i] = textInput(target.Body)
+		}
+	}
+	return inputs
+}
+
+// meanEmbedding averages the embeddings of an input's chunks into one of
+// unit length. A single embedding is returned as it is.
+func meanEmbedding(vectors [][]float32) []float32 {
+	if len(vectors) == 1 {
+		return vectors[0]
+	}
+	mean := make([]float32, len(vectors[0]))
+	for _, v := range vectors {
+		for i := range mean {
+			if i < len(v) {
+				mean[i] += v[i]
+			}
+		}
+	}
+	var norm float64
+	for _, x := range mean {
+		norm += float64(x) * float64(x)
+	}
+	if norm = math.Sqrt(norm); norm > 0 {
+		for i := range mean {
+			mean[i] = float32(float64(mean[i]) / norm)
+		}
+	}
+	return mean
+}
+
+// cachedEmbeddings looks up the cached embeddings of texts by hash. Cache
+// failures only cost an API call, so they are logged rather than returned.
+func (s *EmbeddingService) cachedEmbeddings(database *db.DB, hashes []string) map[string][]float32 {
+	if s.cacheTTL <= 0 || len(hashes) == 0 {
+		return make(map[string][]float32)
+	}
+
+	cached, err := database.CachedEmbeddings(s.Model(), hashes, s.cacheTTL)
+	if err != nil {
+		log.Printf("Failed to read embedding cache: %v", err)
+		return make(map[string][]float32)
+	}
+	return cached
+}
+
+// cacheEmbeddings caches newly generated embeddings by text hash, and now
+// and then deletes those past their TTL
+func (s *EmbeddingService) cacheEmbeddings(database *db.DB, embeddings map[string][]float32) {
+	if s.cacheTTL <= 0 || len(embeddings) == 0 {
+		return
+	}
+
+	if err := database.CacheEmbeddings(s.Model(), embeddings); err != nil {
+		log.Printf("Failed to cache embeddings: %v", err)
+	}
+
+	s.pruneMu.Lock()
+	prune := time.Since(s.lastPruned) >= cachePruneInterval
+	if prune {
+		s.lastPruned = time.Now()
+	}
+	s.pruneMu.Unlock()
+	if prune {
+		if _, err := database.PruneEmbeddingCache(s.cacheTTL); err != nil {
+			log.Printf("Failed to prune embedding cache: %v", err)
+		}
+	}
+}
+
+// SerializeEmbedding serializes an embedding to a byte array at full
+// precision
 func (s *EmbeddingService) SerializeEmbedding(embedding []float32) ([]byte, error) {
-	return json.Marshal(embedding)
+	return vector.Encode(embedding), nil
 }
 
-// DeserializeEmbedding deserializes an embedding from a byte array
+// DeserializeEmbedding deserializes an embedding from a byte array, in any
+// of the formats vectors are stored in
 func (s *EmbeddingService) DeserializeEmbedding(data []byte) ([]float32, error) {
-	var embedding []float32
-	if err := json.Unmarshal(data, &embedding); err != nil {
+	embedding, err := vector.Decode(data)
+	if err != nil {
 		return nil, fmt.Errorf("failed to deserialize embedding: %w", err)
 	}
 	return embedding, nil
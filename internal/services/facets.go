@@ -0,0 +1,173 @@
+package services
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+
+	"github.com/rgehrsitz/me/internal/db"
+	"github.com/rgehrsitz/me/internal/models"
+	"github.com/rgehrsitz/me/internal/search"
+)
+
+// maxTagFacets bounds how many of the most used tags are counted
+const maxTagFacets = 50
+
+// facets counts the items a search matches by type, tag, snippet language and
+// month created.
+// Semantic search ranks every item its filters let through that has an
+// embedding, so those are what its facets count; hybrid search counts the
+// items its filters let through.
+func (s *SearchService) facets(userID int64, parsed *search.Query, query models.SearchQuery, mode int) (*models.SearchFacets, error) {
+	condition, args, inMemory := s.conditions(userID, parsed, query, mode != searchKeyword)
+	if mode == searchSemantic {
+		condition += " AND EXISTS (SELECT 1 FROM embeddings e WHERE e.content_id = c.id AND e.model = ?)"
+		args = append(args, s.embeddingService.Model())
+	}
+
+	if len(inMemory) > 0 {
+		return s.facetsInMemory(condition, args, inMemory)
+	}
+
+	facets := &models.SearchFacets{}
+	var err error
+	facets.Types, err = s.facetCounts(`
+		SELECT c.type, COUNT(*) FROM content c
+		WHERE `+condition+`
+		GROUP BY c.type
+		ORDER BY COUNT(*) DESC, c.type`, args)
+	if err != nil {
+		return nil, err
+	}
+	facets.Tags, err = s.facetCounts(`
+		SELECT t.name, COUNT(*) FROM content c
+		JOIN content_tags ct ON ct.content_id = c.id
+		JOIN tags t ON t.id = ct.tag_id
+		WHERE `+condition+`
+		GROUP BY t.name
+		ORDER BY COUNT(*) DESC, t.name
+		LIMIT ?`, append(args, maxTagFacets))
+	if err != nil {
+		return nil, err
+	}
+	facets.Languages, err = s.facetCounts(`
+		SELECT c.language, COUNT(*) FROM content c
+		WHERE `+condition+` AND c.language <> ''
+		GROUP BY c.language
+		ORDER BY COUNT(*) DESC, c.language`, args)
+	if err != nil {
+		return nil, err
+	}
+	facets.Months, err = s.facetCounts(`
+		SELECT strftime('%Y-%m', c.created_at) AS month, COUNT(*) FROM content c
+		WHERE `+condition+`
+		GROUP BY month
+		ORDER BY month DESC`, args)
+	if err != nil {
+		return nil, err
+	}
+	return facets, nil
+}
+
+// facetCounts runs a query for facet values and their counts
+func (s *SearchService) facetCounts(query string, args []interface{}) ([]models.FacetCount, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count facets: %w", err)
+	}
+	defer rows.Close()
+
+	counts := []models.FacetCount{}
+	for rows.Next() {
+		var count models.FacetCount
+		if err := rows.Scan(&count.Value, &count.Count); err != nil {
+			return nil, fmt.Errorf("failed to scan facet count: %w", err)
+		}
+		counts = append(counts, count)
+	}
+	return counts, rows.Err()
+}
+
+// facetsInMemory counts facets when some terms can only be matched once the
+// content is decrypted
+func (s *SearchService) facetsInMemory(condition string, args []interface{}, inMemory []search.Term) (*models.SearchFacets, error) {
+	stored, err := s.db.QueryContent(`
+		SELECT `+db.ContentColumns+` FROM content c
+		WHERE `+condition, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count facets: %w", err)
+	}
+
+	matched := make(map[int64]bool)
+	types := make(map[string]int)
+	languages := make(map[string]int)
+	months := make(map[string]int)
+	for _, item := range stored {
+		content := toModel(item)
+		if !matchTerms(inMemory, &content) {
+			continue
+		}
+
+		matched[content.ID] = true
+		types[string(content.Type)]++
+		if content.Language != "" {
+			languages[content.Language]++
+		}
+		months[content.CreatedAt.Format("2006-01")]++
+	}
+
+	tagRows, err := s.db.Query(`
+		SELECT c.id, t.name FROM content c
+		JOIN content_tags ct ON ct.content_id = c.id
+		JOIN tags t ON t.id = ct.tag_id
+		WHERE `+condition, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count facets: %w", err)
+	}
+	defer tagRows.Close()
+
+	tags := make(map[string]int)
+	for tagRows.Next() {
+		var id int64
+		var tag string
+		if err := tagRows.Scan(&id, &tag); err != nil {
+			return nil, fmt.Errorf("failed to scan tag: %w", err)
+		}
+		if matched[id] {
+			tags[tag]++
+		}
+	}
+	if err := tagRows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Newest month first
+	monthCounts := sortedCounts(months, false)
+	slices.Reverse(monthCounts)
+	tagCounts := sortedCounts(tags, true)
+	if len(tagCounts) > maxTagFacets {
+		tagCounts = tagCounts[:maxTagFacets]
+	}
+	return &models.SearchFacets{
+		Types:     sortedCounts(types, true),
+		Tags:      tagCounts,
+		Months:    monthCounts,
+		Languages: sortedCounts(languages, true),
+	}, nil
+}
+
+// sortedCounts turns counts by value into facet counts, ordered by value or,
+// if byCount is set, most common first
+func sortedCounts(counts map[string]int, byCount bool) []models.FacetCount {
+	facets := make([]models.FacetCount, 0, len(counts))
+	for value, count := range counts {
+		facets = append(facets, models.FacetCount{Value: value, Count: count})
+	}
+	sort.Slice(facets, func(i, j int) bool {
+		if byCount && facets[i].Count != facets[j].Count {
+			return facets[i].Count > facets[j].Count
+		}
+		return facets[i].Value < facets[j].Value
+	})
+	return facets
+}
@@ -0,0 +1,378 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/rgehrsitz/me/internal/db"
+	"github.com/rgehrsitz/me/internal/models"
+)
+
+// DefaultSimilarityThreshold is the cosine similarity above which two items
+// are joined by a semantic edge
+const DefaultSimilarityThreshold = 0.85
+
+// GraphService builds the knowledge graph of content, tags and links
+type GraphService struct {
+	db               *db.DB
+	embeddingService *EmbeddingService
+}
+
+// NewGraphService creates a new graph service
+func NewGraphService(db *db.DB, embeddingService *EmbeddingService) *GraphService {
+	return &GraphService{
+		db:               db,
+		embeddingService: embeddingService,
+	}
+}
+
+// contentNodeID returns the graph node ID of a content item
+func contentNodeID(id int64) string {
+	return fmt.Sprintf("content:%d", id)
+}
+
+// tagNodeID returns the graph node ID of a tag
+func tagNodeID(id int64) string {
+	return fmt.Sprintf("tag:%d", id)
+}
+
+// Build builds the knowledge graph for the content the user may read that
+// matches the options
+func (s *GraphService) Build(userID int64, opts models.GraphOptions) (*models.Graph, error) {
+	if opts.Threshold <= 0 || opts.Threshold > 1 {
+		opts.Threshold = DefaultSimilarityThreshold
+	}
+
+	where, args := graphFilter(userID, opts)
+
+	graph := &models.Graph{
+		Nodes: []models.GraphNode{},
+		Edges: []models.GraphEdge{},
+	}
+
+	// Content nodes
+	rows, err := s.db.Query(`
+		SELECT c.id, c.type, c.title, c.created_at
+		FROM content c`+where+`
+		ORDER BY c.id`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load content: %w", err)
+	}
+	included := make(map[int64]bool)
+	for rows.Next() {
+		var id int64
+		var contentType, createdAt string
+		var title sql.NullString
+		if err := rows.Scan(&id, &contentType, &title, &createdAt); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan content: %w", err)
+		}
+		label, err := s.db.Decrypt(title.String)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to decrypt content %d: %w", id, err)
+		}
+		included[id] = true
+		graph.Nodes = append(graph.Nodes, models.GraphNode{
+			ID:        contentNodeID(id),
+			Kind:      models.GraphNodeContent,
+			Label:     label,
+			Type:      contentType,
+			CreatedAt: createdAt,
+		})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Tag nodes and membership edges
+	rows, err = s.db.Query(`
+		SELECT ct.content_id, t.id, t.name
+		FROM content_tags ct
+		JOIN tags t ON t.id = ct.tag_id
+		ORDER BY t.name, ct.content_id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tags: %w", err)
+	}
+	tagSeen := make(map[int64]bool)
+	for rows.Next() {
+		var contentID, tagID int64
+		var name string
+		if err := rows.Scan(&contentID, &tagID, &name); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan tag: %w", err)
+		}
+		if !included[contentID] {
+			continue
+		}
+		if !tagSeen[tagID] {
+			tagSeen[tagID] = true
+			graph.Nodes = append(graph.Nodes, models.GraphNode{
+				ID:    tagNodeID(tagID),
+				Kind:  models.GraphNodeTag,
+				Label: name,
+			})
+		}
+		graph.Edges = append(graph.Edges, models.GraphEdge{
+			Source: contentNodeID(contentID),
+			Target: tagNodeID(tagID),
+			Kind:   models.GraphEdgeTag,
+		})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Explicit [[links]]
+	rows, err = s.db.Query(`
+		SELECT source_id, target_id
+		FROM content_links
+		WHERE target_id IS NOT NULL
+		ORDER BY source_id, target_id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load links: %w", err)
+	}
+	for rows.Next() {
+		var sourceID, targetID int64
+		if err := rows.Scan(&sourceID, &targetID); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan link: %w", err)
+		}
+		if !included[sourceID] || !included[targetID] {
+			continue
+		}
+		graph.Edges = append(graph.Edges, models.GraphEdge{
+			Source: contentNodeID(sourceID),
+			Target: contentNodeID(targetID),
+			Kind:   models.GraphEdgeLink,
+		})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if opts.Semantic {
+		edges, err := s.similarityEdges(included, opts.Threshold)
+		if err != nil {
+			return nil, err
+		}
+		graph.Edges = append(graph.Edges, edges...)
+	}
+
+	return graph, nil
+}
+
+// similarityEdges joins included items whose embeddings are at least
+// threshold similar
+func (s *GraphService) similarityEdges(included map[int64]bool, threshold float64) ([]models.GraphEdge, error) {
+	rows, err := s.db.Query("SELECT content_id, embedding FROM embeddings WHERE model = ? ORDER BY content_id", s.embeddingService.Model())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load embeddings: %w", err)
+	}
+	defer rows.Close()
+
+	type point struct {
+		id     int64
+		vector []float32
+	}
+	points := []point{}
+	seen := make(map[int64]bool)
+	for rows.Next() {
+		var id int64
+		var embeddingBytes []byte
+		if err := rows.Scan(&id, &embeddingBytes); err != nil {
+			return nil, fmt.Errorf("failed to scan embedding: %w", err)
+		}
+		if !included[id] || seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		vector, err := s.embeddingService.DeserializeEmbedding(embeddingBytes)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, point{id: id, vector: vector})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	edges := []models.GraphEdge{}
+	for i := 0; i < len(points); i++ {
+		for j := i + 1; j < len(points); j++ {
+			similarity := cosineSimilarity(points[i].vector, points[j].vector)
+			if similarity < threshold {
+				continue
+			}
+			edges = append(edges, models.GraphEdge{
+				Source: contentNodeID(points[i].id),
+				Target: contentNodeID(points[j].id),
+				Kind:   models.GraphEdgeSimilar,
+				Weight: similarity,
+			})
+		}
+	}
+
+	return edges, nil
+}
+
+// graphFilter builds the WHERE clause selecting the content in the graph
+func graphFilter(userID int64, opts models.GraphOptions) (string, []interface{}) {
+	access, args := db.ContentAccessSQL("c.id", userID, db.AccessRead)
+	conditions := []string{access}
+
+	if len(opts.Types) > 0 {
+		placeholders := strings.Repeat("?,", len(opts.Types)-1) + "?"
+		conditions = append(conditions, fmt.Sprintf("c.type IN (%s)", placeholders))
+		for _, t := range opts.Types {
+			args = append(args, t)
+		}
+	}
+
+	// Any of the tags may match, including their children
+	if len(opts.Tags) > 0 {
+		tagConditions := []string{}
+		for _, tag := range opts.Tags {
+			condition, tagArgs := db.TagFilterSQL("c.id", tag)
+			tagConditions = append(tagConditions, condition)
+			args = append(args, tagArgs...)
+		}
+		conditions = append(conditions, "("+strings.Join(tagConditions, " OR ")+")")
+	}
+
+	if opts.From != "" {
+		conditions = append(conditions, "c.created_at >= ?")
+		args = append(args, opts.From)
+	}
+	if opts.To != "" {
+		conditions = append(conditions, "c.created_at < ?")
+		args = append(args, opts.To)
+	}
+
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// WriteGraphML writes the graph in GraphML format
+func WriteGraphML(w io.Writer, graph *models.Graph) error {
+	type data struct {
+		Key   string `xml:"key,attr"`
+		Value string `xml:",chardata"`
+	}
+	type node struct {
+		ID   string `xml:"id,attr"`
+		Data []data `xml:"data"`
+	}
+	type edge struct {
+		ID     string `xml:"id,attr"`
+		Source string `xml:"source,attr"`
+		Target string `xml:"target,attr"`
+		Data   []data `xml:"data"`
+	}
+	type key struct {
+		ID   string `xml:"id,attr"`
+		For  string `xml:"for,attr"`
+		Name string `xml:"attr.name,attr"`
+		Type string `xml:"attr.type,attr"`
+	}
+	type graphElem struct {
+		EdgeDefault string `xml:"edgedefault,attr"`
+		Nodes       []node `xml:"node"`
+		Edges       []edge `xml:"edge"`
+	}
+	type graphML struct {
+		XMLName xml.Name  `xml:"graphml"`
+		XMLNS   string    `xml:"xmlns,attr"`
+		Keys    []key     `xml:"key"`
+		Graph   graphElem `xml:"graph"`
+	}
+
+	doc := graphML{
+		XMLNS: "http://graphml.graphdrawing.org/xmlns",
+		Keys: []key{
+			{ID: "kind", For: "node", Name: "kind", Type: "string"},
+			{ID: "label", For: "node", Name: "label", Type: "string"},
+			{ID: "type", For: "node", Name: "type", Type: "string"},
+			{ID: "created_at", For: "node", Name: "created_at", Type: "string"},
+			{ID: "edge_kind", For: "edge", Name: "kind", Type: "string"},
+			{ID: "weight", For: "edge", Name: "weight", Type: "double"},
+		},
+		Graph: graphElem{EdgeDefault: "directed"},
+	}
+
+	for _, n := range graph.Nodes {
+		elem := node{ID: n.ID, Data: []data{{Key: "kind", Value: n.Kind}, {Key: "label", Value: n.Label}}}
+		if n.Type != "" {
+			elem.Data = append(elem.Data, data{Key: "type", Value: n.Type})
+		}
+		if n.CreatedAt != "" {
+			elem.Data = append(elem.Data, data{Key: "created_at", Value: n.CreatedAt})
+		}
+		doc.Graph.Nodes = append(doc.Graph.Nodes, elem)
+	}
+
+	for i, e := range graph.Edges {
+		elem := edge{ID: fmt.Sprintf("e%d", i), Source: e.Source, Target: e.Target, Data: []data{{Key: "edge_kind", Value: e.Kind}}}
+		if e.Weight != 0 {
+			elem.Data = append(elem.Data, data{Key: "weight", Value: fmt.Sprintf("%.4f", e.Weight)})
+		}
+		doc.Graph.Edges = append(doc.Graph.Edges, elem)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// WriteDOT writes the graph in Graphviz DOT format
+func WriteDOT(w io.Writer, graph *models.Graph) error {
+	var b strings.Builder
+
+	b.WriteString("digraph pkb {\n")
+	for _, n := range graph.Nodes {
+		shape := "box"
+		if n.Kind == models.GraphNodeTag {
+			shape = "ellipse"
+		}
+		fmt.Fprintf(&b, "  %s [label=%s, shape=%s];\n", dotQuote(n.ID), dotQuote(n.Label), shape)
+	}
+	for _, e := range graph.Edges {
+		style := "solid"
+		switch e.Kind {
+		case models.GraphEdgeTag:
+			style = "dotted"
+		case models.GraphEdgeSimilar:
+			style = "dashed"
+		}
+		fmt.Fprintf(&b, "  %s -> %s [label=%s, style=%s", dotQuote(e.Source), dotQuote(e.Target), dotQuote(e.Kind), style)
+		if e.Weight != 0 {
+			fmt.Fprintf(&b, ", weight=%.4f", e.Weight)
+		}
+		b.WriteString("];\n")
+	}
+	b.WriteString("}\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// dotQuote quotes a string for use as a DOT identifier
+func dotQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	return `"` + s + `"`
+}
@@ -0,0 +1,201 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/rgehrsitz/me/internal/db"
+)
+
+const (
+	// reembedBatchSize is how many items a re-embedding job reads and embeds
+	// at a time
+	reembedBatchSize = 500
+	// reembedMaxFailures is how many batches in a row may fail entirely
+	// before a re-embedding job gives up
+	reembedMaxFailures = 3
+)
+
+// Re-embedding job states
+const (
+	ReembedRunning   = "running"
+	ReembedDone      = "done"
+	ReembedCancelled = "cancelled"
+	ReembedFailed    = "failed"
+)
+
+// ErrReembedRunning is returned when a re-embedding job is started while
+// another is running
+var ErrReembedRunning = errors.New("a re-embedding job is already running")
+
+// ReembedProgress reports on a re-embedding job
+type ReembedProgress struct {
+	Model  string `json:"model"`
+	All    bool   `json:"all"`
+	State  string `json:"state"`
+	Total  int    `json:"total"`
+	Done   int    `json:"done"`
+	Failed int    `json:"failed"`
+	// Unchanged counts items skipped because their embedding is already
+	// of their current text
+	Unchanged  int        `json:"unchanged"`
+	LastError  string     `json:"last_error,omitempty"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// ReembedService embeds content with a model in the background, to fill in
+// missing embeddings or to switch to another model. One job runs at a time.
+// A job only embeds items without an embedding from its model unless told
+// to redo all of them, so an interrupted job resumes when started again.
+type ReembedService struct {
+	db *db.DB
+
+	mu       sync.Mutex
+	progress *ReembedProgress
+	cancel   context.CancelFunc
+}
+
+// NewReembedService creates a new re-embedding service
+func NewReembedService(db *db.DB) *ReembedService {
+	return &ReembedService{db: db}
+}
+
+// Start sets up a job embedding content with the given service's model and
+// returns the function that runs it, for the caller to run in the
+// background
+func (s *ReembedService) Start(embeddingService *EmbeddingService, all bool) (func(ctx context.Context), error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.progress != nil && s.progress.State == ReembedRunning {
+		return nil, ErrReembedRunning
+	}
+
+	model := embeddingService.Model()
+	total, err := s.db.CountContentToEmbed(model, all)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count content to embed: %w", err)
+	}
+
+	progress := &ReembedProgress{
+		Model:     model,
+		All:       all,
+		State:     ReembedRunning,
+		Total:     total,
+		StartedAt: time.Now().UTC(),
+	}
+	s.progress = progress
+
+	jobCtx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+
+	return func(ctx context.Context) {
+		defer cancel()
+		// Stop when either the caller's context or Cancel says so
+		stop := context.AfterFunc(ctx, cancel)
+		defer stop()
+
+		s.run(jobCtx, embeddingService, all, progress)
+	}, nil
+}
+
+// Progress returns the progress of the current or last job, or nil if none
+// has run
+func (s *ReembedService) Progress() *ReembedProgress {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.progress == nil {
+		return nil
+	}
+	progress := *s.progress
+	return &progress
+}
+
+// Cancel stops the running job. It reports whether a job was running.
+func (s *ReembedService) Cancel() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.progress == nil || s.progress.State != ReembedRunning {
+		return false
+	}
+	s.cancel()
+	return true
+}
+
+// run embeds the content in batches, updating progress as it goes
+func (s *ReembedService) run(ctx context.Context, embeddingService *EmbeddingService, all bool, progress *ReembedProgress) {
+	model := embeddingService.Model()
+	log.Printf("Re-embedding %d items with %s", progress.Total, model)
+
+	state, err := s.embedAll(ctx, embeddingService, all, progress)
+
+	s.mu.Lock()
+	now := time.Now().UTC()
+	progress.State = state
+	progress.FinishedAt = &now
+	if err != nil {
+		progress.LastError = err.Error()
+	}
+	done, failed, unchanged := progress.Done, progress.Failed, progress.Unchanged
+	s.mu.Unlock()
+
+	log.Printf("Re-embedding with %s %s: %d embedded, %d failed, %d unchanged", model, state, done, failed, unchanged)
+}
+
+// embedAll goes through the content to embed and returns the state the job
+// ended in
+func (s *ReembedService) embedAll(ctx context.Context, embeddingService *EmbeddingService, all bool, progress *ReembedProgress) (string, error) {
+	model := embeddingService.Model()
+	var afterID int64
+	failures := 0
+	for {
+		targets, lastID, err := s.db.ListContentToEmbed(model, all, afterID, reembedBatchSize)
+		if err != nil {
+			return ReembedFailed, fmt.Errorf("failed to list content to embed: %w", err)
+		}
+		if lastID == afterID {
+			return ReembedDone, nil
+		}
+		afterID = lastID
+
+		if ctx.Err() != nil {
+			return ReembedCancelled, nil
+		}
+		if len(targets) == 0 {
+			continue
+		}
+
+		stored, failed := embeddingService.EmbedContents(ctx, s.db, targets)
+
+		s.mu.Lock()
+		progress.Done += len(stored)
+		progress.Failed += len(failed)
+		progress.Unchanged += len(targets) - len(stored) - len(failed)
+		var lastErr error
+		for id, err := range failed {
+			lastErr = err
+			progress.LastError = fmt.Sprintf("content %d: %v", id, err)
+		}
+		s.mu.Unlock()
+
+		if ctx.Err() != nil {
+			return ReembedCancelled, nil
+		}
+		// Nothing more can be embedded until the budget period ends
+		if errors.Is(lastErr, ErrBudgetExceeded) {
+			return ReembedFailed, lastErr
+		}
+		if len(failed) < len(targets) {
+			failures = 0
+		} else if failures++; failures >= reembedMaxFailures {
+			return ReembedFailed, fmt.Errorf("gave up after %d failed batches in a row, the last: %w", failures, lastErr)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package services
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// maxAPIRetries is how often a rate limited or failed AI API request is
+	// retried
+	maxAPIRetries = 5
+	// initialRetryWait is the first wait between retries when the API does
+	// not say how long to wait; it doubles with each retry
+	initialRetryWait = time.Second
+	// maxRetryWait caps the wait between retries
+	maxRetryWait = 2 * time.Minute
+)
+
+// retryTransport retries AI API requests that were rate limited (429) or hit
+// a temporary server error, waiting as long as the Retry-After header asks,
+// or backing off exponentially without one
+type retryTransport struct {
+	base http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := t.base.RoundTrip(req)
+		if err != nil || !retryable(resp.StatusCode) || attempt == maxAPIRetries {
+			return resp, err
+		}
+		if req.Body != nil && req.GetBody == nil {
+			// The body cannot be sent again
+			return resp, nil
+		}
+
+		wait := retryWait(resp.Header, attempt)
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		log.Printf("AI API returned %s, retrying in %v", resp.Status, wait)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+
+		retry := req.Clone(req.Context())
+		if req.GetBody != nil {
+			if retry.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		req = retry
+	}
+}
+
+// retryable reports whether a response status is worth retrying
+func retryable(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryWait returns how long to wait before retrying: what the
+// retry-after-ms or Retry-After header asks for, or else an exponential
+// backoff
+func retryWait(header http.Header, attempt int) time.Duration {
+	wait := initialRetryWait << attempt
+	if ms, err := strconv.Atoi(header.Get("Retry-After-Ms")); err == nil && ms >= 0 {
+		wait = time.Duration(ms) * time.Millisecond
+	} else if value := header.Get("Retry-After"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+			wait = time.Duration(seconds) * time.Second
+		} else if at, err := http.ParseTime(value); err == nil {
+			wait = time.Until(at)
+		}
+	}
+
+	if wait < 0 {
+		wait = 0
+	}
+	if wait > maxRetryWait {
+		wait = maxRetryWait
+	}
+	return wait
+}
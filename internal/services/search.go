@@ -1,252 +1,845 @@
 package services
 
 import (
+	"cmp"
 	"context"
-
 	"fmt"
 	"math"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/rgehrsitz/me/internal/db"
 	"github.com/rgehrsitz/me/internal/models"
+	"github.com/rgehrsitz/me/internal/search"
+	"github.com/rgehrsitz/me/internal/vector"
 )
 
 // SearchService handles searching for content
 type SearchService struct {
-	db              *db.DB
+	db               *db.DB
 	embeddingService *EmbeddingService
 }
 
 // NewSearchService creates a new search service
 func NewSearchService(db *db.DB, embeddingService *EmbeddingService) *SearchService {
 	return &SearchService{
-		db:              db,
+		db:               db,
 		embeddingService: embeddingService,
 	}
 }
 
-// Search searches for content based on the given query
-func (s *SearchService) Search(ctx context.Context, query models.SearchQuery) ([]models.SearchResult, error) {
-	if query.Semantic {
-		return s.semanticSearch(ctx, query)
+// Search searches the content the user may read based on the given query,
+// which is parsed as the search query language
+func (s *SearchService) Search(ctx context.Context, userID int64, query models.SearchQuery) (*models.SearchResponse, error) {
+	parsed, err := search.Parse(query.Query)
+	if err != nil {
+		return nil, err
 	}
-	return s.keywordSearch(query)
-}
 
-// keywordSearch performs a keyword-based search
-func (s *SearchService) keywordSearch(query models.SearchQuery) ([]models.SearchResult, error) {
-	// Build the SQL query
-	sqlQuery := `
-		SELECT c.id, c.type, c.title, c.body, c.source_url, c.file_path, c.created_at, c.updated_at
-		FROM content c
-		WHERE (c.title LIKE ? OR c.body LIKE ?)`
+	// The other fields are filters like those in the query
+	filters := []struct{ field, value string }{
+		{search.FieldType, query.Type},
+		{search.FieldLanguage, query.Language},
+		{search.FieldCreated, dateRange(query.CreatedFrom, query.CreatedTo)},
+		{search.FieldUpdated, dateRange(query.UpdatedFrom, query.UpdatedTo)},
+	}
+	for _, tag := range query.Tags {
+		filters = append(filters, struct{ field, value string }{search.FieldTag, tag})
+	}
+	for _, filter := range filters {
+		if filter.value == "" {
+			continue
+		}
+		term, err := search.NewFilter(filter.field, filter.value)
+		if err != nil {
+			return nil, err
+		}
+		parsed.Terms = append(parsed.Terms, term)
+	}
 
-	args := []interface{}{
-		"%" + query.Query + "%",
-		"%" + query.Query + "%",
+	sort, err := search.ParseSort(query.Sort, query.Order)
+	if err != nil {
+		return nil, err
+	}
+	if query.Limit <= 0 {
+		query.Limit = 10
 	}
 
-	// Add type filter if specified
-	if query.Type != "" {
-		sqlQuery += " AND c.type = ?"
-		args = append(args, query.Type)
+	// Without text there is nothing to rank by similarity, so only filters
+	// apply
+	mode := searchKeyword
+	if parsed.Text() != "" && query.Hybrid {
+		mode = searchHybrid
+	} else if parsed.Text() != "" && query.Semantic {
+		mode = searchSemantic
 	}
 
-	// Add tag filters if specified
-	if len(query.Tags) > 0 {
-		placeholders := strings.Repeat("?,", len(query.Tags)-1) + "?"
-		sqlQuery += fmt.Sprintf(` AND c.id IN (
-			SELECT ct.content_id
-			FROM content_tags ct
-			JOIN tags t ON ct.tag_id = t.id
-			WHERE t.name IN (%s)
-			GROUP BY ct.content_id
-			HAVING COUNT(DISTINCT t.name) = ?
-		)`, placeholders)
+	// Keyword search has no relevance score, so it ranks newest first
+	if mode == searchKeyword && sort.Field == search.SortRelevance {
+		sort = search.Sort{Field: search.SortCreated}
+	}
 
-		for _, tag := range query.Tags {
-			args = append(args, tag)
+	by := cursorOrder(mode, sort)
+	var after *db.Cursor
+	if query.Cursor != "" {
+		if after, err = db.ParseCursor(query.Cursor, by); err != nil {
+			return nil, err
 		}
-		args = append(args, len(query.Tags))
+		query.Offset = 0
 	}
 
-	// Add limit and offset
-	if query.Limit <= 0 {
-		query.Limit = 10
+	// One more result than asked for tells whether there is a next page
+	limit := query.Limit
+	query.Limit++
+
+	var found *searchPage
+	switch mode {
+	case searchHybrid:
+		found, err = s.hybridSearch(ctx, userID, parsed, sort, after, query)
+	case searchSemantic:
+		found, err = s.semanticSearch(ctx, userID, parsed, sort, after, query)
+	default:
+		found, err = s.keywordSearch(userID, parsed, sort, after, query)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	response := &models.SearchResponse{
+		Query:          parsed.String(),
+		Results:        found.results,
+		Total:          found.total,
+		TotalEstimated: found.estimated,
+	}
+	if len(response.Results) > limit {
+		response.Results = response.Results[:limit]
+		next := cursorAt(response.Results[limit-1], sort, by)
+		if mode == searchHybrid && sort.Field == search.SortRelevance {
+			next.Key = strconv.Itoa(found.depth)
+		}
+		response.NextCursor = next.Encode()
+	}
+	if query.Facets {
+		if response.Facets, err = s.facets(userID, parsed, query, mode); err != nil {
+			return nil, err
+		}
+	}
+	return response, nil
+}
+
+// Search modes
+const (
+	searchKeyword = iota
+	searchSemantic
+	searchHybrid
+)
+
+// searchPage is a page of search results and how many there are in all
+type searchPage struct {
+	results   []models.SearchResult
+	total     int
+	estimated bool
+	// depth is how many candidates hybrid search ranked on each side
+	depth int
+}
+
+// cursorOrder names the order a search's cursors are made for
+func cursorOrder(mode int, order search.Sort) string {
+	switch {
+	case order.Field != search.SortRelevance && order.Ascending:
+		return order.Field + " asc"
+	case order.Field != search.SortRelevance:
+		return order.Field + " desc"
+	case mode == searchHybrid:
+		return "fused score"
+	}
+	return "similarity"
+}
+
+// cursorAt returns the cursor for the page ending with a result
+func cursorAt(result models.SearchResult, order search.Sort, by string) db.Cursor {
+	cursor := db.Cursor{By: by, ID: result.Content.ID}
+	switch order.Field {
+	case search.SortCreated:
+		cursor.Key = db.FormatTime(result.Content.CreatedAt)
+	case search.SortUpdated:
+		cursor.Key = db.FormatTime(result.Content.UpdatedAt)
+	case search.SortTitle:
+		cursor.Key = result.Content.Title
+	default:
+		cursor.Score = result.Score
+	}
+	return cursor
+}
+
+// resultAt returns a result with the sort values of the one a cursor was
+// made at, to compare others with
+func resultAt(cursor *db.Cursor) models.SearchResult {
+	at := parseTime(cursor.Key)
+	return models.SearchResult{
+		Content: models.Content{ID: cursor.ID, Title: cursor.Key, CreatedAt: at, UpdatedAt: at},
+		Score:   cursor.Score,
+	}
+}
+
+// dateRange returns the date filter value for an inclusive range, either
+// end of which may be empty
+func dateRange(from, to string) string {
+	if from == "" && to == "" {
+		return ""
+	}
+	return from + ".." + to
+}
+
+// conditions returns the SQL conditions on content c that a search's
+// filters, the user's access and the requested collection make, along with
+// the terms left to match in memory
+func (s *SearchService) conditions(userID int64, parsed *search.Query, query models.SearchQuery, semantic bool) (string, []interface{}, []search.Term) {
+	access, args := db.ContentAccessSQL("c.id", userID, db.AccessRead)
+	conditions, filterArgs, inMemory := compileQuery(parsed, semantic, s.db.Encrypted())
+	conditions = append([]string{access}, conditions...)
+	args = append(args, filterArgs...)
+
+	// Add collection filter if specified
+	if query.Collection != 0 {
+		conditions = append(conditions, db.InCollectionSQL("c.id", query.Recursive))
+		args = append(args, query.Collection)
+	}
+	return strings.Join(conditions, " AND "), args, inMemory
+}
+
+// keywordSearch performs a keyword-based search. Encrypted titles and bodies
+// cannot be matched or sorted in SQL, so while an encrypted knowledge base
+// is unlocked every item the other filters let through is decrypted and
+// matched, and if need be sorted, in memory instead.
+func (s *SearchService) keywordSearch(userID int64, parsed *search.Query, sort search.Sort, after *db.Cursor, query models.SearchQuery) (*searchPage, error) {
+	condition, args, inMemory := s.conditions(userID, parsed, query, false)
+	sortInMemory := sort.Field == search.SortTitle && s.db.Encrypted()
+	paged := len(inMemory) == 0 && !sortInMemory
+
+	found := &searchPage{}
+	sqlQuery := `
+		SELECT ` + db.ContentColumns + `
+		FROM content c
+		WHERE ` + condition
+	if paged {
+		err := s.db.QueryRow("SELECT COUNT(*) FROM content c WHERE "+condition, args...).Scan(&found.total)
+		if err != nil {
+			return nil, fmt.Errorf("failed to count search results: %w", err)
+		}
+		if after != nil {
+			keyset, keysetArgs := keysetSQL(sort, after)
+			sqlQuery += " AND " + keyset
+			args = append(args, keysetArgs...)
+		}
+	}
+	sqlQuery += " ORDER BY " + orderSQL(sort)
+	if paged {
+		sqlQuery += " LIMIT ? OFFSET ?"
+		args = append(args, query.Limit, query.Offset)
 	}
-	sqlQuery += " ORDER BY c.created_at DESC LIMIT ? OFFSET ?"
-	args = append(args, query.Limit, query.Offset)
 
 	// Execute the query
-	rows, err := s.db.Query(sqlQuery, args...)
+	contents, err := s.db.QueryContent(sqlQuery, args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to execute search query: %w", err)
 	}
-	defer rows.Close()
 
 	// Process the results
 	results := []models.SearchResult{}
-	for rows.Next() {
-		var content models.Content
-		var createdAt, updatedAt string
-
-		err := rows.Scan(
-			&content.ID,
-			&content.Type,
-			&content.Title,
-			&content.Body,
-			&content.SourceURL,
-			&content.FilePath,
-			&createdAt,
-			&updatedAt,
-		)
-		if err != nil {
-			return nil, fmt.Errorf("failed to scan search result: %w", err)
+	for _, stored := range contents {
+		content := toModel(stored)
+		if !matchTerms(inMemory, &content) {
+			continue
 		}
+		results = append(results, models.SearchResult{Content: content})
+	}
 
-		// Get tags for this content
-		content.Tags, err = s.getContentTags(content.ID)
-		if err != nil {
-			return nil, fmt.Errorf("failed to get content tags: %w", err)
+	// Every match was read, so the page is picked out of them
+	if !paged {
+		if sortInMemory {
+			sortResults(results, sort)
 		}
+		found.total = len(results)
+		results = pageAfter(results, sort, after, query.Offset, query.Limit)
+	}
+
+	// Only the items on the page need their tags
+	ids := make([]int64, len(results))
+	for i := range results {
+		ids[i] = results[i].Content.ID
+	}
+	tags, err := s.db.ContentTags(ids)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get content tags: %w", err)
+	}
+
+	snippetText := snippetTerm(parsed)
+	for i := range results {
+		results[i].Content.Tags = tags[results[i].Content.ID]
+		results[i].Snippet = extractSnippet(results[i].Content.Body, snippetText)
+	}
 
-		// Create a search result
-		result := models.SearchResult{
-			Content: content,
-			Snippet: extractSnippet(content.Body, query.Query),
+	found.results = results
+	return found, nil
+}
+
+// orderSQL returns the ORDER BY clause for a sort on content c. Keyword
+// search has no relevance score, so relevance sorts newest first.
+func orderSQL(sort search.Sort) string {
+	direction := " DESC"
+	if sort.Ascending {
+		direction = " ASC"
+	}
+
+	switch sort.Field {
+	case search.SortUpdated:
+		return "c.updated_at" + direction + ", c.id" + direction
+	case search.SortTitle:
+		return "c.title COLLATE NOCASE" + direction + ", c.id" + direction
+	}
+	return "c.created_at" + direction + ", c.id" + direction
+}
+
+// keysetSQL returns the condition on content c that keeps the items sorting
+// after a cursor's
+func keysetSQL(sort search.Sort, after *db.Cursor) (string, []interface{}) {
+	column := "c.created_at"
+	switch sort.Field {
+	case search.SortUpdated:
+		column = "c.updated_at"
+	case search.SortTitle:
+		column = "c.title COLLATE NOCASE"
+	}
+	op := "<"
+	if sort.Ascending {
+		op = ">"
+	}
+	return fmt.Sprintf("(%s %s ? OR (%s = ? AND c.id %s ?))", column, op, column, op),
+		[]interface{}{after.Key, after.Key, after.ID}
+}
+
+// sortResults sorts search results in memory. Relevance sorts by score.
+func sortResults(results []models.SearchResult, order search.Sort) {
+	sort.SliceStable(results, func(i, j int) bool {
+		return compareResults(&results[i], &results[j], order) < 0
+	})
+}
+
+// compareResults returns a negative number if result a sorts before b, and
+// a positive one if after. Ties are broken by ID, in the same direction.
+func compareResults(a, b *models.SearchResult, order search.Sort) int {
+	var c int
+	switch order.Field {
+	case search.SortCreated:
+		c = a.Content.CreatedAt.Compare(b.Content.CreatedAt)
+	case search.SortUpdated:
+		c = a.Content.UpdatedAt.Compare(b.Content.UpdatedAt)
+	case search.SortTitle:
+		c = strings.Compare(strings.ToLower(a.Content.Title), strings.ToLower(b.Content.Title))
+	default:
+		c = cmp.Compare(a.Score, b.Score)
+	}
+	if c == 0 {
+		c = cmp.Compare(a.Content.ID, b.Content.ID)
+	}
+	if !order.Ascending {
+		c = -c
+	}
+	return c
+}
+
+// pageAfter returns the results on a page of sorted results: those after a
+// cursor's if there is one, or else past an offset, up to a limit
+func pageAfter(results []models.SearchResult, order search.Sort, after *db.Cursor, offset, limit int) []models.SearchResult {
+	if after != nil {
+		at := resultAt(after)
+		offset = sort.Search(len(results), func(i int) bool {
+			return compareResults(&at, &results[i], order) < 0
+		})
+	}
+
+	if offset >= len(results) {
+		return []models.SearchResult{}
+	}
+	end := offset + limit
+	if end > len(results) {
+		end = len(results)
+	}
+	return results[offset:end]
+}
+
+// parseTime parses a timestamp read from the database
+func parseTime(value string) time.Time {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t
 		}
+	}
+	return time.Time{}
+}
 
-		results = append(results, result)
+// compileQuery compiles the terms of a parsed query into SQL conditions on
+// content c. Text terms that cannot be matched in SQL because the content is
+// encrypted are returned to be matched in memory with matchTerms. Semantic
+// search ranks by the plain words, so only phrases and negated words filter
+// its results.
+func compileQuery(parsed *search.Query, semantic, encrypted bool) ([]string, []interface{}, []search.Term) {
+	var conditions []string
+	var args []interface{}
+	var inMemory []search.Term
+	for _, term := range parsed.Terms {
+		var condition string
+		var termArgs []interface{}
+		switch term.Field {
+		case "":
+			if semantic && !term.Phrase && !term.Negated {
+				continue
+			}
+			if encrypted {
+				inMemory = append(inMemory, term)
+				continue
+			}
+			condition = `(c.title LIKE ? ESCAPE '\' OR c.body LIKE ? ESCAPE '\')`
+			termArgs = []interface{}{likePattern(term.Value), likePattern(term.Value)}
+		case search.FieldTitle:
+			if encrypted {
+				inMemory = append(inMemory, term)
+				continue
+			}
+			condition = `c.title LIKE ? ESCAPE '\'`
+			termArgs = []interface{}{likePattern(term.Value)}
+		case search.FieldURL:
+			condition = `c.source_url LIKE ? ESCAPE '\'`
+			termArgs = []interface{}{likePattern(term.Value)}
+		case search.FieldType:
+			condition = "c.type = ?"
+			termArgs = []interface{}{term.Value}
+		case search.FieldLanguage:
+			// IS rather than =, so negated filters match items without one
+			condition = "c.language IS ?"
+			termArgs = []interface{}{term.Value}
+		case search.FieldTag:
+			// A parent tag also matches its children
+			condition, termArgs = db.TagFilterSQL("c.id", term.Value)
+		case search.FieldCreated, search.FieldUpdated:
+			condition, termArgs = dateRangeSQL("c."+term.Field+"_at", term.From, term.To)
+		}
+
+		if term.Negated {
+			condition = "NOT (" + condition + ")"
+		}
+		conditions = append(conditions, condition)
+		args = append(args, termArgs...)
 	}
+	return conditions, args, inMemory
+}
 
-	return results, nil
+// dateRangeSQL returns a condition restricting a timestamp column to a
+// range, either end of which may be unbounded
+func dateRangeSQL(column string, from, to time.Time) (string, []interface{}) {
+	const layout = "2006-01-02 15:04:05"
+	var bounds []string
+	var args []interface{}
+	if !from.IsZero() {
+		bounds = append(bounds, column+" >= ?")
+		args = append(args, from.Format(layout))
+	}
+	if !to.IsZero() {
+		bounds = append(bounds, column+" < ?")
+		args = append(args, to.Format(layout))
+	}
+	return "(" + strings.Join(bounds, " AND ") + ")", args
 }
 
-// semanticSearch performs a semantic search using embeddings
-func (s *SearchService) semanticSearch(ctx context.Context, query models.SearchQuery) ([]models.SearchResult, error) {
-	// Generate embedding for the query
-	queryEmbedding, err := s.embeddingService.GenerateEmbedding(ctx, query.Query)
+// likePattern returns a LIKE pattern, escaped with \, matching text anywhere
+// in a value
+func likePattern(text string) string {
+	text = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(text)
+	return "%" + text + "%"
+}
+
+// matchTerms reports whether a decrypted content item matches text terms
+// left by compileQuery
+func matchTerms(terms []search.Term, content *models.Content) bool {
+	for _, term := range terms {
+		matched := containsFold(content.Title, term.Value)
+		if term.Field == "" {
+			matched = matched || containsFold(content.Body, term.Value)
+		}
+		if matched == term.Negated {
+			return false
+		}
+	}
+	return true
+}
+
+// snippetTerm returns the text snippets are centered on: the first word or
+// phrase searched for
+func snippetTerm(parsed *search.Query) string {
+	for _, term := range parsed.Terms {
+		if term.Field == "" && !term.Negated {
+			return term.Value
+		}
+	}
+	return ""
+}
+
+// containsFold reports whether s contains substr, ignoring case
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+// semanticSortPool is how many of the best semantic matches are sorted
+// when results are sorted by something other than relevance
+const semanticSortPool = 100
+
+// semanticSearch performs a semantic search using embeddings. Only the
+// embeddings are scanned; the content on the requested page is loaded
+// afterwards. Sorted by something other than relevance, the best matches
+// are sorted and paged through.
+func (s *SearchService) semanticSearch(ctx context.Context, userID int64, parsed *search.Query, sort search.Sort, after *db.Cursor, query models.SearchQuery) (*searchPage, error) {
+	// Embed the query, or reuse the embedding of the same query made lately
+	queryEmbedding, _, err := s.embeddingService.EmbedText(withCall(ctx, UsageSearch, 0), s.db, parsed.Text())
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate query embedding: %w", err)
 	}
 
-	// Since SQLite doesn't have built-in vector similarity search,
-	// we'll retrieve all embeddings and compute similarity in memory
-	// In a production system, you'd want to use a vector database or SQLite extension
-	// Build the SQL query to get all embeddings
-	sqlQuery := `
-		SELECT c.id, c.type, c.title, c.body, c.source_url, c.file_path, c.created_at, c.updated_at, e.embedding
-		FROM content c
-		JOIN embeddings e ON c.id = e.content_id`
+	// The filters narrow down the embeddings scanned
+	condition, args, inMemory := s.conditions(userID, parsed, query, true)
 
-	args := []interface{}{}
-
-	// Add type filter if specified
-	if query.Type != "" {
-		sqlQuery += " WHERE c.type = ?"
-		args = append(args, query.Type)
+	sorted := sort.Field != search.SortRelevance
+	need, skip := query.Offset+query.Limit, query.Offset
+	var from *vectorMatch
+	if sorted {
+		need, skip = max(need, semanticSortPool), 0
+	} else if after != nil {
+		from = &vectorMatch{id: after.ID, score: after.Score}
 	}
 
-	// Execute the query
-	rows, err := s.db.Query(sqlQuery, args...)
+	// Terms matched in memory can rule out any candidate, so then every
+	// candidate is ranked
+	n := need
+	if len(inMemory) > 0 {
+		n = 0
+	}
+	ranked, total, err := s.rankByVector(queryEmbedding, condition, args, n, from)
 	if err != nil {
-		return nil, fmt.Errorf("failed to execute semantic search query: %w", err)
+		return nil, err
+	}
+
+	// Without terms to match, the ranking has every result, so the ones
+	// before the page need not be loaded
+	if len(inMemory) == 0 {
+		ranked = ranked[min(skip, len(ranked)):]
+		skip = 0
 	}
-	defer rows.Close()
 
-	// Process the results and compute similarities
 	results := []models.SearchResult{}
-	for rows.Next() {
-		var content models.Content
-		var createdAt, updatedAt string
-		var embeddingBytes []byte
-
-		err := rows.Scan(
-			&content.ID,
-			&content.Type,
-			&content.Title,
-			&content.Body,
-			&content.SourceURL,
-			&content.FilePath,
-			&createdAt,
-			&updatedAt,
-			&embeddingBytes,
-		)
+	skipped := 0
+	snippetText := snippetTerm(parsed)
+	for len(ranked) > 0 && len(results) < need-skip {
+		// Load as many candidates as could still be skipped or fill the page
+		batch := ranked[:min(len(ranked), need-len(results)-skipped)]
+		ranked = ranked[len(batch):]
+		contents, err := s.loadContents(batch)
 		if err != nil {
-			return nil, fmt.Errorf("failed to scan semantic search result: %w", err)
+			return nil, err
 		}
 
-		// Deserialize the embedding
-		contentEmbedding, err := s.embeddingService.DeserializeEmbedding(embeddingBytes)
-		if err != nil {
-			return nil, fmt.Errorf("failed to deserialize embedding: %w", err)
+		for _, match := range batch {
+			content, ok := contents[match.id]
+			if !ok || !matchTerms(inMemory, &content) {
+				continue
+			}
+			if skipped < skip {
+				skipped++
+				continue
+			}
+
+			results = append(results, models.SearchResult{
+				Content: content,
+				Score:   match.score,
+				Snippet: extractSnippet(content.Body, snippetText),
+			})
 		}
+	}
 
-		// Compute cosine similarity
-		similarity := cosineSimilarity(queryEmbedding, contentEmbedding)
+	// Every candidate is counted, though terms matched in memory may yet rule
+	// some out. Sorted, only the best matches are paged through.
+	found := &searchPage{results: results, total: total, estimated: len(inMemory) > 0}
+	if sorted {
+		sortResults(results, sort)
+		found.total, found.estimated = len(results), false
+		found.results = pageAfter(results, sort, after, query.Offset, query.Limit)
+	}
+	return found, nil
+}
 
-		// Get tags for this content
-		content.Tags, err = s.getContentTags(content.ID)
+// rescoreFactor is how many candidates per requested result are rescored at
+// full precision when the embeddings scanned are quantized
+const rescoreFactor = 4
+
+// vectorMatch is a content item's similarity to a query vector
+type vectorMatch struct {
+	id    int64
+	score float64
+}
+
+// ranksBefore reports whether m ranks ahead of o: it scores higher, or the
+// same with a higher ID
+func (m vectorMatch) ranksBefore(o vectorMatch) bool {
+	if m.score != o.score {
+		return m.score > o.score
+	}
+	return m.id > o.id
+}
+
+// rankByVector returns the n content items, or all of them if n is 0,
+// matching a condition on c.id whose embeddings from the active model are
+// most similar to target, best first, starting after the given match if it
+// is not nil. It also returns how many items match in all. SQLite has no
+// vector index, so every matching embedding is scored in memory. The
+// quantized copies are scanned where they exist, and the best candidates
+// rescored with the full vectors.
+func (s *SearchService) rankByVector(target []float32, condition string, args []interface{}, n int, after *vectorMatch) ([]vectorMatch, int, error) {
+	rows, err := s.db.Query(`
+		SELECT e.id, c.id, COALESCE(e.quantized, e.embedding), e.quantized IS NOT NULL
+		FROM content c
+		JOIN embeddings e ON c.id = e.content_id AND e.model = ?
+		WHERE `+condition, append([]interface{}{s.embeddingService.Model()}, args...)...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to execute semantic search query: %w", err)
+	}
+	defer rows.Close()
+
+	query := vector.NewQuery(target)
+	type candidate struct {
+		vectorMatch
+		embeddingID int64
+		quantized   bool
+	}
+	candidates := []candidate{}
+	anyQuantized := false
+	for rows.Next() {
+		var c candidate
+		var data []byte
+		if err := rows.Scan(&c.embeddingID, &c.id, &data, &c.quantized); err != nil {
+			return nil, 0, fmt.Errorf("failed to scan embedding: %w", err)
+		}
+		if c.score, err = query.Score(data); err != nil {
+			return nil, 0, fmt.Errorf("failed to score embedding %d: %w", c.embeddingID, err)
+		}
+		anyQuantized = anyQuantized || c.quantized
+		candidates = append(candidates, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	rows.Close()
+
+	total := len(candidates)
+	byScore := func(i, j int) bool { return candidates[i].ranksBefore(candidates[j].vectorMatch) }
+	sort.Slice(candidates, byScore)
+
+	// behind returns the index of the first candidate ranked behind after
+	behind := func() int {
+		return sort.Search(len(candidates), func(i int) bool { return after.ranksBefore(candidates[i].vectorMatch) })
+	}
+
+	if anyQuantized {
+		// Candidates ranked ahead of the cursor may rescore behind it
+		keep := n * rescoreFactor
+		if after != nil {
+			keep += behind()
+		}
+		if n > 0 && len(candidates) > keep {
+			candidates = candidates[:keep]
+		}
+		var ids []int64
+		for _, c := range candidates {
+			if c.quantized {
+				ids = append(ids, c.embeddingID)
+			}
+		}
+		full, err := s.db.EmbeddingsByIDs(ids)
 		if err != nil {
-			return nil, fmt.Errorf("failed to get content tags: %w", err)
+			return nil, 0, fmt.Errorf("failed to load embeddings: %w", err)
 		}
+		for i := range candidates {
+			data, ok := full[candidates[i].embeddingID]
+			if !candidates[i].quantized || !ok {
+				continue
+			}
+			if candidates[i].score, err = query.Score(data); err != nil {
+				return nil, 0, fmt.Errorf("failed to score embedding %d: %w", candidates[i].embeddingID, err)
+			}
+		}
+		sort.Slice(candidates, byScore)
+	}
 
-		// Filter by tags if specified
-		if len(query.Tags) > 0 && !containsAllTags(content.Tags, query.Tags) {
-			continue
+	if after != nil {
+		candidates = candidates[behind():]
+	}
+	if n > 0 && len(candidates) > n {
+		candidates = candidates[:n]
+	}
+	matches := make([]vectorMatch, len(candidates))
+	for i, c := range candidates {
+		matches[i] = c.vectorMatch
+	}
+	return matches, total, nil
+}
+
+// loadContents loads the content items of vector matches, with their tags,
+// by ID. Items deleted since they were ranked are left out.
+func (s *SearchService) loadContents(matches []vectorMatch) (map[int64]models.Content, error) {
+	ids := make([]int64, len(matches))
+	for i, match := range matches {
+		ids[i] = match.id
+	}
+	stored, err := s.db.ContentByIDs(ids)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load content: %w", err)
+	}
+
+	contents := make(map[int64]models.Content, len(stored))
+	for id, content := range stored {
+		contents[id] = toModel(content)
+	}
+	return contents, nil
+}
+
+// toModel converts a content item read from the database
+func toModel(content db.Content) models.Content {
+	return models.Content{
+		ID:        content.ID,
+		Type:      models.ContentType(content.Type),
+		Title:     content.Title,
+		Body:      content.Body,
+		SourceURL: content.SourceURL,
+		FilePath:  content.FilePath,
+		Language:  content.Language,
+		CreatedAt: parseTime(content.CreatedAt),
+		UpdatedAt: parseTime(content.UpdatedAt),
+		Tags:      content.Tags,
+	}
+}
+
+// rrfK dampens the influence of top ranks in reciprocal rank fusion
+const rrfK = 60
+
+// hybridSearch runs keyword and semantic search and merges the rankings
+// using reciprocal rank fusion. Sorted by something other than relevance,
+// the best merged matches are sorted and paged through. The total is
+// estimated from the larger of the two searches' totals.
+func (s *SearchService) hybridSearch(ctx context.Context, userID int64, parsed *search.Query, sort search.Sort, after *db.Cursor, query models.SearchQuery) (*searchPage, error) {
+	// Rank enough candidates from each side to fill the requested page.
+	// Fused scores depend on how deep each side is ranked, so the first page
+	// picks the depth and its cursor carries it to the next pages.
+	candidates := query
+	candidates.Offset = 0
+	candidates.Limit = max(2*(query.Offset+query.Limit), semanticSortPool)
+	sorted := sort.Field != search.SortRelevance
+	if after != nil && !sorted {
+		depth, err := strconv.Atoi(after.Key)
+		if err != nil || depth <= 0 {
+			return nil, db.ErrInvalidCursor
 		}
+		candidates.Limit = depth
+	}
+	relevance := search.Sort{Field: search.SortRelevance}
+
+	keywordPage, err := s.keywordSearch(userID, parsed, relevance, nil, candidates)
+	if err != nil {
+		return nil, err
+	}
+	semanticPage, err := s.semanticSearch(ctx, userID, parsed, relevance, nil, candidates)
+	if err != nil {
+		return nil, err
+	}
 
-		// Create a search result
-		result := models.SearchResult{
-			Content: content,
-			Score:   similarity,
-			Snippet: extractSnippet(content.Body, query.Query),
+	scores := make(map[int64]float64)
+	merged := make(map[int64]models.SearchResult)
+	for _, ranking := range [][]models.SearchResult{keywordPage.results, semanticPage.results} {
+		for rank, result := range ranking {
+			id := result.Content.ID
+			scores[id] += 1 / float64(rrfK+rank+1)
+			if _, ok := merged[id]; !ok {
+				merged[id] = result
+			}
 		}
+	}
 
+	results := make([]models.SearchResult, 0, len(merged))
+	for id, result := range merged {
+		result.Score = scores[id]
 		results = append(results, result)
 	}
+	sortResults(results, relevance)
 
-	// Sort results by similarity score (descending)
-	sortResultsByScore(results)
+	found := &searchPage{
+		total:     max(keywordPage.total, semanticPage.total, len(results)),
+		estimated: true,
+		depth:     candidates.Limit,
+	}
+	if sorted {
+		if len(results) > candidates.Limit {
+			results = results[:candidates.Limit]
+		}
+		sortResults(results, sort)
+		found.total, found.estimated = len(results), false
+	}
+	found.results = pageAfter(results, sort, after, query.Offset, query.Limit)
+	return found, nil
+}
 
-	// Apply limit and offset
-	if query.Limit <= 0 {
-		query.Limit = 10
+// Related finds the content most similar to the given item, comparing its
+// stored embedding against every other item the user may read
+func (s *SearchService) Related(ctx context.Context, userID, id int64, limit int) ([]models.SearchResult, error) {
+	if limit <= 0 {
+		limit = 10
 	}
-	start := query.Offset
-	end := query.Offset + query.Limit
-	if start >= len(results) {
-		return []models.SearchResult{}, nil
+
+	if _, err := s.db.GetContent(userID, id); err != nil {
+		return nil, fmt.Errorf("content %d not found: %w", id, err)
 	}
-	if end > len(results) {
-		end = len(results)
+
+	var embeddingBytes []byte
+	err := s.db.QueryRow("SELECT embedding FROM embeddings WHERE content_id = ? AND model = ?", id, s.embeddingService.Model()).Scan(&embeddingBytes)
+	if err != nil {
+		return nil, fmt.Errorf("no embedding for content %d: %w", id, err)
 	}
 
-	return results[start:end], nil
-}
+	target, err := s.embeddingService.DeserializeEmbedding(embeddingBytes)
+	if err != nil {
+		return nil, err
+	}
 
-// getContentTags retrieves the tags for a content item
-func (s *SearchService) getContentTags(contentID int64) ([]string, error) {
-	rows, err := s.db.Query(`
-		SELECT t.name 
-		FROM tags t 
-		JOIN content_tags ct ON t.id = ct.tag_id 
-		WHERE ct.content_id = ?`, contentID)
+	access, args := db.ContentAccessSQL("c.id", userID, db.AccessRead)
+	ranked, _, err := s.rankByVector(target, "c.id != ? AND "+access, append([]interface{}{id}, args...), limit, nil)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
 
-	tags := []string{}
-	for rows.Next() {
-		var tag string
-		if err := rows.Scan(&tag); err != nil {
-			return nil, err
+	contents, err := s.loadContents(ranked)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []models.SearchResult{}
+	for _, match := range ranked {
+		if content, ok := contents[match.id]; ok {
+			results = append(results, models.SearchResult{
+				Content: content,
+				Score:   match.score,
+			})
 		}
-		tags = append(tags, tag)
 	}
 
-	return tags, nil
+	return results, nil
 }
 
 // cosineSimilarity computes the cosine similarity between two vectors
@@ -317,30 +910,3 @@ func extractSnippet(text, query string) string {
 
 	return snippet
 }
-
-// containsAllTags checks if the content tags contain all the query tags
-func containsAllTags(contentTags, queryTags []string) bool {
-	tagMap := make(map[string]bool)
-	for _, tag := range contentTags {
-		tagMap[tag] = true
-	}
-
-	for _, tag := range queryTags {
-		if !tagMap[tag] {
-			return false
-		}
-	}
-
-	return true
-}
-
-// sortResultsByScore sorts search results by score in descending order
-func sortResultsByScore(results []models.SearchResult) {
-	for i := 0; i < len(results); i++ {
-		for j := i + 1; j < len(results); j++ {
-			if results[i].Score < results[j].Score {
-				results[i], results[j] = results[j], results[i]
-			}
-		}
-	}
-}
@@ -0,0 +1,95 @@
+package services_test
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/rgehrsitz/me/internal/config"
+	"github.com/rgehrsitz/me/internal/db"
+	"github.com/rgehrsitz/me/internal/db/dbtest"
+	"github.com/rgehrsitz/me/internal/models"
+	"github.com/rgehrsitz/me/internal/services"
+	"github.com/rgehrsitz/me/internal/vector"
+)
+
+// TestSemanticSearchQuantized checks that semantic search over quantized
+// embeddings returns the best matches by full precision similarity, with
+// their full precision scores
+func TestSemanticSearchQuantized(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "pkb.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	userID, err := database.DefaultUserID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.SetEmbeddingQuantization(vector.Binary); err != nil {
+		t.Fatal(err)
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	query := dbtest.RandomVector(rng, dbtest.Dimensions)
+	type item struct {
+		id    int64
+		score float64
+	}
+	var items []item
+	for i := 0; i < 200; i++ {
+		id, err := database.CreateContent(userID, &db.Content{Type: "note", Title: "item", Body: "body"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Mix in the query to a varying degree, so similarities spread out
+		embedding := dbtest.RandomVector(rng, dbtest.Dimensions)
+		weight := float32(rng.Float64())
+		for j := range embedding {
+			embedding[j] += weight * query[j]
+		}
+		if _, err := database.StoreEmbedding(id, embedding, dbtest.EmbeddingModel, ""); err != nil {
+			t.Fatal(err)
+		}
+		score, err := vector.NewQuery(query).Score(vector.Encode(embedding))
+		if err != nil {
+			t.Fatal(err)
+		}
+		items = append(items, item{id, score})
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].score > items[j].score })
+
+	embeddingService, err := services.NewEmbeddingService(config.AIConfig{
+		APIKey:            "unused",
+		EmbeddingModel:    dbtest.EmbeddingModel,
+		EmbeddingCacheTTL: config.Duration{Duration: 24 * time.Hour},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := database.TextHash(dbtest.Word)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.CacheEmbeddings(dbtest.EmbeddingModel, map[string][]float32{hash: query}); err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := services.NewSearchService(database, embeddingService).Search(context.Background(), userID,
+		models.SearchQuery{Query: dbtest.Word, Semantic: true, Limit: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Results) != 5 {
+		t.Fatalf("got %d results, want 5", len(response.Results))
+	}
+	for i, result := range response.Results {
+		if result.Content.ID != items[i].id || math.Abs(result.Score-items[i].score) > 1e-6 {
+			t.Errorf("result %d is item %d scoring %v, want item %d scoring %v", i, result.Content.ID, result.Score, items[i].id, items[i].score)
+		}
+	}
+}
@@ -2,34 +2,43 @@ package services
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"os"
+	"strings"
 
+	"github.com/rgehrsitz/me/internal/config"
 	"github.com/sashabaranov/go-openai"
 )
 
 // SummarizeService handles summarizing content
 type SummarizeService struct {
 	openAIClient *openai.Client
+	model        string
+	usage        *UsageService
 }
 
-// NewSummarizeService creates a new summarize service
-func NewSummarizeService() (*SummarizeService, error) {
-	apiKey := os.Getenv("OPENAI_API_KEY")
-	if apiKey == "" {
-		return nil, fmt.Errorf("OPENAI_API_KEY environment variable not set")
+// NewSummarizeService creates a new summarize service. Usage is recorded
+// with the usage service, if any.
+func NewSummarizeService(cfg config.AIConfig, usage *UsageService) (*SummarizeService, error) {
+	if cfg.APIKey == "" {
+		return nil, errors.New("ai.api_key must be set (or OPENAI_API_KEY)")
 	}
 
-	client := openai.NewClient(apiKey)
 	return &SummarizeService{
-		openAIClient: client,
+		openAIClient: newOpenAIClient(cfg),
+		model:        cfg.ChatModel,
+		usage:        usage,
 	}, nil
 }
 
-// Summarize summarizes the given text
-func (s *SummarizeService) Summarize(ctx context.Context, text string) (string, error) {
+// Summarize summarizes the text of a content item
+func (s *SummarizeService) Summarize(ctx context.Context, contentID int64, text string) (string, error) {
+	if err := s.usage.checkBudget(); err != nil {
+		return "", err
+	}
+
 	resp, err := s.openAIClient.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
-		Model: openai.GPT3Dot5Turbo,
+		Model: s.model,
 		Messages: []openai.ChatCompletionMessage{
 			{
 				Role:    openai.ChatMessageRoleSystem,
@@ -45,6 +54,7 @@ func (s *SummarizeService) Summarize(ctx context.Context, text string) (string,
 	if err != nil {
 		return "", fmt.Errorf("failed to create summary: %w", err)
 	}
+	s.usage.record(withCall(ctx, UsageSummarize, contentID), s.model, 1, resp.Usage)
 
 	if len(resp.Choices) == 0 {
 		return "", fmt.Errorf("no summary data returned")
@@ -52,3 +62,35 @@ func (s *SummarizeService) Summarize(ctx context.Context, text string) (string,
 
 	return resp.Choices[0].Message.Content, nil
 }
+
+// NameCluster suggests a short topic name for a group of related items
+func (s *SummarizeService) NameCluster(ctx context.Context, samples []string) (string, error) {
+	if err := s.usage.checkBudget(); err != nil {
+		return "", err
+	}
+
+	resp, err := s.openAIClient.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
+		Model: s.model,
+		Messages: []openai.ChatCompletionMessage{
+			{
+				Role:    openai.ChatMessageRoleSystem,
+				Content: "You are a helpful assistant that names groups of related notes. Reply with a topic name of two to five words and nothing else.",
+			},
+			{
+				Role:    openai.ChatMessageRoleUser,
+				Content: fmt.Sprintf("Name the topic shared by these items:\n\n- %s", strings.Join(samples, "\n- ")),
+			},
+		},
+		MaxTokens: 16,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to name cluster: %w", err)
+	}
+	s.usage.record(withCall(ctx, UsageNameCluster, 0), s.model, 1, resp.Usage)
+
+	if len(resp.Choices) == 0 {
+		return "", fmt.Errorf("no cluster name returned")
+	}
+
+	return strings.Trim(strings.TrimSpace(resp.Choices[0].Message.Content), `"'.`), nil
+}
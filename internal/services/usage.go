@@ -0,0 +1,218 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/rgehrsitz/me/internal/config"
+	"github.com/rgehrsitz/me/internal/db"
+	"github.com/sashabaranov/go-openai"
+)
+
+// AI operations usage is recorded under
+const (
+	UsageEmbed       = "embed"
+	UsageSearch      = "search"
+	UsageSummarize   = "summarize"
+	UsageNameCluster = "name_cluster"
+)
+
+// ErrBudgetExceeded is returned instead of making an AI call once the daily
+// or monthly budget has been spent
+var ErrBudgetExceeded = errors.New("AI budget exceeded")
+
+// defaultPrices are what known models cost, in US dollars per million
+// tokens. Model versions such as gpt-4-0613 match by prefix.
+var defaultPrices = map[string]config.ModelPrice{
+	"text-embedding-ada-002": {Input: 0.10},
+	"text-embedding-3-small": {Input: 0.02},
+	"text-embedding-3-large": {Input: 0.13},
+	"gpt-3.5-turbo":          {Input: 0.50, Output: 1.50},
+	"gpt-3.5-turbo-16k":      {Input: 3, Output: 4},
+	"gpt-4":                  {Input: 30, Output: 60},
+	"gpt-4-32k":              {Input: 60, Output: 120},
+	"gpt-4-turbo":            {Input: 10, Output: 30},
+	"gpt-4o":                 {Input: 2.50, Output: 10},
+	"gpt-4o-mini":            {Input: 0.15, Output: 0.60},
+}
+
+// UsageService records what AI calls cost and enforces the spend budgets.
+// Calls for every vault are recorded in the main database, so the budgets
+// cover them all.
+type UsageService struct {
+	db            *db.DB
+	vault         string
+	provider      string
+	prices        map[string]config.ModelPrice
+	dailyBudget   float64
+	monthlyBudget float64
+}
+
+// NewUsageService creates a new usage service recording into the main
+// database
+func NewUsageService(database *db.DB, cfg config.AIConfig) *UsageService {
+	return &UsageService{
+		db:            database,
+		provider:      cfg.Provider,
+		prices:        modelPrices(cfg),
+		dailyBudget:   cfg.DailyBudget,
+		monthlyBudget: cfg.MonthlyBudget,
+	}
+}
+
+// ForVault returns a service that records a vault's calls, priced by the
+// vault's config, alongside this one's and against the same budgets
+func (s *UsageService) ForVault(name string, cfg config.AIConfig) *UsageService {
+	return &UsageService{
+		db:            s.db,
+		vault:         name,
+		provider:      cfg.Provider,
+		prices:        modelPrices(cfg),
+		dailyBudget:   s.dailyBudget,
+		monthlyBudget: s.monthlyBudget,
+	}
+}
+
+// modelPrices returns the default prices with those configured on top
+func modelPrices(cfg config.AIConfig) map[string]config.ModelPrice {
+	prices := make(map[string]config.ModelPrice)
+	for model, price := range defaultPrices {
+		prices[model] = price
+	}
+	for model, price := range cfg.Prices {
+		prices[model] = price
+	}
+	return prices
+}
+
+// Totals sums the usage recorded by period, as db.UsageTotals does: a
+// vault's own calls, or for the main knowledge base every vault's
+func (s *UsageService) Totals(period string, n int) ([]db.UsageTotal, error) {
+	return s.db.UsageTotals(period, n, s.vault)
+}
+
+// Budget reports the budgets and what has been spent against them
+type Budget struct {
+	Daily          float64 `json:"daily"`
+	Monthly        float64 `json:"monthly"`
+	SpentToday     float64 `json:"spent_today"`
+	SpentThisMonth float64 `json:"spent_this_month"`
+}
+
+// Budget returns the budgets and the spend so far this day and month
+func (s *UsageService) Budget() (*Budget, error) {
+	today, err := s.db.UsageCost(db.UsageDay)
+	if err != nil {
+		return nil, err
+	}
+	month, err := s.db.UsageCost(db.UsageMonth)
+	if err != nil {
+		return nil, err
+	}
+	return &Budget{
+		Daily:          s.dailyBudget,
+		Monthly:        s.monthlyBudget,
+		SpentToday:     today,
+		SpentThisMonth: month,
+	}, nil
+}
+
+// checkBudget returns ErrBudgetExceeded if the daily or monthly budget has
+// been spent. Calls already under way may still take the spend a little
+// over budget.
+func (s *UsageService) checkBudget() error {
+	if s == nil {
+		return nil
+	}
+
+	for _, budget := range []struct {
+		name   string
+		period string
+		limit  float64
+	}{
+		{"daily", db.UsageDay, s.dailyBudget},
+		{"monthly", db.UsageMonth, s.monthlyBudget},
+	} {
+		if budget.limit <= 0 {
+			continue
+		}
+		spent, err := s.db.UsageCost(budget.period)
+		if err != nil {
+			return fmt.Errorf("failed to check AI budget: %w", err)
+		}
+		if spent >= budget.limit {
+			return fmt.Errorf("%w: $%.2f of the $%.2f %s budget spent", ErrBudgetExceeded, spent, budget.limit, budget.name)
+		}
+	}
+	return nil
+}
+
+// record stores the usage of a call, estimating its cost. Failing to record
+// usage does not fail the call, which has already been paid for.
+func (s *UsageService) record(ctx context.Context, model string, inputs int, usage openai.Usage) {
+	if s == nil {
+		return
+	}
+
+	c := callFrom(ctx)
+	price := s.price(model)
+	cost := (float64(usage.PromptTokens)*price.Input + float64(usage.CompletionTokens)*price.Output) / 1e6
+
+	err := s.db.RecordUsage(db.Usage{
+		Vault:            s.vault,
+		Provider:         s.provider,
+		Model:            model,
+		Operation:        c.operation,
+		ContentID:        c.contentID,
+		Inputs:           inputs,
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+		Cost:             cost,
+	})
+	if err != nil {
+		log.Printf("Failed to record AI usage: %v", err)
+	}
+}
+
+// price looks up the price of a model, by its longest matching prefix for
+// versioned names. Unknown models are counted as free.
+func (s *UsageService) price(model string) config.ModelPrice {
+	if price, ok := s.prices[model]; ok {
+		return price
+	}
+
+	var match string
+	for name := range s.prices {
+		if strings.HasPrefix(model, name+"-") && len(name) > len(match) {
+			match = name
+		}
+	}
+	return s.prices[match]
+}
+
+// callKey is the context key for what an AI call is made for
+type callKey struct{}
+
+// call describes what an AI call is made for, for recording its usage
+type call struct {
+	operation string
+	contentID int64
+}
+
+// withCall returns a context whose AI calls are recorded under an operation
+// and, when they are for a single content item, its ID
+func withCall(ctx context.Context, operation string, contentID int64) context.Context {
+	return context.WithValue(ctx, callKey{}, call{operation: operation, contentID: contentID})
+}
+
+// callFrom returns what the AI calls made with a context are for,
+// defaulting to embedding content
+func callFrom(ctx context.Context) call {
+	if c, ok := ctx.Value(callKey{}).(call); ok {
+		return c
+	}
+	return call{operation: UsageEmbed}
+}
@@ -0,0 +1,277 @@
+// Package vector encodes embedding vectors for storage and scores stored
+// vectors against a query. Vectors can be quantized to int8 or to one bit per
+// dimension, so semantic search reads and scores less data before rescoring
+// its best candidates at full precision.
+package vector
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+// An encoded vector starts with an 8 byte header: 'V', the format version,
+// the Kind, a reserved byte and the dimensions as a little-endian uint32.
+//
+//	Float32: dims little-endian float32 values
+//	Int8:    a float32 scale, then dims int8 values (value = int8 * scale)
+//	Binary:  dims bits packed into little-endian uint64 words, set when the
+//	         value is positive
+const (
+	magic      = 'V'
+	version    = 1
+	headerSize = 8
+)
+
+// Kind is how the values of an encoded vector are stored
+type Kind byte
+
+const (
+	Float32 Kind = iota
+	Int8
+	Binary
+)
+
+// ErrInvalid is returned for data that is not an encoded vector
+var ErrInvalid = errors.New("invalid encoded vector")
+
+func (k Kind) String() string {
+	switch k {
+	case Float32:
+		return "none"
+	case Int8:
+		return "int8"
+	case Binary:
+		return "binary"
+	}
+	return fmt.Sprintf("kind(%d)", byte(k))
+}
+
+// ParseKind parses a quantization setting: "none" (or empty), "int8" or
+// "binary"
+func ParseKind(name string) (Kind, error) {
+	switch name {
+	case "", "none":
+		return Float32, nil
+	case "int8":
+		return Int8, nil
+	case "binary":
+		return Binary, nil
+	}
+	return 0, fmt.Errorf("unknown quantization %q (want none, int8 or binary)", name)
+}
+
+// Encode encodes a vector at full precision
+func Encode(v []float32) []byte {
+	data := header(Float32, len(v), 4*len(v))
+	for i, x := range v {
+		binary.LittleEndian.PutUint32(data[headerSize+4*i:], math.Float32bits(x))
+	}
+	return data
+}
+
+// Quantize encodes a vector as the given kind
+func Quantize(v []float32, kind Kind) []byte {
+	switch kind {
+	case Int8:
+		var max float32
+		for _, x := range v {
+			if x < 0 {
+				x = -x
+			}
+			if x > max {
+				max = x
+			}
+		}
+		scale := max / 127
+
+		data := header(Int8, len(v), 4+len(v))
+		binary.LittleEndian.PutUint32(data[headerSize:], math.Float32bits(scale))
+		for i, x := range v {
+			var q int8
+			if scale > 0 {
+				q = int8(math.Round(float64(x / scale)))
+			}
+			data[headerSize+4+i] = byte(q)
+		}
+		return data
+
+	case Binary:
+		words := packBits(v)
+		data := header(Binary, len(v), 8*len(words))
+		for i, w := range words {
+			binary.LittleEndian.PutUint64(data[headerSize+8*i:], w)
+		}
+		return data
+	}
+	return Encode(v)
+}
+
+// KindOf returns how an encoded vector is stored
+func KindOf(data []byte) (Kind, error) {
+	kind, _, err := parseHeader(data)
+	return kind, err
+}
+
+// Decode decodes a vector of any kind. Quantized vectors come back as an
+// approximation, with binary ones as -1 and 1. JSON arrays, the format
+// vectors were stored in before, are accepted too.
+func Decode(data []byte) ([]float32, error) {
+	if len(data) > 0 && data[0] == '[' {
+		var v []float32
+		if err := json.Unmarshal(data, &v); err != nil {
+			return nil, fmt.Errorf("failed to decode vector: %w", err)
+		}
+		return v, nil
+	}
+
+	kind, dims, err := parseHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	body := data[headerSize:]
+
+	v := make([]float32, dims)
+	switch kind {
+	case Float32:
+		for i := range v {
+			v[i] = math.Float32frombits(binary.LittleEndian.Uint32(body[4*i:]))
+		}
+	case Int8:
+		scale := math.Float32frombits(binary.LittleEndian.Uint32(body))
+		for i := range v {
+			v[i] = float32(int8(body[4+i])) * scale
+		}
+	case Binary:
+		for i := range v {
+			if binary.LittleEndian.Uint64(body[8*(i/64):])&(1<<(i%64)) != 0 {
+				v[i] = 1
+			} else {
+				v[i] = -1
+			}
+		}
+	}
+	return v, nil
+}
+
+// Query is a vector prepared for scoring many stored vectors against it
+type Query struct {
+	v    []float32
+	norm float64
+	bits []uint64
+}
+
+// NewQuery prepares a query vector
+func NewQuery(v []float32) *Query {
+	var norm float64
+	for _, x := range v {
+		norm += float64(x) * float64(x)
+	}
+	return &Query{v: v, norm: math.Sqrt(norm), bits: packBits(v)}
+}
+
+// Score returns the similarity of an encoded vector to the query. Full
+// precision and int8 vectors give the cosine similarity; binary ones give
+// 1 - 2*hamming/dims, a rough estimate of it. Vectors whose dimensions differ
+// from the query's score 0.
+func (q *Query) Score(data []byte) (float64, error) {
+	if len(data) > 0 && data[0] == '[' {
+		v, err := Decode(data)
+		if err != nil {
+			return 0, err
+		}
+		return q.Score(Encode(v))
+	}
+
+	kind, dims, err := parseHeader(data)
+	if err != nil {
+		return 0, err
+	}
+	if dims != len(q.v) || q.norm == 0 {
+		return 0, nil
+	}
+	body := data[headerSize:]
+
+	var dot, norm float64
+	switch kind {
+	case Float32:
+		for i, x := range q.v {
+			y := float64(math.Float32frombits(binary.LittleEndian.Uint32(body[4*i:])))
+			dot += float64(x) * y
+			norm += y * y
+		}
+	case Int8:
+		// The scale cancels out of the cosine, so it is left out
+		for i, x := range q.v {
+			y := float64(int8(body[4+i]))
+			dot += float64(x) * y
+			norm += y * y
+		}
+	case Binary:
+		var hamming int
+		for i, w := range q.bits {
+			hamming += bits.OnesCount64(w ^ binary.LittleEndian.Uint64(body[8*i:]))
+		}
+		return 1 - 2*float64(hamming)/float64(dims), nil
+	}
+
+	if norm == 0 {
+		return 0, nil
+	}
+	return dot / (q.norm * math.Sqrt(norm)), nil
+}
+
+// header allocates an encoded vector with its header filled in and room for
+// size bytes of values
+func header(kind Kind, dims, size int) []byte {
+	data := make([]byte, headerSize+size)
+	data[0] = magic
+	data[1] = version
+	data[2] = byte(kind)
+	binary.LittleEndian.PutUint32(data[4:], uint32(dims))
+	return data
+}
+
+// parseHeader checks the header of an encoded vector and that its values are
+// all there
+func parseHeader(data []byte) (Kind, int, error) {
+	if len(data) < headerSize || data[0] != magic {
+		return 0, 0, ErrInvalid
+	}
+	if data[1] != version {
+		return 0, 0, fmt.Errorf("unsupported vector format version %d", data[1])
+	}
+
+	kind := Kind(data[2])
+	dims := int(binary.LittleEndian.Uint32(data[4:]))
+	var size int
+	switch kind {
+	case Float32:
+		size = 4 * dims
+	case Int8:
+		size = 4 + dims
+	case Binary:
+		size = 8 * ((dims + 63) / 64)
+	default:
+		return 0, 0, fmt.Errorf("unknown vector kind %d", data[2])
+	}
+	if len(data)-headerSize != size {
+		return 0, 0, ErrInvalid
+	}
+	return kind, dims, nil
+}
+
+// packBits packs the signs of a vector's values into words, one bit per
+// value
+func packBits(v []float32) []uint64 {
+	words := make([]uint64, (len(v)+63)/64)
+	for i, x := range v {
+		if x > 0 {
+			words[i/64] |= 1 << (i % 64)
+		}
+	}
+	return words
+}
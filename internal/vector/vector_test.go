@@ -0,0 +1,262 @@
+package vector
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// randomVector returns a vector of normally distributed values
+func randomVector(rng *rand.Rand, dims int) []float32 {
+	v := make([]float32, dims)
+	for i := range v {
+		v[i] = float32(rng.NormFloat64())
+	}
+	return v
+}
+
+// cosine is the cosine similarity of two vectors, computed directly
+func cosine(a, b []float32) float64 {
+	var dot, na, nb float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+	return dot / math.Sqrt(na*nb)
+}
+
+func TestEncodeDecode(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, v := range [][]float32{
+		{},
+		{1},
+		{0.5, -0.25, 3, float32(math.Inf(1)), -0},
+		randomVector(rng, 1536),
+	} {
+		data := Encode(v)
+		if len(data) != headerSize+4*len(v) {
+			t.Errorf("Encode of %d dims is %d bytes, want %d", len(v), len(data), headerSize+4*len(v))
+		}
+		if kind, err := KindOf(data); err != nil || kind != Float32 {
+			t.Errorf("KindOf(Encode(v)) = %v, %v, want none", kind, err)
+		}
+
+		got, err := Decode(data)
+		if err != nil {
+			t.Fatalf("Decode failed: %v", err)
+		}
+		if len(got) != len(v) {
+			t.Fatalf("Decode returned %d dims, want %d", len(got), len(v))
+		}
+		for i := range v {
+			if got[i] != v[i] {
+				t.Errorf("value %d decoded as %v, want %v", i, got[i], v[i])
+			}
+		}
+	}
+}
+
+func TestQuantize(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, dims := range []int{1, 63, 64, 65, 1536} {
+		v := randomVector(rng, dims)
+		var max float32
+		for _, x := range v {
+			max = float32(math.Max(float64(max), math.Abs(float64(x))))
+		}
+
+		data := Quantize(v, Int8)
+		if len(data) != headerSize+4+dims {
+			t.Errorf("int8 of %d dims is %d bytes, want %d", dims, len(data), headerSize+4+dims)
+		}
+		got, err := Decode(data)
+		if err != nil {
+			t.Fatalf("Decode of int8 failed: %v", err)
+		}
+		// Each value is rounded to the nearest step of max/127
+		tolerance := float64(max)/127/2 + 1e-6
+		for i := range v {
+			if diff := math.Abs(float64(got[i] - v[i])); diff > tolerance {
+				t.Errorf("int8 value %d of %d decoded as %v, want %v within %v", i, dims, got[i], v[i], tolerance)
+			}
+		}
+
+		data = Quantize(v, Binary)
+		if want := headerSize + 8*((dims+63)/64); len(data) != want {
+			t.Errorf("binary of %d dims is %d bytes, want %d", dims, len(data), want)
+		}
+		got, err = Decode(data)
+		if err != nil {
+			t.Fatalf("Decode of binary failed: %v", err)
+		}
+		for i := range v {
+			want := float32(-1)
+			if v[i] > 0 {
+				want = 1
+			}
+			if got[i] != want {
+				t.Errorf("binary value %d of %d decoded as %v, want %v", i, dims, got[i], want)
+			}
+		}
+
+		if data := Quantize(v, Float32); string(data) != string(Encode(v)) {
+			t.Errorf("Quantize to none differs from Encode")
+		}
+	}
+}
+
+func TestQuantizeZero(t *testing.T) {
+	got, err := Decode(Quantize(make([]float32, 4), Int8))
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	for i, x := range got {
+		if x != 0 {
+			t.Errorf("value %d of a zero vector decoded as %v", i, x)
+		}
+	}
+}
+
+func TestDecodeLegacyJSON(t *testing.T) {
+	got, err := Decode([]byte(`[0.5, -1, 2e-3]`))
+	if err != nil {
+		t.Fatalf("Decode of JSON failed: %v", err)
+	}
+	want := []float32{0.5, -1, 2e-3}
+	if len(got) != len(want) {
+		t.Fatalf("Decode of JSON returned %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("JSON value %d decoded as %v, want %v", i, got[i], want[i])
+		}
+	}
+
+	// What the migration stores for it decodes the same
+	again, err := Decode(Encode(got))
+	if err != nil || len(again) != len(want) || again[1] != -1 {
+		t.Errorf("Decode(Encode(%v)) = %v, %v", got, again, err)
+	}
+
+	score, err := NewQuery(want).Score([]byte(`[0.5, -1, 2e-3]`))
+	if err != nil || math.Abs(score-1) > 1e-6 {
+		t.Errorf("Score of JSON = %v, %v, want 1", score, err)
+	}
+
+	if _, err := Decode([]byte(`[0.5, `)); err == nil {
+		t.Error("Decode of truncated JSON succeeded")
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	valid := Encode([]float32{1, 2, 3})
+	modified := func(f func([]byte) []byte) []byte {
+		data := append([]byte(nil), valid...)
+		return f(data)
+	}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		invalid bool // whether the error is ErrInvalid
+	}{
+		{"empty", nil, true},
+		{"short header", valid[:headerSize-1], true},
+		{"wrong magic", modified(func(d []byte) []byte { d[0] = 'X'; return d }), true},
+		{"truncated", valid[:len(valid)-1], true},
+		{"header only", valid[:headerSize], true},
+		{"trailing bytes", append(append([]byte(nil), valid...), 0), true},
+		{"truncated int8", func() []byte { d := Quantize([]float32{1, 2}, Int8); return d[:len(d)-1] }(), true},
+		{"truncated binary", func() []byte { d := Quantize(make([]float32, 65), Binary); return d[:len(d)-8] }(), true},
+		{"unknown version", modified(func(d []byte) []byte { d[1] = version + 1; return d }), false},
+		{"unknown kind", modified(func(d []byte) []byte { d[2] = 9; return d }), false},
+	}
+
+	query := NewQuery([]float32{1, 2, 3})
+	for _, tt := range tests {
+		_, err := Decode(tt.data)
+		if err == nil {
+			t.Errorf("%s: Decode succeeded", tt.name)
+			continue
+		}
+		if errors.Is(err, ErrInvalid) != tt.invalid {
+			t.Errorf("%s: Decode error = %v, want ErrInvalid: %v", tt.name, err, tt.invalid)
+		}
+		if _, err := KindOf(tt.data); err == nil {
+			t.Errorf("%s: KindOf succeeded", tt.name)
+		}
+		if _, err := query.Score(tt.data); err == nil {
+			t.Errorf("%s: Score succeeded", tt.name)
+		}
+	}
+}
+
+func TestScore(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	a := randomVector(rng, 1536)
+	b := randomVector(rng, 1536)
+	negated := make([]float32, len(a))
+	for i, x := range a {
+		negated[i] = -x
+	}
+	query := NewQuery(a)
+
+	tests := []struct {
+		name      string
+		data      []byte
+		want      float64
+		tolerance float64
+	}{
+		{"same", Encode(a), 1, 1e-6},
+		{"opposite", Encode(negated), -1, 1e-6},
+		{"other", Encode(b), cosine(a, b), 1e-6},
+		{"int8 same", Quantize(a, Int8), 1, 1e-3},
+		{"int8 other", Quantize(b, Int8), cosine(a, b), 1e-2},
+		{"binary same", Quantize(a, Binary), 1, 0},
+		{"binary opposite", Quantize(negated, Binary), -1, 0},
+		// Sign bits estimate the angle, not the cosine, so only roughly
+		{"binary other", Quantize(b, Binary), cosine(a, b), 0.1},
+		{"fewer dimensions", Encode(a[:100]), 0, 0},
+	}
+
+	for _, tt := range tests {
+		got, err := query.Score(tt.data)
+		if err != nil {
+			t.Errorf("%s: Score failed: %v", tt.name, err)
+			continue
+		}
+		if math.Abs(got-tt.want) > tt.tolerance {
+			t.Errorf("%s: Score = %v, want %v within %v", tt.name, got, tt.want, tt.tolerance)
+		}
+	}
+
+	orthogonal, err := NewQuery([]float32{1, 0}).Score(Encode([]float32{0, 1}))
+	if err != nil || orthogonal != 0 {
+		t.Errorf("Score of orthogonal vectors = %v, %v, want 0", orthogonal, err)
+	}
+	zero, err := NewQuery([]float32{0, 0}).Score(Encode([]float32{1, 1}))
+	if err != nil || zero != 0 {
+		t.Errorf("Score against a zero query = %v, %v, want 0", zero, err)
+	}
+	zero, err = NewQuery([]float32{1, 1}).Score(Encode([]float32{0, 0}))
+	if err != nil || zero != 0 {
+		t.Errorf("Score of a zero vector = %v, %v, want 0", zero, err)
+	}
+}
+
+func TestParseKind(t *testing.T) {
+	for _, kind := range []Kind{Float32, Int8, Binary} {
+		parsed, err := ParseKind(kind.String())
+		if err != nil || parsed != kind {
+			t.Errorf("ParseKind(%q) = %v, %v, want %v", kind.String(), parsed, err, kind)
+		}
+	}
+	if kind, err := ParseKind(""); err != nil || kind != Float32 {
+		t.Errorf(`ParseKind("") = %v, %v, want none`, kind, err)
+	}
+	if _, err := ParseKind("int4"); err == nil {
+		t.Error(`ParseKind("int4") succeeded`)
+	}
+}
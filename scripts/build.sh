@@ -0,0 +1,15 @@
+#!/bin/sh
+# Build the frontend and embed it in the server and CLI binaries
+set -e
+
+cd "$(dirname "$0")/.."
+
+echo "Building frontend..."
+(cd web && npm ci --no-audit --no-fund && npm run build)
+
+echo "Building backend..."
+mkdir -p bin
+CGO_ENABLED=0 go build -o bin/pkb-server ./cmd/server
+CGO_ENABLED=0 go build -o bin/pkb ./cmd/pkb
+
+echo "Done! Run bin/pkb-server to start the server."
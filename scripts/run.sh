@@ -0,0 +1,10 @@
+#!/bin/sh
+# Run the server with the frontend proxied to the Vite dev server
+set -e
+
+cd "$(dirname "$0")/.."
+
+(cd web && npm run dev) &
+trap 'kill $!' EXIT
+
+go run ./cmd/server -dev-proxy http://localhost:5173 "$@"
@@ -0,0 +1,29 @@
+const TOKEN_KEY = 'pkb-token';
+
+// API_BASE is relative, so the app calls whatever origin served it: the Go
+// server in production, and the Vite dev server, which proxies it, in
+// development
+const API_BASE = '/api';
+
+// apiFetch calls the PKB API with the stored API token. When the server
+// rejects the token, it asks for a new one and retries once.
+export async function apiFetch(path, options = {}) {
+  let response = await send(path, options);
+  if (response.status === 401) {
+    const token = window.prompt('Enter your PKB API token');
+    if (token) {
+      localStorage.setItem(TOKEN_KEY, token.trim());
+      response = await send(path, options);
+    }
+  }
+  return response;
+}
+
+function send(path, options) {
+  const headers = { ...(options.headers || {}) };
+  const token = localStorage.getItem(TOKEN_KEY);
+  if (token) {
+    headers['Authorization'] = `Bearer ${token}`;
+  }
+  return fetch(API_BASE + path, { ...options, headers });
+}
@@ -1,9 +1,19 @@
 import { defineConfig } from 'vite';
 import { svelte } from '@sveltejs/vite-plugin-svelte';
+import { writeFileSync } from 'node:fs';
+
+// The Go server embeds dist/ and needs it to contain at least one file, so
+// restore the placeholder that emptyOutDir removes.
+const keepDist = {
+  name: 'keep-dist',
+  closeBundle() {
+    writeFileSync('dist/.gitkeep', '');
+  }
+};
 
 // https://vitejs.dev/config/
 export default defineConfig({
-  plugins: [svelte()],
+  plugins: [svelte(), keepDist],
   server: {
     port: 5173,
     strictPort: true,
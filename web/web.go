@@ -0,0 +1,22 @@
+// Package web embeds the built Svelte frontend so the server binary can serve
+// it from any working directory. Run `npm run build` in this directory before
+// `go build` to include the UI; web/dist/.gitkeep keeps the embed valid until
+// then.
+package web
+
+import (
+	"embed"
+	"io/fs"
+)
+
+//go:embed all:dist
+var dist embed.FS
+
+// Dist returns the built frontend rooted at web/dist
+func Dist() fs.FS {
+	sub, err := fs.Sub(dist, "dist")
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}